@@ -0,0 +1,182 @@
+package backup
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// runResult is the outcome of a finished backup
+type runResult struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Status     string    `json:"status"` // success or failure
+	Error      string    `json:"error,omitempty"`
+}
+
+// jobStatus is the state of a database's backups as reported by the API
+type jobStatus struct {
+	Database  string     `json:"database"`
+	Running   bool       `json:"running"`
+	StartedAt *time.Time `json:"started_at,omitempty"` // of the running backup
+	Queued    bool       `json:"queued"`               // an on-demand backup is waiting to run
+	NextRun   *time.Time `json:"next_run,omitempty"`
+	LastRun   *runResult `json:"last_run,omitempty"`
+}
+
+// status returns a snapshot of the job's state
+func (job *databaseJob) status() jobStatus {
+	job.activity.mu.Lock()
+	running, startedAt := job.activity.running, job.activity.startedAt
+	job.activity.mu.Unlock()
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	s := jobStatus{
+		Database: job.db.ID,
+		Running:  running,
+		Queued:   len(job.trigger) > 0,
+		LastRun:  job.lastRun,
+	}
+	if running {
+		s.StartedAt = &startedAt
+	}
+	if !job.nextRun.IsZero() {
+		nextRun := job.nextRun
+		s.NextRun = &nextRun
+	}
+	return s
+}
+
+// serveAPI runs the admin HTTP listener until it fails. Requests are
+// handled by the tool of the current config, which live points to.
+func (bt *Tool) serveAPI(live *atomic.Pointer[Tool]) {
+	route := func(handler func(*Tool, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			current := live.Load()
+			current.authorized(func(w http.ResponseWriter, r *http.Request) {
+				handler(current, w, r)
+			})(w, r)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /status", route((*Tool).handleStatus))
+	mux.HandleFunc("GET /backups", route((*Tool).handleBackups))
+	mux.HandleFunc("POST /backup", route((*Tool).handleBackup))
+
+	bt.logger.Info("Serving API", "addr", bt.config.API.ListenAddr)
+	if err := http.ListenAndServe(bt.config.API.ListenAddr, mux); err != nil {
+		bt.logger.Error("API listener failed", "error", err)
+	}
+}
+
+// authorized rejects requests without the configured bearer token
+func (bt *Tool) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := bt.config.API.Token
+		if token != "" {
+			given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				writeJSONError(w, http.StatusUnauthorized, "missing or invalid token")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// handleStatus reports the state of every database, or of the one given
+// with ?db=
+func (bt *Tool) handleStatus(w http.ResponseWriter, r *http.Request) {
+	jobs, ok := bt.selectJobs(w, r)
+	if !ok {
+		return
+	}
+
+	statuses := make([]jobStatus, 0, len(jobs))
+	for _, job := range jobs {
+		statuses = append(statuses, job.status())
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// handleBackups lists the catalog, optionally only for ?db=
+func (bt *Tool) handleBackups(w http.ResponseWriter, r *http.Request) {
+	cat, err := loadCatalog(bt.config.Backup.OutputDir)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	backups := make([]*backupManifest, 0, len(cat.Backups))
+	dbID := r.URL.Query().Get("db")
+	for _, m := range cat.Backups {
+		if dbID == "" || m.Database == dbID {
+			backups = append(backups, m)
+		}
+	}
+	writeJSON(w, http.StatusOK, backups)
+}
+
+// handleBackup queues an immediate backup of every database, or of the one
+// given with ?db=. A database that already has one queued is skipped; a
+// running backup finishes before the queued one starts.
+func (bt *Tool) handleBackup(w http.ResponseWriter, r *http.Request) {
+	jobs, ok := bt.selectJobs(w, r)
+	if !ok {
+		return
+	}
+
+	queued := []string{}
+	alreadyQueued := []string{}
+	for _, job := range jobs {
+		select {
+		case job.trigger <- struct{}{}:
+			job.logger.Info("Backup requested via API")
+			queued = append(queued, job.db.ID)
+		default:
+			alreadyQueued = append(alreadyQueued, job.db.ID)
+		}
+	}
+
+	status := http.StatusAccepted
+	if len(queued) == 0 {
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, map[string][]string{"queued": queued, "already_queued": alreadyQueued})
+}
+
+// selectJobs returns the job named by ?db=, or all jobs without one
+func (bt *Tool) selectJobs(w http.ResponseWriter, r *http.Request) ([]*databaseJob, bool) {
+	dbID := r.URL.Query().Get("db")
+	if dbID == "" {
+		return bt.jobs, true
+	}
+	for _, job := range bt.jobs {
+		if job.db.ID == dbID {
+			return []*databaseJob{job}, true
+		}
+	}
+	writeJSONError(w, http.StatusNotFound, "unknown database "+dbID)
+	return nil, false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
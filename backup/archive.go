@@ -0,0 +1,117 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"beackup/tracing"
+)
+
+// archiveBackup moves a backup, and its masked copy, to archive storage.
+// Each file is copied from local disk if it is still there and otherwise
+// from remote storage; only then are the other copies removed and the
+// manifest marked archived.
+func (bt *Tool) archiveBackup(ctx context.Context, job *databaseJob, m *backupManifest) (err error) {
+	ctx, span := tracing.Start(ctx, "archive", tracing.Attr("beackup.storage", bt.config.Storage.Archive.Type))
+	defer func() { span.End(err) }()
+
+	if m.Dedup {
+		return fmt.Errorf("deduplicated backups cannot be archived")
+	}
+	files := []string{m.File}
+	if m.MaskedCopy != "" {
+		files = append(files, m.MaskedCopy)
+	}
+	for _, file := range files {
+		if err := bt.archiveFile(ctx, job, m, file); err != nil {
+			return err
+		}
+	}
+
+	if err := bt.removeCopies(ctx, job, m); err != nil {
+		return err
+	}
+	m.Archived = true
+	m.Uploaded = false
+	if err := bt.writeManifest(job.outputDir, m); err != nil {
+		return err
+	}
+	bt.recordArchival(job, m)
+	return nil
+}
+
+// archiveFile copies one file of a backup, or every file of a directory,
+// to archive storage under the key it has in remote storage
+func (bt *Tool) archiveFile(ctx context.Context, job *databaseJob, m *backupManifest, file string) error {
+	key := path.Join(job.db.ID, filepath.ToSlash(file))
+	local := filepath.Join(job.outputDir, file)
+	if _, err := os.Stat(local); err == nil {
+		return filepath.WalkDir(local, func(p string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(local, p)
+			if err != nil {
+				return err
+			}
+			return bt.archiveObject(ctx, job, path.Join(key, filepath.ToSlash(rel)), func() (io.ReadCloser, error) {
+				return os.Open(p)
+			})
+		})
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if !m.Uploaded || bt.storage == nil {
+		return fmt.Errorf("no copy of %s is left to archive", file)
+	}
+	objects, err := remoteObjects(ctx, bt.storage, key)
+	if err != nil {
+		return fmt.Errorf("failed to list remote copy: %w", err)
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("no copy of %s is left to archive", file)
+	}
+	for _, object := range objects {
+		err := bt.archiveObject(ctx, job, object.Key, func() (io.ReadCloser, error) {
+			return bt.storage.Get(ctx, object.Key)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveObject uploads what open returns to archive storage under key,
+// retrying transient failures
+func (bt *Tool) archiveObject(ctx context.Context, job *databaseJob, key string, open func() (io.ReadCloser, error)) error {
+	return bt.retry(ctx, job.logger, "archive", func() error {
+		body, err := open()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		defer body.Close()
+
+		job.logger.Debug("Archiving file", "key", key)
+		if err := bt.archive.Put(ctx, key, bt.throttleUpload(ctx, body)); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", key, err)
+		}
+		return nil
+	})
+}
+
+// deleteArchived removes a backup, and its masked copy, from archive storage
+func (bt *Tool) deleteArchived(ctx context.Context, job *databaseJob, m *backupManifest) error {
+	if err := deleteObjects(ctx, bt.archive, path.Join(job.db.ID, filepath.ToSlash(m.File))); err != nil {
+		return err
+	}
+	if m.MaskedCopy != "" {
+		return deleteObjects(ctx, bt.archive, path.Join(job.db.ID, filepath.ToSlash(m.MaskedCopy)))
+	}
+	return nil
+}
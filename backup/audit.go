@@ -0,0 +1,318 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"beackup/config"
+	"beackup/storage"
+)
+
+// Results of the checks of an audit
+const (
+	auditOK       = "ok"
+	auditFailed   = "failed"
+	auditUnsigned = "unsigned"
+	auditSkipped  = "skipped"
+)
+
+// ErrAuditFailed is returned by Audit, after printing its results, when a
+// backup fails a check
+var ErrAuditFailed = errors.New("backups failed the audit")
+
+// ErrCatalogUnverified is returned by Audit when signing is configured and
+// the catalog's signature is missing or bad, as none of its entries can
+// then be trusted
+var ErrCatalogUnverified = errors.New("catalog signature could not be verified")
+
+// auditedBackup is the outcome of auditing one backup
+type auditedBackup struct {
+	Database string   `json:"database"`
+	File     string   `json:"file"`
+	Manifest string   `json:"manifest"` // signature of the manifest
+	Checksum string   `json:"checksum"` // of the local artifact, or else of the stored copy
+	Artifact string   `json:"artifact"` // signature of the artifact
+	Problems []string `json:"problems,omitempty"`
+}
+
+// failed reports whether any check of the backup failed
+func (a *auditedBackup) failed() bool {
+	return len(a.Problems) > 0
+}
+
+// Audit checks every backup in the catalog of the output directory. With
+// signing configured, the catalog's own signature is checked first, as an
+// altered catalog could hide backups, and then the signatures of each
+// backup's manifest and artifact. Each manifest must agree with the
+// catalog, and each backup still have the recorded checksum: the local
+// artifact is read if it is still there, and otherwise the copy in remote
+// or archive storage is streamed. It prints the outcome, as JSON if asJSON
+// is set, and returns an error if any backup fails.
+//
+// The catalog is rebuilt from the manifests on disk after every backup, so
+// a backup whose manifest was deleted along with it is left out of the
+// next signed catalog, and the audit cannot tell it ever existed.
+func (bt *Tool) Audit(ctx context.Context, w io.Writer, asJSON bool) error {
+	if err := verifyCatalog(bt.config); err != nil {
+		return err
+	}
+	cat, err := loadCatalog(bt.config.Backup.OutputDir)
+	if err != nil {
+		return fmt.Errorf("failed to load catalog: %w", err)
+	}
+
+	audited := []*auditedBackup{}
+	failures := 0
+	for _, m := range cat.Backups {
+		a := bt.auditBackup(ctx, m)
+		if a.failed() {
+			failures++
+		}
+		audited = append(audited, a)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(audited); err != nil {
+			return err
+		}
+	} else if len(audited) == 0 {
+		fmt.Fprintln(w, "No backups found")
+	} else {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "DATABASE\tFILE\tMANIFEST\tCHECKSUM\tARTIFACT\tPROBLEMS")
+		for _, a := range audited {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", a.Database, a.File, a.Manifest, a.Checksum, a.Artifact,
+				valueOrDash(strings.Join(a.Problems, "; ")))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d of %d %w", failures, len(audited), ErrAuditFailed)
+	}
+	return nil
+}
+
+// verifyCatalog checks the signature of the catalog if signing is
+// configured. A missing catalog has nothing to check only while no backup
+// was written yet: with manifests in the output directory, it may have
+// been deleted to hide them.
+func verifyCatalog(cfg *config.Config) error {
+	if !cfg.Signing.Enabled() {
+		return nil
+	}
+	path := filepath.Join(cfg.Backup.OutputDir, catalogFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		found, err := hasManifests(cfg.Backup.OutputDir)
+		if err != nil {
+			return err
+		}
+		if found {
+			return fmt.Errorf("%w: %s is missing", ErrCatalogUnverified, catalogFile)
+		}
+		return nil
+	}
+	if err := verifyFile(cfg.Signing, path); err != nil {
+		return fmt.Errorf("%w: %v", ErrCatalogUnverified, err)
+	}
+	return nil
+}
+
+// hasManifests reports whether any backup manifest is under dir
+func hasManifests(dir string) (bool, error) {
+	found := false
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipAll
+			}
+			return fmt.Errorf("failed to read backup directory: %w", err)
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), manifestSuffix) {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found, err
+}
+
+// auditBackup checks one backup of the catalog against its files on disk
+// and its stored copy
+func (bt *Tool) auditBackup(ctx context.Context, listed *backupManifest) *auditedBackup {
+	cfg := bt.config
+	a := &auditedBackup{Database: listed.Database, File: listed.File, Manifest: auditSkipped, Checksum: auditSkipped, Artifact: auditSkipped}
+	artifact := filepath.Join(cfg.Backup.OutputDir, listed.Database, listed.File)
+	manifest := manifestPath(artifact)
+
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		a.Manifest = auditFailed
+		a.Problems = append(a.Problems, fmt.Sprintf("failed to read manifest: %v", err))
+		return a
+	}
+	if cfg.Signing.Enabled() {
+		a.Manifest = checkSignature(cfg.Signing, manifest, "manifest", a)
+	}
+
+	var m backupManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		a.Problems = append(a.Problems, fmt.Sprintf("failed to parse manifest: %v", err))
+		return a
+	}
+	if m.File != listed.File || m.SHA256 != listed.SHA256 || m.Size != listed.Size {
+		a.Problems = append(a.Problems, "manifest differs from the catalog")
+	}
+
+	info, statErr := os.Stat(artifact)
+	switch {
+	case m.SHA256 == "":
+		// Streamed or incomplete
+	case os.IsNotExist(statErr):
+		a.Checksum = bt.auditStoredCopy(ctx, &m, a)
+	case statErr != nil:
+		a.Checksum = auditFailed
+		a.Problems = append(a.Problems, fmt.Sprintf("failed to read backup: %v", statErr))
+	default:
+		a.Checksum = auditOK
+		sum, err := artifactChecksum(artifact)
+		if err != nil {
+			a.Checksum = auditFailed
+			a.Problems = append(a.Problems, fmt.Sprintf("failed to checksum backup: %v", err))
+		} else if sum != m.SHA256 {
+			a.Checksum = auditFailed
+			a.Problems = append(a.Problems, fmt.Sprintf("backup has checksum %s instead of %s", sum, m.SHA256))
+		}
+	}
+
+	if cfg.Signing.Enabled() && statErr == nil && info.Mode().IsRegular() {
+		if _, err := os.Stat(signaturePath(artifact)); err == nil || cfg.Signing.Artifacts {
+			a.Artifact = checkSignature(cfg.Signing, artifact, "backup", a)
+		}
+	}
+	return a
+}
+
+// auditStoredCopy checks the checksum of a backup without a local artifact
+// against its copy in archive storage if it was archived, and in remote
+// storage if it was uploaded, recording a problem in a if it differs. It
+// returns the result of the check.
+func (bt *Tool) auditStoredCopy(ctx context.Context, m *backupManifest, a *auditedBackup) string {
+	backend := bt.storage
+	if m.Archived {
+		backend = bt.archive
+	}
+	if backend == nil || !m.Uploaded && !m.Archived {
+		// Deleted, with no copy left to check
+		return auditSkipped
+	}
+
+	var sum string
+	var err error
+	if m.Dedup {
+		sum, err = bt.snapshotChecksum(ctx, m)
+	} else {
+		sum, err = storedChecksum(ctx, backend, path.Join(m.Database, filepath.ToSlash(m.File)))
+	}
+	switch {
+	case err != nil:
+		a.Problems = append(a.Problems, fmt.Sprintf("failed to checksum stored copy: %v", err))
+		return auditFailed
+	case sum != m.SHA256:
+		a.Problems = append(a.Problems, fmt.Sprintf("stored copy has checksum %s instead of %s", sum, m.SHA256))
+		return auditFailed
+	}
+	return auditOK
+}
+
+// storedChecksum streams the backup stored under key and returns its
+// checksum as artifactChecksum computes it on disk: of the object itself,
+// or of the objects under key for a directory-format backup
+func storedChecksum(ctx context.Context, backend storage.Backend, key string) (string, error) {
+	objects, err := remoteObjects(ctx, backend, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to list %s: %w", key, err)
+	}
+	if len(objects) == 0 {
+		return "", fmt.Errorf("%s not found", key)
+	}
+	if len(objects) == 1 && objects[0].Key == key {
+		return objectChecksum(ctx, backend, key)
+	}
+
+	// In the order filepath.WalkDir visits the files
+	slices.SortFunc(objects, func(a, b storage.Object) int {
+		return slices.Compare(strings.Split(a.Key, "/"), strings.Split(b.Key, "/"))
+	})
+	tree := sha256.New()
+	for _, object := range objects {
+		sum, err := objectChecksum(ctx, backend, object.Key)
+		if err != nil {
+			return "", err
+		}
+		addTreeEntry(tree, sum, strings.TrimPrefix(object.Key, key+"/"))
+	}
+	return hex.EncodeToString(tree.Sum(nil)), nil
+}
+
+// objectChecksum returns the hex SHA-256 of an object's contents
+func objectChecksum(ctx context.Context, backend storage.Backend, key string) (string, error) {
+	body, err := backend.Get(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// snapshotChecksum reassembles a deduplicated backup from its chunks in a
+// temporary directory and returns its checksum
+func (bt *Tool) snapshotChecksum(ctx context.Context, m *backupManifest) (string, error) {
+	dir, err := os.MkdirTemp("", "beackup-audit-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	target, err := bt.fetchSnapshot(ctx, m.Database, m.File, dir)
+	if err != nil {
+		return "", err
+	}
+	return artifactChecksum(target)
+}
+
+// checkSignature verifies the signature of the file at path, recording a
+// problem with what in a if it is missing or bad, and returns the result
+func checkSignature(s config.Signing, path, what string, a *auditedBackup) string {
+	err := verifyFile(s, path)
+	switch {
+	case err == nil:
+		return auditOK
+	case errors.Is(err, errUnsigned):
+		a.Problems = append(a.Problems, what+" is not signed")
+		return auditUnsigned
+	default:
+		a.Problems = append(a.Problems, fmt.Sprintf("%s signature: %v", what, err))
+		return auditFailed
+	}
+}
@@ -0,0 +1,192 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"beackup/config"
+)
+
+// auditTool returns a tool signing with a new Ed25519 key, uploading to
+// memory, with one database, app
+func auditTool(t *testing.T) (*Tool, *memBackend) {
+	t.Helper()
+	dir := t.TempDir()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "signing.pem")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Backup.OutputDir = filepath.Join(dir, "backups")
+	cfg.Signing = config.Signing{Type: "ed25519", PrivateKey: config.KeySource{File: keyPath}}
+	remote := newMemBackend()
+	job := &databaseJob{db: &config.Database{ID: "app"}, outputDir: filepath.Join(cfg.Backup.OutputDir, "app")}
+	if err := os.MkdirAll(job.outputDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &Tool{config: cfg, storage: remote, jobs: []*databaseJob{job}}, remote
+}
+
+// addBackup writes and uploads a backup of app with contents, and records
+// it in its manifest and the catalog
+func addBackup(t *testing.T, bt *Tool, remote *memBackend, file, contents string) {
+	t.Helper()
+	dir := bt.jobs[0].outputDir
+	artifact := filepath.Join(dir, file)
+	if err := os.WriteFile(artifact, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := fileChecksum(artifact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.Put(context.Background(), "app/"+file, bytes.NewReader([]byte(contents)))
+	m := &backupManifest{Database: "app", File: file, CreatedAt: time.Now(), Size: int64(len(contents)), SHA256: sum, Uploaded: true}
+	if err := bt.writeManifest(dir, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := bt.updateCatalog(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// audit runs an audit, returning its results
+func audit(t *testing.T, bt *Tool) ([]auditedBackup, error) {
+	t.Helper()
+	var out bytes.Buffer
+	err := bt.Audit(context.Background(), &out, true)
+	var results []auditedBackup
+	if out.Len() > 0 {
+		if jsonErr := json.Unmarshal(out.Bytes(), &results); jsonErr != nil {
+			t.Fatalf("failed to parse audit output %q: %v", out.String(), jsonErr)
+		}
+	}
+	return results, err
+}
+
+func TestAudit(t *testing.T) {
+	bt, remote := auditTool(t)
+	addBackup(t, bt, remote, "app.dump", "dump contents")
+
+	results, err := audit(t, bt)
+	if err != nil || len(results) != 1 || results[0].Manifest != auditOK || results[0].Checksum != auditOK {
+		t.Fatalf("Audit() = %+v, %v; want the backup ok", results, err)
+	}
+
+	// Without the local artifact, the uploaded copy is checked
+	if err := os.Remove(filepath.Join(bt.jobs[0].outputDir, "app.dump")); err != nil {
+		t.Fatal(err)
+	}
+	results, err = audit(t, bt)
+	if err != nil || results[0].Checksum != auditOK {
+		t.Errorf("Audit() without the local artifact = %+v, %v; want the stored copy ok", results, err)
+	}
+
+	remote.Put(context.Background(), "app/app.dump", bytes.NewReader([]byte("altered contents")))
+	results, err = audit(t, bt)
+	if !errors.Is(err, ErrAuditFailed) || results[0].Checksum != auditFailed {
+		t.Errorf("Audit() of an altered stored copy = %+v, %v; want its checksum failed", results, err)
+	}
+
+	// Entries cannot be trusted from an altered catalog
+	catalog := filepath.Join(bt.config.Backup.OutputDir, catalogFile)
+	if err := os.WriteFile(catalog, []byte(`{"backups": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := audit(t, bt); !errors.Is(err, ErrCatalogUnverified) {
+		t.Errorf("Audit() of an altered catalog = %v, want %v", err, ErrCatalogUnverified)
+	}
+	if err := os.Remove(signaturePath(catalog)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := audit(t, bt); !errors.Is(err, ErrCatalogUnverified) {
+		t.Errorf("Audit() of an unsigned catalog = %v, want %v", err, ErrCatalogUnverified)
+	}
+
+	// Deleting the catalog does not hide the backups it listed
+	if err := os.Remove(catalog); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := audit(t, bt); !errors.Is(err, ErrCatalogUnverified) {
+		t.Errorf("Audit() without a catalog = %v, want %v", err, ErrCatalogUnverified)
+	}
+}
+
+func TestAuditWithoutBackups(t *testing.T) {
+	bt, _ := auditTool(t)
+	if results, err := audit(t, bt); err != nil || len(results) != 0 {
+		t.Errorf("Audit() before any backup = %+v, %v; want nothing to check", results, err)
+	}
+}
+
+func TestAuditSignatures(t *testing.T) {
+	bt, remote := auditTool(t)
+	addBackup(t, bt, remote, "app.dump", "dump contents")
+
+	manifest := manifestPath(filepath.Join(bt.jobs[0].outputDir, "app.dump"))
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(manifest, append(data, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+	results, err := audit(t, bt)
+	if !errors.Is(err, ErrAuditFailed) || results[0].Manifest != auditFailed {
+		t.Errorf("Audit() of an altered manifest = %+v, %v; want its signature failed", results, err)
+	}
+
+	if err := os.Remove(signaturePath(manifest)); err != nil {
+		t.Fatal(err)
+	}
+	results, err = audit(t, bt)
+	if !errors.Is(err, ErrAuditFailed) || results[0].Manifest != auditUnsigned {
+		t.Errorf("Audit() of an unsigned manifest = %+v, %v; want it unsigned", results, err)
+	}
+}
+
+func TestStoredChecksum(t *testing.T) {
+	// x.b sorts before x/c as a path, but WalkDir visits x/c first
+	dir := filepath.Join(t.TempDir(), "app.dir")
+	remote := newMemBackend()
+	for name, contents := range map[string]string{"toc.dat": "toc", "x.b": "b", "x/c": "c"} {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		remote.Put(context.Background(), "app/app.dir/"+name, bytes.NewReader([]byte(contents)))
+	}
+	remote.Put(context.Background(), "app/app.dump", bytes.NewReader([]byte("dump")))
+
+	want, err := artifactChecksum(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := storedChecksum(context.Background(), remote, "app/app.dir"); err != nil || got != want {
+		t.Errorf("storedChecksum() of a directory = %s, %v; want %s", got, err, want)
+	}
+	if _, err := storedChecksum(context.Background(), remote, "app/app"); err == nil {
+		t.Error("storedChecksum() of a missing backup succeeded")
+	}
+}
@@ -0,0 +1,1236 @@
+// Package backup is the beackup engine: it runs the scheduled dumps of the
+// configured databases through compression, encryption, verification and
+// upload, applies retention, and restores backups. The beackup command is a
+// thin CLI on top of it.
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"beackup/config"
+	"beackup/scheduler"
+	"beackup/storage"
+	"beackup/tracing"
+)
+
+// processKillDelay is how long a cancelled child process has to exit after
+// SIGTERM before it is killed
+const processKillDelay = 10 * time.Second
+
+// Tool handles the backup operations
+type Tool struct {
+	config     *config.Config
+	configPath string
+	overrides  []config.Override // re-applied on every reload
+	logger     *slog.Logger
+	logOutput  *logOutput // shared by reloads
+	storage    storage.Backend
+	archive    storage.Backend // where retention archives backups, nil if not configured
+	metrics    *metrics
+	dedup      *dedupStore // shared by reloads that keep the storage settings
+	tracer     *tracing.Tracer
+	notifiers  []notifier
+	secrets    map[string]secretProvider
+	jobs       []*databaseJob
+	slots      chan struct{} // limits concurrent backups, nil for no limit
+	limiter    *rateLimiter  // limits dump and upload bandwidth, nil for no limit
+	catalogMu  sync.Mutex
+}
+
+// databaseJob holds the per-database state used while running backups
+type databaseJob struct {
+	db        *config.Database
+	driver    driver
+	logger    *slog.Logger
+	outputDir string
+	trigger   chan struct{} // queues an on-demand backup
+	activity  *jobActivity  // shared with the job it resumed
+
+	mu      sync.Mutex // guards the fields below
+	nextRun time.Time
+	lastRun *runResult
+	runID   string // of the running backup, rehearsal or other run
+}
+
+// jobActivity is what is running for a database. It is carried over by
+// reloads, so that work started under an earlier config keeps the current
+// one from overlapping it.
+type jobActivity struct {
+	slot chan struct{} // held while a backup or other run is in progress
+
+	mu        sync.Mutex // guards the fields below
+	running   bool       // a backup is in progress
+	startedAt time.Time
+}
+
+// New creates a new backup tool instance, with overrides taking precedence
+// over the config file
+func New(configPath string, overrides ...config.Override) (*Tool, error) {
+	config, err := LoadConfig(configPath, overrides...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	output := &logOutput{dest: openLogDestination(config)}
+	bt, err := newTool(config, configPath, setupLogger(config, output), newMetrics())
+	if err != nil {
+		closeLogDestination(output.dest)
+		return nil, err
+	}
+	bt.logOutput = output
+	bt.overrides = overrides
+	bt.dedup = newDedupStore()
+	return bt, nil
+}
+
+// newTool sets up a backup tool for a loaded config, recording its
+// statistics in metrics
+func newTool(config *config.Config, configPath string, logger *slog.Logger, metrics *metrics) (*Tool, error) {
+	backend, err := newStorageBackend(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up storage: %w", err)
+	}
+	archive, err := newArchiveBackend(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up archive storage: %w", err)
+	}
+
+	notifiers, err := newNotifiers(config.Notifications)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up notifications: %w", err)
+	}
+
+	secrets, err := newSecretProviders(config.Secrets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up secret providers: %w", err)
+	}
+
+	bt := &Tool{
+		config:     config,
+		configPath: configPath,
+		logger:     logger,
+		storage:    backend,
+		archive:    archive,
+		metrics:    metrics,
+		notifiers:  notifiers,
+		secrets:    secrets,
+		tracer: tracing.New(config.Tracing, func(err error) {
+			logger.Warn("Failed to export trace", "error", err)
+		}),
+	}
+	if config.Backup.MaxConcurrent > 0 {
+		bt.slots = make(chan struct{}, config.Backup.MaxConcurrent)
+	}
+	if config.Backup.RateLimit > 0 {
+		bt.limiter = newRateLimiter(int64(config.Backup.RateLimit))
+		if limited, ok := backend.(storage.RateLimiter); ok {
+			limited.SetRateLimit(int64(config.Backup.RateLimit))
+		}
+	}
+	if config.Storage.Lock.Enabled() {
+		if locker, ok := backend.(storage.Locker); ok {
+			locker.SetLock(config.Storage.Lock)
+		}
+	}
+
+	for i := range config.Databases {
+		db := &config.Databases[i]
+		job := &databaseJob{
+			db:        db,
+			driver:    drivers[db.Type],
+			outputDir: filepath.Join(config.Backup.OutputDir, db.ID),
+			trigger:   make(chan struct{}, 1),
+			activity:  &jobActivity{slot: make(chan struct{}, 1)},
+		}
+		job.logger = slog.New(runIDHandler{Handler: logger.With("db", db.ID).Handler(), job: job})
+		bt.jobs = append(bt.jobs, job)
+		bt.metrics.register(db.ID)
+	}
+
+	return bt, nil
+}
+
+// LoadConfig loads the configuration file and checks the settings of each
+// database against its type's driver, filling in the defaults it sets
+func LoadConfig(configPath string, overrides ...config.Override) (*config.Config, error) {
+	cfg, err := config.Load(configPath, overrides...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range cfg.Databases {
+		db := &cfg.Databases[i]
+		driver, err := driverFor(db.Type)
+		if err != nil {
+			return nil, fmt.Errorf("database %q: %w", db.ID, err)
+		}
+		if err := driver.validate(db, cfg.Backup.Format); err != nil {
+			return nil, fmt.Errorf("database %q: %w", db.ID, err)
+		}
+		if db.RemotePrograms() && !driver.streams(db) {
+			return nil, fmt.Errorf("database %q: the %s format cannot be streamed from a remote connection", db.ID, db.Format)
+		}
+		if cfg.Storage.Stream && !driver.streams(db) {
+			return nil, fmt.Errorf("database %q: the %s format cannot be streamed to storage", db.ID, db.Format)
+		}
+		if db.Masking.Enabled() && (db.Type != config.TypePostgres || db.Format != "plain") {
+			return nil, fmt.Errorf("database %q: masking only applies to the plain format of postgres", db.ID)
+		}
+		if (db.Format == "directory" || db.Format == baseBackupFormat || db.Format == copyFormat) && cfg.Encryption.Enabled() {
+			return nil, fmt.Errorf("database %q: encryption is not supported for the %s format", db.ID, db.Format)
+		}
+		filtered := len(db.IncludeSchemas) > 0 || len(db.ExcludeSchemas) > 0 || len(db.IncludeTables) > 0 || len(db.ExcludeTables) > 0
+		if filtered && db.Format == baseBackupFormat {
+			return nil, fmt.Errorf("database %q: schema and table filters do not apply to the basebackup format", db.ID)
+		}
+		if slices.Contains(cfg.VerifyRestore.Databases, db.ID) {
+			if _, ok := driver.(rehearsalDriver); !ok {
+				return nil, fmt.Errorf("invalid verify_restore config: restore rehearsals do not support %s databases", db.Type)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// newStorageBackend creates the remote storage backend, if one is configured
+func newStorageBackend(config *config.Config) (storage.Backend, error) {
+	switch config.Storage.Type {
+	case "":
+		return nil, nil
+	case "s3":
+		return storage.NewS3(config.Storage.S3)
+	case "gcs":
+		return storage.NewGCS(config.Storage.GCS)
+	case "azure":
+		return storage.NewAzure(config.Storage.Azure)
+	case "sftp":
+		return storage.NewSFTP(config.Storage.SFTP)
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", config.Storage.Type)
+	}
+}
+
+// newArchiveBackend creates the storage retention archives backups to, if
+// one is configured
+func newArchiveBackend(config *config.Config) (storage.Backend, error) {
+	archive := config.Storage.Archive
+	switch archive.Type {
+	case "":
+		return nil, nil
+	case "s3":
+		return storage.NewS3(archive.S3)
+	case "gcs":
+		return storage.NewGCS(archive.GCS)
+	case "azure":
+		return storage.NewAzure(archive.Azure)
+	case "sftp":
+		return storage.NewSFTP(archive.SFTP)
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", archive.Type)
+	}
+}
+
+// Start begins the periodic backup process and runs until ctx is cancelled.
+// SIGHUP, or a change to the config file if watch_config is set, reloads
+// the config without interrupting running backups. Backups still running
+// at shutdown are given the configured grace period to finish before their
+// child processes are killed.
+func (bt *Tool) Start(ctx context.Context) error {
+	bt.logger.Info("Starting backup tool", "databases", len(bt.jobs))
+
+	if err := bt.createOutputDirs(); err != nil {
+		return err
+	}
+
+	// The listeners outlive reloads and serve whichever tool is current
+	var live atomic.Pointer[Tool]
+	live.Store(bt)
+	if bt.config.Metrics.ListenAddr != "" {
+		go bt.serveMetrics()
+	}
+	if bt.config.API.ListenAddr != "" {
+		go bt.serveAPI(&live)
+	}
+
+	scheduler.Run(ctx, bt, func(next *Tool) {
+		live.Store(next)
+		next.logger.Info("Config reloaded", "databases", len(next.jobs))
+	})
+	return nil
+}
+
+// Kinds of scheduled runs
+const (
+	runKindBackup     = "backup"
+	runKindGlobals    = "globals backup"
+	runKindBaseBackup = "base backup"
+)
+
+// heldRun is a scheduled run delayed until the schedule allows it
+type heldRun struct {
+	kind string
+	run  func()
+}
+
+// runSchedule performs an initial backup of a database and then repeats it
+// at the database's configured frequency until ctx is cancelled, skipping
+// or delaying runs outside its run window or during blackouts. Backups
+// requested through the API run in between, whatever the schedule.
+// Backups themselves run under runCtx. A job resumed after a config reload
+// skips the initial backups and continues its schedule.
+func (bt *Tool) runSchedule(ctx, runCtx context.Context, job *databaseJob) {
+	job.logger.Info("Scheduling backups", "frequency", job.db.Frequency)
+
+	job.mu.Lock()
+	next := job.nextRun
+	job.mu.Unlock()
+	resumed := !next.IsZero()
+
+	// Runs due while the schedule does not allow them are skipped, or held
+	// until holdTick by the delay policy
+	var held []heldRun
+	var holdTick <-chan time.Time
+	scheduled := func(kind string, run func()) {
+		reopen, reason := job.db.Schedule.Hold(time.Now())
+		if reason == "" {
+			run()
+			return
+		}
+		if slices.ContainsFunc(held, func(h heldRun) bool { return h.kind == kind }) {
+			bt.metrics.observeHeld(job.db.ID, true)
+			job.logger.Warn("Skipping scheduled run, a delayed one is pending", "run", kind, "reason", reason)
+			return
+		}
+		if job.db.Schedule.Missed == config.MissedSkip || reopen.IsZero() {
+			bt.metrics.observeHeld(job.db.ID, true)
+			job.logger.Warn("Skipping scheduled run", "run", kind, "reason", reason)
+			return
+		}
+		bt.metrics.observeHeld(job.db.ID, false)
+		job.logger.Warn("Delaying scheduled run", "run", kind, "reason", reason, "until", reopen)
+		if kind == runKindBackup {
+			job.setNextRun(reopen)
+		}
+		held = append(held, heldRun{kind: kind, run: run})
+		holdTick = time.After(time.Until(reopen))
+	}
+
+	// Run initial backup
+	if !resumed {
+		next = time.Now().Add(job.db.Frequency)
+		job.setNextRun(next)
+		scheduled(runKindBackup, func() {
+			job.setNextRun(next)
+			logRunError(job, "Initial backup failed", bt.runBackup(ctx, runCtx, job))
+		})
+	}
+
+	runGlobals := func() {
+		logRunError(job, "Globals backup failed", bt.withSlot(ctx, job, func() { bt.runGlobalsBackup(runCtx, job) }))
+	}
+	runBase := func() {
+		logRunError(job, "Base backup failed", bt.withSlot(ctx, job, func() { bt.runBaseBackup(runCtx, job) }))
+	}
+
+	// Globals dumped on their own schedule get a second ticker
+	var globalsTick <-chan time.Time
+	if bt.config.Backup.IncludeGlobals && bt.config.Backup.GlobalsFrequency > 0 && job.db.Type == config.TypePostgres {
+		if !resumed {
+			scheduled(runKindGlobals, runGlobals)
+		}
+
+		globalsTicker := time.NewTicker(bt.config.Backup.GlobalsFrequency)
+		defer globalsTicker.Stop()
+		globalsTick = globalsTicker.C
+	}
+
+	// Point-in-time recovery archives WAL continuously and takes base
+	// backups on their own schedule
+	var baseTick <-chan time.Time
+	if job.db.WAL.Enabled() {
+		var archiver sync.WaitGroup
+		archiver.Add(1)
+		go func() {
+			defer archiver.Done()
+			bt.runWALArchiver(ctx, runCtx, job)
+		}()
+		defer archiver.Wait()
+
+		if bt.baseBackupDue(job) {
+			scheduled(runKindBaseBackup, runBase)
+		}
+		baseTicker := time.NewTicker(job.db.WAL.BaseBackupFrequency)
+		defer baseTicker.Stop()
+		baseTick = baseTicker.C
+	}
+
+	// Restore rehearsals run on their own schedule too
+	var rehearsalTick <-chan time.Time
+	if bt.rehearses(job.db) {
+		if bt.rehearsalDue(job) {
+			logRunError(job, "Restore rehearsal failed", bt.withSlot(ctx, job, func() { bt.runRehearsal(runCtx, job) }))
+		}
+		rehearsalTicker := time.NewTicker(bt.config.VerifyRestore.Frequency)
+		defer rehearsalTicker.Stop()
+		rehearsalTick = rehearsalTicker.C
+	}
+
+	// Set up periodic backups. The timer is rearmed as soon as it fires, so
+	// backups start at a fixed frequency however long they take.
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+
+	runScheduled := func(overlapping bool) {
+		job.setNextRun(time.Now().Add(job.db.Frequency))
+		var err error
+		if overlapping {
+			err = bt.overlap(job, "the previous backup was still running")
+		}
+		if err == nil {
+			err = bt.runBackup(ctx, runCtx, job)
+		}
+		logRunError(job, "Backup failed", err)
+	}
+
+	overlapping := false
+	for {
+		if overlapping {
+			scheduled(runKindBackup, func() { runScheduled(true) })
+		} else {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				timer.Reset(job.db.Frequency)
+				scheduled(runKindBackup, func() { runScheduled(false) })
+			case <-job.trigger:
+				logRunError(job, "Requested backup failed", bt.runBackup(ctx, runCtx, job))
+			case <-globalsTick:
+				scheduled(runKindGlobals, runGlobals)
+			case <-baseTick:
+				scheduled(runKindBaseBackup, runBase)
+			case <-holdTick:
+				holdTick = nil
+				reopen, reason := job.db.Schedule.Hold(time.Now())
+				switch {
+				case reason == "":
+					runs := held
+					held = nil
+					for _, h := range runs {
+						h.run()
+					}
+				case !reopen.IsZero():
+					holdTick = time.After(time.Until(reopen))
+				default:
+					job.logger.Warn("Skipping delayed runs", "reason", reason)
+					held = nil
+				}
+			case <-rehearsalTick:
+				logRunError(job, "Restore rehearsal failed", bt.withSlot(ctx, job, func() { bt.runRehearsal(runCtx, job) }))
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A tick that fired while the work above was running is a backup
+		// overlapping it, handled by the overlap policy
+		select {
+		case <-timer.C:
+			timer.Reset(job.db.Frequency)
+			overlapping = true
+		default:
+			overlapping = false
+		}
+	}
+}
+
+// logRunError logs the error a scheduled run failed with. Skipped runs have
+// been logged by the overlap policy.
+func logRunError(job *databaseJob, msg string, err error) {
+	if err != nil && !errors.Is(err, errOverlapSkipped) {
+		job.logger.Error(msg, "error", err)
+	}
+}
+
+// runBackup performs a backup in a free slot and records its outcome for
+// the status API
+func (bt *Tool) runBackup(ctx, runCtx context.Context, job *databaseJob) error {
+	var err error
+	slotErr := bt.withSlot(ctx, job, func() {
+		started := time.Now()
+		job.activity.mu.Lock()
+		job.activity.running = true
+		job.activity.startedAt = started
+		job.activity.mu.Unlock()
+
+		_, err = bt.performBackup(runCtx, job)
+
+		result := &runResult{StartedAt: started, FinishedAt: time.Now(), Status: "success"}
+		if err != nil {
+			result.Status = "failure"
+			result.Error = err.Error()
+		}
+		job.activity.mu.Lock()
+		job.activity.running = false
+		job.activity.mu.Unlock()
+		job.mu.Lock()
+		job.lastRun = result
+		job.mu.Unlock()
+	})
+	if slotErr != nil {
+		return slotErr
+	}
+	return err
+}
+
+// setNextRun records when the next scheduled backup is due
+func (job *databaseJob) setNextRun(t time.Time) {
+	job.mu.Lock()
+	job.nextRun = t
+	job.mu.Unlock()
+}
+
+// withSlot runs fn once nothing started before a reload is running for the
+// database, fewer than max_concurrent backups are running and no other
+// process is backing up the database. It gives up silently if ctx is
+// cancelled while waiting, and returns the overlap policy's error if the
+// backup is not run because of an earlier run or another process.
+func (bt *Tool) withSlot(ctx context.Context, job *databaseJob, fn func()) error {
+	select {
+	case job.activity.slot <- struct{}{}:
+	default:
+		// Runs of one config follow each other, so the slot is held by a
+		// run of an earlier one
+		if err := bt.overlap(job, "a backup started before the config was reloaded is still running"); err != nil {
+			return err
+		}
+		select {
+		case job.activity.slot <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	defer func() { <-job.activity.slot }()
+
+	if bt.slots != nil {
+		select {
+		case bt.slots <- struct{}{}:
+		default:
+			job.logger.Debug("Waiting for a free backup slot")
+			select {
+			case bt.slots <- struct{}{}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		defer func() { <-bt.slots }()
+	}
+
+	lock, err := bt.lockDatabase(ctx, job)
+	if err != nil || lock == nil {
+		return err
+	}
+	defer lock.release()
+
+	fn()
+	return nil
+}
+
+// performBackup executes a single backup operation, returning the manifest
+// of the backup if it got as far as writing one
+func (bt *Tool) performBackup(ctx context.Context, job *databaseJob) (manifest *backupManifest, err error) {
+	ctx, run := bt.startRun(ctx, job, "backup")
+	defer func() { bt.endRun(job, run, err) }()
+	run.SetAttributes(tracing.Attr("beackup.format", job.db.Format))
+
+	logger := job.logger.With("format", job.db.Format)
+	logger.Info("Starting backup")
+	bt.heartbeat(job, pingStart, "")
+
+	start := time.Now()
+	var size int64
+	var outputPath string
+	defer func() {
+		duration := time.Since(start)
+		bt.recordRun(job, job.db.Format, outputPath, start, manifest, err)
+		bt.metrics.observeBackup(job.db.ID, duration, size, err)
+
+		// Hooks still run when the backup was aborted by a shutdown, e.g. to
+		// take an application out of maintenance mode again
+		hookCtx := context.WithoutCancel(ctx)
+		if err != nil {
+			env := hookEnv{status: eventFailure, err: err}
+			if hookErr := bt.runHooks(hookCtx, job, "on_failure", job.db.Hooks.OnFailure, env); hookErr != nil {
+				logger.Error("Hook failed", "error", hookErr)
+			}
+		} else {
+			env := hookEnv{file: outputPath, status: eventSuccess, size: size}
+			if hookErr := bt.runHooks(hookCtx, job, "post_backup", job.db.Hooks.PostBackup, env); hookErr != nil {
+				logger.Error("Hook failed", "error", hookErr)
+			}
+		}
+
+		if err != nil {
+			bt.notify(job, notification{Event: eventFailure, Duration: duration.Seconds(), Error: err.Error()})
+			bt.heartbeat(job, pingFail, err.Error())
+		} else {
+			n := notification{Event: eventSuccess, Database: job.db.ID, File: outputPath, Duration: duration.Seconds(), Size: size}
+			bt.notify(job, n)
+			bt.heartbeat(job, pingSuccess, n.summary())
+		}
+	}()
+
+	compression := bt.config.Backup.Compression
+	encryption := bt.config.Encryption
+	target, err := bt.dumpTarget(job, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	filename := target.filename
+	outputPath = filepath.Join(job.outputDir, filename)
+	if err := prepareOutput(outputPath); err != nil {
+		return nil, err
+	}
+
+	if err := bt.checkQuota(ctx, job); err != nil {
+		return nil, err
+	}
+
+	if err := bt.runHooks(ctx, job, "pre_backup", job.db.Hooks.PreBackup, hookEnv{file: outputPath, status: "running"}); err != nil {
+		return nil, err
+	}
+
+	password, err := bt.resolvePassword(ctx, job.db)
+	if err != nil {
+		return nil, err
+	}
+	// db is what the backup connects to, the selected server reached
+	// through the tunnel if any
+	source, db, err := bt.selectSource(ctx, job, password, logger)
+	if err != nil {
+		return nil, err
+	}
+	closeTunnel, err := openTunnel(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	defer closeTunnel()
+
+	tool := job.driver.tool(db)
+
+	// Record versions for the manifest; a failure here is not fatal since
+	// the dump reports connection problems itself
+	serverVersion, dumpVersion := job.driver.versions(ctx, logger, db)
+	var walStart string
+	if job.db.Format == baseBackupFormat {
+		// Archived WAL from this segment on is needed to restore the backup
+		walStart, err = queryValue(ctx, db, "SELECT pg_walfile_name(pg_current_wal_lsn())")
+		if err != nil {
+			logger.Warn("Failed to query current WAL segment", "error", err)
+			walStart = ""
+		}
+	}
+
+	// Dumps uploaded to the dedup store are chunked as they are written
+	// when streamed, before compression and encryption, and once written
+	// otherwise
+	dedup := bt.storage != nil && bt.config.Storage.Dedup.Enabled
+	var session *dedupSession
+	defer func() {
+		if session != nil {
+			session.discard()
+		}
+	}()
+
+	// Transient failures such as a refused connection are retried; a failed
+	// attempt never leaves partial output behind. Dumps running too long or
+	// no longer writing output are aborted.
+	var masking *config.Masking
+	if target.masked {
+		masking = &job.db.Masking
+	}
+	var maskedPath string
+	if target.maskedCopy != "" {
+		maskedPath = filepath.Join(job.outputDir, target.maskedCopy)
+	}
+
+	var output string
+	var uploaded uploadedDump
+	var verifier *dumpVerifier
+	dumpCtx, stopDump := bt.limitDump(ctx)
+	defer stopDump()
+	dumpCtx, dumpSpan := tracing.Start(dumpCtx, "dump", tracing.Attr("beackup.tool", tool))
+	err = bt.retry(dumpCtx, logger, tool, func() (err error) {
+		// The output does not exist until the dump program creates it
+		var written atomic.Int64
+		progress := func() int64 {
+			size, _ := artifactSize(outputPath)
+			return size
+		}
+		if target.uploaded {
+			progress = written.Load
+		}
+		attemptCtx, stopWatchdog := bt.watchDump(dumpCtx, progress)
+		defer func() {
+			err = dumpAborted(dumpCtx, attemptCtx, err)
+			stopWatchdog()
+		}()
+
+		if job.db.Format == copyFormat {
+			output, err = bt.exportTables(attemptCtx, job, db, outputPath, compression)
+			if err != nil {
+				os.RemoveAll(outputPath)
+			}
+			return err
+		}
+
+		cmd, cleanup, err := job.driver.dumpCommand(attemptCtx, db, target.commandOutput(outputPath), compression)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		applyPriority(bt.config.Backup.Priority, cmd)
+
+		logger.Debug("Running "+tool, "command", redactedCommand(cmd, db))
+
+		// Execute backup
+		if target.uploaded {
+			// Without a local copy to read back, dumps are verified as they
+			// are uploaded
+			var tee io.WriteCloser
+			verifier = nil
+			if bt.config.Backup.Verify || isTextFormat(job.db.Format) {
+				verifier = newDumpVerifier(attemptCtx, job, formatFromExtension(target.rawName(bt.config)))
+				defer verifier.Close()
+				tee = verifier
+			}
+			key := path.Join(job.db.ID, filename)
+			output, uploaded, err = bt.uploadDump(attemptCtx, job, tool, cmd, key, target.pipeCompression, masking, tee, &written)
+			return err
+		}
+		if target.streamed {
+			var tee io.WriteCloser
+			if dedup {
+				if session != nil {
+					session.discard()
+				}
+				session, err = bt.newDedupSession(ctx, job, filename, target.rawName(bt.config), !job.driver.compresses(job.db) && compression.Enabled())
+				if err != nil {
+					return err
+				}
+				tee = session.add("")
+			}
+			if maskedPath != "" {
+				tee, err = bt.newMaskedCopy(maskedPath, job.db.Masking, target.pipeCompression)
+				if err != nil {
+					return err
+				}
+			}
+			output, err = bt.streamDump(attemptCtx, tool, cmd, outputPath, target.pipeCompression, masking, tee)
+			if err != nil && maskedPath != "" {
+				os.Remove(maskedPath)
+			}
+			return err
+		}
+		combined, err := cmd.CombinedOutput()
+		output = string(combined)
+		if err != nil {
+			// Don't leave a partial dump behind that looks like a valid backup
+			os.RemoveAll(outputPath)
+			return fmt.Errorf("%s failed: %w, output: %s", tool, err, output)
+		}
+		return nil
+	})
+	err = dumpAborted(ctx, dumpCtx, err)
+	dumpSpan.End(err)
+	if err != nil {
+		return nil, failedWith(ErrDumpFailed, err)
+	}
+
+	checksum := uploaded.checksum
+	if target.uploaded {
+		size = uploaded.size
+	} else {
+		size, err = artifactSize(outputPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure backup: %w", err)
+		}
+		checksum, err = artifactChecksum(outputPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to checksum backup: %w", err)
+		}
+	}
+	finished := time.Now()
+
+	// A dump program exiting successfully does not guarantee a complete
+	// dump. Incomplete backups are recorded as failed rather than removed,
+	// and are never uploaded or counted by retention.
+	failure := failedWith(ErrDumpFailed, bt.checkDump(ctx, job, outputPath, size, output, verifier))
+
+	// Verify the backup before it is uploaded anywhere
+	var verification string
+	if bt.config.Backup.Verify && failure == nil {
+		verifyCtx, verifySpan := tracing.Start(ctx, "verify")
+		err := bt.verifyDump(verifyCtx, job, outputPath, verifier)
+		verifySpan.End(err)
+		switch {
+		case errors.Is(err, errVerifySkipped):
+			logger.Warn("Backup not verified", "error", err)
+			verification = verifySkipped
+		case err != nil:
+			verification = verifyFailed
+			failure = failedWith(ErrVerifyFailed, fmt.Errorf("verification failed: %w", err))
+		default:
+			logger.Info("Backup verified", "file", outputPath)
+			verification = verifyPassed
+		}
+		bt.metrics.observeVerification(job.db.ID, verification)
+	}
+
+	// Record the backup so retention and the catalog can recognise it
+	manifest = &backupManifest{
+		Database:      job.db.ID,
+		DatabaseName:  job.db.Name,
+		File:          filename,
+		Format:        job.db.Format,
+		ServerVersion: serverVersion,
+		WALStart:      walStart,
+		RunID:         run.TraceID(),
+		CreatedAt:     start,
+		FinishedAt:    finished,
+		Size:          size,
+		SHA256:        checksum,
+		Verification:  verification,
+		Uploaded:      target.uploaded,
+		Masked:        target.masked,
+		MaskedCopy:    target.maskedCopy,
+		Source:        source,
+	}
+	if job.db.Type == config.TypePostgres {
+		manifest.PgDumpVersion = dumpVersion
+	} else {
+		manifest.Type = job.db.Type
+		manifest.ToolVersion = dumpVersion
+	}
+	if compression.Enabled() {
+		manifest.Compression = compression.Algorithm
+	}
+	if job.db.Format == baseBackupFormat && job.db.BaseBackup.Compression != "" {
+		manifest.Compression = job.db.BaseBackup.Compression
+	} else if job.db.Format == baseBackupFormat && job.db.BaseBackup.Output == "plain" {
+		manifest.Compression = ""
+	}
+	if encryption.Enabled() {
+		manifest.Encryption = encryption.Type
+	}
+	if failure != nil {
+		manifest.Status = statusFailed
+		manifest.Error = failure.Error()
+	}
+	if err := bt.writeMeta(ctx, job, manifest); err != nil {
+		logger.Warn("Failed to record backup meta", "error", err)
+	}
+	if err := bt.writeManifest(job.outputDir, manifest); err != nil {
+		return manifest, err
+	}
+	if failure != nil {
+		if err := bt.updateCatalog(); err != nil {
+			logger.Warn("Failed to update catalog", "error", err)
+		}
+		return manifest, failure
+	}
+
+	logger.Info("Backup completed successfully", "file", outputPath, "size", size, "duration", time.Since(start))
+
+	// Upload to remote storage. Dumps streamed there already are recorded
+	// as uploaded even when incomplete, so retention removes them from it.
+	if bt.storage != nil && !target.uploaded {
+		if dedup && session == nil {
+			session, err = bt.chunkArtifact(ctx, job, outputPath, filename)
+			if err != nil {
+				return manifest, failedWith(ErrUploadFailed, err)
+			}
+		}
+		if err := bt.uploadBackup(ctx, job, outputPath, manifest.SHA256, session); err != nil {
+			return manifest, failedWith(ErrUploadFailed, fmt.Errorf("upload failed: %w", err))
+		}
+		if maskedPath != "" {
+			if err := bt.uploadBackup(ctx, job, maskedPath, "", nil); err != nil {
+				return manifest, failedWith(ErrUploadFailed, fmt.Errorf("upload of masked copy failed: %w", err))
+			}
+		}
+		manifest.Uploaded = true
+		manifest.Dedup = session != nil
+		if err := bt.writeManifest(job.outputDir, manifest); err != nil {
+			return manifest, err
+		}
+	}
+
+	if bt.config.Backup.IncludeGlobals && bt.config.Backup.GlobalsFrequency == 0 && job.db.Type == config.TypePostgres {
+		if err := bt.performGlobalsBackup(ctx, job); err != nil {
+			return manifest, failedWith(ErrDumpFailed, fmt.Errorf("globals backup failed: %w", err))
+		}
+	}
+
+	bt.resumeUploads(ctx, job)
+
+	// Clean up old backups
+	if err := bt.cleanupOldBackups(ctx, job); err != nil {
+		logger.Warn("Failed to cleanup old backups", "error", err)
+	}
+
+	if err := bt.updateCatalog(); err != nil {
+		logger.Warn("Failed to update catalog", "error", err)
+	}
+
+	return manifest, nil
+}
+
+// dumpTarget describes where and how a database backup is written
+type dumpTarget struct {
+	filename        string
+	pipeCompression bool   // compressed by piping the dump through the compressor
+	streamed        bool   // read from the dump program's standard output
+	uploaded        bool   // streamed straight into remote storage, never written locally
+	masked          bool   // masked as it is written
+	maskedCopy      string // file name of a masked copy written alongside, if any
+}
+
+// dumpTarget names the backup of job started at t. Dumps the dump program
+// cannot compress itself, such as plain and tar dumps, are compressed by
+// piping them through the compressor. Encrypted dumps are always piped
+// through the encryptor, and rate-limited dumps through the limiter. Dumps
+// in a container or on an SSH host are streamed back to this host. With
+// storage.stream, every dump that can be streamed goes straight into remote
+// storage. Masked dumps, or dumps with a masked copy, are streamed through
+// the masker.
+func (bt *Tool) dumpTarget(job *databaseJob, t time.Time) (dumpTarget, error) {
+	compression := bt.config.Backup.Compression
+	encryption := bt.config.Encryption
+	pipeCompression := compression.Enabled() && job.driver.streams(job.db) && !job.driver.compresses(job.db)
+
+	name, err := bt.config.Backup.Naming.Name(job.db, job.db.Format, t)
+	if err != nil {
+		return dumpTarget{}, err
+	}
+	extension := job.driver.extension(job.db)
+	if pipeCompression {
+		extension += compression.Extension()
+	}
+	extension += encryption.Extension()
+
+	uploaded := bt.storage != nil && bt.config.Storage.Stream && job.driver.streams(job.db)
+	target := dumpTarget{
+		filename:        name + extension,
+		pipeCompression: pipeCompression,
+		streamed:        pipeCompression || encryption.Enabled() || (bt.limiter != nil && job.driver.streams(job.db)) || job.db.RemotePrograms() || uploaded || job.db.Masking.Enabled(),
+		uploaded:        uploaded,
+	}
+	switch {
+	case job.db.Masking.Mode == config.MaskReplace:
+		target.masked = true
+	case job.db.Masking.Mode == config.MaskCopy:
+		target.maskedCopy = name + maskedSuffix + extension
+	}
+	return target, nil
+}
+
+// prepareOutput creates the directory a backup is written to, refusing to
+// overwrite an existing backup of the same name
+func prepareOutput(outputPath string) error {
+	if _, err := os.Stat(outputPath); err == nil {
+		return fmt.Errorf("backup %s already exists, the filename template must give unique names", outputPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	return nil
+}
+
+// rawName returns the file name of the dump as the dump program writes it,
+// before it is piped through the compressor and encryptor
+func (t dumpTarget) rawName(cfg *config.Config) string {
+	name := strings.TrimSuffix(filepath.Base(t.filename), cfg.Encryption.Extension())
+	if t.pipeCompression {
+		name = strings.TrimSuffix(name, cfg.Backup.Compression.Extension())
+	}
+	return name
+}
+
+// commandOutput returns the output path passed to the dump program, which
+// is empty for streamed dumps
+func (t dumpTarget) commandOutput(outputPath string) string {
+	if t.streamed {
+		return ""
+	}
+	return outputPath
+}
+
+// streamDump runs cmd, writing its standard output through the masker, if
+// masking is not nil, the compressor and encryptor into outputPath at no
+// more than the configured rate limit, and also to tee if it is not nil.
+// It returns the program's standard error. The partial file is removed if
+// the dump fails.
+func (bt *Tool) streamDump(ctx context.Context, tool string, cmd *exec.Cmd, outputPath string, compress bool, masking *config.Masking, tee io.WriteCloser) (string, error) {
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup file: %w", err)
+	}
+
+	output, err := bt.pipeDump(ctx, tool, cmd, file, compress, masking, tee)
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("failed to write backup file: %w", closeErr)
+	}
+	if err != nil {
+		os.Remove(outputPath)
+		return output, err
+	}
+	return output, nil
+}
+
+// pipeDump runs cmd, writing its standard output through the masker, if
+// masking is not nil, the compressor and encryptor into w at no more than
+// the configured rate limit, and also to tee if it is not nil. It returns
+// the program's standard error.
+func (bt *Tool) pipeDump(ctx context.Context, tool string, cmd *exec.Cmd, w io.Writer, compress bool, masking *config.Masking, tee io.WriteCloser) (string, error) {
+	chain, err := bt.newDumpWriter(w, compress)
+	if err != nil {
+		return "", err
+	}
+	if masking != nil {
+		chain.wrap(newMasker(chain.head(), *masking))
+	}
+
+	// Compression and encryption run alongside the dump program
+	var stages []*tracing.Span
+	if compress {
+		_, span := tracing.Start(ctx, "compress", tracing.Attr("beackup.compression", bt.config.Backup.Compression.Algorithm))
+		stages = append(stages, span)
+	}
+	if bt.config.Encryption.Enabled() {
+		_, span := tracing.Start(ctx, "encrypt", tracing.Attr("beackup.encryption", bt.config.Encryption.Type))
+		stages = append(stages, span)
+	}
+
+	var stderr bytes.Buffer
+	var stdout io.Writer = chain
+	if tee != nil {
+		stdout = io.MultiWriter(chain, tee)
+	}
+	cmd.Stdout = bt.throttleWriter(ctx, stdout)
+	cmd.Stderr = &stderr
+
+	runErr := cmd.Run()
+	chainErr := chain.Close()
+	for _, span := range stages {
+		span.End(chainErr)
+	}
+	var teeErr error
+	if tee != nil {
+		teeErr = tee.Close()
+	}
+
+	switch {
+	case runErr != nil:
+		err = fmt.Errorf("%s failed: %w, output: %s", tool, runErr, stderr.String())
+	case chainErr != nil:
+		err = chainErr
+	case teeErr != nil:
+		err = teeErr
+	}
+	return stderr.String(), err
+}
+
+// newDumpWriter builds the encryption and compression stages a streamed
+// dump is written through before reaching w
+func (bt *Tool) newDumpWriter(w io.Writer, compress bool) (*writeChain, error) {
+	chain := newWriteChain(w)
+
+	if bt.config.Encryption.Enabled() {
+		encryptor, err := newEncryptor(chain.head(), bt.config.Encryption)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start encryptor: %w", err)
+		}
+		chain.wrap(encryptor)
+	}
+
+	if compress {
+		compressor, err := newCompressor(chain.head(), bt.config.Backup.Compression)
+		if err != nil {
+			chain.Close()
+			return nil, fmt.Errorf("failed to start compressor: %w", err)
+		}
+		chain.wrap(compressor)
+	}
+
+	return chain, nil
+}
+
+// buildPgDumpCommand constructs the pg_dump command with appropriate flags.
+// An empty outputPath makes pg_dump write to standard output.
+func buildPgDumpCommand(ctx context.Context, db *config.Database, outputPath string, compression config.Compression) *exec.Cmd {
+	args := append([]string{"pg_dump"}, connectionArgs(db)...)
+	args = append(args, "--verbose")
+
+	// Add format-specific flags
+	switch db.Format {
+	case "plain":
+		args = append(args, "--format=plain")
+	case "tar":
+		args = append(args, "--format=tar")
+	case "directory":
+		args = append(args, "--format=directory")
+	default: // custom
+		args = append(args, "--format=custom")
+	}
+
+	if db.Format == "directory" && db.Jobs > 1 {
+		args = append(args, fmt.Sprintf("--jobs=%d", db.Jobs))
+	}
+
+	// Formats with built-in compression
+	if compression.Enabled() && (db.Format == "custom" || db.Format == "directory") {
+		args = append(args, pgDumpCompressFlag(compression))
+	}
+
+	args = append(args, filterArgs(db)...)
+	args = append(args, db.PgDump.Args(db.Format)...)
+
+	// Add output file/directory
+	if outputPath != "" {
+		args = append(args, "--file", outputPath)
+	}
+
+	return commandContext(ctx, args[0], args[1:]...)
+}
+
+// commandContext creates a command that is asked to terminate when ctx is
+// cancelled, and killed if it has not exited shortly afterwards
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = processKillDelay
+	return cmd
+}
+
+// uploadBackup copies a finished backup to remote storage. Directory-format
+// backups are uploaded file by file under a common key prefix. With a
+// dedup session, the backup is uploaded as its chunks instead. checksum,
+// if set, is the backup's recorded checksum the uploaded data must match.
+func (bt *Tool) uploadBackup(ctx context.Context, job *databaseJob, outputPath, checksum string, session *dedupSession) (err error) {
+	ctx, span := tracing.Start(ctx, "upload", tracing.Attr("beackup.storage", bt.config.Storage.Type), tracing.Attr("beackup.dedup", session != nil))
+	defer func() { span.End(err) }()
+	start := time.Now()
+
+	if session != nil {
+		err := bt.uploadChunks(ctx, session)
+		bt.metrics.observeUpload(job.db.ID, time.Since(start), err)
+		if err != nil {
+			return err
+		}
+		bt.deleteLocal(job, outputPath)
+		return nil
+	}
+
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return err
+	}
+	// Sum what was uploaded like artifactChecksum sums the backup
+	var uploaded string
+	tree := sha256.New()
+	err = filepath.WalkDir(outputPath, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(bt.config.Backup.OutputDir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		err = bt.retry(ctx, job.logger, "upload", func() error {
+			job.logger.Debug("Uploading file", "key", key)
+			uploaded, err = bt.putFile(ctx, job, key, path)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			rel, err := filepath.Rel(outputPath, path)
+			if err != nil {
+				return err
+			}
+			addTreeEntry(tree, uploaded, rel)
+		}
+		return nil
+	})
+	if err == nil && checksum != "" {
+		if info.IsDir() {
+			uploaded = hex.EncodeToString(tree.Sum(nil))
+		}
+		if uploaded != checksum {
+			err = fmt.Errorf("uploaded data of %s does not match its checksum, the backup changed on disk", outputPath)
+		}
+	}
+	bt.metrics.observeUpload(job.db.ID, time.Since(start), err)
+	if err != nil {
+		return err
+	}
+
+	job.logger.Info("Upload completed", "file", outputPath, "duration", time.Since(start))
+	bt.deleteLocal(job, outputPath)
+	return nil
+}
+
+// deleteLocal removes an uploaded backup from local disk if configured
+func (bt *Tool) deleteLocal(job *databaseJob, outputPath string) {
+	if !bt.config.Storage.DeleteLocal {
+		return
+	}
+	if err := os.RemoveAll(outputPath); err != nil {
+		job.logger.Warn("Failed to remove local backup", "file", outputPath, "error", err)
+	} else {
+		job.logger.Info("Removed local backup", "file", outputPath)
+	}
+}
+
+// artifactSize returns the size of a backup file, or the total size of the
+// files in a directory-format backup
+func artifactSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,191 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"beackup/config"
+)
+
+// baseBackupCompressFlag returns the --compress flag for a base backup, if any.
+// Plain output is only compressed when explicitly configured, which
+// pg_basebackup allows for server-side compression.
+func baseBackupCompressFlag(b config.BaseBackup, compression config.Compression) string {
+	if b.Compression != "" {
+		return "--compress=" + b.Compression
+	}
+	if b.Output == "tar" && compression.Enabled() {
+		return pgDumpCompressFlag(compression)
+	}
+	return ""
+}
+
+// buildBaseBackupCommand constructs the pg_basebackup command writing a
+// physical backup of the database's cluster into the directory outputPath
+func buildBaseBackupCommand(ctx context.Context, db *config.Database, outputPath string, compression config.Compression) *exec.Cmd {
+	args := append(replicationArgs(db),
+		"--pgdata="+outputPath,
+		"--format="+db.BaseBackup.Output,
+		"--wal-method="+db.BaseBackup.WALMethod,
+		"--checkpoint=fast",
+		"--label=beackup",
+		"--verbose",
+	)
+	if flag := baseBackupCompressFlag(db.BaseBackup, compression); flag != "" {
+		args = append(args, flag)
+	}
+	return commandContext(ctx, "pg_basebackup", args...)
+}
+
+// IsBaseBackup reports whether path names a base backup, either a single
+// tar archive or a pg_basebackup output directory
+func IsBaseBackup(path string) bool {
+	name := stripArtifactExtensions(filepath.Clean(path))
+	return strings.HasSuffix(name, "_base.tar") || strings.HasSuffix(name, "_base")
+}
+
+// verifyBaseBackupDir checks a pg_basebackup output directory: plain output
+// must hold a backup_label, tar output a readable base archive holding one
+func (bt *Tool) verifyBaseBackupDir(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, "backup_label")); err == nil {
+		return nil
+	}
+
+	base, err := findArchive(dir, "base.tar")
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(base, ".lz4") {
+		return fmt.Errorf("%w: lz4-compressed base backups cannot be read", errVerifySkipped)
+	}
+
+	reader, err := bt.openBackup(base)
+	if err != nil {
+		return err
+	}
+	err = verifyBaseBackup(reader)
+	if closeErr := reader.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("failed to read backup: %w", closeErr)
+	}
+	return err
+}
+
+// findArchive returns the file in dir named name, with any compression
+// suffix pg_basebackup adds
+func findArchive(dir, name string) (string, error) {
+	for _, suffix := range []string{"", ".gz", ".zst", ".lz4"} {
+		path := filepath.Join(dir, name+suffix)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("base backup has no %s", name)
+}
+
+// restoreBaseBackupDir fills dataDir from a pg_basebackup output directory,
+// unpacking the base and WAL archives of tar output or copying plain output
+func (bt *Tool) restoreBaseBackupDir(dir, dataDir string) error {
+	if _, err := os.Stat(filepath.Join(dir, "backup_label")); err == nil {
+		return copyTree(dir, dataDir)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read base backup: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		src := filepath.Join(dir, name)
+		switch {
+		case strings.HasPrefix(name, "base.tar"):
+			err = bt.extractBackup(src, dataDir)
+		case strings.HasPrefix(name, "pg_wal.tar"):
+			err = bt.extractBackup(src, filepath.Join(dataDir, "pg_wal"))
+		case strings.Contains(name, ".tar"):
+			err = fmt.Errorf("tablespace archive %s cannot be restored, only the main data directory is supported", name)
+		default:
+			err = copyFile(src, filepath.Join(dataDir, name), 0600)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractBackup unpacks a possibly compressed and encrypted tar archive
+// into dir
+func (bt *Tool) extractBackup(path, dir string) error {
+	if strings.HasSuffix(path, ".lz4") {
+		return fmt.Errorf("lz4-compressed archive %s cannot be restored", filepath.Base(path))
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	reader, err := bt.openBackup(path)
+	if err != nil {
+		return err
+	}
+	extractErr := extractTar(reader, dir)
+	if err := reader.Close(); err != nil && extractErr == nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+	return extractErr
+}
+
+// copyTree copies the files, directories and symlinks under src into dst
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFile(path, target, info.Mode().Perm())
+		}
+	})
+}
+
+// copyFile copies a single file, creating dst with mode
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	_, copyErr := io.Copy(out, in)
+	if err := errors.Join(copyErr, out.Close()); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", filepath.Base(src), err)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"beackup/config"
+)
+
+// catalogFile is the name of the index kept in the output directory
+const catalogFile = "catalog.json"
+
+// catalog indexes the manifests of every backup in the output directory
+type catalog struct {
+	UpdatedAt time.Time         `json:"updated_at"`
+	Backups   []*backupManifest `json:"backups"`
+}
+
+// updateCatalog rebuilds the catalog from the manifests of every database
+func (bt *Tool) updateCatalog() error {
+	bt.catalogMu.Lock()
+	defer bt.catalogMu.Unlock()
+
+	cat := &catalog{UpdatedAt: time.Now()}
+	for _, job := range bt.jobs {
+		manifests, err := loadManifests(job.outputDir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		cat.Backups = append(cat.Backups, manifests...)
+	}
+
+	sort.SliceStable(cat.Backups, func(i, j int) bool {
+		return cat.Backups[i].CreatedAt.After(cat.Backups[j].CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(cat, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode catalog: %w", err)
+	}
+
+	path := filepath.Join(bt.config.Backup.OutputDir, catalogFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write catalog: %w", err)
+	}
+	if signing := bt.config.Signing; signing.Enabled() {
+		// The signature is moved in place first, so that the catalog is
+		// never older than it
+		err := signFile(signing, tmp)
+		if err == nil {
+			err = os.Rename(signaturePath(tmp), signaturePath(path))
+		}
+		if err != nil {
+			os.Remove(tmp)
+			os.Remove(signaturePath(tmp))
+			return fmt.Errorf("failed to sign catalog: %w", err)
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write catalog: %w", err)
+	}
+	return nil
+}
+
+// loadCatalog reads the catalog from the output directory
+func loadCatalog(outputDir string) (*catalog, error) {
+	data, err := os.ReadFile(filepath.Join(outputDir, catalogFile))
+	if os.IsNotExist(err) {
+		return &catalog{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog: %w", err)
+	}
+
+	var cat catalog
+	if err := json.Unmarshal(data, &cat); err != nil {
+		return nil, fmt.Errorf("failed to parse catalog: %w", err)
+	}
+	return &cat, nil
+}
+
+// find looks a backup up in the catalog of outputDir by file name or path.
+// A path names the backup of its database at that place under outputDir,
+// as filename templates can give backups in different directories the same
+// name; a bare file name must match a single backup.
+func (c *catalog) find(outputDir, name string) (*backupManifest, error) {
+	name = strings.TrimSuffix(name, manifestSuffix)
+	base := filepath.Base(name)
+	if base != name {
+		want, err := filepath.Abs(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range c.Backups {
+			file := filepath.Join(m.Database, filepath.FromSlash(m.File))
+			if filepath.Clean(name) == file {
+				return m, nil
+			}
+			if full, err := filepath.Abs(filepath.Join(outputDir, file)); err == nil && full == want {
+				return m, nil
+			}
+		}
+		return nil, fmt.Errorf("backup %q not found in catalog", name)
+	}
+
+	var found *backupManifest
+	for _, m := range c.Backups {
+		if path.Base(m.File) != base {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("backup name %q is ambiguous, it matches %s and %s; give its path", name,
+				path.Join(found.Database, found.File), path.Join(m.Database, m.File))
+		}
+		found = m
+	}
+	if found == nil {
+		return nil, fmt.Errorf("backup %q not found in catalog", name)
+	}
+	return found, nil
+}
+
+// listedBackup is a backup as List prints it in JSON: its manifest and
+// where it is written locally
+type listedBackup struct {
+	*backupManifest
+	Path string `json:"path"`
+}
+
+// List prints every backup in the catalog of cfg's output directory, as
+// JSON if asJSON is set
+func List(w io.Writer, cfg *config.Config, asJSON bool) error {
+	cat, err := loadCatalog(cfg.Backup.OutputDir)
+	if err != nil {
+		return fmt.Errorf("failed to load catalog: %w", err)
+	}
+
+	if asJSON {
+		backups := []listedBackup{}
+		for _, m := range cat.Backups {
+			path, err := filepath.Abs(filepath.Join(cfg.Backup.OutputDir, m.Database, m.File))
+			if err != nil {
+				return err
+			}
+			backups = append(backups, listedBackup{backupManifest: m, Path: path})
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(backups)
+	}
+	if len(cat.Backups) == 0 {
+		fmt.Fprintln(w, "No backups found")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATABASE\tFILE\tFORMAT\tCREATED\tSIZE\tSTATUS\tVERIFIED\tUPLOADED")
+	for _, m := range cat.Backups {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%t\n",
+			m.Database, m.File, m.Format,
+			m.CreatedAt.Local().Format("2006-01-02 15:04:05"),
+			formatBytes(m.Size), m.status(), valueOrDash(m.Verification), m.Uploaded)
+	}
+	return tw.Flush()
+}
+
+// Info prints the details of the backup name, a file name or path, from
+// the catalog of cfg's output directory
+func Info(w io.Writer, cfg *config.Config, name string) error {
+	cat, err := loadCatalog(cfg.Backup.OutputDir)
+	if err != nil {
+		return fmt.Errorf("failed to load catalog: %w", err)
+	}
+
+	m, err := cat.find(cfg.Backup.OutputDir, name)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Database:\t%s (%s)\n", m.Database, m.DatabaseName)
+	fmt.Fprintf(tw, "File:\t%s\n", filepath.Join(cfg.Backup.OutputDir, m.Database, m.File))
+	fmt.Fprintf(tw, "Format:\t%s\n", m.Format)
+	fmt.Fprintf(tw, "Compression:\t%s\n", valueOrDash(m.Compression))
+	fmt.Fprintf(tw, "Encryption:\t%s\n", valueOrDash(m.Encryption))
+	fmt.Fprintf(tw, "Server version:\t%s\n", valueOrDash(m.ServerVersion))
+	if m.Type != "" {
+		fmt.Fprintf(tw, "Type:\t%s\n", m.Type)
+		fmt.Fprintf(tw, "Dump tool version:\t%s\n", valueOrDash(m.ToolVersion))
+	} else {
+		fmt.Fprintf(tw, "pg_dump version:\t%s\n", valueOrDash(m.PgDumpVersion))
+		fmt.Fprintf(tw, "pg_restore version:\t%s\n", valueOrDash(m.PgRestoreVersion))
+	}
+	fmt.Fprintf(tw, "beackup version:\t%s\n", valueOrDash(m.BeackupVersion))
+	if m.ConfigSHA256 != "" {
+		fmt.Fprintf(tw, "Config SHA-256:\t%s\n", m.ConfigSHA256)
+	}
+	if m.WALStart != "" {
+		fmt.Fprintf(tw, "WAL start:\t%s\n", m.WALStart)
+	}
+	if m.Source != "" {
+		fmt.Fprintf(tw, "Replica:\t%s\n", m.Source)
+	}
+	fmt.Fprintf(tw, "Started:\t%s\n", m.CreatedAt.Local().Format(time.RFC3339))
+	fmt.Fprintf(tw, "Finished:\t%s\n", m.FinishedAt.Local().Format(time.RFC3339))
+	fmt.Fprintf(tw, "Duration:\t%s\n", m.FinishedAt.Sub(m.CreatedAt).Round(time.Millisecond))
+	fmt.Fprintf(tw, "Size:\t%s (%d bytes)\n", formatBytes(m.Size), m.Size)
+	fmt.Fprintf(tw, "SHA-256:\t%s\n", m.SHA256)
+	fmt.Fprintf(tw, "Status:\t%s\n", m.status())
+	if m.Error != "" {
+		fmt.Fprintf(tw, "Error:\t%s\n", m.Error)
+	}
+	fmt.Fprintf(tw, "Verification:\t%s\n", valueOrDash(m.Verification))
+	fmt.Fprintf(tw, "Uploaded:\t%t\n", m.Uploaded)
+	if m.LockedUntil != nil {
+		fmt.Fprintf(tw, "Locked until:\t%s\n", m.LockedUntil.Local().Format(time.RFC3339))
+	}
+	if m.Archived {
+		fmt.Fprintf(tw, "Archived:\t%s:%s\n", cfg.Storage.Archive.Type, path.Join(m.Database, m.File))
+	}
+	if m.Masked {
+		fmt.Fprintf(tw, "Masked:\t%t\n", m.Masked)
+	}
+	if m.MaskedCopy != "" {
+		fmt.Fprintf(tw, "Masked copy:\t%s\n", m.MaskedCopy)
+	}
+	return tw.Flush()
+}
+
+// ShowConfig prints the meta file of the backup with the given file name:
+// the versions and configuration it was made with
+func ShowConfig(w io.Writer, cfg *config.Config, name string) error {
+	cat, err := loadCatalog(cfg.Backup.OutputDir)
+	if err != nil {
+		return fmt.Errorf("failed to load catalog: %w", err)
+	}
+
+	m, err := cat.find(cfg.Backup.OutputDir, name)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(metaPath(filepath.Join(cfg.Backup.OutputDir, m.Database, m.File)))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("backup %q has no recorded configuration, it predates configuration snapshots", name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read backup meta: %w", err)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// formatBytes renders a size with a binary unit suffix
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func valueOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,46 @@
+package backup
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCatalogFind(t *testing.T) {
+	outputDir := filepath.Join(t.TempDir(), "out")
+	cat := &catalog{Backups: []*backupManifest{
+		{Database: "db1", File: "2024/02/x.dump"},
+		{Database: "db2", File: "2024/02/x.dump"},
+		{Database: "db2", File: "2024/01/x.dump"},
+		{Database: "db2", File: "2024/01/y.dump"},
+	}}
+
+	tests := []struct {
+		name    string
+		want    *backupManifest
+		wantErr string
+	}{
+		{name: "y.dump", want: cat.Backups[3]},
+		{name: "y.dump.manifest.json", want: cat.Backups[3]},
+		{name: "x.dump", wantErr: "ambiguous"},
+		{name: "z.dump", wantErr: "not found"},
+		{name: filepath.Join(outputDir, "db2", "2024", "01", "x.dump"), want: cat.Backups[2]},
+		{name: filepath.Join(outputDir, "db2", "2024", "02", "x.dump"), want: cat.Backups[1]},
+		{name: filepath.Join("db1", "2024", "02", "x.dump"), want: cat.Backups[0]},
+		{name: filepath.Join(outputDir, "db1", "2024", "01", "x.dump"), wantErr: "not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := cat.find(outputDir, tt.name)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("find() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || m != tt.want {
+				t.Errorf("find() = %+v, %v; want %+v", m, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"beackup/config"
+)
+
+// checkTimeout bounds the checks that connect to a database or storage
+const checkTimeout = 30 * time.Second
+
+// checkResult is the outcome of a single pre-flight check
+type checkResult struct {
+	name   string
+	detail string // shown when the check passed
+	err    error
+}
+
+// checkOutcome is a check as Check prints it in JSON
+type checkOutcome struct {
+	Database string `json:"database,omitempty"` // id of the database checked
+	Storage  string `json:"storage,omitempty"`  // type of the storage checked
+	Check    string `json:"check"`
+	Status   string `json:"status"` // ok or failed
+	Detail   string `json:"detail,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Check runs the pre-flight checks of every database and the storage
+// backend and prints their results, as JSON if asJSON is set. It returns
+// an error if a check failed.
+func (bt *Tool) Check(ctx context.Context, w io.Writer, asJSON bool) error {
+	text := w
+	if asJSON {
+		text = io.Discard
+	}
+	tw := tabwriter.NewWriter(text, 0, 0, 2, ' ', 0)
+	outcomes := []checkOutcome{}
+	failed := 0
+	report := func(outcome checkOutcome, results []checkResult) {
+		for _, r := range results {
+			outcome.Check = r.name
+			if r.err != nil {
+				failed++
+				outcome.Status, outcome.Detail, outcome.Error = "failed", "", r.err.Error()
+				fmt.Fprintf(tw, "  FAILED\t%s\t%v\n", r.name, r.err)
+			} else {
+				outcome.Status, outcome.Detail, outcome.Error = "ok", r.detail, ""
+				fmt.Fprintf(tw, "  ok\t%s\t%s\n", r.name, r.detail)
+			}
+			outcomes = append(outcomes, outcome)
+		}
+	}
+
+	for _, job := range bt.jobs {
+		fmt.Fprintf(tw, "Database %s (%s)\n", job.db.ID, job.db.Type)
+		outcome := checkOutcome{Database: job.db.ID}
+		// The checks connect with a copy holding the resolved password
+		db := *job.db
+		report(outcome, bt.localChecks(ctx, job, &db))
+		report(outcome, bt.databaseChecks(ctx, job, &db))
+		if db.Source.UsesReplicas() {
+			report(outcome, replicaChecks(ctx, &db))
+		}
+	}
+	if bt.storage != nil {
+		fmt.Fprintf(tw, "Storage %s\n", bt.config.Storage.Type)
+		report(checkOutcome{Storage: bt.config.Storage.Type}, []checkResult{bt.storageCheck(ctx)})
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(struct {
+			Passed bool           `json:"passed"`
+			Failed int            `json:"failed"`
+			Checks []checkOutcome `json:"checks"`
+		}{failed == 0, failed, outcomes})
+		if err != nil {
+			return err
+		}
+	} else {
+		tw.Flush()
+		if failed > 0 {
+			fmt.Fprintf(w, "%d checks failed\n", failed)
+		} else {
+			fmt.Fprintln(w, "All checks passed")
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// localChecks checks what a backup of job needs on this host: the password
+// can be resolved, the programs it runs are installed and the output
+// directory is writable. The password is resolved into db, a copy of job's
+// database.
+func (bt *Tool) localChecks(ctx context.Context, job *databaseJob, db *config.Database) []checkResult {
+	var results []checkResult
+
+	result := checkResult{name: "password", detail: "resolved"}
+	db.Password, result.err = bt.resolvePassword(ctx, job.db)
+	results = append(results, result)
+
+	programs := job.driver.programs(job.db)
+	if bt.config.Backup.IncludeGlobals && job.db.Type == config.TypePostgres {
+		programs = append(programs, "pg_dumpall")
+	}
+	if job.db.RemotePrograms() {
+		// The programs in the container or on the SSH host are checked by
+		// connecting
+		programs = nil
+		if job.db.Exec.InContainer() {
+			programs = append(programs, execPrograms[job.db.Exec.Connection])
+		}
+	}
+	if job.db.SSH.Enabled() {
+		programs = append(programs, "ssh")
+	}
+	if bt.config.Backup.Compression.Algorithm == "zstd" {
+		programs = append(programs, "zstd")
+	}
+	if bt.config.Encryption.Enabled() {
+		programs = append(programs, bt.config.Encryption.Type)
+	}
+	if bt.config.Signing.Type == "gpg" && bt.config.Encryption.Type != "gpg" {
+		programs = append(programs, "gpg")
+	}
+	for _, program := range programs {
+		result := checkResult{name: program}
+		path, err := exec.LookPath(program)
+		if err != nil {
+			result.err = fmt.Errorf("not found: %w", err)
+		} else {
+			result.detail = path
+		}
+		results = append(results, result)
+	}
+
+	result = checkResult{name: "output directory", detail: job.outputDir + " is writable"}
+	result.err = checkWritable(job.outputDir)
+	results = append(results, result)
+
+	return results
+}
+
+// databaseChecks connects to db, job's database, to check the credentials,
+// that the dump program supports the server and that the output directory
+// has room for the next backup
+func (bt *Tool) databaseChecks(ctx context.Context, job *databaseJob, db *config.Database) []checkResult {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	var results []checkResult
+
+	if db.SSH.Enabled() && db.SSH.Mode == config.SSHTunnel {
+		closeTunnel, err := openTunnel(ctx, db)
+		results = append(results, checkResult{name: "ssh tunnel", err: err, detail: "connected to " + db.SSH.Host})
+		if err != nil {
+			return results
+		}
+		defer closeTunnel()
+	}
+
+	server, err := job.driver.ping(ctx, db)
+	result := checkResult{name: "connection", err: err, detail: "connected"}
+	if server != "" {
+		result.detail += ", server version " + server
+	}
+	results = append(results, result)
+	connected := err == nil
+
+	tool := job.driver.tool(db)
+	if db.Type == config.TypePostgres && tool == "pg_dump" && connected {
+		result := checkResult{name: "pg_dump version"}
+		version, err := toolVersion(ctx, db, "pg_dump")
+		if err == nil {
+			err = checkPgDumpVersion(server, version)
+		}
+		result.err = err
+		result.detail = version + " supports server " + server
+		results = append(results, result)
+	}
+
+	results = append(results, bt.spaceCheck(ctx, job, db, connected))
+	return results
+}
+
+// replicaChecks checks that the replicas of db can be backed up from
+func replicaChecks(ctx context.Context, db *config.Database) []checkResult {
+	var results []checkResult
+	for _, r := range probeReplicas(ctx, db) {
+		result := checkResult{name: "replica " + r.address(), err: r.err, detail: "lag " + r.lag.String()}
+		if r.behind >= 0 {
+			result.detail += ", " + formatBytes(r.behind) + " behind the primary"
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// spaceCheck compares the free space of the output directory with the size
+// of the last backup, or of the database if it has not been backed up yet
+func (bt *Tool) spaceCheck(ctx context.Context, job *databaseJob, db *config.Database, connected bool) checkResult {
+	result := checkResult{name: "disk space"}
+
+	free, err := freeSpace(job.outputDir)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	estimate := lastBackupSize(job)
+	source := "last backup"
+	if estimate == 0 && connected {
+		source = "database size"
+		if estimate, err = job.driver.size(ctx, db); err != nil {
+			result.err = fmt.Errorf("failed to query database size: %w", err)
+			return result
+		}
+	}
+
+	if estimate == 0 {
+		result.detail = formatBytes(free) + " free, backup size unknown"
+		return result
+	}
+	minFree := int64(bt.config.Backup.MinFreeSpace)
+	if free-estimate < minFree || free < estimate {
+		result.err = fmt.Errorf("%s free, but the %s is %s and min_free_space is %s", formatBytes(free), source, formatBytes(estimate), formatBytes(minFree))
+		return result
+	}
+	result.detail = fmt.Sprintf("%s free, %s %s", formatBytes(free), source, formatBytes(estimate))
+	return result
+}
+
+// storageCheck lists the backups in remote storage, which fails if the
+// storage is unreachable or the credentials are invalid
+func (bt *Tool) storageCheck(ctx context.Context) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	result := checkResult{name: "credentials"}
+	objects, err := bt.storage.List(ctx, bt.jobs[0].db.ID+"/")
+	if err != nil {
+		result.err = fmt.Errorf("failed to list backups: %w", err)
+		return result
+	}
+	result.detail = fmt.Sprintf("listed %d objects of %s", len(objects), bt.jobs[0].db.ID)
+	return result
+}
+
+// existingDir returns dir, or the nearest existing directory it would be
+// created in
+func existingDir(dir string) (string, error) {
+	for {
+		info, err := os.Stat(dir)
+		if os.IsNotExist(err) && filepath.Dir(dir) != dir {
+			dir = filepath.Dir(dir)
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to access output directory: %w", err)
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("%s is not a directory", dir)
+		}
+		return dir, nil
+	}
+}
+
+// checkWritable checks that dir, or the nearest existing directory it would
+// be created in, is writable
+func checkWritable(dir string) error {
+	existing, err := existingDir(dir)
+	if err != nil {
+		return err
+	}
+	if err := dirWritable(existing); err != nil {
+		return fmt.Errorf("%s is not writable: %w", existing, err)
+	}
+	return nil
+}
+
+// freeSpace returns the bytes available to unprivileged users on the file
+// system dir is, or would be, created on
+func freeSpace(dir string) (int64, error) {
+	existing, err := existingDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	return diskFree(existing)
+}
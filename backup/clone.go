@@ -0,0 +1,288 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"beackup/config"
+)
+
+// CloneOptions adjust how a backup is restored into another database
+type CloneOptions struct {
+	// Backup is the backup to clone, a file name in the source database's
+	// directory or a path; the newest complete backup if empty
+	Backup string
+	// KeepExisting restores into the target database as it is instead of
+	// dropping and recreating it first
+	KeepExisting bool
+	// NoOwner and NoPrivileges skip restoring object owners and grants, so
+	// that everything belongs to the target's user
+	NoOwner      bool
+	NoPrivileges bool
+	// RoleMap renames the owners and grantees of postgres objects
+	RoleMap map[string]string
+}
+
+// Clone restores a backup of the configured database sourceID into the
+// configured database targetID, such as a staging or analytics copy of
+// production
+func (bt *Tool) Clone(ctx context.Context, sourceID, targetID string, opts CloneOptions) error {
+	source, err := bt.findRestoreJob(sourceID, "")
+	if err != nil {
+		return err
+	}
+	target, err := bt.findRestoreJob(targetID, "")
+	if err != nil {
+		return err
+	}
+	if source == target || sameDatabase(source.db, target.db) {
+		return fmt.Errorf("the clone target must be a different database than the source")
+	}
+	if source.db.Type != target.db.Type {
+		return fmt.Errorf("cannot clone a %s database into a %s database", source.db.Type, target.db.Type)
+	}
+	rewrite := opts.NoOwner || opts.NoPrivileges || len(opts.RoleMap) > 0
+	if rewrite && source.db.Type != config.TypePostgres {
+		return fmt.Errorf("owner and privilege options only apply to postgres databases")
+	}
+	rehearser, ok := target.driver.(rehearsalDriver)
+	if !ok && !opts.KeepExisting {
+		return fmt.Errorf("%s databases cannot be recreated, clone with the existing database kept", target.db.Type)
+	}
+
+	backupPath, err := cloneSource(source, opts.Backup)
+	if err != nil {
+		return err
+	}
+	if IsBaseBackup(backupPath) {
+		return fmt.Errorf("base backups cannot be cloned into another database")
+	}
+	logger := target.logger.With("source", source.db.ID, "backup", filepath.Base(backupPath))
+	logger.Info("Cloning backup")
+
+	db := *target.db
+	db.Password, err = bt.resolvePassword(ctx, target.db)
+	if err != nil {
+		return err
+	}
+	closeTunnel, err := openTunnel(ctx, &db)
+	if err != nil {
+		return err
+	}
+	defer closeTunnel()
+
+	fetched, cleanup, err := bt.fetchDedupBackup(ctx, source, backupPath)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if _, err := os.Stat(fetched); err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	if len(opts.RoleMap) > 0 && isCopyExport(fetched) {
+		return fmt.Errorf("roles cannot be mapped when cloning a copy export, use -no-owner instead")
+	}
+
+	if !opts.KeepExisting {
+		logger.Info("Recreating target database", "database", db.Name)
+		if err := rehearser.dropDatabase(ctx, &db); err != nil {
+			return fmt.Errorf("failed to drop target database: %w", err)
+		}
+		if err := rehearser.createDatabase(ctx, &db); err != nil {
+			return fmt.Errorf("failed to create target database: %w", err)
+		}
+	}
+
+	format := formatFromExtension(stripArtifactExtensions(fetched))
+	switch {
+	case len(opts.RoleMap) > 0 || rewrite && format == "plain":
+		err = bt.restoreRewritten(ctx, source, &db, fetched, opts)
+	case rewrite:
+		// pg_restore skips owners and grants itself
+		var args []string
+		if opts.NoOwner {
+			args = append(args, "--no-owner")
+		}
+		if opts.NoPrivileges {
+			args = append(args, "--no-privileges")
+		}
+		err = bt.restoreBackup(ctx, source, &db, fetched, args...)
+	default:
+		err = bt.restoreBackup(ctx, source, &db, fetched)
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Clone completed successfully", "database", db.Name)
+	return nil
+}
+
+// sameDatabase reports whether a and b are configured to reach the same
+// database
+func sameDatabase(a, b *config.Database) bool {
+	return a.Host == b.Host && a.Port == b.Port && a.Name == b.Name && a.Exec == b.Exec && a.SSH.Host == b.SSH.Host
+}
+
+// cloneSource returns the path of the backup of job named name, or of its
+// newest complete backup that can still be restored from here
+func cloneSource(job *databaseJob, name string) (string, error) {
+	if name != "" {
+		name = strings.TrimSuffix(name, manifestSuffix)
+		if strings.ContainsAny(name, `/\`) {
+			return name, nil
+		}
+		return filepath.Join(job.outputDir, name), nil
+	}
+
+	manifests, err := loadManifests(job.outputDir)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range manifests {
+		if m.failed() || m.Archived || m.Format == globalsFormat || m.Format == baseBackupFormat {
+			continue
+		}
+		path := filepath.Join(job.outputDir, m.File)
+		if _, err := os.Stat(path); err == nil || m.Uploaded && m.Dedup {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no backup of %s to clone", job.db.ID)
+}
+
+// restoreRewritten restores the SQL script of a postgres backup with psql,
+// rewriting owners and grants on the way
+func (bt *Tool) restoreRewritten(ctx context.Context, job *databaseJob, db *config.Database, backupPath string, opts CloneOptions) error {
+	script, err := bt.openDumpScript(backupPath)
+	if err != nil {
+		return err
+	}
+	cmd, cleanup, err := job.driver.restoreCommand(ctx, db, "plain")
+	if err != nil {
+		script.Close()
+		return err
+	}
+	defer cleanup()
+	setStdin(cmd, newRoleRewriter(script, opts))
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	job.logger.Debug("Running restore", "command", redactedCommand(cmd, db))
+	runErr := cmd.Run()
+	if err := script.Close(); err != nil && runErr == nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+	if runErr != nil {
+		return fmt.Errorf("%s failed: %w, output: %s", cmd.Args[0], runErr, output.String())
+	}
+	return nil
+}
+
+// identPattern matches a role name as pg_dump writes it, quoted if needed
+const identPattern = `("(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)`
+
+// Role names in the statements of a pg_dump script, each on a line of its
+// own; the role is the second group of each pattern
+var (
+	ownerStatement    = regexp.MustCompile(`^(ALTER .* OWNER TO )` + identPattern + `(;)$`)
+	grantee           = regexp.MustCompile(`^(.* TO )` + identPattern + `((?: WITH GRANT OPTION)?;)$`)
+	revokee           = regexp.MustCompile(`^(.* FROM )` + identPattern + `((?: CASCADE)?;)$`)
+	privilegesGrantor = regexp.MustCompile(`^(ALTER DEFAULT PRIVILEGES FOR ROLE )` + identPattern + `( .*)$`)
+)
+
+// roleRewriter reads the SQL script of a postgres dump, dropping owners and
+// grants or renaming the roles they name. COPY data is passed through as is.
+type roleRewriter struct {
+	reader  *bufio.Reader
+	opts    CloneOptions
+	pending []byte
+	inCopy  bool
+	err     error
+}
+
+func newRoleRewriter(r io.Reader, opts CloneOptions) *roleRewriter {
+	return &roleRewriter{reader: bufio.NewReaderSize(r, 64*1024), opts: opts}
+}
+
+func (rw *roleRewriter) Read(p []byte) (int, error) {
+	for len(rw.pending) == 0 {
+		if rw.err != nil {
+			return 0, rw.err
+		}
+		var line []byte
+		line, rw.err = rw.reader.ReadBytes('\n')
+		if len(line) > 0 {
+			rw.pending = rw.rewriteLine(line)
+		}
+	}
+	n := copy(p, rw.pending)
+	rw.pending = rw.pending[n:]
+	return n, nil
+}
+
+// rewriteLine rewrites one line of the script, including its newline
+func (rw *roleRewriter) rewriteLine(line []byte) []byte {
+	text := string(line)
+	switch {
+	case rw.inCopy:
+		rw.inCopy = text != copyTerminator
+		return line
+	case strings.HasPrefix(text, "COPY "):
+		rw.inCopy = true
+		return line
+	}
+
+	statement := strings.TrimRight(text, "\r\n")
+	newline := text[len(statement):]
+	switch {
+	case ownerStatement.MatchString(statement):
+		if rw.opts.NoOwner {
+			return nil
+		}
+		statement = rw.mapRole(ownerStatement, statement)
+	case strings.HasPrefix(statement, "GRANT ") || strings.HasPrefix(statement, "REVOKE "):
+		if rw.opts.NoPrivileges {
+			return nil
+		}
+		statement = rw.mapRole(grantee, statement)
+		statement = rw.mapRole(revokee, statement)
+	case strings.HasPrefix(statement, "ALTER DEFAULT PRIVILEGES "):
+		if rw.opts.NoPrivileges {
+			return nil
+		}
+		statement = rw.mapRole(privilegesGrantor, statement)
+		statement = rw.mapRole(grantee, statement)
+		statement = rw.mapRole(revokee, statement)
+	default:
+		return line
+	}
+	return []byte(statement + newline)
+}
+
+// mapRole renames the role pattern matches in statement, if it is mapped
+func (rw *roleRewriter) mapRole(pattern *regexp.Regexp, statement string) string {
+	match := pattern.FindStringSubmatchIndex(statement)
+	if match == nil {
+		return statement
+	}
+	start, end := match[4], match[5]
+	role := statement[start:end]
+	if strings.HasPrefix(role, `"`) {
+		role = strings.ReplaceAll(role[1:len(role)-1], `""`, `"`)
+	}
+	mapped, ok := rw.opts.RoleMap[role]
+	if !ok {
+		return statement
+	}
+	return statement[:start] + quoteIdent(mapped) + statement[end:]
+}
@@ -0,0 +1,64 @@
+package backup
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"beackup/config"
+)
+
+// pgDumpCompressFlag returns the pg_dump --compress flag equivalent to c,
+// used for formats that pg_dump compresses internally
+func pgDumpCompressFlag(c config.Compression) string {
+	switch c.Algorithm {
+	case "gzip":
+		level := c.Level
+		if level == gzip.DefaultCompression {
+			level = 6
+		}
+		return fmt.Sprintf("--compress=%d", level)
+	case "zstd":
+		return fmt.Sprintf("--compress=zstd:%d", c.Level)
+	default:
+		return ""
+	}
+}
+
+// newCompressor wraps w so that everything written to the returned writer is
+// compressed. Closing the writer flushes it but does not close w.
+func newCompressor(w io.Writer, c config.Compression) (io.WriteCloser, error) {
+	switch c.Algorithm {
+	case "gzip":
+		return gzip.NewWriterLevel(w, c.Level)
+	case "zstd":
+		return newProcessFilter(w, "zstd", "-q", "-c", fmt.Sprintf("-%d", c.Level))
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// newDecompressor wraps r so that reads return the data compressed with algorithm
+func newDecompressor(r io.Reader, algorithm string) (io.ReadCloser, error) {
+	switch algorithm {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		return newProcessReader(r, "zstd", "-q", "-d", "-c")
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+// compressionFromExtension returns the algorithm implied by path's suffix
+func compressionFromExtension(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return "gzip"
+	case strings.HasSuffix(path, ".zst"):
+		return "zstd"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,571 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"beackup/config"
+	"beackup/pgwire"
+)
+
+// copyFormat is the format of table-level exports: a directory holding a
+// pg_dump of the schema and one file per table written with COPY, all
+// taken from the same snapshot. beackup holds the snapshot and copies the
+// tables in sessions of its own, so the database must be reachable from
+// this host, directly or through an SSH tunnel.
+const copyFormat = "copy"
+
+// copySessionParams are the settings of the sessions copying tables. Like
+// pg_dump's, they make the exported values read back the same on any
+// server.
+var copySessionParams = map[string]string{
+	"application_name":   "beackup",
+	"client_encoding":    "UTF8",
+	"DateStyle":          "ISO",
+	"IntervalStyle":      "postgres",
+	"extra_float_digits": "3",
+}
+
+// Files of a copy export besides the table files
+const (
+	copySchemaFile = "schema.dump"
+	copyIndexFile  = "tables.json"
+)
+
+// copyIndex lists the tables of a copy export. It is written last, so an
+// export without one is incomplete.
+type copyIndex struct {
+	Format string          `json:"format"` // csv or binary
+	Tables []exportedTable `json:"tables"`
+}
+
+// exportedTable is a table of a copy export and the file holding its rows
+type exportedTable struct {
+	Schema string `json:"schema"`
+	Name   string `json:"name"`
+	File   string `json:"file"`
+}
+
+// String returns the table's schema-qualified name
+func (t exportedTable) String() string {
+	return t.Schema + "." + t.Name
+}
+
+// ident returns the table's quoted schema-qualified name
+func (t exportedTable) ident() string {
+	return quoteIdent(t.Schema) + "." + quoteIdent(t.Name)
+}
+
+// pgTablesQuery lists the schema and name of the ordinary tables of a
+// database, largest first so that parallel exports finish close together
+const pgTablesQuery = `SELECT n.nspname, c.relname
+FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind = 'r' AND c.relpersistence <> 't'
+	AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg\_toast%'
+ORDER BY pg_relation_size(c.oid) DESC, 1, 2`
+
+// buildSchemaDumpCommand constructs the pg_dump command writing everything
+// but the table data of a copy export into outputPath, as of snapshot if
+// set. Sequence values and large objects are kept with the schema.
+func buildSchemaDumpCommand(ctx context.Context, db *config.Database, outputPath string, compression config.Compression, snapshot string) *exec.Cmd {
+	args := append(connectionArgs(db), "--verbose", "--format=custom", "--exclude-table-data=*")
+	if snapshot != "" {
+		args = append(args, "--snapshot="+snapshot)
+	}
+	if compression.Enabled() {
+		args = append(args, pgDumpCompressFlag(compression))
+	}
+	args = append(args, filterArgs(db)...)
+	args = append(args, db.PgDump.Args(copyFormat)...)
+	args = append(args, "--file", outputPath)
+	return commandContext(ctx, "pg_dump", args...)
+}
+
+// copyConnection returns how to connect to db for a copy export. It fails
+// on connection settings that beackup's own sessions cannot honour.
+func copyConnection(db *config.Database) (pgwire.Config, error) {
+	conn := pgwire.Config{
+		Host:     db.Host,
+		Port:     db.Port,
+		User:     db.User,
+		Password: db.Password,
+		Database: db.Name,
+		SSL:      pgwire.SSL{Mode: db.SSL.Mode, RootCert: db.SSL.RootCert, Cert: db.SSL.Cert, Key: db.SSL.Key},
+		Params:   maps.Clone(copySessionParams),
+	}
+	for _, variable := range db.DSNEnv {
+		name, value, _ := strings.Cut(variable, "=")
+		switch name {
+		case "PGAPPNAME":
+			conn.Params["application_name"] = value
+		case "PGOPTIONS":
+			conn.Params["options"] = value
+		case "PGCONNECT_TIMEOUT":
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return pgwire.Config{}, fmt.Errorf("invalid connect_timeout %q", value)
+			}
+			conn.ConnectTimeout = time.Duration(seconds) * time.Second
+		case "PGCHANNELBINDING", "PGGSSENCMODE":
+			if value == "require" {
+				return pgwire.Config{}, fmt.Errorf("the copy format does not support %s", variable)
+			}
+		case "PGSSLNEGOTIATION":
+			if value != "postgres" {
+				return pgwire.Config{}, fmt.Errorf("the copy format does not support %s", variable)
+			}
+		case "PGTARGETSESSIONATTRS":
+			if value != "any" {
+				return pgwire.Config{}, fmt.Errorf("the copy format does not support %s", variable)
+			}
+		default:
+			return pgwire.Config{}, fmt.Errorf("the copy format does not support %s", name)
+		}
+	}
+	return conn, nil
+}
+
+// connectCopy opens a session on db for a copy export or its restore,
+// taking the password from the libpq password file if db has none
+func connectCopy(ctx context.Context, db *config.Database) (*pgwire.Conn, error) {
+	conn, err := copyConnection(db)
+	if err != nil {
+		return nil, err
+	}
+	if conn.Password == "" {
+		conn.Password = pgwire.PassFilePassword(conn)
+	}
+	session, err := pgwire.Connect(ctx, conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the database: %w", err)
+	}
+	return session, nil
+}
+
+// exportSnapshot opens a transaction on db and exports its snapshot, which
+// other sessions can share until release ends the transaction and the
+// session. Until then the session can query the snapshot. release may be
+// called more than once; on error the session is already over.
+func exportSnapshot(ctx context.Context, db *config.Database) (session *pgwire.Conn, snapshot string, release func() error, err error) {
+	session, err = connectCopy(ctx, db)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	rows, err := session.Query(ctx, "BEGIN ISOLATION LEVEL REPEATABLE READ; SELECT pg_export_snapshot()")
+	if err == nil && (len(rows) != 1 || len(rows[0]) != 1) {
+		err = fmt.Errorf("unexpected result")
+	}
+	if err != nil {
+		session.Close()
+		return nil, "", nil, fmt.Errorf("failed to export snapshot: %w", err)
+	}
+
+	release = sync.OnceValue(func() error {
+		err := session.Exec(ctx, "COMMIT")
+		if closeErr := session.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to end the snapshot's transaction: %w", err)
+		}
+		return nil
+	})
+	return session, rows[0][0], release, nil
+}
+
+// useSnapshot starts a transaction in session that sees the exported
+// snapshot
+func useSnapshot(ctx context.Context, session *pgwire.Conn, snapshot string) error {
+	return session.Exec(ctx, "BEGIN ISOLATION LEVEL REPEATABLE READ; SET TRANSACTION SNAPSHOT '"+snapshot+"'")
+}
+
+// listTables returns the tables that db's schema and table patterns select
+// in the snapshot session sees
+func listTables(ctx context.Context, session *pgwire.Conn, db *config.Database) ([]exportedTable, error) {
+	rows, err := session.Query(ctx, pgTablesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	var tables []exportedTable
+	for _, row := range rows {
+		if len(row) != 2 {
+			return nil, fmt.Errorf("failed to list tables: unexpected result")
+		}
+		if selectsTable(db, row[0], row[1]) {
+			tables = append(tables, exportedTable{Schema: row[0], Name: row[1]})
+		}
+	}
+	return tables, nil
+}
+
+// selectsTable reports whether the schema and table patterns of db select
+// the table, the way pg_dump applies them: table patterns take precedence
+// over schema patterns, and exclusions over both
+func selectsTable(db *config.Database, schema, name string) bool {
+	switch {
+	case len(db.IncludeTables) > 0:
+		if !matchesAnyTable(db.IncludeTables, schema, name) {
+			return false
+		}
+	case len(db.IncludeSchemas) > 0:
+		if !matchesAny(db.IncludeSchemas, schema) {
+			return false
+		}
+	}
+	return !matchesAny(db.ExcludeSchemas, schema) && !matchesAnyTable(db.ExcludeTables, schema, name)
+}
+
+// matchesAny reports whether name matches one of patterns, in which * and
+// ? are wildcards
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAnyTable reports whether the table matches one of patterns, which
+// name a table in any schema or, with a dot, a table in a schema
+func matchesAnyTable(patterns []string, schema, name string) bool {
+	for _, pattern := range patterns {
+		schemaPattern, tablePattern, qualified := strings.Cut(pattern, ".")
+		if !qualified {
+			schemaPattern, tablePattern = "*", pattern
+		}
+		if matchesAny([]string{schemaPattern}, schema) && matchesAny([]string{tablePattern}, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// exportTables writes a copy export of job's database, connecting to it as
+// db, into the directory outputPath: the schema dump, one file per table
+// exported with COPY by up to jobs workers, and the index. It returns
+// pg_dump's standard error.
+func (bt *Tool) exportTables(ctx context.Context, job *databaseJob, db *config.Database, outputPath string, compression config.Compression) (string, error) {
+	if err := os.Mkdir(outputPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	session, snapshot, release, err := exportSnapshot(ctx, db)
+	if err != nil {
+		return "", err
+	}
+	// Ends the snapshot's session on every error path below
+	defer release()
+
+	var mu sync.Mutex
+	var output strings.Builder
+	addOutput := func(s string) {
+		mu.Lock()
+		output.WriteString(s)
+		mu.Unlock()
+	}
+
+	cmd := buildSchemaDumpCommand(ctx, db, filepath.Join(outputPath, copySchemaFile), compression, snapshot)
+	cmd.Env = pgEnv(db)
+	remoteCommand(db, cmd)
+	applyPriority(bt.config.Backup.Priority, cmd)
+	job.logger.Debug("Running pg_dump", "command", redactedCommand(cmd, db))
+	combined, err := cmd.CombinedOutput()
+	addOutput(string(combined))
+	if err != nil {
+		return output.String(), fmt.Errorf("pg_dump failed: %w, output: %s", err, combined)
+	}
+
+	tables, err := listTables(ctx, session, db)
+	if err != nil {
+		return output.String(), err
+	}
+	index := copyIndex{Format: job.db.Copy.Format, Tables: tables}
+	extension := ".csv"
+	if index.Format == "binary" {
+		extension = ".bin"
+	}
+	extension += compression.Extension()
+
+	workers := max(job.db.Jobs, 1)
+	job.logger.Info("Exporting tables", "tables", len(tables), "workers", workers)
+	err = runParallel(ctx, workers, len(tables), func(ctx context.Context, i int) error {
+		table := &index.Tables[i]
+		table.File = fmt.Sprintf("%04d%s", i+1, extension)
+		query := fmt.Sprintf("COPY %s TO STDOUT (FORMAT %s)", table.ident(), index.Format)
+		if err := bt.exportTable(ctx, db, snapshot, query, filepath.Join(outputPath, table.File), compression.Enabled()); err != nil {
+			return fmt.Errorf("failed to export table %s: %w", table, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return output.String(), err
+	}
+
+	if err := release(); err != nil {
+		return output.String(), err
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return output.String(), err
+	}
+	if err := os.WriteFile(filepath.Join(outputPath, copyIndexFile), data, 0644); err != nil {
+		return output.String(), fmt.Errorf("failed to write table index: %w", err)
+	}
+	return output.String(), nil
+}
+
+// exportTable runs the COPY TO STDOUT query in a session of db that sees
+// snapshot, writing its output through the compressor and encryptor into
+// outputPath at no more than the configured rate limit. The partial file
+// is removed if the export fails.
+func (bt *Tool) exportTable(ctx context.Context, db *config.Database, snapshot, query, outputPath string, compress bool) error {
+	session, err := connectCopy(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	if err := useSnapshot(ctx, session, snapshot); err != nil {
+		return err
+	}
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create table file: %w", err)
+	}
+	chain, err := bt.newDumpWriter(file, compress)
+	if err != nil {
+		file.Close()
+		os.Remove(outputPath)
+		return err
+	}
+	_, err = session.CopyOut(ctx, query, bt.throttleWriter(ctx, chain))
+	if closeErr := chain.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("failed to write table file: %w", closeErr)
+	}
+	if err == nil {
+		err = session.Exec(ctx, "COMMIT")
+	}
+	if err != nil {
+		os.Remove(outputPath)
+		return err
+	}
+	return nil
+}
+
+// runParallel calls fn with 0 to n-1 from up to workers goroutines. It
+// stops at the first error, which it returns.
+func runParallel(ctx context.Context, workers, n int, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(workers, n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if err := fn(ctx, i); err != nil {
+					cancel(err)
+				}
+			}
+		}()
+	}
+feed:
+	for i := range n {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	return context.Cause(ctx)
+}
+
+// isCopyExport reports whether path is a copy export directory
+func isCopyExport(path string) bool {
+	_, err := os.Stat(filepath.Join(path, copySchemaFile))
+	return err == nil
+}
+
+// readCopyIndex reads the index of the copy export in dir
+func readCopyIndex(dir string) (*copyIndex, error) {
+	data, err := os.ReadFile(filepath.Join(dir, copyIndexFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table index, the export is incomplete: %w", err)
+	}
+	var index copyIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse table index: %w", err)
+	}
+	return &index, nil
+}
+
+// verifyCopyExport checks that pg_restore can list the schema dump of the
+// copy export in dir and that every table file it indexes reads back
+func (bt *Tool) verifyCopyExport(ctx context.Context, dir string) error {
+	index, err := readCopyIndex(dir)
+	if err != nil {
+		return err
+	}
+	if err := verifyArchive(commandContext(ctx, "pg_restore", "--list", "--format=custom", filepath.Join(dir, copySchemaFile))); err != nil {
+		return err
+	}
+	for _, table := range index.Tables {
+		reader, err := bt.openBackup(filepath.Join(dir, table.File))
+		if err != nil {
+			return fmt.Errorf("table %s: %w", table, err)
+		}
+		_, err = io.Copy(io.Discard, reader)
+		if closeErr := reader.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read table %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// restoreCopyExport loads the copy export in dir into db: the schema
+// before the table data, then the table data in parallel, then the
+// indexes, constraints and sequence values. args are passed on to
+// pg_restore.
+func (bt *Tool) restoreCopyExport(ctx context.Context, job *databaseJob, db *config.Database, dir string, args ...string) error {
+	index, err := readCopyIndex(dir)
+	if err != nil {
+		return err
+	}
+	if err := bt.restoreSchema(ctx, job, db, dir, append(args, "--section=pre-data")...); err != nil {
+		return err
+	}
+	if err := bt.loadTables(ctx, job, db, dir, index, index.Tables, false); err != nil {
+		return err
+	}
+	if db.Jobs > 1 {
+		args = append(args, fmt.Sprintf("--jobs=%d", db.Jobs))
+	}
+	return bt.restoreSchema(ctx, job, db, dir, append(args, "--section=data", "--section=post-data")...)
+}
+
+// restoreSchema runs pg_restore with args on the schema dump of the copy
+// export in dir
+func (bt *Tool) restoreSchema(ctx context.Context, job *databaseJob, db *config.Database, dir string, args ...string) error {
+	cmd, cleanup, err := job.driver.restoreCommand(ctx, db, "custom")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	cmd.Args = append(cmd.Args, args...)
+	cmd.Args = append(cmd.Args, filepath.Join(dir, copySchemaFile))
+
+	job.logger.Debug("Running restore", "command", redactedCommand(cmd, db))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pg_restore failed: %w, output: %s", err, output)
+	}
+	return nil
+}
+
+// restoreTables replaces the rows of the named tables of db, which must
+// exist already, with those in the copy export at backupPath. Names are
+// table names, qualified with their schema where they are ambiguous.
+func (bt *Tool) restoreTables(ctx context.Context, job *databaseJob, db *config.Database, backupPath string, names []string) error {
+	info, err := os.Stat(backupPath)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	if !info.IsDir() || !isCopyExport(backupPath) {
+		return fmt.Errorf("table-level restores need a backup in the copy format")
+	}
+	index, err := readCopyIndex(backupPath)
+	if err != nil {
+		return err
+	}
+
+	var tables []exportedTable
+	for _, name := range names {
+		var matched []exportedTable
+		for _, table := range index.Tables {
+			if name == table.String() || name == table.Name {
+				matched = append(matched, table)
+			}
+		}
+		switch len(matched) {
+		case 0:
+			return fmt.Errorf("backup has no table %q", name)
+		case 1:
+			tables = append(tables, matched[0])
+		default:
+			return fmt.Errorf("table %q is in several schemas, qualify it such as %s", name, matched[0])
+		}
+	}
+	return bt.loadTables(ctx, job, db, backupPath, index, tables, true)
+}
+
+// loadTables loads the files of tables in the copy export in dir into db
+// with COPY, up to jobs at a time, emptying each table first if truncate
+// is set
+func (bt *Tool) loadTables(ctx context.Context, job *databaseJob, db *config.Database, dir string, index *copyIndex, tables []exportedTable, truncate bool) error {
+	workers := max(db.Jobs, 1)
+	job.logger.Info("Loading tables", "tables", len(tables), "workers", workers)
+	return runParallel(ctx, workers, len(tables), func(ctx context.Context, i int) error {
+		table := tables[i]
+		job.logger.Debug("Loading table", "table", table.String(), "file", table.File)
+		if err := bt.loadTable(ctx, db, filepath.Join(dir, table.File), table, index.Format, truncate); err != nil {
+			return fmt.Errorf("failed to load table %s: %w", table, err)
+		}
+		return nil
+	})
+}
+
+// loadTable loads the table file at path into table of db in a transaction
+// of its own, emptying the table first if truncate is set
+func (bt *Tool) loadTable(ctx context.Context, db *config.Database, path string, table exportedTable, format string, truncate bool) error {
+	reader, err := bt.openBackup(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	session, err := connectCopy(ctx, db)
+	if err != nil {
+		return err
+	}
+	// Closing the session before COMMIT rolls the transaction back
+	defer session.Close()
+
+	statements := "BEGIN"
+	if truncate {
+		statements += "; TRUNCATE " + table.ident()
+	}
+	if err := session.Exec(ctx, statements); err != nil {
+		return err
+	}
+	if _, err := session.CopyIn(ctx, fmt.Sprintf("COPY %s FROM STDIN (FORMAT %s)", table.ident(), format), reader); err != nil {
+		return err
+	}
+	// A failed decompressor may only report it when closed, having ended
+	// the file early
+	if err := reader.Close(); err != nil {
+		return fmt.Errorf("failed to read table file: %w", err)
+	}
+	return session.Exec(ctx, "COMMIT")
+}
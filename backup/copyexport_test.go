@@ -0,0 +1,195 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"beackup/config"
+	"beackup/pgwire/pgwiretest"
+)
+
+// copyServer is a fake database with the tables public.orders and
+// audit.log, recording the rows copied into it
+type copyServer struct {
+	*pgwiretest.Server
+	mu     sync.Mutex
+	loaded map[string]string // COPY FROM STDIN query to data
+}
+
+func newCopyServer(t *testing.T) *copyServer {
+	s := &copyServer{loaded: make(map[string]string)}
+	s.Server = pgwiretest.NewServer(t, func(session *pgwiretest.Session, query string) {
+		switch {
+		case strings.HasSuffix(query, "SELECT pg_export_snapshot()"):
+			session.Rows([]string{"pg_export_snapshot"}, [][]*string{{pgwiretest.Value("00000003-0000001B-1")}})
+		case query == pgTablesQuery:
+			session.Rows([]string{"nspname", "relname"}, [][]*string{
+				{pgwiretest.Value("public"), pgwiretest.Value("orders")},
+				{pgwiretest.Value("audit"), pgwiretest.Value("log")},
+			})
+		case query == `COPY "public"."orders" TO STDOUT (FORMAT csv)`:
+			session.CopyOut("1,book\n", "2,pen\n")
+		case strings.HasSuffix(query, "TO STDOUT (FORMAT csv)"):
+			session.Error("42501", "permission denied")
+		case strings.HasSuffix(query, "FROM STDIN (FORMAT csv)"):
+			if data, ok := session.CopyIn(); ok {
+				s.mu.Lock()
+				s.loaded[query] = data
+				s.mu.Unlock()
+			}
+		}
+	})
+	return s
+}
+
+// copyTool returns a tool compressing with gzip and a database of server
+func copyTool(t *testing.T, server *copyServer) (*Tool, *databaseJob) {
+	cfg := &config.Config{}
+	cfg.Backup.Compression = config.Compression{Algorithm: "gzip", Level: 6}
+	db := &config.Database{ID: "app", Type: config.TypePostgres, Host: server.Host, Port: server.Port, Name: "app", User: "backup", Format: copyFormat}
+	db.Copy.Format = "csv"
+	job := &databaseJob{db: db, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	return &Tool{config: cfg, jobs: []*databaseJob{job}}, job
+}
+
+func TestCopyConnection(t *testing.T) {
+	db := &config.Database{Host: "db.internal", Port: 5433, User: "backup", Name: "app",
+		DSNEnv: []string{"PGAPPNAME=nightly", "PGCONNECT_TIMEOUT=7", "PGCHANNELBINDING=prefer"}}
+	conn, err := copyConnection(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Host != "db.internal" || conn.Port != 5433 || conn.Database != "app" || conn.ConnectTimeout != 7*time.Second {
+		t.Errorf("copyConnection() = %+v", conn)
+	}
+	if conn.Params["application_name"] != "nightly" || conn.Params["DateStyle"] != "ISO" {
+		t.Errorf("session parameters = %v", conn.Params)
+	}
+	if copySessionParams["application_name"] != "beackup" {
+		t.Error("copyConnection() changed the default session parameters")
+	}
+
+	for _, variable := range []string{"PGCHANNELBINDING=require", "PGSSLCRL=/etc/crl.pem", "PGTARGETSESSIONATTRS=read-write", "PGCONNECT_TIMEOUT=soon"} {
+		db.DSNEnv = []string{variable}
+		if _, err := copyConnection(db); err == nil {
+			t.Errorf("copyConnection() accepted %s", variable)
+		}
+	}
+}
+
+func TestExportTable(t *testing.T) {
+	server := newCopyServer(t)
+	bt, job := copyTool(t, server)
+	job.db.ExcludeSchemas = []string{"audit"}
+	ctx := context.Background()
+
+	session, snapshot, release, err := exportSnapshot(ctx, job.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	tables, err := listTables(ctx, session, job.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []exportedTable{{Schema: "public", Name: "orders"}}; !slices.Equal(tables, want) {
+		t.Fatalf("listTables() = %v, want %v", tables, want)
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "0001.csv.gz")
+	if err := bt.exportTable(ctx, job.db, snapshot, `COPY "public"."orders" TO STDOUT (FORMAT csv)`, file, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := release(); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := bt.openBackup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if data, err := io.ReadAll(reader); err != nil || string(data) != "1,book\n2,pen\n" {
+		t.Errorf("table file = %q, %v", data, err)
+	}
+
+	queries := server.Queries()
+	if !slices.Contains(queries, "BEGIN ISOLATION LEVEL REPEATABLE READ; SET TRANSACTION SNAPSHOT '"+snapshot+"'") {
+		t.Errorf("the table was not copied in the snapshot, queries = %q", queries)
+	}
+	if n := len(server.Startup()); n != 2 {
+		t.Errorf("opened %d sessions, want one for the snapshot and one for the table", n)
+	}
+
+	// A failed COPY leaves no partial file behind
+	failed := filepath.Join(dir, "0002.csv.gz")
+	if err := bt.exportTable(ctx, job.db, snapshot, `COPY "audit"."log" TO STDOUT (FORMAT csv)`, failed, true); err == nil {
+		t.Error("exportTable() of a table that cannot be read succeeded")
+	}
+	if _, err := os.Stat(failed); !os.IsNotExist(err) {
+		t.Errorf("failed export left its file: %v", err)
+	}
+}
+
+func TestRestoreTables(t *testing.T) {
+	server := newCopyServer(t)
+	bt, job := copyTool(t, server)
+	dir := t.TempDir()
+
+	index := copyIndex{Format: "csv", Tables: []exportedTable{
+		{Schema: "public", Name: "orders", File: "0001.csv"},
+		{Schema: "audit", Name: "orders", File: "0002.csv"},
+		{Schema: "audit", Name: "log", File: "0003.csv"},
+	}}
+	data, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{copySchemaFile: "", copyIndexFile: string(data), "0001.csv": "1,book\n", "0002.csv": "", "0003.csv": "login\n"}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	if err := bt.restoreTables(ctx, job, job.db, dir, []string{"orders"}); err == nil || !strings.Contains(err.Error(), "several schemas") {
+		t.Errorf("restoreTables() of an ambiguous name error = %v", err)
+	}
+	if err := bt.restoreTables(ctx, job, job.db, dir, []string{"public.orders", "log"}); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	want := map[string]string{
+		`COPY "public"."orders" FROM STDIN (FORMAT csv)`: "1,book\n",
+		`COPY "audit"."log" FROM STDIN (FORMAT csv)`:     "login\n",
+	}
+	if len(server.loaded) != len(want) {
+		t.Errorf("loaded %v, want %v", server.loaded, want)
+	}
+	for query, rows := range want {
+		if server.loaded[query] != rows {
+			t.Errorf("%s loaded %q, want %q", query, server.loaded[query], rows)
+		}
+	}
+	queries := server.Queries()
+	for _, query := range []string{`BEGIN; TRUNCATE "public"."orders"`, `BEGIN; TRUNCATE "audit"."log"`} {
+		if !slices.Contains(queries, query) {
+			t.Errorf("queries %q lack %q", queries, query)
+		}
+	}
+	if n := strings.Count(strings.Join(queries, "\n"), "COMMIT"); n != 2 {
+		t.Errorf("committed %d times, want once per table", n)
+	}
+}
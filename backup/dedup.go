@@ -0,0 +1,769 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"beackup/config"
+	"beackup/storage"
+)
+
+// Layout of the dedup store in remote storage. Each backup uploaded to it
+// is described by a snapshot stored under the backup's own key.
+const (
+	dedupPrefix    = ".dedup"
+	dedupIndexKey  = dedupPrefix + "/index.json"
+	dedupLockKey   = dedupPrefix + "/lock"
+	dedupChunksDir = dedupPrefix + "/chunks"
+	snapshotSuffix = ".chunks.json"
+)
+
+// gearTable holds the random values the chunker's rolling hash adds for
+// each byte. They come from a fixed seed, since different values would
+// move every chunk boundary and defeat deduplication against older
+// backups.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x6265_6163_6b75_70) // "beackup"
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits the data written to it into content-defined chunks with
+// a gear rolling hash, as in FastCDC, so that data inserted or removed
+// only changes the chunks around it. Chunks are passed to emit, which must
+// not keep the slice.
+type chunker struct {
+	min, avg, max int
+	maskS, maskL  uint64 // boundary masks before and after the average size
+	hash          uint64
+	buf           []byte
+	emit          func([]byte) error
+}
+
+// newChunker creates a chunker with the configured chunk sizes
+func newChunker(d config.Dedup, emit func([]byte) error) *chunker {
+	avgBits := bits.TrailingZeros64(uint64(d.AvgChunkSize))
+	return &chunker{
+		min: int(d.MinChunkSize),
+		avg: int(d.AvgChunkSize),
+		max: int(d.MaxChunkSize),
+		// A boundary is harder to hit before the average size and easier
+		// after it, which keeps chunk sizes close to the average
+		maskS: ^uint64(0) << (64 - (avgBits + 1)),
+		maskL: ^uint64(0) << (64 - (avgBits - 1)),
+		emit:  emit,
+	}
+}
+
+func (c *chunker) Write(p []byte) (int, error) {
+	for i, b := range p {
+		c.buf = append(c.buf, b)
+		n := len(c.buf)
+		if n < c.min {
+			continue
+		}
+		c.hash = c.hash<<1 + gearTable[b]
+		mask := c.maskL
+		if n < c.avg {
+			mask = c.maskS
+		}
+		if c.hash&mask == 0 || n >= c.max {
+			if err := c.flush(); err != nil {
+				return i, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Close emits the last chunk
+func (c *chunker) Close() error {
+	return c.flush()
+}
+
+func (c *chunker) flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	err := c.emit(c.buf)
+	c.buf = c.buf[:0]
+	c.hash = 0
+	return err
+}
+
+// dedupChunk is a stored chunk in the dedup index
+type dedupChunk struct {
+	Size int64 `json:"size"` // stored size after compression and encryption
+	Refs int   `json:"refs"` // references from uploaded snapshots
+}
+
+// dedupIndex is the reference-counted list of stored chunks, kept in
+// remote storage next to them
+type dedupIndex struct {
+	Chunks map[string]*dedupChunk `json:"chunks"`
+}
+
+// errDedupLockLost is returned when another process took the store lock
+// over after this process failed to renew it
+var errDedupLockLost = errors.New("lost the dedup store lock to another process")
+
+// dedupLockLease is how long the store lock stays valid unless renewed, so
+// that the lock of a process that died expires
+const dedupLockLease = 2 * time.Minute
+
+// dedupLockSettle is how long a process waits after writing the store lock
+// before checking that it holds it. Storage has no atomic create, so
+// processes taking the lock at once all write it and the last write wins.
+var dedupLockSettle = 2 * time.Second
+
+// dedupLock is the store lock object
+type dedupLock struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// dedupStore tracks the chunks in the dedup store. The process holds a
+// lock object in the store while any of its backups is being chunked or
+// uploaded and while it deletes snapshots, so that the index, read afresh
+// when the lock is taken, cannot change under it. Another process finding
+// the store locked refuses to use it. Chunks referenced by backups still
+// being taken are pinned so that retention cannot delete them before the
+// backup is uploaded.
+type dedupStore struct {
+	mu      sync.Mutex
+	owner   string         // identifies the process in the store lock
+	holders int            // sessions and deletions holding the store lock
+	stop    chan struct{}  // stops renewing the store lock
+	lost    bool           // another process took the store lock over
+	index   *dedupIndex    // nil unless the store lock is held
+	pending map[string]int // pins by backups not yet uploaded
+}
+
+func newDedupStore() *dedupStore {
+	host, _ := os.Hostname()
+	id := make([]byte, 4)
+	rand.Read(id)
+	return &dedupStore{
+		owner:   fmt.Sprintf("%s pid %d (%x)", host, os.Getpid(), id),
+		pending: make(map[string]int),
+	}
+}
+
+// acquire holds the store lock for a session or a deletion until
+// relinquish is called. The process's sessions and deletions share the
+// lock; the first takes it and reads the index, and it is renewed until
+// the last gives it up.
+func (s *dedupStore) acquire(ctx context.Context, backend storage.Backend) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.holders > 0 {
+		s.holders++
+		return nil
+	}
+
+	if err := s.lock(ctx, backend); err != nil {
+		return err
+	}
+	index := &dedupIndex{Chunks: make(map[string]*dedupChunk)}
+	found, err := getJSONIfExists(ctx, backend, dedupIndexKey, index)
+	if err != nil {
+		s.unlock(backend)
+		return fmt.Errorf("failed to read dedup index: %w", err)
+	}
+	if found && index.Chunks == nil {
+		index.Chunks = make(map[string]*dedupChunk)
+	}
+	s.index = index
+	s.holders = 1
+	s.lost = false
+	s.stop = make(chan struct{})
+	go s.renew(backend, s.stop)
+	return nil
+}
+
+// relinquish gives up a hold on the store lock, deleting the lock once
+// nothing in the process holds it
+func (s *dedupStore) relinquish(backend storage.Backend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.holders--; s.holders > 0 {
+		return
+	}
+	close(s.stop)
+	s.index = nil
+	if !s.lost {
+		s.unlock(backend)
+	}
+}
+
+// lock takes the store lock unless another process holds it
+func (s *dedupStore) lock(ctx context.Context, backend storage.Backend) error {
+	var current dedupLock
+	found, err := getJSONIfExists(ctx, backend, dedupLockKey, &current)
+	if err != nil {
+		return fmt.Errorf("failed to read dedup store lock: %w", err)
+	}
+	if found && current.Owner != s.owner && time.Now().Before(current.Expires) {
+		return fmt.Errorf("dedup store is locked by %s until %s", current.Owner, current.Expires.Format(time.RFC3339))
+	}
+	if err := s.writeLock(ctx, backend); err != nil {
+		return err
+	}
+
+	select {
+	case <-time.After(dedupLockSettle):
+	case <-ctx.Done():
+		s.unlock(backend)
+		return ctx.Err()
+	}
+	found, err = getJSONIfExists(ctx, backend, dedupLockKey, &current)
+	if err != nil {
+		return fmt.Errorf("failed to read dedup store lock: %w", err)
+	}
+	if !found || current.Owner != s.owner {
+		return fmt.Errorf("dedup store was locked by %s at the same time", current.Owner)
+	}
+	return nil
+}
+
+// writeLock writes the store lock, valid for another lease
+func (s *dedupStore) writeLock(ctx context.Context, backend storage.Backend) error {
+	data, err := json.Marshal(dedupLock{Owner: s.owner, Expires: time.Now().Add(dedupLockLease)})
+	if err != nil {
+		return err
+	}
+	if err := backend.Put(ctx, dedupLockKey, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write dedup store lock: %w", err)
+	}
+	return nil
+}
+
+// unlock deletes the store lock. A lock left behind expires.
+func (s *dedupStore) unlock(backend storage.Backend) {
+	backend.Delete(context.Background(), dedupLockKey)
+}
+
+// renew extends the store lock until stop is closed. It gives up if
+// another process took the lock over after it expired, which commit and
+// unref then report.
+func (s *dedupStore) renew(backend storage.Backend, stop chan struct{}) {
+	ticker := time.NewTicker(dedupLockLease / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		select {
+		case <-stop:
+			s.mu.Unlock()
+			return
+		default:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), dedupLockLease/4)
+		var current dedupLock
+		found, err := getJSONIfExists(ctx, backend, dedupLockKey, &current)
+		if err == nil && found && current.Owner != s.owner {
+			s.lost = true
+		} else if err == nil {
+			// A failed renewal is retried on the next tick
+			s.writeLock(ctx, backend)
+		}
+		cancel()
+		lost := s.lost
+		s.mu.Unlock()
+		if lost {
+			return
+		}
+	}
+}
+
+// pin holds a reference to a chunk until it is committed or released,
+// reporting whether the chunk is already stored
+func (s *dedupStore) pin(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[name]++
+	_, stored := s.index.Chunks[name]
+	return stored
+}
+
+// release drops pins without committing them
+func (s *dedupStore) release(names []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unpin(names)
+}
+
+func (s *dedupStore) unpin(names []string) {
+	for _, name := range names {
+		if s.pending[name]--; s.pending[name] <= 0 {
+			delete(s.pending, name)
+		}
+	}
+}
+
+// commit turns pins into references of an uploaded snapshot, adding the
+// new chunks with their stored sizes, and saves the index
+func (s *dedupStore) commit(ctx context.Context, backend storage.Backend, names []string, sizes map[string]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lost {
+		return errDedupLockLost
+	}
+	for _, name := range names {
+		chunk := s.index.Chunks[name]
+		if chunk == nil {
+			chunk = &dedupChunk{Size: sizes[name]}
+			s.index.Chunks[name] = chunk
+		}
+		chunk.Refs++
+	}
+	s.unpin(names)
+	return s.save(ctx, backend)
+}
+
+// unref drops the references of a deleted snapshot, deletes the chunks
+// nothing refers to any more and saves the index
+func (s *dedupStore) unref(ctx context.Context, backend storage.Backend, names []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lost {
+		return errDedupLockLost
+	}
+	for _, name := range names {
+		if chunk := s.index.Chunks[name]; chunk != nil {
+			chunk.Refs--
+		}
+	}
+
+	var errs []error
+	for name, chunk := range s.index.Chunks {
+		if chunk.Refs > 0 || s.pending[name] > 0 {
+			continue
+		}
+		if err := backend.Delete(ctx, chunkKey(name)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete chunk %s: %w", name, err))
+			continue
+		}
+		delete(s.index.Chunks, name)
+	}
+	return errors.Join(append(errs, s.save(ctx, backend))...)
+}
+
+// save writes the index to storage
+func (s *dedupStore) save(ctx context.Context, backend storage.Backend) error {
+	data, err := json.Marshal(s.index)
+	if err != nil {
+		return fmt.Errorf("failed to encode dedup index: %w", err)
+	}
+	if err := backend.Put(ctx, dedupIndexKey, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write dedup index: %w", err)
+	}
+	return nil
+}
+
+// storedSize returns the stored size of the chunks
+func (s *dedupStore) storedSize() (chunks int, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.index == nil {
+		return 0, 0
+	}
+	for _, chunk := range s.index.Chunks {
+		size += chunk.Size
+	}
+	return len(s.index.Chunks), size
+}
+
+// chunkKey returns the storage key of a chunk
+func chunkKey(name string) string {
+	return dedupChunksDir + "/" + name
+}
+
+// snapshotKey returns the storage key of the snapshot of a database's backup
+func snapshotKey(dbID, file string) string {
+	return path.Join(dbID, filepath.ToSlash(file)) + snapshotSuffix
+}
+
+// dedupSnapshot lists the chunks a backup was uploaded as
+type dedupSnapshot struct {
+	Name      string      `json:"name"`                // file name of the reassembled backup
+	Directory bool        `json:"directory,omitempty"` // a directory-format backup
+	Files     []dedupFile `json:"files"`
+}
+
+// dedupFile is a file of a snapshot
+type dedupFile struct {
+	Path   string   `json:"path,omitempty"` // within a directory-format backup
+	Size   int64    `json:"size"`
+	Chunks []string `json:"chunks"`
+}
+
+// dedupSession chunks a backup for the dedup store. Chunks not stored
+// yet are compressed and encrypted into a spool directory until the
+// backup is uploaded; every chunk is pinned until then.
+type dedupSession struct {
+	bt        *Tool
+	job       *databaseJob
+	file      string // backup file within the database's directory
+	spool     string
+	compress  bool
+	extension string // compression and encryption suffix of the chunks
+	snapshot  dedupSnapshot
+	spooled   map[string]int64 // new chunks and their stored sizes
+	pinned    []string
+	held      bool // the session holds the store lock
+}
+
+// newDedupSession starts chunking the backup file of job. compress tells
+// whether chunks are compressed, which is pointless for data the dump
+// program already compressed.
+func (bt *Tool) newDedupSession(ctx context.Context, job *databaseJob, file, name string, compress bool) (*dedupSession, error) {
+	spool := filepath.Join(bt.config.Backup.OutputDir, dedupPrefix, "spool", job.db.ID, filepath.Base(file))
+	if err := os.RemoveAll(spool); err != nil {
+		return nil, fmt.Errorf("failed to clear dedup spool: %w", err)
+	}
+	if err := os.MkdirAll(spool, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dedup spool: %w", err)
+	}
+	if err := bt.dedup.acquire(ctx, bt.storage); err != nil {
+		os.RemoveAll(spool)
+		return nil, err
+	}
+
+	extension := bt.config.Encryption.Extension()
+	if compress {
+		extension = bt.config.Backup.Compression.Extension() + extension
+	}
+	return &dedupSession{
+		bt:        bt,
+		job:       job,
+		file:      file,
+		spool:     spool,
+		compress:  compress,
+		extension: extension,
+		snapshot:  dedupSnapshot{Name: name},
+		spooled:   make(map[string]int64),
+		held:      true,
+	}, nil
+}
+
+// chunkArtifact chunks a backup file or directory that was written
+// directly by the dump program
+func (bt *Tool) chunkArtifact(ctx context.Context, job *databaseJob, outputPath, file string) (*dedupSession, error) {
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return nil, err
+	}
+	compress := bt.config.Backup.Compression.Enabled() && !job.driver.compresses(job.db)
+	session, err := bt.newDedupSession(ctx, job, file, filepath.Base(outputPath), compress)
+	if err != nil {
+		return nil, err
+	}
+	session.snapshot.Directory = info.IsDir()
+
+	err = filepath.WalkDir(outputPath, func(name string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(outputPath, name)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = ""
+		}
+
+		src, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		w := session.add(filepath.ToSlash(rel))
+		if _, err := io.Copy(w, src); err != nil {
+			return err
+		}
+		return w.Close()
+	})
+	if err != nil {
+		session.discard()
+		return nil, fmt.Errorf("failed to chunk backup: %w", err)
+	}
+	return session, nil
+}
+
+// add starts a file of the snapshot, returning the writer its contents
+// are chunked through
+func (s *dedupSession) add(rel string) *chunker {
+	s.snapshot.Files = append(s.snapshot.Files, dedupFile{Path: rel, Chunks: []string{}})
+	index := len(s.snapshot.Files) - 1
+	return newChunker(s.bt.config.Storage.Dedup, func(data []byte) error {
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		name := hash[:2] + "/" + hash + s.extension
+
+		file := &s.snapshot.Files[index]
+		file.Chunks = append(file.Chunks, name)
+		file.Size += int64(len(data))
+		s.pinned = append(s.pinned, name)
+		if s.bt.dedup.pin(name) {
+			return nil
+		}
+		if _, ok := s.spooled[name]; ok {
+			return nil
+		}
+		size, err := s.spoolChunk(hash+s.extension, data)
+		if err != nil {
+			return err
+		}
+		s.spooled[name] = size
+		return nil
+	})
+}
+
+// spoolChunk compresses and encrypts a new chunk into the spool
+func (s *dedupSession) spoolChunk(base string, data []byte) (int64, error) {
+	file, err := os.Create(filepath.Join(s.spool, base))
+	if err != nil {
+		return 0, fmt.Errorf("failed to spool chunk: %w", err)
+	}
+	chain, err := s.bt.newDumpWriter(file, s.compress)
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+	_, writeErr := chain.Write(data)
+	if err := errors.Join(writeErr, chain.Close()); err != nil {
+		file.Close()
+		return 0, fmt.Errorf("failed to spool chunk: %w", err)
+	}
+	info, err := file.Stat()
+	if err := errors.Join(err, file.Close()); err != nil {
+		return 0, fmt.Errorf("failed to spool chunk: %w", err)
+	}
+	return info.Size(), nil
+}
+
+// discard releases the session's pins and its hold on the store lock and
+// removes its spool
+func (s *dedupSession) discard() {
+	s.bt.dedup.release(s.pinned)
+	s.pinned = nil
+	if s.held {
+		s.bt.dedup.relinquish(s.bt.storage)
+		s.held = false
+	}
+	os.RemoveAll(s.spool)
+}
+
+// uploadChunks uploads the new chunks of a session, records its
+// references in the index and finally uploads its snapshot. An
+// interruption leaves at most unreferenced chunks behind, never a
+// snapshot with missing chunks.
+func (bt *Tool) uploadChunks(ctx context.Context, s *dedupSession) error {
+	names := make([]string, 0, len(s.spooled))
+	var uploaded int64
+	for name, size := range s.spooled {
+		names = append(names, name)
+		uploaded += size
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		err := bt.retry(ctx, s.job.logger, "upload", func() error {
+			file, err := os.Open(filepath.Join(s.spool, path.Base(name)))
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			if err := bt.storage.Put(ctx, chunkKey(name), bt.throttleUpload(ctx, file)); err != nil {
+				return fmt.Errorf("failed to upload chunk %s: %w", name, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := bt.dedup.commit(ctx, bt.storage, s.pinned, s.spooled); err != nil {
+		return err
+	}
+	s.pinned = nil
+
+	data, err := json.Marshal(s.snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	key := snapshotKey(s.job.db.ID, s.file)
+	err = bt.retry(ctx, s.job.logger, "upload", func() error {
+		if err := bt.storage.Put(ctx, key, bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", key, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for _, f := range s.snapshot.Files {
+		size += f.Size
+	}
+	chunks, stored := bt.dedup.storedSize()
+	s.job.logger.Info("Uploaded deduplicated backup", "snapshot", key, "size", size,
+		"new_chunks", len(names), "uploaded", uploaded, "store_chunks", chunks, "store_size", stored)
+
+	os.RemoveAll(s.spool)
+	return nil
+}
+
+// deleteSnapshot deletes an uploaded snapshot and the chunks only it
+// referred to
+func (bt *Tool) deleteSnapshot(ctx context.Context, job *databaseJob, file string) error {
+	if err := bt.dedup.acquire(ctx, bt.storage); err != nil {
+		return err
+	}
+	defer bt.dedup.relinquish(bt.storage)
+
+	key := snapshotKey(job.db.ID, file)
+	var snapshot dedupSnapshot
+	if err := getJSON(ctx, bt.storage, key, &snapshot); err != nil {
+		return fmt.Errorf("failed to read snapshot %s: %w", key, err)
+	}
+	// The snapshot goes first, so an interruption only leaves chunks
+	// referenced for too long
+	if err := bt.storage.Delete(ctx, key); err != nil {
+		return err
+	}
+
+	var names []string
+	for _, f := range snapshot.Files {
+		names = append(names, f.Chunks...)
+	}
+	return bt.dedup.unref(ctx, bt.storage, names)
+}
+
+// fetchSnapshot reassembles the uploaded snapshot of a backup of database
+// inside dir, returning the path of the backup. Every chunk is checked
+// against its hash.
+func (bt *Tool) fetchSnapshot(ctx context.Context, database, file, dir string) (string, error) {
+	key := snapshotKey(database, file)
+	var snapshot dedupSnapshot
+	if err := getJSON(ctx, bt.storage, key, &snapshot); err != nil {
+		return "", fmt.Errorf("failed to read snapshot %s: %w", key, err)
+	}
+
+	chunkDir := filepath.Join(dir, "chunks")
+	if err := os.MkdirAll(chunkDir, 0700); err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(chunkDir)
+
+	target := filepath.Join(dir, snapshot.Name)
+	for _, f := range snapshot.Files {
+		dest := target
+		if snapshot.Directory {
+			dest = filepath.Join(target, filepath.FromSlash(f.Path))
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return "", err
+		}
+		out, err := os.Create(dest)
+		if err != nil {
+			return "", err
+		}
+		for _, name := range f.Chunks {
+			if err := bt.fetchChunk(ctx, name, chunkDir, out); err != nil {
+				out.Close()
+				return "", err
+			}
+		}
+		if err := out.Close(); err != nil {
+			return "", err
+		}
+	}
+	if snapshot.Directory {
+		// Directory backups without files still need their directory
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return "", err
+		}
+	}
+	return target, nil
+}
+
+// fetchChunk downloads a chunk into dir and appends its decoded contents
+// to w
+func (bt *Tool) fetchChunk(ctx context.Context, name, dir string, w io.Writer) error {
+	local := filepath.Join(dir, path.Base(name))
+	if err := bt.download(ctx, chunkKey(name), local); err != nil {
+		return err
+	}
+	defer os.Remove(local)
+
+	reader, err := bt.openBackup(local)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, copyErr := io.Copy(io.MultiWriter(w, hash), reader)
+	if err := errors.Join(copyErr, reader.Close()); err != nil {
+		return fmt.Errorf("failed to read chunk %s: %w", name, err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); !strings.HasPrefix(path.Base(name), sum) {
+		return fmt.Errorf("chunk %s is corrupt, its contents hash to %s", name, sum)
+	}
+	return nil
+}
+
+// getJSON downloads and decodes a JSON object from storage
+func getJSON(ctx context.Context, backend storage.Backend, key string, v any) error {
+	body, err := backend.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return json.NewDecoder(body).Decode(v)
+}
+
+// getJSONIfExists is getJSON for objects that may not exist, reporting
+// whether it does
+func getJSONIfExists(ctx context.Context, backend storage.Backend, key string, v any) (bool, error) {
+	objects, err := backend.List(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	for _, object := range objects {
+		if object.Key == key {
+			return true, getJSON(ctx, backend, key, v)
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,317 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"beackup/config"
+	"beackup/storage"
+)
+
+// testChunkSizes are small chunk sizes so that tests see many chunks
+var testChunkSizes = config.Dedup{MinChunkSize: 1 << 10, AvgChunkSize: 4 << 10, MaxChunkSize: 16 << 10}
+
+// randomData returns n reproducible random bytes
+func randomData(seed uint64, n int) []byte {
+	r := rand.New(rand.NewPCG(seed, seed))
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(r.Uint32())
+	}
+	return data
+}
+
+// chunkData splits data with a chunker fed writes of up to writeSize bytes
+func chunkData(t *testing.T, d config.Dedup, data []byte, writeSize int) [][]byte {
+	t.Helper()
+	var chunks [][]byte
+	c := newChunker(d, func(chunk []byte) error {
+		chunks = append(chunks, bytes.Clone(chunk))
+		return nil
+	})
+	for rest := data; len(rest) > 0; {
+		n := min(writeSize, len(rest))
+		if _, err := c.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
+
+func TestChunkerBoundaries(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		wantChunks int // 0 to only check the sizes
+	}{
+		{"empty", nil, 0},
+		{"shorter than the minimum", randomData(1, 1000), 1},
+		{"exactly the maximum of zeros", make([]byte, 16<<10), 1},
+		{"zeros", make([]byte, 100<<10), 0},
+		{"random", randomData(2, 1<<20), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := chunkData(t, testChunkSizes, tt.data, len(tt.data)+1)
+			if tt.wantChunks > 0 && len(chunks) != tt.wantChunks {
+				t.Errorf("got %d chunks, want %d", len(chunks), tt.wantChunks)
+			}
+			if len(tt.data) == 0 && len(chunks) != 0 {
+				t.Errorf("got %d chunks of no data", len(chunks))
+			}
+			if joined := bytes.Join(chunks, nil); !bytes.Equal(joined, tt.data) {
+				t.Errorf("chunks do not add up to the data")
+			}
+			for i, chunk := range chunks {
+				last := i == len(chunks)-1
+				if len(chunk) > int(testChunkSizes.MaxChunkSize) || !last && len(chunk) < int(testChunkSizes.MinChunkSize) {
+					t.Errorf("chunk %d has %d bytes, outside %d to %d", i, len(chunk), testChunkSizes.MinChunkSize, testChunkSizes.MaxChunkSize)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkerAverageSize(t *testing.T) {
+	data := randomData(3, 4<<20)
+	chunks := chunkData(t, testChunkSizes, data, len(data))
+	avg := len(data) / len(chunks)
+	if want := int(testChunkSizes.AvgChunkSize); avg < want/2 || avg > want*2 {
+		t.Errorf("average chunk size %d, want about %d", avg, want)
+	}
+}
+
+func TestChunkerWriteSizes(t *testing.T) {
+	data := randomData(4, 256<<10)
+	want := chunkData(t, testChunkSizes, data, len(data))
+	for _, writeSize := range []int{1, 7, 1000, 4096, 65536} {
+		got := chunkData(t, testChunkSizes, data, writeSize)
+		if len(got) != len(want) {
+			t.Fatalf("writes of %d bytes gave %d chunks, want %d", writeSize, len(got), len(want))
+		}
+		for i := range got {
+			if !bytes.Equal(got[i], want[i]) {
+				t.Errorf("writes of %d bytes moved the end of chunk %d", writeSize, i)
+				break
+			}
+		}
+	}
+}
+
+func TestChunkerResynchronizes(t *testing.T) {
+	data := randomData(5, 512<<10)
+	edited := append(randomData(6, 100), data...)
+	edited = append(edited[:300<<10:300<<10], edited[300<<10+50:]...)
+
+	original := make(map[string]bool)
+	for _, chunk := range chunkData(t, testChunkSizes, data, len(data)) {
+		original[string(chunk)] = true
+	}
+	chunks := chunkData(t, testChunkSizes, edited, len(edited))
+	changed := 0
+	for _, chunk := range chunks {
+		if !original[string(chunk)] {
+			changed++
+		}
+	}
+	// An insertion and a deletion each change a few chunks around them
+	if changed > 6 {
+		t.Errorf("%d of %d chunks changed after two small edits", changed, len(chunks))
+	}
+}
+
+func TestChunkerEmitError(t *testing.T) {
+	errEmit := errors.New("emit failed")
+	c := newChunker(testChunkSizes, func([]byte) error { return errEmit })
+	n, err := c.Write(make([]byte, 64<<10))
+	if !errors.Is(err, errEmit) {
+		t.Fatalf("Write() error = %v, want %v", err, errEmit)
+	}
+	if n >= 64<<10 {
+		t.Errorf("Write() = %d, want fewer bytes than written", n)
+	}
+}
+
+// memBackend is a storage backend keeping objects in memory
+type memBackend struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{objects: make(map[string][]byte)}
+}
+
+func (b *memBackend) Put(ctx context.Context, key string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = data
+	return nil
+}
+
+func (b *memBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("object %s not found", key)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *memBackend) List(ctx context.Context, prefix string) ([]storage.Object, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var objects []storage.Object
+	for key, data := range b.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, storage.Object{Key: key, Size: int64(len(data))})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (b *memBackend) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, key)
+	return nil
+}
+
+// has reports whether an object is stored under key
+func (b *memBackend) has(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.objects[key]
+	return ok
+}
+
+func TestDedupStoreLock(t *testing.T) {
+	dedupLockSettle = 0
+	ctx := context.Background()
+	backend := newMemBackend()
+	first, second := newDedupStore(), newDedupStore()
+
+	if err := first.acquire(ctx, backend); err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	// Sessions and deletions of one process share the lock
+	if err := first.acquire(ctx, backend); err != nil {
+		t.Fatalf("second acquire() in one process error = %v", err)
+	}
+	if err := second.acquire(ctx, backend); err == nil || !strings.Contains(err.Error(), "dedup store is locked by") {
+		t.Fatalf("acquire() of a locked store error = %v, want it to be locked", err)
+	}
+
+	first.relinquish(backend)
+	if !backend.has(dedupLockKey) {
+		t.Fatal("lock deleted while still held")
+	}
+	first.relinquish(backend)
+	if backend.has(dedupLockKey) {
+		t.Fatal("lock left behind after the last relinquish")
+	}
+	if err := second.acquire(ctx, backend); err != nil {
+		t.Fatalf("acquire() after relinquish error = %v", err)
+	}
+	second.relinquish(backend)
+}
+
+func TestDedupStoreExpiredLock(t *testing.T) {
+	dedupLockSettle = 0
+	ctx := context.Background()
+	backend := newMemBackend()
+	stale, _ := json.Marshal(dedupLock{Owner: "crashed", Expires: time.Now().Add(-time.Minute)})
+	backend.Put(ctx, dedupLockKey, bytes.NewReader(stale))
+
+	store := newDedupStore()
+	if err := store.acquire(ctx, backend); err != nil {
+		t.Fatalf("acquire() over an expired lock error = %v", err)
+	}
+	defer store.relinquish(backend)
+	var lock dedupLock
+	if err := getJSON(ctx, backend, dedupLockKey, &lock); err != nil || lock.Owner != store.owner {
+		t.Errorf("lock = %+v, %v, want it owned by %s", lock, err, store.owner)
+	}
+}
+
+func TestDedupStoreSharedIndex(t *testing.T) {
+	dedupLockSettle = 0
+	ctx := context.Background()
+	backend := newMemBackend()
+	first, second := newDedupStore(), newDedupStore()
+	chunk := "ab/abcd"
+	backend.Put(ctx, chunkKey(chunk), strings.NewReader("data"))
+
+	// Two processes take turns referencing the same chunk
+	for _, store := range []*dedupStore{first, second} {
+		if err := store.acquire(ctx, backend); err != nil {
+			t.Fatal(err)
+		}
+		store.pin(chunk)
+		if err := store.commit(ctx, backend, []string{chunk}, map[string]int64{chunk: 4}); err != nil {
+			t.Fatal(err)
+		}
+		store.relinquish(backend)
+	}
+
+	// Dropping one reference must see the other process's
+	if err := first.acquire(ctx, backend); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.unref(ctx, backend, []string{chunk}); err != nil {
+		t.Fatal(err)
+	}
+	first.relinquish(backend)
+	if !backend.has(chunkKey(chunk)) {
+		t.Fatal("chunk still referenced by the other process was deleted")
+	}
+
+	if err := second.acquire(ctx, backend); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.unref(ctx, backend, []string{chunk}); err != nil {
+		t.Fatal(err)
+	}
+	second.relinquish(backend)
+	if backend.has(chunkKey(chunk)) {
+		t.Error("unreferenced chunk was not deleted")
+	}
+}
+
+func TestDedupStoreLostLock(t *testing.T) {
+	dedupLockSettle = 0
+	ctx := context.Background()
+	backend := newMemBackend()
+	store := newDedupStore()
+	if err := store.acquire(ctx, backend); err != nil {
+		t.Fatal(err)
+	}
+	defer store.relinquish(backend)
+
+	store.mu.Lock()
+	store.lost = true
+	store.mu.Unlock()
+	if err := store.commit(ctx, backend, nil, nil); !errors.Is(err, errDedupLockLost) {
+		t.Errorf("commit() error = %v, want %v", err, errDedupLockLost)
+	}
+}
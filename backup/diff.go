@@ -0,0 +1,316 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"beackup/config"
+)
+
+// dumpSummary is what a postgres dump contains, as read from the SQL script
+// it restores
+type dumpSummary struct {
+	objects map[string][]string // DDL lines of each object, by type and qualified name
+	tables  map[string]*tableData
+}
+
+// tableData is the size of a table's data in a dump
+type tableData struct {
+	rows  int64
+	bytes int64 // in COPY text format
+}
+
+// Diff compares two postgres dumps, printing the objects added, dropped or
+// changed between them and how the row counts and sizes of their tables
+// changed
+func (bt *Tool) Diff(ctx context.Context, w io.Writer, pathA, pathB string) error {
+	a, err := bt.summarizeDump(ctx, pathA)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", pathA, err)
+	}
+	b, err := bt.summarizeDump(ctx, pathB)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", pathB, err)
+	}
+
+	fmt.Fprintf(w, "Comparing %s (A) with %s (B)\n\n", pathA, pathB)
+	printSchemaDiff(w, a, b)
+	fmt.Fprintln(w)
+	return printDataDiff(w, a, b)
+}
+
+// summarizeDump reads the objects and table data of the dump at path
+func (bt *Tool) summarizeDump(ctx context.Context, path string) (*dumpSummary, error) {
+	if IsBaseBackup(path) {
+		return nil, fmt.Errorf("base backups cannot be compared")
+	}
+	job, err := bt.findRestoreJob("", path)
+	if err != nil {
+		return nil, err
+	}
+	if job.db.Type != config.TypePostgres {
+		return nil, fmt.Errorf("only postgres dumps can be compared")
+	}
+	source, cleanup, err := bt.fetchDedupBackup(ctx, job, path)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	script, err := bt.openDumpScript(source)
+	if err != nil {
+		return nil, err
+	}
+	summary, err := parseDumpScript(script)
+	if closeErr := script.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("failed to read backup: %w", closeErr)
+	}
+	return summary, err
+}
+
+// openDumpScript opens the SQL script a dump restores, which archive
+// formats are turned into by pg_restore
+func (bt *Tool) openDumpScript(path string) (io.ReadCloser, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup: %w", err)
+	}
+	if info.IsDir() {
+		return newProcessReader(nil, "pg_restore", "--format=directory", "--file=-", path)
+	}
+
+	reader, err := bt.openBackup(path)
+	if err != nil {
+		return nil, err
+	}
+	format := formatFromExtension(stripArtifactExtensions(path))
+	if format == "plain" {
+		return reader, nil
+	}
+	restore, err := newProcessReader(reader, "pg_restore", "--format="+format, "--file=-")
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	chain := newReadChain(reader)
+	chain.wrap(restore)
+	return chain, nil
+}
+
+// parseDumpScript reads a pg_dump SQL script. Objects are delimited by the
+// "-- Name: ...; Type: ...; Schema: ...; Owner: ..." comments pg_dump
+// writes before each, and table data by COPY blocks.
+func parseDumpScript(r io.Reader) (*dumpSummary, error) {
+	summary := &dumpSummary{objects: make(map[string][]string), tables: make(map[string]*tableData)}
+	reader := bufio.NewReaderSize(r, 64*1024)
+
+	var object string // collecting the DDL of this object
+	var table *tableData
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Lines longer than the buffer are read whole
+			long := append([]byte(nil), line...)
+			var rest []byte
+			rest, err = reader.ReadBytes('\n')
+			line = append(long, rest...)
+		}
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		switch {
+		case table != nil && string(line) == copyTerminator:
+			table = nil
+		case table != nil:
+			table.rows++
+			table.bytes += int64(len(line))
+		case strings.HasPrefix(string(line), "COPY "):
+			name := copyTable(string(line))
+			if summary.tables[name] == nil {
+				summary.tables[name] = &tableData{}
+			}
+			table = summary.tables[name]
+		case strings.HasPrefix(string(line), "-- Name: "):
+			object = objectKey(strings.TrimPrefix(strings.TrimSpace(string(line)), "-- Name: "))
+		case strings.HasPrefix(string(line), "-- Data for Name: "):
+			object = ""
+		case object != "":
+			if text := strings.TrimSpace(string(line)); text != "" && !strings.HasPrefix(text, "--") {
+				summary.objects[object] = append(summary.objects[object], text)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return summary, nil
+}
+
+// objectKey names the object of a pg_dump header such as
+// "users; Type: TABLE; Schema: public; Owner: postgres" as "TABLE public.users"
+func objectKey(header string) string {
+	name, rest, _ := strings.Cut(header, "; Type: ")
+	kind, rest, _ := strings.Cut(rest, "; Schema: ")
+	schema, _, _ := strings.Cut(rest, "; Owner: ")
+	if schema != "-" && schema != "" {
+		name = schema + "." + name
+	}
+	return kind + " " + name
+}
+
+// copyTable returns the qualified table name of a COPY statement
+func copyTable(statement string) string {
+	spec := strings.TrimSuffix(strings.TrimPrefix(statement, "COPY "), " FROM stdin;\n")
+	if i := strings.Index(spec, " ("); i >= 0 {
+		spec = spec[:i]
+	}
+	return strings.Join(splitIdentifiers(spec, "."), ".")
+}
+
+// printSchemaDiff prints the objects only in a (-), only in b (+), and in
+// both with different DDL (~) along with the lines that differ
+func printSchemaDiff(w io.Writer, a, b *dumpSummary) {
+	fmt.Fprintln(w, "Schema:")
+	var names []string
+	for name := range a.objects {
+		names = append(names, name)
+	}
+	for name := range b.objects {
+		if _, ok := a.objects[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	changed := 0
+	for _, name := range names {
+		ddlA, inA := a.objects[name]
+		ddlB, inB := b.objects[name]
+		switch {
+		case !inB:
+			fmt.Fprintf(w, "  - %s\n", name)
+		case !inA:
+			fmt.Fprintf(w, "  + %s\n", name)
+		case !slices.Equal(ddlA, ddlB):
+			fmt.Fprintf(w, "  ~ %s\n", name)
+			for _, line := range ddlA {
+				if !slices.Contains(ddlB, line) {
+					fmt.Fprintf(w, "      - %s\n", line)
+				}
+			}
+			for _, line := range ddlB {
+				if !slices.Contains(ddlA, line) {
+					fmt.Fprintf(w, "      + %s\n", line)
+				}
+			}
+		default:
+			continue
+		}
+		changed++
+	}
+	if changed == 0 {
+		fmt.Fprintf(w, "  no changes in %d objects\n", len(names))
+	}
+}
+
+// printDataDiff prints the tables whose row count or size changed, with
+// totals for every table
+func printDataDiff(w io.Writer, a, b *dumpSummary) error {
+	fmt.Fprintln(w, "Table data:")
+	var names []string
+	for name := range a.tables {
+		names = append(names, name)
+	}
+	for name := range b.tables {
+		if _, ok := a.tables[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  TABLE\tROWS A\tROWS B\tCHANGE\tSIZE A\tSIZE B\tCHANGE")
+	var totalA, totalB tableData
+	unchanged := 0
+	for _, name := range names {
+		dataA, dataB := a.tables[name], b.tables[name]
+		if dataA != nil {
+			totalA.rows += dataA.rows
+			totalA.bytes += dataA.bytes
+		}
+		if dataB != nil {
+			totalB.rows += dataB.rows
+			totalB.bytes += dataB.bytes
+		}
+		if dataA != nil && dataB != nil && *dataA == *dataB {
+			unchanged++
+			continue
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\t%s\t%s\n", name,
+			tableRows(dataA), tableRows(dataB), rowChange(dataA, dataB),
+			tableSize(dataA), tableSize(dataB), sizeChange(dataA, dataB))
+	}
+	fmt.Fprintf(tw, "  total\t%d\t%d\t%s\t%s\t%s\t%s\n", totalA.rows, totalB.rows, rowChange(&totalA, &totalB),
+		formatBytes(totalA.bytes), formatBytes(totalB.bytes), sizeChange(&totalA, &totalB))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if unchanged > 0 {
+		fmt.Fprintf(w, "  %d tables unchanged\n", unchanged)
+	}
+	return nil
+}
+
+func tableRows(t *tableData) string {
+	if t == nil {
+		return "-"
+	}
+	return fmt.Sprint(t.rows)
+}
+
+func tableSize(t *tableData) string {
+	if t == nil {
+		return "-"
+	}
+	return formatBytes(t.bytes)
+}
+
+// rowChange describes the change in row count from a to b
+func rowChange(a, b *tableData) string {
+	switch {
+	case a == nil:
+		return "new"
+	case b == nil:
+		return "dropped"
+	}
+	return signedChange(fmt.Sprintf("%+d", b.rows-a.rows), a.rows, b.rows)
+}
+
+// sizeChange describes the change in data size from a to b
+func sizeChange(a, b *tableData) string {
+	if a == nil || b == nil {
+		return ""
+	}
+	if b.bytes < a.bytes {
+		return signedChange("-"+formatBytes(a.bytes-b.bytes), a.bytes, b.bytes)
+	}
+	return signedChange("+"+formatBytes(b.bytes-a.bytes), a.bytes, b.bytes)
+}
+
+// signedChange adds the relative change from a to b to delta
+func signedChange(delta string, a, b int64) string {
+	if a == 0 {
+		return delta
+	}
+	return fmt.Sprintf("%s (%+.1f%%)", delta, float64(b-a)*100/float64(a))
+}
@@ -0,0 +1,73 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+
+	"beackup/config"
+)
+
+// driver runs the engine-specific parts of backing up and restoring a
+// database: building the dump and restore commands, reading versions and
+// checking finished dumps. Scheduling, compression, encryption, retention
+// and uploads are shared by all drivers.
+type driver interface {
+	// validate checks the database's engine-specific settings and fills in
+	// defaults such as the port and format
+	validate(db *config.Database, defaultFormat string) error
+	// tool returns the name of the dump program, used in logs and errors
+	tool(db *config.Database) string
+	// extension returns the file suffix of a dump before any compression
+	// and encryption suffixes
+	extension(db *config.Database) string
+	// streams reports whether the dump can be written to standard output
+	// and piped through compression and encryption
+	streams(db *config.Database) bool
+	// compresses reports whether the dump program compresses the database's
+	// format itself
+	compresses(db *config.Database) bool
+	// programs returns the client programs backups and restores of the
+	// database run, starting with the dump program
+	programs(db *config.Database) []string
+	// ping connects to the database and returns the server version, which
+	// is empty if it cannot be queried
+	ping(ctx context.Context, db *config.Database) (string, error)
+	// size returns the size of the database on the server, an upper bound
+	// for an uncompressed dump, or 0 if it cannot be determined
+	size(ctx context.Context, db *config.Database) (int64, error)
+	// versions returns the server and dump program versions recorded in the
+	// manifest, logging rather than failing when they cannot be determined
+	versions(ctx context.Context, logger *slog.Logger, db *config.Database) (server, tool string)
+	// dumpCommand builds the dump command, writing to standard output if
+	// outputPath is empty. cleanup must be called once the command exited.
+	dumpCommand(ctx context.Context, db *config.Database, outputPath string, compression config.Compression) (cmd *exec.Cmd, cleanup func(), err error)
+	// restoreCommand builds the command loading a dump of the given format
+	// from standard input. cleanup must be called once the command exited.
+	restoreCommand(ctx context.Context, db *config.Database, format string) (cmd *exec.Cmd, cleanup func(), err error)
+	// verify checks a dump of db in the given format read from r
+	verify(ctx context.Context, db *config.Database, r io.Reader, format string) error
+	// fatalPatterns returns messages in the dump program's output that mean
+	// the dump is incomplete even though the program exited successfully
+	fatalPatterns() []string
+}
+
+// drivers maps each database type to its driver
+var drivers = map[string]driver{
+	config.TypePostgres: postgresDriver{},
+	config.TypeMySQL:    mysqlDriver{},
+	config.TypeMongoDB:  mongoDriver{},
+}
+
+// driverFor returns the driver for a database type
+func driverFor(dbType string) (driver, error) {
+	d, ok := drivers[dbType]
+	if !ok {
+		return nil, fmt.Errorf("unknown database type %q", dbType)
+	}
+	return d, nil
+}
+
+func noCleanup() {}
@@ -0,0 +1,283 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"beackup/config"
+)
+
+// redacted replaces secrets in printed commands
+const redacted = "******"
+
+// DryRun prints what the next backup of every database would do: the local
+// pre-flight checks, the dump command, the files created, the uploads and
+// the backups retention would delete. Nothing is executed or written. It
+// returns an error if a check failed.
+func (bt *Tool) DryRun(ctx context.Context, w io.Writer) error {
+	now := time.Now()
+	failed := 0
+
+	for i, job := range bt.jobs {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "Database %s (%s, format %s, every %s)\n", job.db.ID, job.db.Type, job.db.Format, job.db.Frequency)
+		if reopen, reason := job.db.Schedule.Hold(now); reason != "" {
+			if job.db.Schedule.Missed == config.MissedSkip || reopen.IsZero() {
+				fmt.Fprintf(w, "  Schedule: a run due now would be skipped, %s\n", reason)
+			} else {
+				fmt.Fprintf(w, "  Schedule: a run due now would be delayed until %s, %s\n", reopen.Format("2006-01-02 15:04"), reason)
+			}
+		}
+
+		target, err := bt.dumpTarget(job, now)
+		if err != nil {
+			fmt.Fprintf(w, "  FAILED: %v\n", err)
+			failed++
+			continue
+		}
+		outputPath := filepath.Join(job.outputDir, target.filename)
+
+		// Only checks that leave the database alone; see "beackup check"
+		fmt.Fprintln(w, "  Checks:")
+		passed := true
+		db := *job.db
+		for _, result := range bt.localChecks(ctx, job, &db) {
+			if result.err != nil {
+				fmt.Fprintf(w, "    FAILED: %s: %v\n", result.name, result.err)
+				passed = false
+				failed++
+			}
+		}
+		if passed {
+			fmt.Fprintln(w, "    all passed")
+		}
+
+		fmt.Fprintln(w, "  Command:")
+		cmd, cleanup, err := job.driver.dumpCommand(ctx, &db, target.commandOutput(outputPath), bt.config.Backup.Compression)
+		if err != nil {
+			fmt.Fprintf(w, "    failed to build: %v\n", err)
+		} else {
+			cleanup()
+			applyPriority(bt.config.Backup.Priority, cmd)
+			fmt.Fprintf(w, "    %s\n", redactedCommand(cmd, &db))
+			if job.db.Format == copyFormat {
+				fmt.Fprintf(w, "    tables exported with COPY in %s format by %d workers\n", job.db.Copy.Format, max(job.db.Jobs, 1))
+			}
+			if stages := bt.pipelineStages(target); stages != "" {
+				fmt.Fprintf(w, "    output piped through %s\n", stages)
+			}
+			if target.maskedCopy != "" {
+				fmt.Fprintf(w, "    output copied through column masking into %s\n", target.maskedCopy)
+			}
+		}
+
+		created := []string{outputPath, manifestPath(outputPath), metaPath(outputPath)}
+		if target.uploaded {
+			created = created[1:]
+		}
+		if target.maskedCopy != "" {
+			created = append(created, filepath.Join(job.outputDir, target.maskedCopy))
+		}
+		if bt.config.Backup.IncludeGlobals && bt.config.Backup.GlobalsFrequency == 0 && job.db.Type == config.TypePostgres {
+			if name, err := bt.globalsFilename(job, now); err == nil {
+				globals := filepath.Join(job.outputDir, name)
+				created = append(created, globals, manifestPath(globals), metaPath(globals))
+			}
+		}
+		if signing := bt.config.Signing; signing.Enabled() {
+			// Directories are covered by their signed manifest instead
+			directory := job.db.Format == "directory" || job.db.Format == copyFormat || job.db.Format == baseBackupFormat
+			for _, file := range created {
+				artifact := strings.TrimSuffix(file, manifestSuffix)
+				if artifact == file {
+					continue
+				}
+				created = append(created, signaturePath(file))
+				if signing.Artifacts && !target.uploaded && !(artifact == outputPath && directory) {
+					created = append(created, signaturePath(artifact))
+				}
+			}
+		}
+		fmt.Fprintln(w, "  Creates:")
+		for _, file := range created {
+			fmt.Fprintf(w, "    %s\n", file)
+		}
+		fmt.Fprintf(w, "    %s (updated)\n", filepath.Join(bt.config.Backup.OutputDir, catalogFile))
+
+		fmt.Fprintln(w, "  Uploads:")
+		if bt.storage == nil {
+			fmt.Fprintln(w, "    none, no storage configured")
+		} else {
+			if target.uploaded {
+				fmt.Fprintf(w, "    %s: %s (streamed, no local copy)\n", bt.config.Storage.Type, path.Join(job.db.ID, target.filename))
+			}
+			for _, file := range created {
+				if strings.HasSuffix(file, manifestSuffix) || strings.HasSuffix(file, metaSuffix) || strings.HasSuffix(file, signatureSuffix) {
+					continue
+				}
+				key := path.Join(job.db.ID, filepath.Base(file))
+				switch {
+				case file == outputPath && bt.config.Storage.Dedup.Enabled:
+					key += snapshotSuffix + " and new chunks under " + dedupChunksDir + "/"
+				case job.db.Format == "directory" && file == outputPath:
+					key += "/ (every file)"
+				}
+				fmt.Fprintf(w, "    %s: %s\n", bt.config.Storage.Type, key)
+			}
+			if bt.config.Storage.DeleteLocal {
+				fmt.Fprintln(w, "    local copies are deleted after uploading")
+			}
+		}
+
+		archive, expired, err := bt.plannedExpiries(job, target.filename, now)
+		if job.db.Retention.Archives() {
+			fmt.Fprintln(w, "  Retention archives:")
+			switch {
+			case err != nil:
+				fmt.Fprintf(w, "    unknown: %v\n", err)
+			case len(archive) == 0:
+				fmt.Fprintln(w, "    nothing")
+			}
+			for _, m := range archive {
+				fmt.Fprintf(w, "    %s (%s) to %s\n", m.File, m.CreatedAt.Local().Format("2006-01-02 15:04:05"), bt.config.Storage.Archive.Type)
+			}
+		}
+		fmt.Fprintln(w, "  Retention deletes:")
+		switch {
+		case err != nil:
+			fmt.Fprintf(w, "    unknown: %v\n", err)
+		case len(expired) == 0:
+			fmt.Fprintln(w, "    nothing")
+		}
+		for _, m := range expired {
+			remote := ""
+			switch {
+			case m.Archived:
+				remote = " from archive storage"
+			case m.Uploaded && bt.storage != nil:
+				remote = " and its remote copy"
+			}
+			fmt.Fprintf(w, "    %s (%s)%s\n", m.File, m.CreatedAt.Local().Format("2006-01-02 15:04:05"), remote)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// pipelineStages describes the stages a streamed dump is written through
+func (bt *Tool) pipelineStages(target dumpTarget) string {
+	var stages []string
+	if target.masked {
+		stages = append(stages, "column masking")
+	}
+	if bt.limiter != nil {
+		stages = append(stages, fmt.Sprintf("a %s/s rate limit", formatBytes(bt.limiter.rate)))
+	}
+	if target.pipeCompression {
+		stages = append(stages, bt.config.Backup.Compression.Algorithm+" compression")
+	}
+	if bt.config.Encryption.Enabled() {
+		stages = append(stages, bt.config.Encryption.Type+" encryption")
+	}
+	return strings.Join(stages, ", ")
+}
+
+// plannedExpiries returns the existing backups retention would archive and
+// delete once the backup named filename, started at now, has been added
+func (bt *Tool) plannedExpiries(job *databaseJob, filename string, now time.Time) (archive, expired []*backupManifest, err error) {
+	var manifests []*backupManifest
+	if _, err := os.Stat(job.outputDir); err == nil {
+		if manifests, err = loadManifests(job.outputDir); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	planned := &backupManifest{File: filename, Format: job.db.Format, CreatedAt: now}
+	manifests = append([]*backupManifest{planned}, manifests...)
+	expired = expiredBackups(job.db.Retention, manifests, now)
+	expired, _ = unlockedBackups(expired, now)
+	if job.db.Retention.Archives() {
+		archive, expired = archivedBackups(job.db.Retention, expired, manifests, now)
+	}
+	return withoutManifest(archive, planned), withoutManifest(expired, planned), nil
+}
+
+// withoutManifest returns manifests without m
+func withoutManifest(manifests []*backupManifest, m *backupManifest) []*backupManifest {
+	var rest []*backupManifest
+	for _, other := range manifests {
+		if other != m {
+			rest = append(rest, other)
+		}
+	}
+	return rest
+}
+
+// redactedCommand renders cmd with the environment it adds, hiding db's
+// passwords wherever they appear and the values of variables named like
+// passwords
+func redactedCommand(cmd *exec.Cmd, db *config.Database) string {
+	secrets := commandSecrets(db)
+	hide := func(s string) string {
+		for _, secret := range secrets {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+		return s
+	}
+
+	var parts []string
+	for _, variable := range addedEnv(cmd.Env) {
+		name, _, _ := strings.Cut(variable, "=")
+		if strings.Contains(name, "PASSWORD") || strings.HasSuffix(name, "PWD") {
+			variable = name + "=" + redacted
+		}
+		parts = append(parts, hide(variable))
+	}
+	for _, arg := range cmd.Args {
+		parts = append(parts, hide(arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+// commandSecrets returns the secrets of db that its commands may carry:
+// its resolved password and the passwords of its connection URLs, both
+// decoded and as written in the URL
+func commandSecrets(db *config.Database) []string {
+	var secrets []string
+	add := func(secret string) {
+		if secret != "" && !slices.Contains(secrets, secret) {
+			secrets = append(secrets, secret)
+		}
+	}
+	add(db.Password)
+	for _, raw := range []string{db.DSN, db.MongoDB.URI} {
+		u, err := url.Parse(raw)
+		if err != nil || u.User == nil {
+			continue
+		}
+		if password, ok := u.User.Password(); ok {
+			add(password)
+			// The userinfo is the part of the authority before its last @
+			_, rest, _ := strings.Cut(raw, "://")
+			authority, _, _ := strings.Cut(rest, "/")
+			userinfo := authority[:max(strings.LastIndex(authority, "@"), 0)]
+			_, written, _ := strings.Cut(userinfo, ":")
+			add(written)
+		}
+	}
+	return secrets
+}
@@ -0,0 +1,156 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"beackup/config"
+)
+
+// encryptionFromExtension returns the encryption type implied by path's suffix
+func encryptionFromExtension(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".age"):
+		return "age"
+	case strings.HasSuffix(path, ".gpg"):
+		return "gpg"
+	default:
+		return ""
+	}
+}
+
+// newEncryptor wraps w so that everything written to the returned writer is
+// encrypted to the configured recipients
+func newEncryptor(w io.Writer, e config.Encryption) (io.WriteCloser, error) {
+	switch e.Type {
+	case "age":
+		args := []string{"--encrypt"}
+		recipients, err := ageRecipients(e)
+		if err != nil {
+			return nil, err
+		}
+		for _, recipient := range recipients {
+			args = append(args, "--recipient", recipient)
+		}
+		return newProcessFilter(w, "age", args...)
+
+	case "gpg":
+		keyDir, err := os.MkdirTemp("", "beackup-gpg-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create key directory: %w", err)
+		}
+
+		args := []string{"--batch", "--yes", "--no-tty", "--homedir", keyDir, "--trust-model", "always", "--encrypt"}
+		for i, key := range e.PublicKeys {
+			path, err := writeKeyFile(keyDir, fmt.Sprintf("public-%d.asc", i), key)
+			if err != nil {
+				os.RemoveAll(keyDir)
+				return nil, err
+			}
+			args = append(args, "--recipient-file", path)
+		}
+
+		filter, err := newProcessFilter(w, "gpg", append(args, "--output", "-")...)
+		if err != nil {
+			os.RemoveAll(keyDir)
+			return nil, err
+		}
+		filter.cleanup = func() { os.RemoveAll(keyDir) }
+		return filter, nil
+
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// newDecryptor wraps r so that reads return data decrypted with the
+// configured private key. encType is the encryption the data was written with.
+func newDecryptor(r io.Reader, encType string, e config.Encryption) (io.ReadCloser, error) {
+	if encType == "" {
+		return io.NopCloser(r), nil
+	}
+	if !e.PrivateKey.IsSet() {
+		return nil, fmt.Errorf("backup is %s-encrypted but no private key is configured", encType)
+	}
+
+	keyDir, err := os.MkdirTemp("", "beackup-key-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key directory: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(keyDir) }
+
+	identity, err := writeKeyFile(keyDir, "private.key", e.PrivateKey)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	var reader *processReader
+	switch encType {
+	case "age":
+		reader, err = newProcessReader(r, "age", "--decrypt", "--identity", identity)
+
+	case "gpg":
+		base := []string{"--batch", "--yes", "--no-tty", "--homedir", keyDir}
+		if output, importErr := runCommand("gpg", append(base, "--import", identity)...); importErr != nil {
+			cleanup()
+			return nil, fmt.Errorf("failed to import gpg key: %w, output: %s", importErr, output)
+		}
+
+		args := append(base, "--decrypt")
+		if e.Passphrase.IsSet() {
+			passphrase, err := writeKeyFile(keyDir, "passphrase", e.Passphrase)
+			if err != nil {
+				cleanup()
+				return nil, err
+			}
+			args = append(args, "--pinentry-mode", "loopback", "--passphrase-file", passphrase)
+		}
+		reader, err = newProcessReader(r, "gpg", args...)
+
+	default:
+		err = fmt.Errorf("unknown encryption type %q", encType)
+	}
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	reader.cleanup = cleanup
+	return reader, nil
+}
+
+// ageRecipients collects inline recipients and those loaded from key sources
+func ageRecipients(e config.Encryption) ([]string, error) {
+	recipients := append([]string(nil), e.Recipients...)
+	for _, key := range e.PublicKeys {
+		data, err := key.Load()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load age recipients: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				recipients = append(recipients, line)
+			}
+		}
+	}
+	return recipients, nil
+}
+
+// writeKeyFile copies key material into a private file inside dir so it can
+// be handed to an external tool
+func writeKeyFile(dir, name string, key config.KeySource) (string, error) {
+	data, err := key.Load()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", fmt.Errorf("failed to write key file: %w", err)
+	}
+	return path, nil
+}
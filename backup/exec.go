@@ -0,0 +1,172 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"beackup/config"
+)
+
+// execPrograms maps each container connection to the program that runs
+// commands in the container
+var execPrograms = map[string]string{
+	config.ConnectionDocker:     "docker",
+	config.ConnectionKubernetes: "kubectl",
+}
+
+// remoteCommand rewrites cmd, built to run a database client program on
+// this host, to run the program where db's client programs run: in its
+// container, on its SSH host, or in its container on its SSH host.
+// Commands of other databases are left alone. The standard input of a
+// rewritten command may carry secrets ahead of the program's own input, so
+// it is set with setStdin.
+func remoteCommand(db *config.Database, cmd *exec.Cmd) {
+	if !db.RemotePrograms() {
+		return
+	}
+	// The mysql clients cannot read the option file holding the password
+	// on this host, so it is passed in the environment instead
+	if db.Type == config.TypeMySQL && db.Password != "" && db.MySQL.OptionsFile == "" {
+		cmd.Env = append(cmd.Environ(), "MYSQL_PWD="+db.Password)
+	}
+
+	// Variables read from standard input are sent a line each
+	var err error
+	overStdin := db.Exec.InContainer() && db.Exec.Connection == config.ConnectionKubernetes || db.SSH.Enabled() && db.SSH.Mode == config.SSHExec
+	for _, variable := range addedEnv(cmd.Env) {
+		if name, value, _ := strings.Cut(variable, "="); overStdin && strings.ContainsAny(value, "\r\n") {
+			err = fmt.Errorf("%s contains a line break and cannot be passed to a remote program", name)
+		}
+	}
+
+	if db.Exec.InContainer() {
+		inContainer(db, cmd)
+	}
+	if db.SSH.Enabled() && db.SSH.Mode == config.SSHExec {
+		overSSH(db.SSH, cmd)
+	}
+	if err != nil {
+		cmd.Err = err
+	}
+}
+
+// inContainer rewrites cmd to run in db's container. docker exec and
+// kubectl exec stream its standard input and output, so dumps and restores
+// work as they do locally. The variables cmd adds to the environment, such
+// as PGPASSWORD, are passed on to the program without showing up in the
+// process list.
+func inContainer(db *config.Database, cmd *exec.Cmd) {
+	program := execPrograms[db.Exec.Connection]
+	args := []string{program, "exec", "-i"}
+	switch db.Exec.Connection {
+	case config.ConnectionDocker:
+		// Without a value, docker passes on the variable's value from its
+		// own environment
+		for _, variable := range addedEnv(cmd.Env) {
+			name, _, _ := strings.Cut(variable, "=")
+			args = append(args, "--env", name)
+		}
+		args = append(args, db.Exec.Container)
+	case config.ConnectionKubernetes:
+		if db.Exec.Namespace != "" {
+			args = append(args, "--namespace", db.Exec.Namespace)
+		}
+		args = append(args, db.Exec.Pod)
+		if db.Exec.Container != "" {
+			args = append(args, "--container", db.Exec.Container)
+		}
+		args = append(args, "--")
+		// kubectl has no way to set variables, so a shell in the container
+		// reads them from standard input
+		if script := envOverStdin(cmd); script != "" {
+			args = append(args, "sh", "-c", script+`exec "$@"`, "sh")
+		}
+	}
+
+	// The program is looked up in the container rather than on this host
+	path, err := exec.LookPath(program)
+	cmd.Path = path
+	cmd.Err = err
+	cmd.Args = append(args, cmd.Args...)
+}
+
+// secretInput is the standard input of a remote command, which sends the
+// variables read by the script of envOverStdin ahead of the program's own
+// input
+type secretInput struct {
+	secrets io.Reader
+	input   io.Reader // nil for none
+}
+
+func (s *secretInput) Read(p []byte) (int, error) {
+	if s.secrets != nil {
+		n, err := s.secrets.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		s.secrets = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+	if s.input == nil {
+		return 0, io.EOF
+	}
+	return s.input.Read(p)
+}
+
+// setStdin sets the standard input of cmd to r, after any secrets
+// remoteCommand sends ahead of it
+func setStdin(cmd *exec.Cmd, r io.Reader) {
+	if in, ok := cmd.Stdin.(*secretInput); ok {
+		in.input = r
+		return
+	}
+	cmd.Stdin = r
+}
+
+// envOverStdin moves the variables cmd adds to the environment to the front
+// of its standard input, one line each, and returns the shell commands that
+// read and export them, to be followed by the command running the program.
+// Passed on the command line instead, secrets would be visible in the
+// process list of both hosts. It returns an empty script if cmd adds no
+// variables.
+func envOverStdin(cmd *exec.Cmd) string {
+	added := addedEnv(cmd.Env)
+	if len(added) == 0 {
+		return ""
+	}
+
+	var script, secrets strings.Builder
+	var names []string
+	for _, variable := range added {
+		name, value, _ := strings.Cut(variable, "=")
+		fmt.Fprintf(&script, "IFS= read -r %s && ", name)
+		secrets.WriteString(value + "\n")
+		names = append(names, name)
+	}
+	script.WriteString("export " + strings.Join(names, " ") + " && ")
+
+	cmd.Env = slices.DeleteFunc(cmd.Env, func(variable string) bool {
+		return slices.Contains(added, variable)
+	})
+	cmd.Stdin = &secretInput{secrets: strings.NewReader(secrets.String()), input: cmd.Stdin}
+	return script.String()
+}
+
+// addedEnv returns the variables of env that are not inherited from this
+// process's environment
+func addedEnv(env []string) []string {
+	inherited := os.Environ()
+	var added []string
+	for _, variable := range env {
+		if !slices.Contains(inherited, variable) {
+			added = append(added, variable)
+		}
+	}
+	return added
+}
@@ -0,0 +1,83 @@
+package backup
+
+import (
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+
+	"beackup/config"
+)
+
+// secretCommand returns a command that prints PGPASSWORD and then copies
+// its standard input, run with the password set as pgEnv sets it
+func secretCommand() *exec.Cmd {
+	cmd := exec.Command("sh", "-c", `printf '%s|' "$PGPASSWORD"; cat`)
+	cmd.Env = append(os.Environ(), "PGPASSWORD=hunter2secret")
+	return cmd
+}
+
+// checkNoSecret fails if the password is on cmd's command line
+func checkNoSecret(t *testing.T, cmd *exec.Cmd) {
+	t.Helper()
+	for _, arg := range cmd.Args {
+		if strings.Contains(arg, "hunter2secret") {
+			t.Errorf("password on the command line: %q", cmd.Args)
+		}
+	}
+}
+
+func TestInContainerDocker(t *testing.T) {
+	db := &config.Database{Exec: config.ExecTarget{Connection: config.ConnectionDocker, Container: "pg"}}
+	cmd := secretCommand()
+	remoteCommand(db, cmd)
+
+	checkNoSecret(t, cmd)
+	want := []string{"docker", "exec", "-i", "--env", "PGPASSWORD", "pg", "sh", "-c"}
+	if !slices.Equal(cmd.Args[:len(want)], want) {
+		t.Errorf("args = %q, want them to start with %q", cmd.Args, want)
+	}
+	// docker takes the value from its own environment
+	if !slices.Contains(cmd.Env, "PGPASSWORD=hunter2secret") {
+		t.Error("PGPASSWORD was removed from the environment of docker")
+	}
+}
+
+func TestInContainerKubernetes(t *testing.T) {
+	db := &config.Database{Exec: config.ExecTarget{Connection: config.ConnectionKubernetes, Namespace: "db", Pod: "pg-0"}}
+	cmd := secretCommand()
+	remoteCommand(db, cmd)
+	setStdin(cmd, strings.NewReader("dump data"))
+
+	checkNoSecret(t, cmd)
+	if slices.Contains(cmd.Env, "PGPASSWORD=hunter2secret") {
+		t.Error("PGPASSWORD left in the environment of kubectl")
+	}
+	want := []string{"kubectl", "exec", "-i", "--namespace", "db", "pg-0", "--"}
+	if !slices.Equal(cmd.Args[:len(want)], want) {
+		t.Fatalf("args = %q, want them to start with %q", cmd.Args, want)
+	}
+
+	// Run what kubectl would run in the pod
+	inPod := cmd.Args[len(want):]
+	run := exec.Command(inPod[0], inPod[1:]...)
+	run.Stdin = cmd.Stdin
+	output, err := run.Output()
+	if err != nil {
+		t.Fatalf("command in the pod failed: %v", err)
+	}
+	if string(output) != "hunter2secret|dump data" {
+		t.Errorf("command in the pod printed %q, want the password and then the input", output)
+	}
+}
+
+func TestRemoteCommandLineBreak(t *testing.T) {
+	db := &config.Database{Exec: config.ExecTarget{Connection: config.ConnectionKubernetes, Pod: "pg-0"}}
+	cmd := secretCommand()
+	cmd.Env = append(os.Environ(), "PGPASSWORD=two\nlines")
+	remoteCommand(db, cmd)
+	if cmd.Err == nil || !strings.Contains(cmd.Err.Error(), "line break") {
+		t.Errorf("Err = %v, want a password with a line break rejected", cmd.Err)
+	}
+}
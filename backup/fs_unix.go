@@ -0,0 +1,35 @@
+//go:build !windows
+
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on file without waiting, returning
+// errLocked if another process holds it
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errLocked
+	}
+	return err
+}
+
+// dirWritable checks that the existing directory dir is writable
+func dirWritable(dir string) error {
+	return syscall.Access(dir, 2) // W_OK
+}
+
+// diskFree returns the bytes available to unprivileged users on the file
+// system of the existing directory dir
+func diskFree(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, fmt.Errorf("failed to determine free space: %w", err)
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,64 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32               = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx         = kernel32.NewProc("LockFileEx")
+	procGetDiskFreeSpaceEx = kernel32.NewProc("GetDiskFreeSpaceExW")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+// lockFile takes an exclusive lock on file without waiting, returning
+// errLocked if another process holds it. Windows locks are mandatory, so a
+// byte far past the end of the file is locked to leave its contents
+// readable.
+func lockFile(file *os.File) error {
+	overlapped := syscall.Overlapped{OffsetHigh: 0x7fffffff}
+	r, _, err := procLockFileEx.Call(file.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r != 0 {
+		return nil
+	}
+	if errors.Is(err, errorLockViolation) {
+		return errLocked
+	}
+	return err
+}
+
+// dirWritable checks that the existing directory dir is writable by
+// creating a file in it
+func dirWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".beackup-check-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// diskFree returns the bytes available to the user on the volume of the
+// existing directory dir
+func diskFree(dir string) (int64, error) {
+	path, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	r, _, err := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(path)),
+		uintptr(unsafe.Pointer(&available)), uintptr(unsafe.Pointer(&total)), uintptr(unsafe.Pointer(&free)))
+	if r == 0 {
+		return 0, fmt.Errorf("failed to determine free space: %w", err)
+	}
+	return int64(available), nil
+}
@@ -0,0 +1,161 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// globalsFormat is the manifest format of pg_dumpall --globals-only backups
+const globalsFormat = "globals"
+
+// performGlobalsBackup dumps the roles, tablespaces and their grants of the
+// database's cluster, which pg_dump leaves out, as plain SQL. The dump goes
+// through the same compression, encryption, verification and upload steps
+// as database backups.
+func (bt *Tool) performGlobalsBackup(ctx context.Context, job *databaseJob) (err error) {
+	logger := job.logger.With("format", globalsFormat)
+	logger.Info("Starting globals backup")
+	start := time.Now()
+	var outputPath string
+	var manifest *backupManifest
+	defer func() { bt.recordRun(job, globalsFormat, outputPath, start, manifest, err) }()
+
+	compression := bt.config.Backup.Compression
+	encryption := bt.config.Encryption
+
+	filename, err := bt.globalsFilename(job, start)
+	if err != nil {
+		return err
+	}
+	outputPath = filepath.Join(job.outputDir, filename)
+	if err := prepareOutput(outputPath); err != nil {
+		return err
+	}
+
+	db := *job.db
+	db.Password, err = bt.resolvePassword(ctx, job.db)
+	if err != nil {
+		return err
+	}
+	closeTunnel, err := openTunnel(ctx, &db)
+	if err != nil {
+		return err
+	}
+	defer closeTunnel()
+
+	err = bt.retry(ctx, logger, "pg_dumpall", func() error {
+		cmd := commandContext(ctx, "pg_dumpall",
+			"-h", db.Host,
+			"-p", strconv.Itoa(db.Port),
+			"-U", db.User,
+			"-l", db.Name,
+			"--globals-only",
+			"--no-password",
+		)
+		cmd.Env = pgEnv(&db)
+		remoteCommand(&db, cmd)
+		applyPriority(bt.config.Backup.Priority, cmd)
+
+		logger.Debug("Running pg_dumpall", "command", redactedCommand(cmd, &db))
+		_, err := bt.streamDump(ctx, "pg_dumpall", cmd, outputPath, compression.Enabled(), nil, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	size, err := artifactSize(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to measure backup: %w", err)
+	}
+	checksum, err := artifactChecksum(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to checksum backup: %w", err)
+	}
+	finished := time.Now()
+
+	var verification string
+	if bt.config.Backup.Verify {
+		err := bt.verifyBackup(ctx, job, outputPath)
+		switch {
+		case errors.Is(err, errVerifySkipped):
+			logger.Warn("Backup not verified", "error", err)
+			verification = verifySkipped
+		case err != nil:
+			return fmt.Errorf("verification failed: %w", err)
+		default:
+			verification = verifyPassed
+		}
+	}
+
+	manifest = &backupManifest{
+		Database:     job.db.ID,
+		DatabaseName: job.db.Name,
+		File:         filename,
+		Format:       globalsFormat,
+		RunID:        job.currentRunID(),
+		CreatedAt:    start,
+		FinishedAt:   finished,
+		Size:         size,
+		SHA256:       checksum,
+		Verification: verification,
+	}
+	if compression.Enabled() {
+		manifest.Compression = compression.Algorithm
+	}
+	if encryption.Enabled() {
+		manifest.Encryption = encryption.Type
+	}
+	if err := bt.writeMeta(ctx, job, manifest); err != nil {
+		logger.Warn("Failed to record backup meta", "error", err)
+	}
+	if err := bt.writeManifest(job.outputDir, manifest); err != nil {
+		return err
+	}
+
+	if bt.storage != nil {
+		if err := bt.uploadBackup(ctx, job, outputPath, manifest.SHA256, nil); err != nil {
+			return fmt.Errorf("upload failed: %w", err)
+		}
+		manifest.Uploaded = true
+		if err := bt.writeManifest(job.outputDir, manifest); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Globals backup completed successfully", "file", outputPath, "size", size, "duration", time.Since(start))
+	return nil
+}
+
+// globalsFilename names the globals backup of job started at t
+func (bt *Tool) globalsFilename(job *databaseJob, t time.Time) (string, error) {
+	name, err := bt.config.Backup.Naming.Name(job.db, globalsFormat, t)
+	if err != nil {
+		return "", err
+	}
+	return name + "_globals.sql" + bt.config.Backup.Compression.Extension() + bt.config.Encryption.Extension(), nil
+}
+
+// runGlobalsBackup performs a globals backup on its own schedule, followed
+// by the retention and catalog updates a database backup would do
+func (bt *Tool) runGlobalsBackup(ctx context.Context, job *databaseJob) {
+	ctx, run := bt.startRun(ctx, job, "globals backup")
+	err := bt.performGlobalsBackup(ctx, job)
+	defer bt.endRun(job, run, err)
+	if err != nil {
+		job.logger.Error("Globals backup failed", "error", err)
+		bt.notify(job, notification{Event: eventFailure, Error: "globals backup failed: " + err.Error()})
+		return
+	}
+
+	if err := bt.cleanupOldBackups(ctx, job); err != nil {
+		job.logger.Warn("Failed to cleanup old backups", "error", err)
+	}
+	if err := bt.updateCatalog(); err != nil {
+		job.logger.Warn("Failed to update catalog", "error", err)
+	}
+}
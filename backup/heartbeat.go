@@ -0,0 +1,62 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Heartbeat pings
+const (
+	pingSuccess = ""
+	pingStart   = "/start"
+	pingFail    = "/fail"
+)
+
+// heartbeat pings job's heartbeat URL with kind appended to its path,
+// sending message as the body, if the database has a heartbeat and wants
+// that kind of ping. Failures are logged: a missed ping is what the
+// service alerts on.
+func (bt *Tool) heartbeat(job *databaseJob, kind, message string) {
+	hb := job.db.Heartbeat
+	if hb.URL == "" || kind == pingStart && !hb.Start || kind == pingFail && !hb.Fail {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+	defer cancel()
+	if err := ping(ctx, hb.URL, kind, message); err != nil {
+		job.logger.Warn("Failed to send heartbeat", "ping", strings.TrimPrefix(kind, "/"), "error", err)
+	}
+}
+
+// ping posts message to rawURL with suffix appended to its path, keeping
+// any query string
+func ping(ctx context.Context, rawURL, suffix, message string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse heartbeat url: %w", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + suffix
+	if u.RawPath != "" {
+		u.RawPath = strings.TrimSuffix(u.RawPath, "/") + suffix
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(message))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// hookEnv describes the backup a hook runs for
+type hookEnv struct {
+	file   string
+	status string // running, success or failure
+	size   int64
+	err    error
+}
+
+// runHooks runs commands one after another with sh -c, stopping at the
+// first failure
+func (bt *Tool) runHooks(ctx context.Context, job *databaseJob, name string, commands []string, env hookEnv) error {
+	for _, command := range commands {
+		hookCtx, cancel := context.WithTimeout(ctx, job.db.Hooks.Timeout)
+		cmd := commandContext(hookCtx, "sh", "-c", command)
+		cmd.Env = append(os.Environ(),
+			"BEACKUP_HOOK="+name,
+			"BEACKUP_DB="+job.db.ID,
+			"BEACKUP_DB_NAME="+job.db.Name,
+			"BEACKUP_FILE="+env.file,
+			"BEACKUP_STATUS="+env.status,
+			fmt.Sprintf("BEACKUP_SIZE=%d", env.size),
+			"BEACKUP_RUN_ID="+job.currentRunID(),
+		)
+		if env.err != nil {
+			cmd.Env = append(cmd.Env, "BEACKUP_ERROR="+env.err.Error())
+		}
+
+		job.logger.Debug("Running hook", "hook", name, "command", command)
+		output, err := cmd.CombinedOutput()
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%s hook %q failed: %w, output: %s", name, command, err, strings.TrimSpace(string(output)))
+		}
+		if len(output) > 0 {
+			job.logger.Debug("Hook output", "hook", name, "output", strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
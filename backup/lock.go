@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"beackup/config"
+)
+
+// lockFileName is the lock file in each database's output directory
+const lockFileName = ".beackup.lock"
+
+// lockPollInterval is how often a queued backup retries a lock held by
+// another process
+const lockPollInterval = 5 * time.Second
+
+// errLocked is returned by lockFile if another process holds the lock
+var errLocked = errors.New("locked by another process")
+
+// errOverlapSkipped is returned for backups dropped by the skip policy
+var errOverlapSkipped = errors.New("backup skipped")
+
+// databaseLock is an exclusive lock on a database's output directory, held
+// while backing the database up. It keeps several beackup processes sharing
+// the directory from backing up the same database at once. The operating
+// system releases it if the process dies.
+type databaseLock struct {
+	file *os.File
+}
+
+// tryLock takes the lock on dir without waiting. It returns a nil lock if
+// another process holds it, along with that process's id if known.
+func tryLock(dir string) (*databaseLock, string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+	path := filepath.Join(dir, lockFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := lockFile(file); err != nil {
+		owner, _ := os.ReadFile(path)
+		file.Close()
+		if errors.Is(err, errLocked) {
+			return nil, strings.TrimSpace(string(owner)), nil
+		}
+		return nil, "", fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	// Record the owner for the processes that find the directory locked
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &databaseLock{file: file}, "", nil
+}
+
+// release gives up the lock
+func (l *databaseLock) release() {
+	l.file.Truncate(0)
+	l.file.Close()
+}
+
+// lockDatabase takes the lock on job's output directory. If another process
+// holds it, the overlap policy decides whether to wait for it, skip the
+// backup or fail it. It returns a nil lock if ctx is cancelled while waiting.
+func (bt *Tool) lockDatabase(ctx context.Context, job *databaseJob) (*databaseLock, error) {
+	waiting := false
+	for {
+		lock, owner, err := tryLock(job.outputDir)
+		if err != nil || lock != nil {
+			return lock, err
+		}
+
+		if !waiting {
+			reason := "another process is backing up the database"
+			switch owner {
+			case "":
+			case strconv.Itoa(os.Getpid()):
+				reason = "a backup started before the config was reloaded is still running"
+			default:
+				reason += " (pid " + owner + ")"
+			}
+			if err := bt.overlap(job, reason); err != nil {
+				return nil, err
+			}
+			waiting = true
+		}
+
+		select {
+		case <-time.After(lockPollInterval):
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
+
+// overlap applies the overlap policy to a backup of job that is due while
+// another one is running, returning an error unless it should be queued.
+// Failed backups are recorded and notified like any other failure.
+func (bt *Tool) overlap(job *databaseJob, reason string) error {
+	bt.metrics.observeOverlap(job.db.ID)
+
+	switch bt.config.Backup.Overlap {
+	case config.OverlapSkip:
+		job.logger.Warn("Skipping overlapping backup", "reason", reason)
+		return fmt.Errorf("%w: %s", errOverlapSkipped, reason)
+	case config.OverlapFail:
+		err := fmt.Errorf("overlapping backup: %s", reason)
+		now := time.Now()
+		job.mu.Lock()
+		job.lastRun = &runResult{StartedAt: now, FinishedAt: now, Status: "failure", Error: err.Error()}
+		job.mu.Unlock()
+		bt.metrics.observeBackup(job.db.ID, 0, 0, err)
+		bt.notify(job, notification{Event: eventFailure, Error: err.Error()})
+		return err
+	default:
+		job.logger.Warn("Queueing overlapping backup", "reason", reason)
+		return nil
+	}
+}
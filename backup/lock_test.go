@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"testing"
+
+	"beackup/config"
+)
+
+func TestTryLock(t *testing.T) {
+	dir := t.TempDir()
+	lock, owner, err := tryLock(dir)
+	if err != nil || lock == nil {
+		t.Fatalf("tryLock() = %v, %q, %v", lock, owner, err)
+	}
+
+	held, owner, err := tryLock(dir)
+	if err != nil || held != nil {
+		t.Fatalf("tryLock() of a held lock = %v, %v, want no lock", held, err)
+	}
+	if owner != strconv.Itoa(os.Getpid()) {
+		t.Errorf("owner = %q, want this process", owner)
+	}
+
+	lock.release()
+	lock, _, err = tryLock(dir)
+	if err != nil || lock == nil {
+		t.Fatalf("tryLock() after release = %v, %v", lock, err)
+	}
+	lock.release()
+}
+
+func TestLockDatabaseOverlap(t *testing.T) {
+	for _, policy := range []string{config.OverlapSkip, config.OverlapFail, config.OverlapQueue} {
+		t.Run(policy, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Backup.Overlap = policy
+			job := &databaseJob{
+				db:        &config.Database{ID: "app"},
+				outputDir: t.TempDir(),
+				logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			bt := &Tool{config: cfg, metrics: newMetrics(), jobs: []*databaseJob{job}}
+
+			held, _, err := tryLock(job.outputDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer held.release()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if policy == config.OverlapQueue {
+				// Stops the wait for the lock
+				cancel()
+			}
+			defer cancel()
+			lock, err := bt.lockDatabase(ctx, job)
+			if lock != nil {
+				lock.release()
+				t.Fatal("lockDatabase() took a held lock")
+			}
+
+			switch policy {
+			case config.OverlapSkip:
+				if !errors.Is(err, errOverlapSkipped) {
+					t.Errorf("lockDatabase() error = %v, want %v", err, errOverlapSkipped)
+				}
+			case config.OverlapFail:
+				if err == nil {
+					t.Fatal("lockDatabase() did not fail")
+				}
+				if job.lastRun == nil || job.lastRun.Status != "failure" {
+					t.Errorf("last run = %+v, want a failure", job.lastRun)
+				}
+			default:
+				if err != nil {
+					t.Errorf("lockDatabase() error = %v, want none once cancelled", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package backup
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"beackup/config"
+)
+
+// setupLogger configures logging based on config, writing through output
+func setupLogger(cfg *config.Config, output io.Writer) *slog.Logger {
+	// The level was validated when the config was loaded
+	level, _ := config.ParseLevel(cfg.Logging.Level)
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if cfg.Logging.Format == "json" {
+		handler = slog.NewJSONHandler(output, options)
+	} else {
+		handler = slog.NewTextHandler(output, options)
+	}
+	return slog.New(handler)
+}
+
+// openLogDestination opens where config sends the logs
+func openLogDestination(cfg *config.Config) io.Writer {
+	var output io.Writer = os.Stdout
+	if cfg.Logging.Output == "stderr" {
+		output = os.Stderr
+	}
+
+	if cfg.Logging.FilePath != "" {
+		file, err := newRotatingFile(cfg.Logging)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open log file, using %s: %v\n", cmp.Or(cfg.Logging.Output, "stdout"), err)
+		} else {
+			output = file
+		}
+	}
+	return output
+}
+
+// closeLogDestination closes a destination opened by openLogDestination,
+// leaving the standard streams open
+func closeLogDestination(dest io.Writer) {
+	if file, ok := dest.(*rotatingFile); ok {
+		file.Close()
+	}
+}
+
+// logOutput is the writer every logger of the daemon writes through. A
+// reload points it at a new destination, so that loggers still used by
+// work started under the old config never write to a closed file.
+type logOutput struct {
+	mu   sync.Mutex
+	dest io.Writer
+}
+
+func (o *logOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.dest.Write(p)
+}
+
+// set switches to dest, closing the previous destination
+func (o *logOutput) set(dest io.Writer) {
+	o.mu.Lock()
+	prev := o.dest
+	o.dest = dest
+	o.mu.Unlock()
+	if prev != dest {
+		closeLogDestination(prev)
+	}
+}
+
+// rotatingFile is a log file that is renamed aside and reopened once it
+// grows past a size limit or gets older than an age limit
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingFile(config config.Logging) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       config.FilePath,
+		maxSize:    int64(config.MaxSizeMB) << 20,
+		maxAge:     config.MaxAge,
+		maxBackups: config.MaxBackups,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the log file for appending, picking up an existing file's
+// size and age
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.size = info.Size()
+	r.opened = info.ModTime()
+	if r.size == 0 {
+		r.opened = time.Now()
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.needsRotation(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file: %v\n", err)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) needsRotation(incoming int64) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.maxSize > 0 && r.size+incoming > r.maxSize {
+		return true
+	}
+	return r.maxAge > 0 && time.Since(r.opened) > r.maxAge
+}
+
+// rotate renames the current file with a timestamp suffix, starts a new one
+// and prunes old rotated files
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+
+	rotated := r.path + "." + time.Now().Format("2006-01-02T15-04-05")
+	if err := os.Rename(r.path, rotated); err != nil {
+		// Keep appending to the current file rather than losing logs
+		if openErr := r.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+// Close closes the log file
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// prune deletes the oldest rotated files beyond maxBackups
+func (r *rotatingFile) prune() {
+	if r.maxBackups <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	// Timestamp suffixes sort chronologically
+	sort.Strings(matches)
+	for len(matches) > r.maxBackups {
+		os.Remove(matches[0])
+		matches = matches[1:]
+	}
+}
@@ -0,0 +1,238 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// manifestSuffix is appended to a backup's name to form its manifest file
+const manifestSuffix = ".manifest.json"
+
+// backupManifest records a backup created by this tool. Only backups with a
+// manifest are considered by retention, so unrelated files in the output
+// directory are never touched.
+type backupManifest struct {
+	Database         string     `json:"database"` // database id
+	DatabaseName     string     `json:"database_name"`
+	Type             string     `json:"type,omitempty"` // database type, empty for postgres
+	File             string     `json:"file"`           // artifact name within the database's directory
+	Format           string     `json:"format"`
+	Compression      string     `json:"compression,omitempty"`
+	Encryption       string     `json:"encryption,omitempty"`
+	ServerVersion    string     `json:"server_version,omitempty"`
+	PgDumpVersion    string     `json:"pg_dump_version,omitempty"`
+	ToolVersion      string     `json:"tool_version,omitempty"` // dump program version of other database types
+	PgRestoreVersion string     `json:"pg_restore_version,omitempty"`
+	BeackupVersion   string     `json:"beackup_version,omitempty"`
+	ConfigSHA256     string     `json:"config_sha256,omitempty"` // digest of the configuration recorded in the meta file
+	WALStart         string     `json:"wal_start,omitempty"`     // first WAL segment a base backup needs
+	RunID            string     `json:"run_id,omitempty"`        // run, and trace, that created the backup
+	Source           string     `json:"source,omitempty"`        // replica the backup was taken from, empty for the primary
+	CreatedAt        time.Time  `json:"created_at"`              // when the backup started
+	FinishedAt       time.Time  `json:"finished_at"`
+	Size             int64      `json:"size"`
+	SHA256           string     `json:"sha256"`
+	Verification     string     `json:"verification,omitempty"` // passed, failed or skipped
+	Uploaded         bool       `json:"uploaded"`
+	Dedup            bool       `json:"dedup,omitempty"`        // uploaded as chunks to the dedup store
+	Archived         bool       `json:"archived,omitempty"`     // moved to archive storage by retention, no other copy is left
+	LockedUntil      *time.Time `json:"locked_until,omitempty"` // until when storage.lock keeps the uploaded copy from deletion
+	Masked           bool       `json:"masked,omitempty"`       // column values were masked as the dump was written
+	MaskedCopy       string     `json:"masked_copy,omitempty"`  // masked copy written alongside the backup
+	Status           string     `json:"status,omitempty"`       // failed for incomplete backups, empty otherwise
+	Error            string     `json:"error,omitempty"`        // why the backup failed
+}
+
+// statusFailed marks the manifest of a backup that turned out incomplete.
+// Its artifact is kept for inspection but never counts as a backup.
+const statusFailed = "failed"
+
+// failed reports whether the backup was found incomplete
+func (m *backupManifest) failed() bool {
+	return m.Status == statusFailed
+}
+
+// status returns the status shown for the backup
+func (m *backupManifest) status() string {
+	if m.failed() {
+		return statusFailed
+	}
+	if m.Archived {
+		return "archived"
+	}
+	return "ok"
+}
+
+// manifestPath returns where the manifest for an artifact is stored
+func manifestPath(artifactPath string) string {
+	return artifactPath + manifestSuffix
+}
+
+// writeManifest saves m next to its artifact in dir, recording how long
+// its upload is locked, and signs it if signing is configured. The artifact
+// is signed once, with the first manifest, if signing.artifacts is set.
+func (bt *Tool) writeManifest(dir string, m *backupManifest) error {
+	if lock := bt.config.Storage.Lock; m.Uploaded && m.LockedUntil == nil && lock.Enabled() {
+		until := lock.Until(time.Now())
+		m.LockedUntil = &until
+	}
+	if err := saveManifest(dir, m); err != nil {
+		return err
+	}
+
+	signing := bt.config.Signing
+	if !signing.Enabled() {
+		return nil
+	}
+	artifact := filepath.Join(dir, m.File)
+	if err := signFile(signing, manifestPath(artifact)); err != nil {
+		return fmt.Errorf("failed to sign manifest: %w", err)
+	}
+	if !signing.Artifacts {
+		return nil
+	}
+	info, err := os.Stat(artifact)
+	if err != nil || !info.Mode().IsRegular() {
+		// Directories are covered by the checksum of the signed manifest
+		return nil
+	}
+	if _, err := os.Stat(signaturePath(artifact)); err == nil {
+		return nil
+	}
+	if err := signFile(signing, artifact); err != nil {
+		return fmt.Errorf("failed to sign backup: %w", err)
+	}
+	return nil
+}
+
+// saveManifest writes m next to its artifact in dir
+func saveManifest(dir string, m *backupManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	path := manifestPath(filepath.Join(dir, m.File))
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// loadManifests reads every manifest in dir and the subdirectories backups
+// are laid out in, newest backup first
+func loadManifests(dir string) ([]*backupManifest, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("failed to read backup directory: %w", err)
+	}
+
+	var manifests []*backupManifest
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to read backup directory: %w", err)
+		}
+		if d.IsDir() {
+			// Neither archived WAL nor directory-format backups hold manifests
+			if path == dir {
+				return nil
+			}
+			if filepath.Dir(path) == dir && (d.Name() == walDir || d.Name() == walIncomingDir) {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(manifestPath(path)); err == nil {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(d.Name(), manifestSuffix) {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read manifest %s: %w", d.Name(), err)
+		}
+		var m backupManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("failed to parse manifest %s: %w", d.Name(), err)
+		}
+		manifests = append(manifests, &m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].CreatedAt.After(manifests[j].CreatedAt)
+	})
+	return manifests, nil
+}
+
+// artifactChecksum returns the hex SHA-256 of a backup file. For a
+// directory-format backup it hashes the sorted list of file names and their
+// individual checksums.
+func artifactChecksum(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return fileChecksum(path)
+	}
+
+	tree := sha256.New()
+	err = filepath.WalkDir(path, func(file string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		sum, err := fileChecksum(file)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return err
+		}
+		addTreeEntry(tree, sum, rel)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(tree.Sum(nil)), nil
+}
+
+// addTreeEntry adds the checksum of the file rel of a directory-format
+// backup to the backup's checksum
+func addTreeEntry(tree io.Writer, sum, rel string) {
+	fmt.Fprintf(tree, "%s  %s\n", sum, filepath.ToSlash(rel))
+}
+
+// fileChecksum returns the hex SHA-256 of a file's contents
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
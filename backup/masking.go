@@ -0,0 +1,325 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"beackup/config"
+)
+
+// maskedSuffix is added to the name of a backup for its masked copy
+const maskedSuffix = ".masked"
+
+// copyTerminator ends the data of a COPY block
+const copyTerminator = "\\.\n"
+
+// masker is a dump stage that masks column values in the COPY blocks of a
+// plain-format postgres dump. A rule naming a column its table lacks, or a
+// table that is not in the dump, fails the dump when the masker is closed
+// so that a mistyped rule cannot leak the data it was meant to mask.
+type masker struct {
+	out    *bufio.Writer
+	salt   []byte
+	tables map[string]map[string]*columnMask // by table as configured
+	seen   map[string]bool                   // configured tables found in the dump
+
+	line   []byte        // partial line carried over between writes
+	inCopy bool          // within the data of a COPY block
+	masks  []*columnMask // masks of the columns of a masked COPY block
+	table  string
+	row    int
+	err    error // a rule that cannot be applied; the rest of the dump is dropped
+}
+
+// columnMask is a compiled masking rule
+type columnMask struct {
+	config.MaskRule
+	pattern *regexp.Regexp
+}
+
+// newMasker creates a masker writing the masked dump to w. The rules have
+// been checked when the config was loaded.
+func newMasker(w io.Writer, masking config.Masking) *masker {
+	m := &masker{
+		out:    bufio.NewWriterSize(w, 64*1024),
+		salt:   []byte(masking.Salt),
+		tables: make(map[string]map[string]*columnMask),
+		seen:   make(map[string]bool),
+	}
+	for table, columns := range masking.Tables {
+		m.tables[table] = make(map[string]*columnMask)
+		for column, rule := range columns {
+			mask := &columnMask{MaskRule: rule}
+			if rule.Action == config.MaskRegex {
+				mask.pattern = regexp.MustCompile(rule.Pattern)
+			}
+			m.tables[table][column] = mask
+		}
+	}
+	return m
+}
+
+func (m *masker) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			m.line = append(m.line, p...)
+			break
+		}
+		line := p[:i+1]
+		if len(m.line) > 0 {
+			line = append(m.line, line...)
+		}
+		if err := m.writeLine(line); err != nil {
+			return 0, err
+		}
+		m.line = m.line[:0]
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Close writes out the rest of the dump and reports rules that could not be
+// applied
+func (m *masker) Close() error {
+	if len(m.line) > 0 {
+		if err := m.writeLine(m.line); err != nil {
+			return err
+		}
+	}
+	if m.err != nil {
+		return m.err
+	}
+	if err := m.out.Flush(); err != nil {
+		return err
+	}
+
+	var missing []string
+	for table := range m.tables {
+		if !m.seen[table] {
+			missing = append(missing, table)
+		}
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		return fmt.Errorf("masked tables are not in the dump: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// writeLine masks one line of the dump, including its newline
+func (m *masker) writeLine(line []byte) error {
+	if m.err != nil {
+		return nil
+	}
+	switch {
+	case m.inCopy && string(line) == copyTerminator:
+		m.inCopy = false
+		m.masks = nil
+	case m.inCopy && m.masks != nil:
+		line = m.maskRow(line)
+	case !m.inCopy && bytes.HasPrefix(line, []byte("COPY ")):
+		m.startCopy(string(line))
+	}
+	if m.err != nil {
+		return nil
+	}
+	_, err := m.out.Write(line)
+	return err
+}
+
+// startCopy looks up the rules for the table of a COPY statement such as
+// COPY public.users (id, email) FROM stdin;
+func (m *masker) startCopy(statement string) {
+	m.inCopy = true
+	m.masks = nil
+	m.row = 0
+
+	spec := strings.TrimSuffix(strings.TrimPrefix(statement, "COPY "), " FROM stdin;\n")
+	var columns []string
+	if i := strings.Index(spec, " ("); i >= 0 && strings.HasSuffix(spec, ")") {
+		columns = splitIdentifiers(spec[i+2:len(spec)-1], ", ")
+		spec = spec[:i]
+	}
+	name := splitIdentifiers(spec, ".")
+
+	table := strings.Join(name, ".")
+	rules, ok := m.tables[table]
+	if !ok {
+		table = name[len(name)-1]
+		rules, ok = m.tables[table]
+	}
+	if !ok {
+		return
+	}
+	m.seen[table] = true
+	m.table = table
+
+	m.masks = make([]*columnMask, len(columns))
+	for column, mask := range rules {
+		i := slices.Index(columns, column)
+		if i < 0 {
+			m.err = fmt.Errorf("masked table %s has no column %s", table, column)
+			return
+		}
+		m.masks[i] = mask
+	}
+}
+
+// maskRow masks the values of a row in COPY text format, tab-separated
+// with \N for NULL
+func (m *masker) maskRow(line []byte) []byte {
+	m.row++
+	fields := strings.Split(strings.TrimSuffix(string(line), "\n"), "\t")
+	if len(fields) != len(m.masks) {
+		m.err = fmt.Errorf("row %d of masked table %s has %d columns, expected %d", m.row, m.table, len(fields), len(m.masks))
+		return nil
+	}
+	for i, mask := range m.masks {
+		if mask != nil {
+			fields[i] = m.maskValue(mask, fields[i])
+		}
+	}
+	return []byte(strings.Join(fields, "\t") + "\n")
+}
+
+// maskValue masks one COPY value
+func (m *masker) maskValue(mask *columnMask, value string) string {
+	if mask.Action == config.MaskNullify || value == `\N` {
+		return `\N`
+	}
+	switch mask.Action {
+	case config.MaskHash:
+		mac := hmac.New(sha256.New, m.salt)
+		mac.Write([]byte(copyUnescape(value)))
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	case config.MaskFake:
+		return copyEscape(strings.ReplaceAll(mask.Value, "{row}", strconv.Itoa(m.row)))
+	default:
+		return copyEscape(mask.pattern.ReplaceAllString(copyUnescape(value), mask.Replacement))
+	}
+}
+
+// splitIdentifiers splits s on sep outside double quotes, removing the
+// quotes from quoted identifiers
+func splitIdentifiers(s, sep string) []string {
+	var parts []string
+	var current strings.Builder
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"' && quoted && i+1 < len(s) && s[i+1] == '"':
+			current.WriteByte('"')
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && strings.HasPrefix(s[i:], sep):
+			parts = append(parts, current.String())
+			current.Reset()
+			i += len(sep) - 1
+		default:
+			current.WriteByte(s[i])
+		}
+	}
+	return append(parts, current.String())
+}
+
+// copyEscapes are the single-character escapes of COPY text format
+var copyEscapes = map[byte]byte{'b': '\b', 'f': '\f', 'n': '\n', 'r': '\r', 't': '\t', 'v': '\v'}
+
+// copyUnescape decodes a value in COPY text format
+func copyUnescape(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 == len(value) {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		c := value[i]
+		switch {
+		case copyEscapes[c] != 0:
+			b.WriteByte(copyEscapes[c])
+		case c >= '0' && c <= '7':
+			end := i + 1
+			for end < len(value) && end < i+3 && value[end] >= '0' && value[end] <= '7' {
+				end++
+			}
+			n, _ := strconv.ParseUint(value[i:end], 8, 8)
+			b.WriteByte(byte(n))
+			i = end - 1
+		case c == 'x' && i+1 < len(value) && isHexDigit(value[i+1]):
+			end := i + 2
+			if end < len(value) && isHexDigit(value[end]) {
+				end++
+			}
+			n, _ := strconv.ParseUint(value[i+1:end], 16, 8)
+			b.WriteByte(byte(n))
+			i = end - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// copyEscape encodes a value in COPY text format
+func copyEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`).Replace(value)
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// maskedCopy writes a masked copy of a dump to a file, compressed and
+// encrypted like the backup itself
+type maskedCopy struct {
+	file  *os.File
+	chain *writeChain
+}
+
+// newMaskedCopy creates the masked copy of a dump at path
+func (bt *Tool) newMaskedCopy(path string, masking config.Masking, compress bool) (*maskedCopy, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create masked copy: %w", err)
+	}
+	chain, err := bt.newDumpWriter(file, compress)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	chain.wrap(newMasker(chain.head(), masking))
+	return &maskedCopy{file: file, chain: chain}, nil
+}
+
+func (c *maskedCopy) Write(p []byte) (int, error) {
+	return c.chain.Write(p)
+}
+
+func (c *maskedCopy) Close() error {
+	err := c.chain.Close()
+	if closeErr := c.file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write masked copy: %w", err)
+	}
+	return nil
+}
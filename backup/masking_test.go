@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"beackup/config"
+)
+
+// maskDump runs dump through a masker in small writes, splitting lines
+func maskDump(masking config.Masking, dump string) (string, error) {
+	var out bytes.Buffer
+	m := newMasker(&out, masking)
+	for len(dump) > 0 {
+		n := min(7, len(dump))
+		if _, err := m.Write([]byte(dump[:n])); err != nil {
+			return out.String(), err
+		}
+		dump = dump[n:]
+	}
+	err := m.Close()
+	return out.String(), err
+}
+
+func TestMasker(t *testing.T) {
+	masking := config.Masking{Salt: "pepper", Tables: map[string]map[string]config.MaskRule{
+		"public.users": {
+			"email":     {Action: config.MaskHash},
+			"Full Name": {Action: config.MaskFake, Value: "user {row}"},
+			"phone":     {Action: config.MaskRegex, Pattern: `\d{4}$`, Replacement: "XXXX"},
+		},
+		"notes": {"body": {Action: config.MaskNullify}},
+	}}
+	dump := "SET client_encoding = 'UTF8';\n" +
+		"COPY public.users (id, email, \"Full Name\", phone) FROM stdin;\n" +
+		"1\ta@example.com\tAda\t555-1234\n" +
+		"2\ta@example.com\tBob\\tBy\t\\N\n" +
+		"\\.\n" +
+		"COPY public.orders (id, total) FROM stdin;\n" +
+		"1\t9.99\n" +
+		"\\.\n" +
+		"COPY app.notes (id, body) FROM stdin;\n" +
+		"1\tcall Ada on 555-1234\n" +
+		"\\.\n"
+
+	got, err := maskDump(masking, dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(got, "\n")
+	ada := strings.Split(lines[2], "\t")
+	bob := strings.Split(lines[3], "\t")
+	if ada[1] == "a@example.com" || len(ada[1]) != 16 || ada[1] != bob[1] {
+		t.Errorf("hashed emails = %q, %q, want equal 16-digit hashes", ada[1], bob[1])
+	}
+	if ada[2] != "user 1" || bob[2] != "user 2" {
+		t.Errorf("fake names = %q, %q", ada[2], bob[2])
+	}
+	if ada[3] != "555-XXXX" || bob[3] != `\N` {
+		t.Errorf("replaced phones = %q, %q, want 555-XXXX and NULL kept", ada[3], bob[3])
+	}
+	if lines[6] != "1\t9.99" {
+		t.Errorf("unmasked table row = %q", lines[6])
+	}
+	if lines[9] != "1\t\\N" {
+		t.Errorf("nullified row = %q", lines[9])
+	}
+	if !strings.HasPrefix(got, "SET client_encoding = 'UTF8';\nCOPY public.users") || !strings.HasSuffix(got, "\\.\n") {
+		t.Errorf("masked dump changed the rest of the dump:\n%s", got)
+	}
+
+	// Hashes depend on the salt
+	masking.Salt = "salt"
+	other, err := maskDump(masking, dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Split(strings.Split(other, "\n")[2], "\t")[1] == ada[1] {
+		t.Error("hash did not change with the salt")
+	}
+}
+
+func TestMaskerErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules map[string]map[string]config.MaskRule
+		dump  string
+		want  string
+	}{
+		{
+			name:  "missing column",
+			rules: map[string]map[string]config.MaskRule{"users": {"mail": {Action: config.MaskNullify}}},
+			dump:  "COPY public.users (id, email) FROM stdin;\n1\ta@example.com\n\\.\n",
+			want:  "masked table users has no column mail",
+		},
+		{
+			name:  "missing table",
+			rules: map[string]map[string]config.MaskRule{"public.user": {"email": {Action: config.MaskNullify}}},
+			dump:  "COPY public.users (id, email) FROM stdin;\n1\ta@example.com\n\\.\n",
+			want:  "masked tables are not in the dump: public.user",
+		},
+		{
+			name:  "short row",
+			rules: map[string]map[string]config.MaskRule{"users": {"email": {Action: config.MaskNullify}}},
+			dump:  "COPY public.users (id, email) FROM stdin;\n1\n\\.\n",
+			want:  "row 1 of masked table users has 1 columns, expected 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := maskDump(config.Masking{Tables: tt.rules}, tt.dump)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("error = %v, want %s", err, tt.want)
+			}
+			if strings.Contains(got, "a@example.com") && tt.name != "missing table" {
+				t.Errorf("dump with an unusable rule kept the value: %q", got)
+			}
+		})
+	}
+}
+
+func TestCopyEscaping(t *testing.T) {
+	tests := []struct{ escaped, value string }{
+		{`plain`, "plain"},
+		{`a\tb\nc\\d`, "a\tb\nc\\d"},
+		{`\101\x42`, "AB"},
+	}
+	for _, tt := range tests {
+		if got := copyUnescape(tt.escaped); got != tt.value {
+			t.Errorf("copyUnescape(%q) = %q, want %q", tt.escaped, got, tt.value)
+		}
+	}
+	if got := copyEscape("a\tb\nc\\d"); got != `a\tb\nc\\d` {
+		t.Errorf("copyEscape() = %q", got)
+	}
+}
@@ -0,0 +1,100 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// metaSuffix is appended to a backup's name to form the file recording how
+// it was made
+const metaSuffix = ".meta.yaml"
+
+// backupMeta records how a backup was made, so that it can be understood
+// long after the configuration and programs have changed
+type backupMeta struct {
+	Database         string        `yaml:"database"`
+	File             string        `yaml:"file"`
+	CreatedAt        time.Time     `yaml:"created_at"`
+	BeackupVersion   string        `yaml:"beackup_version"`
+	ServerVersion    string        `yaml:"server_version,omitempty"`
+	PgDumpVersion    string        `yaml:"pg_dump_version,omitempty"`
+	PgRestoreVersion string        `yaml:"pg_restore_version,omitempty"`
+	ToolVersion      string        `yaml:"tool_version,omitempty"`
+	Config           yaml.MapSlice `yaml:"config"` // in effect for the database, secrets redacted
+}
+
+// metaPath returns where the meta file for an artifact is stored
+func metaPath(artifactPath string) string {
+	return artifactPath + metaSuffix
+}
+
+// Version returns the version beackup was built as, or the revision it was
+// built from for development builds
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	version := "devel"
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision":
+			version += " " + setting.Value
+		case setting.Key == "vcs.modified" && setting.Value == "true":
+			version += " (modified)"
+		}
+	}
+	return version
+}
+
+// writeMeta records the beackup and pg_restore versions and the digest of
+// the configuration in the manifest m, and writes the meta file of its
+// backup next to it
+func (bt *Tool) writeMeta(ctx context.Context, job *databaseJob, m *backupManifest) error {
+	m.BeackupVersion = Version()
+	if m.Type == "" && m.Format != baseBackupFormat && m.Format != globalsFormat {
+		version, err := toolVersion(ctx, job.db, "pg_restore")
+		if err != nil {
+			job.logger.Warn("Failed to determine pg_restore version", "error", err)
+		}
+		m.PgRestoreVersion = version
+	}
+
+	snapshot := bt.config.Snapshot(job.db.ID)
+	config, err := yaml.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	sum := sha256.Sum256(config)
+	m.ConfigSHA256 = hex.EncodeToString(sum[:])
+
+	data, err := yaml.Marshal(backupMeta{
+		Database:         m.Database,
+		File:             m.File,
+		CreatedAt:        m.CreatedAt,
+		BeackupVersion:   m.BeackupVersion,
+		ServerVersion:    m.ServerVersion,
+		PgDumpVersion:    m.PgDumpVersion,
+		PgRestoreVersion: m.PgRestoreVersion,
+		ToolVersion:      m.ToolVersion,
+		Config:           snapshot,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode backup meta: %w", err)
+	}
+	if err := os.WriteFile(metaPath(filepath.Join(job.outputDir, m.File)), data, 0600); err != nil {
+		return fmt.Errorf("failed to write backup meta: %w", err)
+	}
+	return nil
+}
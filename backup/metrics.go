@@ -0,0 +1,351 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics tracks backup statistics for export to Prometheus
+type metrics struct {
+	mu        sync.Mutex
+	databases map[string]*databaseMetrics
+}
+
+// databaseMetrics holds the statistics for one database
+type databaseMetrics struct {
+	lastSuccess        time.Time
+	lastDuration       time.Duration
+	lastSize           int64
+	successes          int64
+	failures           int64
+	retentionDeletions int64
+	retentionArchives  int64
+	overlaps           int64
+	heldSkips          int64
+	heldDelays         int64
+	rehearsals         int64
+	rehearsalFailures  int64
+	lastRehearsal      time.Time
+	lastUploadDuration time.Duration
+	uploadSeconds      float64
+	uploads            int64
+	uploadFailures     int64
+	verifications      map[string]int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{databases: make(map[string]*databaseMetrics)}
+}
+
+// database returns the statistics for id, creating them if needed.
+// The caller must hold m.mu.
+func (m *metrics) database(id string) *databaseMetrics {
+	db, ok := m.databases[id]
+	if !ok {
+		db = &databaseMetrics{verifications: make(map[string]int64)}
+		m.databases[id] = db
+	}
+	return db
+}
+
+// register makes a database appear in the output before its first backup
+func (m *metrics) register(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.database(id)
+}
+
+// observeBackup records the outcome of a backup run
+func (m *metrics) observeBackup(id string, duration time.Duration, size int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	db := m.database(id)
+	if err != nil {
+		db.failures++
+		return
+	}
+	db.successes++
+	db.lastSuccess = time.Now()
+	db.lastDuration = duration
+	db.lastSize = size
+}
+
+// observeUpload records the outcome of uploading a backup
+func (m *metrics) observeUpload(id string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	db := m.database(id)
+	if err != nil {
+		db.uploadFailures++
+		return
+	}
+	db.uploads++
+	db.uploadSeconds += duration.Seconds()
+	db.lastUploadDuration = duration
+}
+
+// observeVerification records the outcome of verifying a backup
+func (m *metrics) observeVerification(id, result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.database(id).verifications[result]++
+}
+
+// observeRetentionDeletion records a backup removed by the retention policy
+func (m *metrics) observeRetentionDeletion(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.database(id).retentionDeletions++
+}
+
+// observeRetentionArchive records a backup moved to archive storage by the
+// retention policy
+func (m *metrics) observeRetentionArchive(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.database(id).retentionArchives++
+}
+
+// observeOverlap records a backup that was due while another was running
+func (m *metrics) observeOverlap(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.database(id).overlaps++
+}
+
+// observeHeld records a scheduled run due while the schedule did not allow
+// it, skipped or delayed
+func (m *metrics) observeHeld(id string, skipped bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	db := m.database(id)
+	if skipped {
+		db.heldSkips++
+		return
+	}
+	db.heldDelays++
+}
+
+// observeRehearsal records the outcome of a restore rehearsal
+func (m *metrics) observeRehearsal(id string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	db := m.database(id)
+	if err != nil {
+		db.rehearsalFailures++
+		return
+	}
+	db.rehearsals++
+	db.lastRehearsal = time.Now()
+}
+
+// metricFamily describes one exported metric
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	values func(db *databaseMetrics) []labeledValue
+}
+
+// labeledValue is a sample with optional labels beyond the database label
+type labeledValue struct {
+	labels string
+	value  float64
+}
+
+func single(value float64) []labeledValue {
+	return []labeledValue{{value: value}}
+}
+
+var metricFamilies = []metricFamily{
+	{
+		name: "beackup_last_backup_timestamp_seconds",
+		help: "Unix time of the last successful backup.",
+		kind: "gauge",
+		values: func(db *databaseMetrics) []labeledValue {
+			if db.lastSuccess.IsZero() {
+				return nil
+			}
+			return single(float64(db.lastSuccess.Unix()))
+		},
+	},
+	{
+		name:   "beackup_last_backup_duration_seconds",
+		help:   "Duration of the last successful backup.",
+		kind:   "gauge",
+		values: func(db *databaseMetrics) []labeledValue { return single(db.lastDuration.Seconds()) },
+	},
+	{
+		name:   "beackup_last_backup_size_bytes",
+		help:   "Size of the last successful backup.",
+		kind:   "gauge",
+		values: func(db *databaseMetrics) []labeledValue { return single(float64(db.lastSize)) },
+	},
+	{
+		name: "beackup_backups_total",
+		help: "Backup runs by outcome.",
+		kind: "counter",
+		values: func(db *databaseMetrics) []labeledValue {
+			return []labeledValue{
+				{labels: `status="success"`, value: float64(db.successes)},
+				{labels: `status="failure"`, value: float64(db.failures)},
+			}
+		},
+	},
+	{
+		name:   "beackup_retention_deletions_total",
+		help:   "Backups deleted by the retention policy.",
+		kind:   "counter",
+		values: func(db *databaseMetrics) []labeledValue { return single(float64(db.retentionDeletions)) },
+	},
+	{
+		name:   "beackup_retention_archives_total",
+		help:   "Backups moved to archive storage by the retention policy.",
+		kind:   "counter",
+		values: func(db *databaseMetrics) []labeledValue { return single(float64(db.retentionArchives)) },
+	},
+	{
+		name:   "beackup_backup_overlaps_total",
+		help:   "Backups that were due while the previous backup of the database was still running.",
+		kind:   "counter",
+		values: func(db *databaseMetrics) []labeledValue { return single(float64(db.overlaps)) },
+	},
+	{
+		name: "beackup_scheduled_runs_held_total",
+		help: "Scheduled runs due outside the run window or during a blackout, by action.",
+		kind: "counter",
+		values: func(db *databaseMetrics) []labeledValue {
+			return []labeledValue{
+				{labels: `action="skipped"`, value: float64(db.heldSkips)},
+				{labels: `action="delayed"`, value: float64(db.heldDelays)},
+			}
+		},
+	},
+	{
+		name: "beackup_restore_rehearsals_total",
+		help: "Restore rehearsals by outcome.",
+		kind: "counter",
+		values: func(db *databaseMetrics) []labeledValue {
+			return []labeledValue{
+				{labels: `status="success"`, value: float64(db.rehearsals)},
+				{labels: `status="failure"`, value: float64(db.rehearsalFailures)},
+			}
+		},
+	},
+	{
+		name: "beackup_last_restore_rehearsal_timestamp_seconds",
+		help: "Unix time of the last successful restore rehearsal.",
+		kind: "gauge",
+		values: func(db *databaseMetrics) []labeledValue {
+			if db.lastRehearsal.IsZero() {
+				return nil
+			}
+			return single(float64(db.lastRehearsal.Unix()))
+		},
+	},
+	{
+		name:   "beackup_last_upload_duration_seconds",
+		help:   "Duration of the last successful upload to remote storage.",
+		kind:   "gauge",
+		values: func(db *databaseMetrics) []labeledValue { return single(db.lastUploadDuration.Seconds()) },
+	},
+	{
+		name:   "beackup_upload_duration_seconds_total",
+		help:   "Total time spent on successful uploads to remote storage.",
+		kind:   "counter",
+		values: func(db *databaseMetrics) []labeledValue { return single(db.uploadSeconds) },
+	},
+	{
+		name: "beackup_uploads_total",
+		help: "Uploads to remote storage by outcome.",
+		kind: "counter",
+		values: func(db *databaseMetrics) []labeledValue {
+			return []labeledValue{
+				{labels: `status="success"`, value: float64(db.uploads)},
+				{labels: `status="failure"`, value: float64(db.uploadFailures)},
+			}
+		},
+	},
+	{
+		name: "beackup_verifications_total",
+		help: "Backup verifications by result.",
+		kind: "counter",
+		values: func(db *databaseMetrics) []labeledValue {
+			var values []labeledValue
+			for _, result := range []string{verifyPassed, verifyFailed, verifySkipped} {
+				values = append(values, labeledValue{
+					labels: fmt.Sprintf(`result="%s"`, result),
+					value:  float64(db.verifications[result]),
+				})
+			}
+			return values
+		},
+	},
+}
+
+// writeTo renders all metrics in the Prometheus text exposition format
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]string, 0, len(m.databases))
+	for id := range m.databases {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, family := range metricFamilies {
+		fmt.Fprintf(w, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", family.name, family.kind)
+		for _, id := range ids {
+			for _, sample := range family.values(m.databases[id]) {
+				labels := fmt.Sprintf(`database="%s"`, escapeLabel(id))
+				if sample.labels != "" {
+					labels += "," + sample.labels
+				}
+				fmt.Fprintf(w, "%s{%s} %g\n", family.name, labels, sample.value)
+			}
+		}
+	}
+}
+
+// ServeHTTP exposes the metrics to Prometheus
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.writeTo(w)
+}
+
+// escapeLabel escapes a label value for the exposition format
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// serveMetrics runs the metrics HTTP listener until it fails
+func (bt *Tool) serveMetrics() {
+	path := bt.config.Metrics.Path
+	if path == "" {
+		path = "/metrics"
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, bt.metrics)
+
+	bt.logger.Info("Serving metrics", "addr", bt.config.Metrics.ListenAddr, "path", path)
+	if err := http.ListenAndServe(bt.config.Metrics.ListenAddr, mux); err != nil {
+		bt.logger.Error("Metrics listener failed", "error", err)
+	}
+}
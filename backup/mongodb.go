@@ -0,0 +1,244 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"beackup/config"
+)
+
+// mongoArchiveMagic starts every mongodump archive, little-endian
+const mongoArchiveMagic = 0x8199e26d
+
+// mongoDriver backs up MongoDB with mongodump and restores with
+// mongorestore. Dumps are single archives (mongodump --archive), which the
+// shared compression settings gzip or zstd like any other stream.
+type mongoDriver struct{}
+
+func (mongoDriver) validate(db *config.Database, _ string) error {
+	if db.Port == 0 {
+		db.Port = 27017
+	}
+	// backup.format names PostgreSQL formats, so it is not inherited
+	switch db.Format {
+	case "":
+		db.Format = "archive"
+	case "archive":
+	default:
+		return fmt.Errorf("unknown mongodb format %q, only archive is supported", db.Format)
+	}
+	if len(db.IncludeSchemas)+len(db.ExcludeSchemas)+len(db.IncludeTables)+len(db.ExcludeTables) > 0 {
+		return fmt.Errorf("schema and table filters do not apply to mongodb, use mongodb.include_collections and exclude_collections")
+	}
+	if len(db.MongoDB.IncludeCollections) > 1 {
+		return fmt.Errorf("mongodump can only include a single collection")
+	}
+	if len(db.MongoDB.IncludeCollections) > 0 && len(db.MongoDB.ExcludeCollections) > 0 {
+		return fmt.Errorf("include_collections and exclude_collections cannot be combined")
+	}
+	for _, collections := range [][]string{db.MongoDB.IncludeCollections, db.MongoDB.ExcludeCollections} {
+		for _, collection := range collections {
+			if strings.TrimSpace(collection) == "" || collection == "*" {
+				return fmt.Errorf("invalid collection name %q", collection)
+			}
+		}
+	}
+	if db.MongoDB.URI != "" {
+		uri, err := url.Parse(db.MongoDB.URI)
+		if err != nil || (uri.Scheme != "mongodb" && uri.Scheme != "mongodb+srv") {
+			return fmt.Errorf("mongodb.uri must be a mongodb:// or mongodb+srv:// connection string")
+		}
+		if uri.User != nil && (db.User != "" || db.Password != "" || db.PasswordFile != "" || db.PasswordSecret.Provider != "") {
+			return fmt.Errorf("credentials must be given either in mongodb.uri or separately, not both")
+		}
+	}
+	return nil
+}
+
+func (mongoDriver) tool(*config.Database) string {
+	return "mongodump"
+}
+
+func (mongoDriver) extension(*config.Database) string {
+	return ".archive"
+}
+
+func (mongoDriver) streams(*config.Database) bool {
+	return true
+}
+
+func (mongoDriver) compresses(*config.Database) bool {
+	return false
+}
+
+func (mongoDriver) programs(*config.Database) []string {
+	return []string{"mongodump", "mongorestore"}
+}
+
+// ping dumps a collection that does not exist, which connects and
+// authenticates without reading any data. The server version is not known.
+func (mongoDriver) ping(ctx context.Context, db *config.Database) (string, error) {
+	args, cleanup, err := mongoConnectionArgs(db)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	args = append(args, "--db="+db.Name, "--collection=beackup_check_nonexistent", "--archive")
+	cmd := commandContext(ctx, "mongodump", args...)
+	remoteCommand(db, cmd)
+	var stderr bytes.Buffer
+	cmd.Stdout = io.Discard
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("mongodump failed: %w, output: %s", err, stderr.String())
+	}
+	return "", nil
+}
+
+// size is not known without mongosh
+func (mongoDriver) size(context.Context, *config.Database) (int64, error) {
+	return 0, nil
+}
+
+// versions only reports mongodump's version; querying the server would
+// need mongosh, which is not part of the database tools
+func (mongoDriver) versions(ctx context.Context, logger *slog.Logger, db *config.Database) (string, string) {
+	cmd := commandContext(ctx, "mongodump", "--version")
+	remoteCommand(db, cmd)
+	output, err := cmd.Output()
+	if err != nil {
+		logger.Warn("Failed to determine mongodump version", "error", err)
+		return "", ""
+	}
+	// "mongodump version: 100.9.4"
+	fields := strings.Fields(string(output))
+	for i, field := range fields[:max(len(fields)-1, 0)] {
+		if field == "version:" {
+			return "", fields[i+1]
+		}
+	}
+	return "", ""
+}
+
+func (mongoDriver) dumpCommand(ctx context.Context, db *config.Database, outputPath string, _ config.Compression) (*exec.Cmd, func(), error) {
+	args, cleanup, err := mongoConnectionArgs(db)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	args = append(args, "--db="+db.Name)
+	for _, collection := range db.MongoDB.IncludeCollections {
+		args = append(args, "--collection="+collection)
+	}
+	for _, collection := range db.MongoDB.ExcludeCollections {
+		if prefix, ok := strings.CutSuffix(collection, "*"); ok {
+			args = append(args, "--excludeCollectionsWithPrefix="+prefix)
+		} else {
+			args = append(args, "--excludeCollection="+collection)
+		}
+	}
+	if outputPath != "" {
+		args = append(args, "--archive="+outputPath)
+	} else {
+		args = append(args, "--archive")
+	}
+
+	cmd := commandContext(ctx, "mongodump", args...)
+	remoteCommand(db, cmd)
+	return cmd, cleanup, nil
+}
+
+func (mongoDriver) restoreCommand(ctx context.Context, db *config.Database, _ string) (*exec.Cmd, func(), error) {
+	args, cleanup, err := mongoConnectionArgs(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	args = append(args, "--nsInclude="+db.Name+".*", "--archive")
+	cmd := commandContext(ctx, "mongorestore", args...)
+	remoteCommand(db, cmd)
+	return cmd, cleanup, nil
+}
+
+// verify checks the archive header and reads the archive to its end, which
+// catches truncated, corrupt or undecryptable backups
+func (mongoDriver) verify(_ context.Context, _ *config.Database, r io.Reader, _ string) error {
+	var magic uint32
+	if err := binary.Read(r, binary.LittleEndian, &magic); err != nil {
+		return fmt.Errorf("archive is empty or unreadable: %w", err)
+	}
+	if magic != mongoArchiveMagic {
+		return fmt.Errorf("archive does not start with the mongodump header")
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	return nil
+}
+
+// fatalPatterns matches the Failed: line mongodump logs when it gives up
+func (mongoDriver) fatalPatterns() []string {
+	return []string{
+		"Failed:",
+		"error writing data",
+		"No space left on device",
+	}
+}
+
+// mongoConnectionArgs returns the flags connecting mongodump or
+// mongorestore to db. The URI and password are passed in a temporary
+// --config file that cleanup removes, keeping them out of the process list.
+// Programs in a container or on an SSH host cannot read the file and get the
+// URI as a flag.
+func mongoConnectionArgs(db *config.Database) ([]string, func(), error) {
+	uri := db.MongoDB.URI
+	if uri == "" {
+		uri = "mongodb://" + db.Host + ":" + strconv.Itoa(db.Port) + "/"
+	}
+	if db.RemotePrograms() {
+		return append([]string{"--uri=" + uri}, mongoAuthArgs(db)...), noCleanup, nil
+	}
+
+	// The tools' config file is YAML; JSON-quoted strings are valid in it
+	config := "uri: " + strconv.Quote(uri) + "\n"
+	if db.Password != "" {
+		config += "password: " + strconv.Quote(db.Password) + "\n"
+	}
+
+	file, err := os.CreateTemp("", "beackup-mongodb-*.yaml")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create mongodb config file: %w", err)
+	}
+	_, err = file.WriteString(config)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, nil, fmt.Errorf("failed to write mongodb config file: %w", err)
+	}
+
+	args := append([]string{"--config=" + file.Name()}, mongoAuthArgs(db)...)
+	return args, func() { os.Remove(file.Name()) }, nil
+}
+
+// mongoAuthArgs returns the flags naming the user db authenticates as
+func mongoAuthArgs(db *config.Database) []string {
+	var args []string
+	if db.User != "" {
+		args = append(args, "--username="+db.User)
+	}
+	if db.MongoDB.AuthDatabase != "" {
+		args = append(args, "--authenticationDatabase="+db.MongoDB.AuthDatabase)
+	}
+	return args
+}
@@ -0,0 +1,328 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"beackup/config"
+)
+
+// mysqlDriver backs up MySQL and MariaDB with mysqldump and restores with
+// the mysql client. Dumps are plain SQL.
+type mysqlDriver struct{}
+
+func (mysqlDriver) validate(db *config.Database, _ string) error {
+	if db.Port == 0 {
+		db.Port = 3306
+	}
+	// backup.format names PostgreSQL formats, so it is not inherited
+	switch db.Format {
+	case "":
+		db.Format = "sql"
+	case "sql":
+	default:
+		return fmt.Errorf("unknown mysql format %q, only sql is supported", db.Format)
+	}
+	if len(db.IncludeSchemas) > 0 || len(db.ExcludeSchemas) > 0 {
+		return fmt.Errorf("schema filters do not apply to mysql, use table filters")
+	}
+	for _, tables := range [][]string{db.IncludeTables, db.ExcludeTables} {
+		for _, table := range tables {
+			if strings.ContainsAny(table, "*?") {
+				return fmt.Errorf("mysql table filters do not support wildcards: %q", table)
+			}
+		}
+	}
+	return nil
+}
+
+func (mysqlDriver) tool(*config.Database) string {
+	return "mysqldump"
+}
+
+func (mysqlDriver) extension(*config.Database) string {
+	return ".sql"
+}
+
+func (mysqlDriver) streams(*config.Database) bool {
+	return true
+}
+
+func (mysqlDriver) compresses(*config.Database) bool {
+	return false
+}
+
+func (mysqlDriver) programs(*config.Database) []string {
+	return []string{"mysqldump", "mysql"}
+}
+
+func (mysqlDriver) ping(ctx context.Context, db *config.Database) (string, error) {
+	return mysqlQueryValue(ctx, db, "SELECT VERSION()")
+}
+
+func (mysqlDriver) size(ctx context.Context, db *config.Database) (int64, error) {
+	value, err := mysqlQueryValue(ctx, db, "SELECT COALESCE(SUM(data_length + index_length), 0) FROM information_schema.tables WHERE table_schema = DATABASE()")
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid database size %q", value)
+	}
+	return size, nil
+}
+
+func (mysqlDriver) versions(ctx context.Context, logger *slog.Logger, db *config.Database) (string, string) {
+	server, err := mysqlQueryValue(ctx, db, "SELECT VERSION()")
+	if err != nil {
+		logger.Warn("Failed to query server version", "error", err)
+	}
+	tool, err := mysqldumpVersion(ctx, db)
+	if err != nil {
+		logger.Warn("Failed to determine mysqldump version", "error", err)
+	}
+	return server, tool
+}
+
+func (mysqlDriver) dumpCommand(ctx context.Context, db *config.Database, outputPath string, _ config.Compression) (*exec.Cmd, func(), error) {
+	args, cleanup, err := mysqlConnectionArgs(db)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if db.MySQL.LockTables {
+		args = append(args, "--lock-tables")
+	} else {
+		args = append(args, "--single-transaction")
+	}
+	if db.MySQL.Routines {
+		args = append(args, "--routines")
+	}
+	if db.MySQL.Events {
+		args = append(args, "--events")
+	}
+	if db.MySQL.HexBlob {
+		args = append(args, "--hex-blob")
+	}
+	for _, table := range db.ExcludeTables {
+		args = append(args, "--ignore-table="+db.Name+"."+table)
+	}
+	if outputPath != "" {
+		args = append(args, "--result-file="+outputPath)
+	}
+
+	// Tables to include follow the database name
+	args = append(args, db.Name)
+	args = append(args, db.IncludeTables...)
+
+	cmd := commandContext(ctx, "mysqldump", args...)
+	remoteCommand(db, cmd)
+	return cmd, cleanup, nil
+}
+
+func (mysqlDriver) restoreCommand(ctx context.Context, db *config.Database, _ string) (*exec.Cmd, func(), error) {
+	args, cleanup, err := mysqlConnectionArgs(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	args = append(args, db.Name)
+	cmd := commandContext(ctx, "mysql", args...)
+	remoteCommand(db, cmd)
+	return cmd, cleanup, nil
+}
+
+func (mysqlDriver) verify(_ context.Context, _ *config.Database, r io.Reader, _ string) error {
+	return verifyMySQLDump(r)
+}
+
+func (mysqlDriver) createDatabase(ctx context.Context, db *config.Database) error {
+	_, err := mysqlQueryValue(ctx, mysqlSchemaDatabase(db), "CREATE DATABASE "+quoteMySQLIdent(db.Name))
+	return err
+}
+
+func (mysqlDriver) dropDatabase(ctx context.Context, db *config.Database) error {
+	_, err := mysqlQueryValue(ctx, mysqlSchemaDatabase(db), "DROP DATABASE IF EXISTS "+quoteMySQLIdent(db.Name))
+	return err
+}
+
+// rowCounts lists the tables, then counts all of their rows in one query,
+// since information_schema only has estimates for InnoDB
+func (mysqlDriver) rowCounts(ctx context.Context, db *config.Database) (map[string]int64, error) {
+	output, err := mysqlQueryValue(ctx, db, "SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE'")
+	if err != nil || output == "" {
+		return nil, err
+	}
+
+	var counts []string
+	for _, table := range strings.Split(output, "\n") {
+		counts = append(counts, fmt.Sprintf("SELECT '%s', COUNT(*) FROM %s",
+			strings.NewReplacer(`\`, `\\`, "'", "''").Replace(table), quoteMySQLIdent(table)))
+	}
+	output, err = mysqlQueryValue(ctx, db, strings.Join(counts, " UNION ALL "))
+	if err != nil {
+		return nil, err
+	}
+	return parseRowCounts(output, "\t")
+}
+
+func (mysqlDriver) query(ctx context.Context, db *config.Database, query string) (string, error) {
+	return mysqlQueryValue(ctx, db, query)
+}
+
+// mysqlSchemaDatabase returns db connected to information_schema, which
+// every user can use, to create and drop databases from
+func mysqlSchemaDatabase(db *config.Database) *config.Database {
+	schema := *db
+	schema.Name = "information_schema"
+	return &schema
+}
+
+// quoteMySQLIdent quotes a MySQL identifier
+func quoteMySQLIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func (mysqlDriver) fatalPatterns() []string {
+	return []string{
+		"mysqldump: Error",
+		"mysqldump: Got error",
+		"mysqldump: Couldn't",
+		"Lost connection to MySQL server",
+		"No space left on device",
+	}
+}
+
+// mysqlConnectionArgs returns the flags connecting a MySQL client program
+// to db. The option file must come first, so a configured password is
+// written to a temporary one that cleanup removes; this keeps it out of the
+// process list and environment. Programs in a container or on an SSH host
+// get the password from remoteCommand instead.
+func mysqlConnectionArgs(db *config.Database) ([]string, func(), error) {
+	var args []string
+	cleanup := noCleanup
+
+	switch {
+	case db.MySQL.OptionsFile != "":
+		args = append(args, "--defaults-extra-file="+db.MySQL.OptionsFile)
+	case db.Password != "" && !db.RemotePrograms():
+		path, err := writeMySQLOptionFile(db.Password)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, "--defaults-extra-file="+path)
+		cleanup = func() { os.Remove(path) }
+	}
+
+	args = append(args, "--host="+db.Host, "--port="+strconv.Itoa(db.Port))
+	if db.User != "" {
+		args = append(args, "--user="+db.User)
+	}
+	return args, cleanup, nil
+}
+
+// writeMySQLOptionFile writes password to a new client option file only
+// readable by the current user
+func writeMySQLOptionFile(password string) (string, error) {
+	file, err := os.CreateTemp("", "beackup-mysql-*.cnf")
+	if err != nil {
+		return "", fmt.Errorf("failed to create mysql option file: %w", err)
+	}
+
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(password)
+	_, err = fmt.Fprintf(file, "[client]\npassword=\"%s\"\n", escaped)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write mysql option file: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// mysqlQueryValue runs a single-value query with the mysql client and
+// returns the result
+func mysqlQueryValue(ctx context.Context, db *config.Database, query string) (string, error) {
+	args, cleanup, err := mysqlConnectionArgs(db)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	args = append(args, "--batch", "--skip-column-names", "--execute="+query, db.Name)
+	cmd := commandContext(ctx, "mysql", args...)
+	remoteCommand(db, cmd)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("mysql failed: %w, output: %s", err, stderr.String())
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// mysqldumpVersion returns the server version mysqldump was built for, as
+// printed in "Ver 8.0.35 for Linux", "Distrib 10.11.6-MariaDB," or
+// "from 11.4.2-MariaDB,"
+func mysqldumpVersion(ctx context.Context, db *config.Database) (string, error) {
+	cmd := commandContext(ctx, "mysqldump", "--version")
+	remoteCommand(db, cmd)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run mysqldump --version: %w", err)
+	}
+
+	fields := strings.Fields(string(output))
+	for _, marker := range []string{"Distrib", "from", "Ver"} {
+		for i, field := range fields[:max(len(fields)-1, 0)] {
+			if field == marker {
+				return strings.TrimSuffix(fields[i+1], ","), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unexpected mysqldump --version output: %s", strings.TrimSpace(string(output)))
+}
+
+// verifyMySQLDump checks that a mysqldump file carries the dump header and
+// ends with the completion comment mysqldump writes last
+func verifyMySQLDump(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	var lines int
+	var sawHeader bool
+	var last string
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		lines++
+		if lines <= 5 && (strings.HasPrefix(line, "-- MySQL dump") || strings.HasPrefix(line, "-- MariaDB dump")) {
+			sawHeader = true
+		}
+		if strings.TrimSpace(line) != "" {
+			last = line
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read dump: %w", err)
+	}
+
+	switch {
+	case lines == 0:
+		return fmt.Errorf("dump is empty")
+	case !sawHeader:
+		return fmt.Errorf("dump does not start with a mysqldump header")
+	case !strings.HasPrefix(last, "-- Dump completed"):
+		return fmt.Errorf("dump is missing the completion trailer")
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"beackup/config"
+)
+
+// notificationTimeout bounds how long a single channel may take to deliver
+const notificationTimeout = 15 * time.Second
+
+// Notification events
+const (
+	eventSuccess = "success"
+	eventFailure = "failure"
+	eventCleanup = "cleanup"
+	eventReport  = "report" // scheduled summary reports
+)
+
+// notification is the payload describing a backup event
+type notification struct {
+	Event    string    `json:"event"`
+	Database string    `json:"database"`
+	RunID    string    `json:"run_id,omitempty"`
+	File     string    `json:"file,omitempty"`
+	Duration float64   `json:"duration_seconds,omitempty"`
+	Size     int64     `json:"size_bytes,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Removed  []string  `json:"removed,omitempty"`
+	Archived []string  `json:"archived,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// summary renders the notification as a one-line human readable message
+func (n notification) summary() string {
+	switch n.Event {
+	case eventSuccess:
+		return fmt.Sprintf("Backup of %s succeeded: %s (%d bytes in %.1fs)", n.Database, n.File, n.Size, n.Duration)
+	case eventFailure:
+		return fmt.Sprintf("Backup of %s failed after %.1fs: %s", n.Database, n.Duration, n.Error)
+	case eventCleanup:
+		if len(n.Archived) > 0 {
+			return fmt.Sprintf("Retention cleanup for %s archived %d backup(s): %s; removed %d backup(s): %s", n.Database,
+				len(n.Archived), strings.Join(n.Archived, ", "), len(n.Removed), strings.Join(n.Removed, ", "))
+		}
+		return fmt.Sprintf("Retention cleanup for %s removed %d backup(s): %s", n.Database, len(n.Removed), strings.Join(n.Removed, ", "))
+	default:
+		return fmt.Sprintf("Backup event %s for %s", n.Event, n.Database)
+	}
+}
+
+// notifier delivers notifications to a single channel
+type notifier interface {
+	Name() string
+	Wants(event string) bool
+	Notify(ctx context.Context, n notification) error
+}
+
+// newNotifiers creates a notifier for every configured channel
+func newNotifiers(config config.Notifications) ([]notifier, error) {
+	var notifiers []notifier
+
+	if config.Slack.WebhookURL != "" {
+		events, err := parseEvents("slack", config.Slack.Events)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, &slackNotifier{
+			url:    config.Slack.WebhookURL,
+			events: events,
+		})
+	}
+
+	if len(config.Email.To) > 0 {
+		if config.Email.Host == "" || config.Email.From == "" {
+			return nil, fmt.Errorf("email notifications need smtp_host and from")
+		}
+		events, err := parseEvents("email", config.Email.Events)
+		if err != nil {
+			return nil, err
+		}
+		port := config.Email.Port
+		if port == 0 {
+			port = 587
+		}
+		n := &emailNotifier{
+			addr:   net.JoinHostPort(config.Email.Host, strconv.Itoa(port)),
+			from:   config.Email.From,
+			to:     config.Email.To,
+			events: events,
+		}
+		if config.Email.Username != "" {
+			n.auth = smtp.PlainAuth("", config.Email.Username, config.Email.Password, config.Email.Host)
+		}
+		notifiers = append(notifiers, n)
+	}
+
+	if config.Webhook.URL != "" {
+		events, err := parseEvents("webhook", config.Webhook.Events)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, &webhookNotifier{
+			url:     config.Webhook.URL,
+			headers: config.Webhook.Headers,
+			events:  events,
+		})
+	}
+
+	return notifiers, nil
+}
+
+// eventFilter is the set of events a channel wants; empty means all
+type eventFilter map[string]bool
+
+func (f eventFilter) wants(event string) bool {
+	return len(f) == 0 || f[event]
+}
+
+// parseEvents validates the events configured for a channel
+func parseEvents(channel string, events []string) (eventFilter, error) {
+	filter := make(eventFilter)
+	for _, event := range events {
+		switch event {
+		case eventSuccess, eventFailure, eventCleanup, eventReport:
+			filter[event] = true
+		default:
+			return nil, fmt.Errorf("%s notifications: unknown event %q", channel, event)
+		}
+	}
+	return filter, nil
+}
+
+// notify delivers a notification to every interested channel, logging
+// rather than returning delivery failures
+func (bt *Tool) notify(job *databaseJob, n notification) {
+	n.Database = job.db.ID
+	n.RunID = job.currentRunID()
+	n.Time = time.Now()
+	if err := recordEvent(job, n); err != nil {
+		job.logger.Warn("Failed to record backup event", "error", err)
+	}
+
+	for _, channel := range bt.notifiers {
+		if !channel.Wants(n.Event) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+		if err := channel.Notify(ctx, n); err != nil {
+			job.logger.Warn("Failed to send notification", "channel", channel.Name(), "event", n.Event, "error", err)
+		}
+		cancel()
+	}
+}
+
+// slackNotifier posts messages to a Slack incoming webhook
+type slackNotifier struct {
+	url    string
+	events eventFilter
+}
+
+func (s *slackNotifier) Name() string { return "slack" }
+
+func (s *slackNotifier) Wants(event string) bool { return s.events.wants(event) }
+
+func (s *slackNotifier) Notify(ctx context.Context, n notification) error {
+	icon := ":information_source:"
+	switch n.Event {
+	case eventSuccess:
+		icon = ":white_check_mark:"
+	case eventFailure:
+		icon = ":x:"
+	}
+	return postJSON(ctx, s.url, nil, map[string]string{"text": icon + " " + n.summary()})
+}
+
+// webhookNotifier posts the raw notification payload as JSON
+type webhookNotifier struct {
+	url     string
+	headers map[string]string
+	events  eventFilter
+}
+
+func (w *webhookNotifier) Name() string { return "webhook" }
+
+func (w *webhookNotifier) Wants(event string) bool { return w.events.wants(event) }
+
+func (w *webhookNotifier) Notify(ctx context.Context, n notification) error {
+	return postJSON(ctx, w.url, w.headers, n)
+}
+
+// emailNotifier sends notifications over SMTP
+type emailNotifier struct {
+	addr   string
+	auth   smtp.Auth
+	from   string
+	to     []string
+	events eventFilter
+}
+
+func (e *emailNotifier) Name() string { return "email" }
+
+func (e *emailNotifier) Wants(event string) bool { return e.events.wants(event) }
+
+func (e *emailNotifier) Notify(ctx context.Context, n notification) error {
+	body := n.summary() + "\r\n"
+	if n.RunID != "" {
+		body += fmt.Sprintf("\r\nRun ID: %s\r\n", n.RunID)
+	}
+	return e.send(ctx, fmt.Sprintf("[beackup] %s %s", n.Database, n.Event), n.Time, "text/plain", []byte(body))
+}
+
+// send mails a message with the given subject and body
+func (e *emailNotifier) send(ctx context.Context, subject string, date time.Time, contentType string, body []byte) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: %s; charset=utf-8\r\n\r\n", contentType)
+	msg.Write(body)
+
+	// net/smtp has no context support, so bound it from the outside
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(e.addr, e.auth, e.from, e.to, msg.Bytes())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// postJSON sends payload to url as a JSON POST request
+func postJSON(ctx context.Context, url string, headers map[string]string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Classes of backup failures, matched with errors.Is on the errors of the
+// results of RunOnce
+var (
+	ErrDumpFailed   = errors.New("dump failed")
+	ErrUploadFailed = errors.New("upload failed")
+	ErrVerifyFailed = errors.New("verification failed")
+)
+
+// classifiedError puts err in a class of failures without changing its
+// message
+type classifiedError struct {
+	err   error
+	class error
+}
+
+func (e classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e classifiedError) Unwrap() []error {
+	return []error{e.err, e.class}
+}
+
+// failedWith puts err, if any, in the class of failures
+func failedWith(class, err error) error {
+	if err == nil {
+		return nil
+	}
+	return classifiedError{err: err, class: class}
+}
+
+// failureClass names the class of a failed backup's error
+func failureClass(err error) string {
+	switch {
+	case errors.Is(err, ErrDumpFailed):
+		return "dump"
+	case errors.Is(err, ErrUploadFailed):
+		return "upload"
+	case errors.Is(err, ErrVerifyFailed):
+		return "verification"
+	default:
+		return "other"
+	}
+}
+
+// BackupResult is the outcome of a backup run by RunOnce
+type BackupResult struct {
+	Database        string    `json:"database"`
+	Status          string    `json:"status"`            // success or failure
+	Failure         string    `json:"failure,omitempty"` // dump, upload, verification or other
+	Error           string    `json:"error,omitempty"`
+	File            string    `json:"file,omitempty"`
+	Path            string    `json:"path,omitempty"`            // local copy, if kept
+	RemoteLocation  string    `json:"remote_location,omitempty"` // storage type and key of the uploaded copy
+	Size            int64     `json:"size"`
+	SHA256          string    `json:"sha256,omitempty"`
+	Verification    string    `json:"verification,omitempty"`
+	StartedAt       time.Time `json:"started_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+
+	// Err is why the backup failed, in the classes of ErrDumpFailed,
+	// ErrUploadFailed and ErrVerifyFailed where they apply
+	Err error `json:"-"`
+}
+
+// RunOnce backs up the database with id dbID, or every database if empty,
+// once and returns the results. Databases are backed up concurrently up to
+// max_concurrent. It returns an error only if no backup could be started.
+func (bt *Tool) RunOnce(ctx context.Context, dbID string) ([]BackupResult, error) {
+	jobs := bt.jobs
+	if dbID != "" {
+		jobs = nil
+		for _, job := range bt.jobs {
+			if job.db.ID == dbID {
+				jobs = append(jobs, job)
+			}
+		}
+		if len(jobs) == 0 {
+			return nil, fmt.Errorf("no database with id %q", dbID)
+		}
+	}
+	if err := bt.createOutputDirs(); err != nil {
+		return nil, err
+	}
+
+	results := make([]BackupResult, len(jobs))
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started := time.Now()
+			var m *backupManifest
+			var err error
+			ran := false
+			slotErr := bt.withSlot(ctx, job, func() {
+				ran = true
+				m, err = bt.performBackup(ctx, job)
+			})
+			switch {
+			case slotErr != nil:
+				err = slotErr
+			case !ran:
+				err = fmt.Errorf("backup did not run: %w", context.Cause(ctx))
+			}
+			results[i] = bt.backupResult(job, m, started, err)
+		}()
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// PrintBackupResults prints the results of RunOnce, as JSON if asJSON is
+// set
+func PrintBackupResults(w io.Writer, results []BackupResult, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATABASE\tSTATUS\tFILE\tSIZE\tDURATION\tERROR")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Database, r.Status, valueOrDash(r.File),
+			formatBytes(r.Size), time.Duration(r.DurationSeconds*float64(time.Second)).Round(time.Millisecond), valueOrDash(r.Error))
+	}
+	return tw.Flush()
+}
+
+// backupResult describes the backup of job started at started, with
+// manifest m if it got as far as writing one
+func (bt *Tool) backupResult(job *databaseJob, m *backupManifest, started time.Time, err error) BackupResult {
+	r := BackupResult{
+		Database:        job.db.ID,
+		Status:          "success",
+		StartedAt:       started,
+		DurationSeconds: time.Since(started).Seconds(),
+	}
+	if err != nil {
+		r.Status = "failure"
+		r.Failure = failureClass(err)
+		r.Error = err.Error()
+		r.Err = err
+	}
+	if m == nil {
+		return r
+	}
+	r.File = m.File
+	r.Size = m.Size
+	r.SHA256 = m.SHA256
+	r.Verification = m.Verification
+	r.RemoteLocation = bt.remoteLocation(job, m)
+	localPath := filepath.Join(job.outputDir, m.File)
+	if _, err := os.Stat(localPath); err == nil {
+		r.Path, _ = filepath.Abs(localPath)
+	}
+	return r
+}
+
+// remoteLocation returns the storage type and key of the uploaded copy of
+// the backup m of job, empty if it was not uploaded
+func (bt *Tool) remoteLocation(job *databaseJob, m *backupManifest) string {
+	if !m.Uploaded {
+		return ""
+	}
+	key := path.Join(job.db.ID, filepath.ToSlash(m.File))
+	if m.Dedup {
+		key = snapshotKey(job.db.ID, m.File)
+	}
+	return bt.config.Storage.Type + ":" + key
+}
@@ -0,0 +1,178 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// processFilter pipes written data through an external command such as zstd
+// or age, sending the command's output to the underlying writer
+type processFilter struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stderr  bytes.Buffer
+	cleanup func()
+}
+
+// newProcessFilter starts name with args, writing its output to w
+func newProcessFilter(w io.Writer, name string, args ...string) (*processFilter, error) {
+	f := &processFilter{cmd: exec.Command(name, args...)}
+	f.cmd.Stdout = w
+	f.cmd.Stderr = &f.stderr
+
+	stdin, err := f.cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s pipe: %w", name, err)
+	}
+	f.stdin = stdin
+
+	if err := f.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", name, err)
+	}
+	return f, nil
+}
+
+func (f *processFilter) Write(p []byte) (int, error) {
+	return f.stdin.Write(p)
+}
+
+// Close signals end of input and waits for the command to finish
+func (f *processFilter) Close() error {
+	f.stdin.Close()
+	err := f.cmd.Wait()
+	if f.cleanup != nil {
+		f.cleanup()
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %w, output: %s", f.cmd.Path, err, f.stderr.String())
+	}
+	return nil
+}
+
+// processReader exposes the output of an external command fed from a reader
+type processReader struct {
+	cmd     *exec.Cmd
+	stdout  io.ReadCloser
+	stderr  bytes.Buffer
+	cleanup func()
+}
+
+// newProcessReader starts name with args, feeding it r on standard input
+func newProcessReader(r io.Reader, name string, args ...string) (*processReader, error) {
+	p := &processReader{cmd: exec.Command(name, args...)}
+	p.cmd.Stdin = r
+	p.cmd.Stderr = &p.stderr
+
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s pipe: %w", name, err)
+	}
+	p.stdout = stdout
+
+	if err := p.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", name, err)
+	}
+	return p, nil
+}
+
+func (p *processReader) Read(b []byte) (int, error) {
+	return p.stdout.Read(b)
+}
+
+// Close waits for the command to finish. Commands are expected to have been
+// read to completion; closing early kills them.
+func (p *processReader) Close() error {
+	p.stdout.Close()
+	err := p.cmd.Wait()
+	if p.cleanup != nil {
+		p.cleanup()
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %w, output: %s", p.cmd.Path, err, p.stderr.String())
+	}
+	return nil
+}
+
+// writeChain is a stack of writers where each stage writes into the next.
+// Closing it closes every stage, outermost first, so each can flush.
+type writeChain struct {
+	stages []io.WriteCloser
+}
+
+// newWriteChain starts a chain that ends in w. w itself is not closed.
+func newWriteChain(w io.Writer) *writeChain {
+	return &writeChain{stages: []io.WriteCloser{nopWriteCloser{w}}}
+}
+
+// head returns the writer a new stage should write into
+func (c *writeChain) head() io.Writer {
+	return c.stages[0]
+}
+
+// wrap adds a stage in front of the chain
+func (c *writeChain) wrap(stage io.WriteCloser) {
+	c.stages = append([]io.WriteCloser{stage}, c.stages...)
+}
+
+func (c *writeChain) Write(p []byte) (int, error) {
+	return c.stages[0].Write(p)
+}
+
+func (c *writeChain) Close() error {
+	var firstErr error
+	for _, stage := range c.stages {
+		if err := stage.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// readChain is a stack of readers where each stage reads from the previous.
+// Closing it closes every stage, outermost first.
+type readChain struct {
+	stages []io.ReadCloser
+}
+
+// newReadChain starts a chain that reads from r
+func newReadChain(r io.ReadCloser) *readChain {
+	return &readChain{stages: []io.ReadCloser{r}}
+}
+
+// head returns the reader a new stage should read from
+func (c *readChain) head() io.Reader {
+	return c.stages[0]
+}
+
+// wrap adds a stage on top of the chain
+func (c *readChain) wrap(stage io.ReadCloser) {
+	c.stages = append([]io.ReadCloser{stage}, c.stages...)
+}
+
+func (c *readChain) Read(p []byte) (int, error) {
+	return c.stages[0].Read(p)
+}
+
+func (c *readChain) Close() error {
+	var firstErr error
+	for _, stage := range c.stages {
+		if err := stage.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// runCommand runs a command to completion and returns its combined output
+func runCommand(name string, args ...string) (string, error) {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	return string(output), err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,705 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"beackup/config"
+)
+
+// baseBackupFormat is the manifest format of pg_basebackup backups
+const baseBackupFormat = "basebackup"
+
+// walDir is the subdirectory of a database's output directory, and of its
+// remote prefix, holding archived WAL
+const walDir = "wal"
+
+// walIncomingDir is the subdirectory of a database's output directory
+// pg_receivewal writes segments to
+const walIncomingDir = "wal_incoming"
+
+// walFileName matches complete WAL segments, timeline history files and
+// backup history files, but not pg_receivewal's .partial segments
+var walFileName = regexp.MustCompile(`^[0-9A-F]{24}(\.[0-9A-F]{8}\.backup)?$|^[0-9A-F]{8}\.history$`)
+
+// walSourceDir returns the directory new WAL segments appear in
+func (job *databaseJob) walSourceDir() string {
+	if job.db.WAL.Mode == config.WALArchive {
+		return job.db.WAL.ArchiveDir
+	}
+	return filepath.Join(job.outputDir, walIncomingDir)
+}
+
+// runWALArchiver archives WAL segments as they appear until ctx is
+// cancelled, running pg_receivewal alongside in receivewal mode. Segments
+// are archived under runCtx.
+func (bt *Tool) runWALArchiver(ctx, runCtx context.Context, job *databaseJob) {
+	job.logger.Info("Archiving WAL", "mode", job.db.WAL.Mode, "dir", job.walSourceDir())
+
+	var wg sync.WaitGroup
+	if job.db.WAL.Mode == config.WALReceive {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bt.receiveWAL(ctx, job)
+		}()
+	}
+
+	ticker := time.NewTicker(job.db.WAL.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := bt.archiveSegments(runCtx, job); err != nil {
+			job.logger.Error("WAL archiving failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// receiveWAL keeps pg_receivewal running, restarting it with a growing
+// delay whenever it exits
+func (bt *Tool) receiveWAL(ctx context.Context, job *databaseJob) {
+	policy := bt.config.Backup.Retry
+	delay := policy.Backoff
+
+	for {
+		started := time.Now()
+		err := bt.runReceiveWAL(ctx, job)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > policy.MaxInterval {
+			delay = policy.Backoff
+		}
+
+		job.logger.Error("pg_receivewal stopped, restarting", "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, policy.MaxInterval)
+	}
+}
+
+// runReceiveWAL runs pg_receivewal until it exits, creating the
+// replication slot first if one is configured
+func (bt *Tool) runReceiveWAL(ctx context.Context, job *databaseJob) error {
+	dir := job.walSourceDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create WAL directory: %w", err)
+	}
+	db := *job.db
+	var err error
+	db.Password, err = bt.resolvePassword(ctx, job.db)
+	if err != nil {
+		return err
+	}
+
+	args := replicationArgs(&db)
+	if slot := db.WAL.Slot; slot != "" {
+		create := commandContext(ctx, "pg_receivewal", append(args, "--slot="+slot, "--create-slot", "--if-not-exists")...)
+		create.Env = pgEnv(&db)
+		if output, err := create.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to create replication slot: %w, output: %s", err, output)
+		}
+		args = append(args, "--slot="+slot)
+	}
+
+	cmd := commandContext(ctx, "pg_receivewal", append(args, "--directory="+dir, "--no-loop")...)
+	cmd.Env = pgEnv(&db)
+
+	job.logger.Debug("Running pg_receivewal", "command", redactedCommand(cmd, &db))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("pg_receivewal failed: %w, output: %s", err, output)
+	}
+	return fmt.Errorf("pg_receivewal exited, output: %s", output)
+}
+
+// archiveSegments archives every complete segment in the source directory
+// in order, removing each from there once it is stored
+func (bt *Tool) archiveSegments(ctx context.Context, job *databaseJob) error {
+	src := job.walSourceDir()
+	entries, err := os.ReadDir(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read WAL directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !walFileName.MatchString(entry.Name()) {
+			continue
+		}
+		segment := filepath.Join(src, entry.Name())
+		if err := bt.archiveSegment(ctx, job, segment); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", entry.Name(), err)
+		}
+		if err := os.Remove(segment); err != nil {
+			return fmt.Errorf("failed to remove archived segment: %w", err)
+		}
+	}
+	return nil
+}
+
+// archiveSegment compresses and encrypts a WAL file into the database's
+// WAL directory and uploads it
+func (bt *Tool) archiveSegment(ctx context.Context, job *databaseJob, segment string) error {
+	compression := bt.config.Backup.Compression
+	dir := filepath.Join(job.outputDir, walDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create WAL directory: %w", err)
+	}
+	outputPath := filepath.Join(dir, filepath.Base(segment)+compression.Extension()+bt.config.Encryption.Extension())
+
+	src, err := os.Open(segment)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := outputPath + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	chain, err := bt.newDumpWriter(file, compression.Enabled())
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	_, copyErr := io.Copy(chain, src)
+	chainErr := chain.Close()
+	closeErr := file.Close()
+	if err := errors.Join(copyErr, chainErr, closeErr); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, outputPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	job.logger.Debug("Archived WAL segment", "file", outputPath)
+
+	if bt.storage != nil {
+		if err := bt.uploadBackup(ctx, job, outputPath, "", nil); err != nil {
+			return fmt.Errorf("upload failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// performBaseBackup takes a physical backup of the database's cluster with
+// pg_basebackup. It carries no WAL of its own: restoring it replays the
+// archived WAL from the segment recorded in the manifest onwards.
+func (bt *Tool) performBaseBackup(ctx context.Context, job *databaseJob) error {
+	logger := job.logger.With("format", baseBackupFormat)
+	logger.Info("Starting base backup")
+	start := time.Now()
+
+	compression := bt.config.Backup.Compression
+	encryption := bt.config.Encryption
+
+	name, err := bt.config.Backup.Naming.Name(job.db, baseBackupFormat, start)
+	if err != nil {
+		return err
+	}
+	filename := name + "_base.tar" + compression.Extension() + encryption.Extension()
+	outputPath := filepath.Join(job.outputDir, filename)
+	if err := prepareOutput(outputPath); err != nil {
+		return err
+	}
+
+	db := *job.db
+	db.Password, err = bt.resolvePassword(ctx, job.db)
+	if err != nil {
+		return err
+	}
+	closeTunnel, err := openTunnel(ctx, &db)
+	if err != nil {
+		return err
+	}
+	defer closeTunnel()
+
+	// The backup's checkpoint comes after the current WAL position, so
+	// nothing before this segment is needed to restore it
+	walStart, err := queryValue(ctx, &db, "SELECT pg_walfile_name(pg_current_wal_lsn())")
+	if err != nil {
+		logger.Warn("Failed to query current WAL segment, older WAL will be kept", "error", err)
+		walStart = ""
+	}
+	serverVersion, err := queryValue(ctx, &db, "SHOW server_version")
+	if err != nil {
+		logger.Warn("Failed to query server version", "error", err)
+	}
+
+	err = bt.retry(ctx, logger, "pg_basebackup", func() error {
+		args := append(replicationArgs(&db),
+			"--pgdata=-",
+			"--format=tar",
+			"--wal-method=none",
+			"--checkpoint=fast",
+			"--label=beackup",
+		)
+		cmd := commandContext(ctx, "pg_basebackup", args...)
+		cmd.Env = pgEnv(&db)
+		applyPriority(bt.config.Backup.Priority, cmd)
+
+		logger.Debug("Running pg_basebackup", "command", redactedCommand(cmd, &db))
+		_, err := bt.streamDump(ctx, "pg_basebackup", cmd, outputPath, compression.Enabled(), nil, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	size, err := artifactSize(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to measure backup: %w", err)
+	}
+	checksum, err := artifactChecksum(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to checksum backup: %w", err)
+	}
+	finished := time.Now()
+
+	var verification string
+	if bt.config.Backup.Verify {
+		err := bt.verifyBackup(ctx, job, outputPath)
+		switch {
+		case errors.Is(err, errVerifySkipped):
+			logger.Warn("Backup not verified", "error", err)
+			verification = verifySkipped
+		case err != nil:
+			return fmt.Errorf("verification failed: %w", err)
+		default:
+			verification = verifyPassed
+		}
+	}
+
+	manifest := &backupManifest{
+		Database:      job.db.ID,
+		DatabaseName:  job.db.Name,
+		File:          filename,
+		Format:        baseBackupFormat,
+		ServerVersion: serverVersion,
+		WALStart:      walStart,
+		RunID:         job.currentRunID(),
+		CreatedAt:     start,
+		FinishedAt:    finished,
+		Size:          size,
+		SHA256:        checksum,
+		Verification:  verification,
+	}
+	if compression.Enabled() {
+		manifest.Compression = compression.Algorithm
+	}
+	if encryption.Enabled() {
+		manifest.Encryption = encryption.Type
+	}
+	if err := bt.writeMeta(ctx, job, manifest); err != nil {
+		logger.Warn("Failed to record backup meta", "error", err)
+	}
+	if err := bt.writeManifest(job.outputDir, manifest); err != nil {
+		return err
+	}
+
+	if bt.storage != nil {
+		if err := bt.uploadBackup(ctx, job, outputPath, manifest.SHA256, nil); err != nil {
+			return fmt.Errorf("upload failed: %w", err)
+		}
+		manifest.Uploaded = true
+		if err := bt.writeManifest(job.outputDir, manifest); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Base backup completed successfully", "file", outputPath, "size", size, "duration", time.Since(start))
+	return nil
+}
+
+// runBaseBackup performs a base backup on its own schedule, followed by the
+// retention and catalog updates a database backup would do
+func (bt *Tool) runBaseBackup(ctx context.Context, job *databaseJob) {
+	ctx, run := bt.startRun(ctx, job, "base backup")
+	err := bt.performBaseBackup(ctx, job)
+	defer bt.endRun(job, run, err)
+	if err != nil {
+		job.logger.Error("Base backup failed", "error", err)
+		bt.notify(job, notification{Event: eventFailure, Error: "base backup failed: " + err.Error()})
+		return
+	}
+
+	if err := bt.cleanupOldBackups(ctx, job); err != nil {
+		job.logger.Warn("Failed to cleanup old backups", "error", err)
+	}
+	if err := bt.updateCatalog(); err != nil {
+		job.logger.Warn("Failed to update catalog", "error", err)
+	}
+}
+
+// baseBackupDue reports whether the newest base backup is older than the
+// base backup frequency, so a restart does not take a needless one
+func (bt *Tool) baseBackupDue(job *databaseJob) bool {
+	manifests, err := loadManifests(job.outputDir)
+	if err != nil {
+		return true
+	}
+	for _, m := range manifests {
+		if m.Format == baseBackupFormat && !m.failed() {
+			return time.Since(m.CreatedAt) >= job.db.WAL.BaseBackupFrequency
+		}
+	}
+	return true
+}
+
+// cleanupWAL removes archived WAL older than the oldest remaining base
+// backup needs. Nothing is removed while any base backup lacks a recorded
+// start segment.
+func (bt *Tool) cleanupWAL(ctx context.Context, job *databaseJob, manifests []*backupManifest) error {
+	var oldest string
+	for _, m := range manifests {
+		if m.Format != baseBackupFormat {
+			continue
+		}
+		if m.WALStart == "" {
+			return nil
+		}
+		if oldest == "" || walPosition(m.WALStart) < walPosition(oldest) {
+			oldest = m.WALStart
+		}
+	}
+	if oldest == "" {
+		return nil
+	}
+	obsolete := func(name string) bool {
+		name = stripArtifactExtensions(name)
+		return walFileName.MatchString(name) && !strings.HasSuffix(name, ".history") &&
+			walPosition(name) < walPosition(oldest)
+	}
+
+	dir := filepath.Join(job.outputDir, walDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	removed := 0
+	for _, entry := range entries {
+		if !obsolete(entry.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+		removed++
+	}
+
+	if bt.storage != nil {
+		prefix := path.Join(job.db.ID, walDir) + "/"
+		objects, err := bt.storage.List(ctx, prefix)
+		if err != nil {
+			return fmt.Errorf("failed to list remote WAL: %w", err)
+		}
+		for _, object := range objects {
+			if !obsolete(path.Base(object.Key)) {
+				continue
+			}
+			if err := bt.storage.Delete(ctx, object.Key); err != nil {
+				return fmt.Errorf("failed to delete remote WAL: %w", err)
+			}
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		job.logger.Info("Removed old WAL", "files", removed, "before", oldest)
+	}
+	return nil
+}
+
+// walPosition returns the log and segment part of a WAL file name, which
+// orders segments independently of their timeline
+func walPosition(name string) string {
+	if len(name) < 24 {
+		return ""
+	}
+	return name[8:24]
+}
+
+// verifyBaseBackup checks that a base backup is a readable tar archive
+// holding a backup_label
+func verifyBaseBackup(r io.Reader) error {
+	archive := tar.NewReader(r)
+	hasLabel := false
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read base backup: %w", err)
+		}
+		if path.Clean(header.Name) == "backup_label" {
+			hasLabel = true
+		}
+	}
+	if !hasLabel {
+		return fmt.Errorf("base backup has no backup_label")
+	}
+	return nil
+}
+
+// RestoreBaseBackup extracts a base backup into dataDir, which must not
+// exist or be empty. With WAL archiving configured it also sets up recovery
+// to fetch archived WAL through the wal-fetch subcommand, so that starting
+// PostgreSQL on dataDir replays WAL up to targetTime, or to the end of the
+// archive if it is empty.
+func (bt *Tool) RestoreBaseBackup(ctx context.Context, dbID, backupPath, dataDir, targetTime string) error {
+	job, err := bt.findRestoreJob(dbID, backupPath)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(backupPath)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	if targetTime != "" && !job.db.WAL.Enabled() {
+		return fmt.Errorf("a target time needs WAL archiving to be configured for database %q", job.db.ID)
+	}
+	if targetTime != "" {
+		t, err := time.Parse(time.RFC3339, targetTime)
+		if err != nil {
+			return fmt.Errorf("invalid target time, expected RFC 3339: %w", err)
+		}
+		targetTime = t.Format("2006-01-02 15:04:05.999999Z07:00")
+	}
+
+	if entries, err := os.ReadDir(dataDir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("data directory %s is not empty", dataDir)
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	job.logger.Info("Restoring base backup", "file", backupPath, "data_dir", dataDir, "target_time", targetTime)
+
+	if info.IsDir() {
+		err = bt.restoreBaseBackupDir(backupPath, dataDir)
+	} else {
+		err = bt.extractBackup(backupPath, dataDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !job.db.WAL.Enabled() {
+		job.logger.Info("Base backup restored, start PostgreSQL on the data directory", "data_dir", dataDir)
+		return nil
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate beackup executable: %w", err)
+	}
+	configPath, err := filepath.Abs(bt.configPath)
+	if err != nil {
+		return err
+	}
+
+	settings := fmt.Sprintf("\n# Added by beackup restore\nrestore_command = %s\n",
+		pgQuote(fmt.Sprintf("%s wal-fetch %s %s %%f %%p", strconv.Quote(executable), strconv.Quote(configPath), strconv.Quote(job.db.ID))))
+	if targetTime != "" {
+		settings += fmt.Sprintf("recovery_target_time = %s\nrecovery_target_action = 'promote'\n", pgQuote(targetTime))
+	}
+
+	conf, err := os.OpenFile(filepath.Join(dataDir, "postgresql.auto.conf"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write recovery settings: %w", err)
+	}
+	_, writeErr := conf.WriteString(settings)
+	if err := errors.Join(writeErr, conf.Close()); err != nil {
+		return fmt.Errorf("failed to write recovery settings: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "recovery.signal"), nil, 0600); err != nil {
+		return fmt.Errorf("failed to write recovery.signal: %w", err)
+	}
+
+	job.logger.Info("Base backup restored, start PostgreSQL on the data directory to replay WAL", "data_dir", dataDir)
+	return nil
+}
+
+// extractTar unpacks a tar stream into dir, refusing entries that would
+// land outside it
+func extractTar(r io.Reader, dir string) error {
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read base backup: %w", err)
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if target != dir && !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("base backup entry %q escapes the data directory", header.Name)
+		}
+
+		mode := os.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+			if err != nil {
+				return err
+			}
+			_, copyErr := io.Copy(file, archive)
+			if err := errors.Join(copyErr, file.Close()); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// pgQuote quotes a value for postgresql.conf
+func pgQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// fetchWAL writes the archived WAL file name to dest, looking in the local
+// WAL directory first and then in remote storage
+func (bt *Tool) fetchWAL(ctx context.Context, job *databaseJob, name, dest string) error {
+	dir := filepath.Join(job.outputDir, walDir)
+	source := ""
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if stripArtifactExtensions(entry.Name()) == name {
+			source = filepath.Join(dir, entry.Name())
+			break
+		}
+	}
+
+	if source == "" && bt.storage != nil {
+		prefix := path.Join(job.db.ID, walDir, name)
+		objects, err := bt.storage.List(ctx, prefix)
+		if err != nil {
+			return fmt.Errorf("failed to list remote WAL: %w", err)
+		}
+		for _, object := range objects {
+			base := path.Base(object.Key)
+			if stripArtifactExtensions(base) != name {
+				continue
+			}
+			// openBackup works out decryption and decompression from the
+			// file name, so the download keeps it
+			tmpDir, err := os.MkdirTemp("", "beackup-wal-")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(tmpDir)
+			source = filepath.Join(tmpDir, base)
+			if err := bt.download(ctx, object.Key, source); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	if source == "" {
+		return ErrWALNotFound
+	}
+
+	reader, err := bt.openBackup(source)
+	if err != nil {
+		return err
+	}
+	tmp := dest + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		reader.Close()
+		return err
+	}
+	_, copyErr := io.Copy(file, reader)
+	if err := errors.Join(copyErr, reader.Close(), file.Close()); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to restore %s: %w", name, err)
+	}
+	return os.Rename(tmp, dest)
+}
+
+// ErrWALNotFound is returned for WAL files missing from the archive, which
+// PostgreSQL expects at the end of recovery
+var ErrWALNotFound = errors.New("WAL file not found in archive")
+
+// FetchWAL copies the WAL file name of database dbID from the archive to
+// dest, as PostgreSQL's restore_command. It returns ErrWALNotFound for
+// files missing from the archive, which PostgreSQL treats as the end of the
+// available WAL.
+func (bt *Tool) FetchWAL(ctx context.Context, dbID, name, dest string) error {
+	job, err := bt.findRestoreJob(dbID, "")
+	if err != nil {
+		bt.logger.Error("Failed to fetch WAL", "file", name, "error", err)
+		return err
+	}
+
+	err = bt.fetchWAL(ctx, job, name, dest)
+	switch {
+	case errors.Is(err, ErrWALNotFound):
+		job.logger.Debug("WAL file not in archive", "file", name)
+	case err != nil:
+		job.logger.Error("Failed to fetch WAL", "file", name, "error", err)
+	default:
+		job.logger.Info("Fetched WAL", "file", name)
+	}
+	return err
+}
+
+// download copies a remote object to a local file
+func (bt *Tool) download(ctx context.Context, key, dest string) error {
+	return bt.retry(ctx, bt.logger, "download", func() error {
+		body, err := bt.storage.Get(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to download %s: %w", key, err)
+		}
+		defer body.Close()
+
+		file, err := os.Create(dest)
+		if err != nil {
+			return err
+		}
+		_, copyErr := io.Copy(file, body)
+		if err := errors.Join(copyErr, file.Close()); err != nil {
+			return fmt.Errorf("failed to download %s: %w", key, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,350 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"beackup/config"
+)
+
+// sslEnv returns the libpq environment variables for the SSL settings
+func sslEnv(s config.SSL) []string {
+	var env []string
+	for name, value := range map[string]string{
+		"PGSSLMODE":     s.Mode,
+		"PGSSLROOTCERT": s.RootCert,
+		"PGSSLCERT":     s.Cert,
+		"PGSSLKEY":      s.Key,
+	} {
+		if value != "" {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// connectionArgs returns the libpq connection flags shared by pg_dump,
+// pg_restore and psql
+func connectionArgs(db *config.Database) []string {
+	return []string{
+		"-h", db.Host,
+		"-p", fmt.Sprintf("%d", db.Port),
+		"-U", db.User,
+		"-d", db.Name,
+		"--no-password",
+	}
+}
+
+// replicationArgs returns the connection flags for pg_basebackup and
+// pg_receivewal, which connect to the cluster rather than a database
+func replicationArgs(db *config.Database) []string {
+	return []string{
+		"-h", db.Host,
+		"-p", fmt.Sprintf("%d", db.Port),
+		"-U", db.User,
+		"--no-password",
+	}
+}
+
+// filterArgs returns the pg_dump flags selecting the schemas and tables to
+// dump. pg_dump expands the wildcards in each pattern itself.
+func filterArgs(db *config.Database) []string {
+	var args []string
+	for _, pattern := range db.IncludeSchemas {
+		args = append(args, "--schema="+pattern)
+	}
+	for _, pattern := range db.ExcludeSchemas {
+		args = append(args, "--exclude-schema="+pattern)
+	}
+	for _, pattern := range db.IncludeTables {
+		args = append(args, "--table="+pattern)
+	}
+	for _, pattern := range db.ExcludeTables {
+		args = append(args, "--exclude-table="+pattern)
+	}
+	return args
+}
+
+// pgEnv returns the environment for a PostgreSQL client command
+func pgEnv(db *config.Database) []string {
+	env := append(os.Environ(),
+		fmt.Sprintf("PGPASSWORD=%s", db.Password),
+	)
+	env = append(env, sslEnv(db.SSL)...)
+	return append(env, db.DSNEnv...)
+}
+
+// queryValue runs a single-value query with psql and returns the result
+func queryValue(ctx context.Context, db *config.Database, query string) (string, error) {
+	args := append(connectionArgs(db), "--tuples-only", "--no-align", "--command", query)
+	cmd := commandContext(ctx, "psql", args...)
+	cmd.Env = pgEnv(db)
+	remoteCommand(db, cmd)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("psql failed: %w, output: %s", err, stderr.String())
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// toolVersion returns the version reported by a PostgreSQL client binary,
+// e.g. "16.2" from "pg_dump (PostgreSQL) 16.2", in db's container if it has one
+func toolVersion(ctx context.Context, db *config.Database, name string) (string, error) {
+	cmd := commandContext(ctx, name, "--version")
+	remoteCommand(db, cmd)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s --version: %w", name, err)
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("%s --version printed nothing", name)
+	}
+	return fields[len(fields)-1], nil
+}
+
+// postgresDriver backs up PostgreSQL with pg_dump, or pg_basebackup for
+// the basebackup format, and restores with pg_restore or psql
+type postgresDriver struct{}
+
+func (postgresDriver) validate(db *config.Database, defaultFormat string) error {
+	if db.Port == 0 {
+		db.Port = 5432
+	}
+	if db.Format == "" {
+		db.Format = defaultFormat
+	}
+	switch db.Format {
+	case "custom", "plain", "tar", "directory", baseBackupFormat, copyFormat:
+	default:
+		return fmt.Errorf("unknown format %q", db.Format)
+	}
+	if db.Format == copyFormat {
+		if _, err := copyConnection(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (postgresDriver) tool(db *config.Database) string {
+	if db.Format == baseBackupFormat {
+		return "pg_basebackup"
+	}
+	return "pg_dump"
+}
+
+func (postgresDriver) extension(db *config.Database) string {
+	switch db.Format {
+	case "plain":
+		return ".sql"
+	case "tar":
+		return ".tar"
+	case "directory":
+		return ""
+	case baseBackupFormat:
+		return "_base"
+	case copyFormat:
+		return "_copy"
+	default: // custom
+		return ".dump"
+	}
+}
+
+// Directory, base and copy backups are written as directories, which can
+// only be created by the dump programs themselves
+func (postgresDriver) streams(db *config.Database) bool {
+	return db.Format != "directory" && db.Format != baseBackupFormat && db.Format != copyFormat
+}
+
+func (postgresDriver) compresses(db *config.Database) bool {
+	return db.Format == "custom" || db.Format == "directory" || db.Format == baseBackupFormat || db.Format == copyFormat
+}
+
+func (d postgresDriver) programs(db *config.Database) []string {
+	programs := []string{d.tool(db), "psql"}
+	if db.Format != baseBackupFormat {
+		programs = append(programs, "pg_restore")
+	}
+	if db.WAL.Mode == config.WALReceive {
+		programs = append(programs, "pg_receivewal")
+	}
+	if db.WAL.Enabled() && db.Format != baseBackupFormat {
+		programs = append(programs, "pg_basebackup")
+	}
+	return programs
+}
+
+func (postgresDriver) ping(ctx context.Context, db *config.Database) (string, error) {
+	return queryValue(ctx, db, "SHOW server_version")
+}
+
+func (postgresDriver) size(ctx context.Context, db *config.Database) (int64, error) {
+	value, err := queryValue(ctx, db, "SELECT pg_database_size(current_database())")
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid database size %q", value)
+	}
+	return size, nil
+}
+
+func (d postgresDriver) versions(ctx context.Context, logger *slog.Logger, db *config.Database) (string, string) {
+	server, err := queryValue(ctx, db, "SHOW server_version")
+	if err != nil {
+		logger.Warn("Failed to query server version", "error", err)
+	}
+	// pg_basebackup copies files and does not depend on its version the
+	// way a logical dump does
+	if db.Format == baseBackupFormat {
+		return server, ""
+	}
+	tool, err := toolVersion(ctx, db, "pg_dump")
+	if err != nil {
+		logger.Warn("Failed to determine pg_dump version", "error", err)
+	}
+	return server, tool
+}
+
+func (postgresDriver) dumpCommand(ctx context.Context, db *config.Database, outputPath string, compression config.Compression) (*exec.Cmd, func(), error) {
+	var cmd *exec.Cmd
+	switch db.Format {
+	case baseBackupFormat:
+		cmd = buildBaseBackupCommand(ctx, db, outputPath, compression)
+	case copyFormat:
+		// Only the schema dump; the tables are exported by exportTables
+		cmd = buildSchemaDumpCommand(ctx, db, filepath.Join(outputPath, copySchemaFile), compression, "")
+	default:
+		cmd = buildPgDumpCommand(ctx, db, outputPath, compression)
+	}
+	cmd.Env = pgEnv(db)
+	remoteCommand(db, cmd)
+	return cmd, noCleanup, nil
+}
+
+func (postgresDriver) restoreCommand(ctx context.Context, db *config.Database, format string) (*exec.Cmd, func(), error) {
+	cmd := buildRestoreCommand(ctx, db, format)
+	cmd.Env = pgEnv(db)
+	remoteCommand(db, cmd)
+	return cmd, noCleanup, nil
+}
+
+func (postgresDriver) verify(ctx context.Context, db *config.Database, r io.Reader, format string) error {
+	if format == "plain" {
+		return verifyPlainDump(r)
+	}
+	cmd := commandContext(ctx, "pg_restore", "--list", "--format="+format)
+	remoteCommand(db, cmd)
+	setStdin(cmd, r)
+	return verifyArchive(cmd)
+}
+
+func (postgresDriver) createDatabase(ctx context.Context, db *config.Database) error {
+	_, err := queryValue(ctx, pgMaintenanceDatabase(db), "CREATE DATABASE "+quoteIdent(db.Name))
+	return err
+}
+
+func (postgresDriver) dropDatabase(ctx context.Context, db *config.Database) error {
+	_, err := queryValue(ctx, pgMaintenanceDatabase(db), "DROP DATABASE IF EXISTS "+quoteIdent(db.Name))
+	return err
+}
+
+// pgRowCountQuery counts the rows of every table exactly, with one
+// "schema.table|count" line per table
+const pgRowCountQuery = `SELECT table_schema || '.' || table_name,
+	(xpath('/row/c/text()', query_to_xml(format('SELECT count(*) AS c FROM %I.%I', table_schema, table_name), false, true, '')))[1]::text
+FROM information_schema.tables
+WHERE table_type = 'BASE TABLE' AND table_schema NOT IN ('pg_catalog', 'information_schema')`
+
+func (postgresDriver) rowCounts(ctx context.Context, db *config.Database) (map[string]int64, error) {
+	output, err := queryValue(ctx, db, pgRowCountQuery)
+	if err != nil {
+		return nil, err
+	}
+	return parseRowCounts(output, "|")
+}
+
+func (postgresDriver) query(ctx context.Context, db *config.Database, query string) (string, error) {
+	return queryValue(ctx, db, query)
+}
+
+// pgMaintenanceDatabase returns db connected to the postgres database, from
+// which databases are created and dropped
+func pgMaintenanceDatabase(db *config.Database) *config.Database {
+	maintenance := *db
+	maintenance.Name = "postgres"
+	return &maintenance
+}
+
+// quoteIdent quotes a PostgreSQL identifier
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (postgresDriver) fatalPatterns() []string {
+	return []string{
+		": error:",
+		"FATAL:",
+		"PANIC:",
+		"server closed the connection unexpectedly",
+		"could not write to output file",
+		"No space left on device",
+	}
+}
+
+// pgMajorVersion returns the major version of a PostgreSQL version string
+// such as "16.2 (Debian 16.2-1)" or "9.6.24" as a comparable number, e.g.
+// 1600 or 906
+func pgMajorVersion(version string) (int, error) {
+	fields := strings.Fields(version)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty version")
+	}
+	parts := strings.FieldsFunc(fields[0], func(r rune) bool { return r < '0' || r > '9' })
+	if len(parts) == 0 {
+		return 0, fmt.Errorf("invalid version %q", version)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid version %q", version)
+	}
+	// Before PostgreSQL 10 the major version had two components
+	if major < 10 && len(parts) > 1 {
+		minor, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid version %q", version)
+		}
+		return major*100 + minor, nil
+	}
+	return major * 100, nil
+}
+
+// checkPgDumpVersion returns an error if pg_dump is older than the server,
+// which pg_dump refuses to dump
+func checkPgDumpVersion(server, tool string) error {
+	serverMajor, err := pgMajorVersion(server)
+	if err != nil {
+		return fmt.Errorf("failed to parse server version: %w", err)
+	}
+	toolMajor, err := pgMajorVersion(tool)
+	if err != nil {
+		return fmt.Errorf("failed to parse pg_dump version: %w", err)
+	}
+	if toolMajor < serverMajor {
+		return fmt.Errorf("pg_dump %s cannot dump server version %s, install a newer pg_dump", tool, server)
+	}
+	return nil
+}
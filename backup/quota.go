@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// errQuotaExceeded is returned for backups refused by the disk quotas
+var errQuotaExceeded = errors.New("disk quota exceeded")
+
+// checkQuota refuses to start a backup of job that would leave less than
+// min_free_space free or grow the output directory beyond max_total_size,
+// going by the size of the database's last backup. With quota_cleanup set,
+// retention runs early to try to make room first.
+func (bt *Tool) checkQuota(ctx context.Context, job *databaseJob) error {
+	err := bt.quotaExceeded(job)
+	if err == nil || !errors.Is(err, errQuotaExceeded) || !bt.config.Backup.QuotaCleanup {
+		return err
+	}
+
+	job.logger.Warn("Running retention early to make room", "reason", err)
+	if err := bt.cleanupOldBackups(ctx, job); err != nil {
+		job.logger.Warn("Failed to cleanup old backups", "error", err)
+	}
+	return bt.quotaExceeded(job)
+}
+
+// quotaExceeded returns an error wrapping errQuotaExceeded if the next
+// backup of job would break a disk quota
+func (bt *Tool) quotaExceeded(job *databaseJob) error {
+	minFree := int64(bt.config.Backup.MinFreeSpace)
+	maxTotal := int64(bt.config.Backup.MaxTotalSize)
+	if minFree == 0 && maxTotal == 0 {
+		return nil
+	}
+	estimate := lastBackupSize(job)
+
+	if minFree > 0 {
+		free, err := freeSpace(job.outputDir)
+		if err != nil {
+			return err
+		}
+		if free-estimate < minFree {
+			return fmt.Errorf("%w: %s free, the backup needs about %s and min_free_space is %s",
+				errQuotaExceeded, formatBytes(free), formatBytes(estimate), formatBytes(minFree))
+		}
+	}
+
+	if maxTotal > 0 {
+		total, err := artifactSize(bt.config.Backup.OutputDir)
+		if err != nil {
+			return fmt.Errorf("failed to measure output directory: %w", err)
+		}
+		if total+estimate > maxTotal {
+			return fmt.Errorf("%w: backups take %s, the backup needs about %s and max_total_size is %s",
+				errQuotaExceeded, formatBytes(total), formatBytes(estimate), formatBytes(maxTotal))
+		}
+	}
+	return nil
+}
+
+// lastBackupSize returns the size of job's last complete backup in its
+// current format, or 0 if there is none
+func lastBackupSize(job *databaseJob) int64 {
+	manifests, err := loadManifests(job.outputDir)
+	if err != nil {
+		return 0
+	}
+	for _, m := range manifests {
+		if m.Format == job.db.Format && !m.failed() {
+			return m.Size
+		}
+	}
+	return 0
+}
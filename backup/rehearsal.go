@@ -0,0 +1,265 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"beackup/config"
+)
+
+// rehearsalReportFile holds the report of a database's last rehearsal in
+// its output directory
+const rehearsalReportFile = ".beackup.rehearsal.json"
+
+// rehearsalDriver is implemented by the drivers that can rehearse restores
+type rehearsalDriver interface {
+	// createDatabase creates the empty database db.Name on db's server
+	createDatabase(ctx context.Context, db *config.Database) error
+	// dropDatabase drops db.Name if it exists
+	dropDatabase(ctx context.Context, db *config.Database) error
+	// rowCounts returns the exact number of rows in each table of db
+	rowCounts(ctx context.Context, db *config.Database) (map[string]int64, error)
+	// query runs a query against db and returns its output
+	query(ctx context.Context, db *config.Database, query string) (string, error)
+}
+
+// rehearsalReport is the outcome of a restore rehearsal
+type rehearsalReport struct {
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt time.Time        `json:"finished_at"`
+	Backup     string           `json:"backup,omitempty"` // artifact name within the database's directory
+	Scratch    string           `json:"scratch_database,omitempty"`
+	Status     string           `json:"status"` // success or failure
+	Error      string           `json:"error,omitempty"`
+	RowCounts  map[string]int64 `json:"row_counts,omitempty"`
+	Queries    []rehearsalQuery `json:"queries,omitempty"`
+}
+
+// rehearsalQuery is the outcome of a validation query
+type rehearsalQuery struct {
+	Query  string `json:"query"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// rehearses reports whether db's restores are rehearsed. Without a list of
+// databases, every database whose type supports rehearsals is.
+func (bt *Tool) rehearses(db *config.Database) bool {
+	r := bt.config.VerifyRestore
+	if !r.Enabled() {
+		return false
+	}
+	if len(r.Databases) > 0 {
+		return slices.Contains(r.Databases, db.ID)
+	}
+	_, ok := drivers[db.Type].(rehearsalDriver)
+	return ok
+}
+
+// runRehearsal rehearses a restore of job's latest backup, reporting a
+// failure like a failed backup
+func (bt *Tool) runRehearsal(ctx context.Context, job *databaseJob) {
+	ctx, run := bt.startRun(ctx, job, "restore rehearsal")
+	report := bt.rehearseRestore(ctx, job)
+	var err error
+	if report.Status != "success" {
+		err = errors.New(report.Error)
+		job.logger.Error("Restore rehearsal failed", "error", report.Error)
+		bt.notify(job, notification{Event: eventFailure, Error: "restore rehearsal failed: " + report.Error})
+	}
+	bt.endRun(job, run, err)
+}
+
+// rehearseRestore restores job's latest complete backup into a scratch
+// database, counts its rows, runs the validation queries and drops it
+// again. The report is saved in the database's output directory.
+func (bt *Tool) rehearseRestore(ctx context.Context, job *databaseJob) *rehearsalReport {
+	report := &rehearsalReport{StartedAt: time.Now(), Status: "success"}
+	err := bt.rehearse(ctx, job, report)
+	report.FinishedAt = time.Now()
+	if err != nil {
+		report.Status = "failure"
+		report.Error = err.Error()
+	}
+	bt.metrics.observeRehearsal(job.db.ID, err)
+
+	if err := writeRehearsalReport(job.outputDir, report); err != nil {
+		job.logger.Warn("Failed to save rehearsal report", "error", err)
+	}
+	return report
+}
+
+// rehearse does the work of rehearseRestore, filling in report
+func (bt *Tool) rehearse(ctx context.Context, job *databaseJob, report *rehearsalReport) error {
+	rehearser, ok := job.driver.(rehearsalDriver)
+	if !ok {
+		return fmt.Errorf("restore rehearsals do not support %s databases", job.db.Type)
+	}
+
+	backup, err := latestBackup(job)
+	if err != nil {
+		return err
+	}
+	report.Backup = backup.File
+
+	db := *job.db
+	db.Password, err = bt.resolvePassword(ctx, job.db)
+	if err != nil {
+		return err
+	}
+	closeTunnel, err := openTunnel(ctx, &db)
+	if err != nil {
+		return err
+	}
+	defer closeTunnel()
+	scratch := bt.scratchDatabase(&db, report.StartedAt)
+	report.Scratch = scratch.Name
+	logger := job.logger.With("backup", backup.File, "scratch_database", scratch.Name)
+	logger.Info("Starting restore rehearsal")
+
+	if err := rehearser.createDatabase(ctx, scratch); err != nil {
+		return fmt.Errorf("failed to create scratch database: %w", err)
+	}
+	defer func() {
+		// The scratch database is dropped even if the rehearsal was aborted
+		if err := rehearser.dropDatabase(context.WithoutCancel(ctx), scratch); err != nil {
+			logger.Warn("Failed to drop scratch database", "error", err)
+		}
+	}()
+
+	if err := bt.restoreBackup(ctx, job, scratch, filepath.Join(job.outputDir, backup.File)); err != nil {
+		return err
+	}
+
+	report.RowCounts, err = rehearser.rowCounts(ctx, scratch)
+	if err != nil {
+		return fmt.Errorf("failed to count rows: %w", err)
+	}
+	var rows int64
+	for _, n := range report.RowCounts {
+		rows += n
+	}
+
+	var failed []string
+	for _, query := range bt.config.VerifyRestore.Queries {
+		result := rehearsalQuery{Query: query}
+		output, err := rehearser.query(ctx, scratch, query)
+		if err != nil {
+			result.Error = err.Error()
+			failed = append(failed, query)
+		} else {
+			result.Result = output
+		}
+		report.Queries = append(report.Queries, result)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("validation queries failed: %s", strings.Join(failed, "; "))
+	}
+
+	logger.Info("Restore rehearsal succeeded", "tables", len(report.RowCounts), "rows", rows, "duration", time.Since(report.StartedAt))
+	return nil
+}
+
+// latestBackup returns the manifest of job's newest complete backup in its
+// current format that is available locally
+func latestBackup(job *databaseJob) (*backupManifest, error) {
+	manifests, err := loadManifests(job.outputDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range manifests {
+		if m.Format != job.db.Format || m.failed() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(job.outputDir, m.File)); err == nil {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("no local %s backup to rehearse", job.db.Format)
+}
+
+// scratchDatabase returns the settings of the scratch database a rehearsal
+// of db started at t restores into
+func (bt *Tool) scratchDatabase(db *config.Database, t time.Time) *config.Database {
+	config := bt.config.VerifyRestore
+	scratch := *db
+
+	// Database names are limited to 63 characters by PostgreSQL
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, db.Name)
+	suffix := "_" + t.Format("20060102150405")
+	name = config.Prefix + "_" + name
+	scratch.Name = name[:min(len(name), 63-len(suffix))] + suffix
+
+	if config.Host != "" {
+		scratch.Host = config.Host
+	}
+	if config.Port != 0 {
+		scratch.Port = config.Port
+	}
+	if config.User != "" {
+		scratch.User = config.User
+		scratch.Password = config.Password
+	}
+	return &scratch
+}
+
+// parseRowCounts parses query output with a table name and its row count,
+// separated by sep, on each line
+func parseRowCounts(output, sep string) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		table, count, ok := strings.Cut(line, sep)
+		n, err := strconv.ParseInt(strings.TrimSpace(count), 10, 64)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid row count %q", line)
+		}
+		counts[table] = n
+	}
+	return counts, nil
+}
+
+// writeRehearsalReport saves report in dir
+func writeRehearsalReport(dir string, report *rehearsalReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode rehearsal report: %w", err)
+	}
+	path := filepath.Join(dir, rehearsalReportFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write rehearsal report: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// rehearsalDue reports whether job's last rehearsal, if any, is older than
+// the rehearsal frequency, so a restart does not repeat a recent one
+func (bt *Tool) rehearsalDue(job *databaseJob) bool {
+	data, err := os.ReadFile(filepath.Join(job.outputDir, rehearsalReportFile))
+	if err != nil {
+		return true
+	}
+	var report rehearsalReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return true
+	}
+	return time.Since(report.StartedAt) >= bt.config.VerifyRestore.Frequency
+}
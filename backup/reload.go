@@ -0,0 +1,121 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+
+	"beackup/scheduler"
+)
+
+// Schedule starts the backup schedules of every database, and the summary
+// reports, in a new generation
+func (bt *Tool) Schedule(ctx context.Context) *scheduler.Generation {
+	var tasks []scheduler.Task
+	for _, job := range bt.jobs {
+		tasks = append(tasks, func(ctx, runCtx context.Context) {
+			bt.runSchedule(ctx, runCtx, job)
+		})
+	}
+	if bt.config.Reports.Enabled() {
+		tasks = append(tasks, func(ctx, runCtx context.Context) {
+			bt.runReports(ctx)
+		})
+	}
+	return scheduler.Start(ctx, tasks)
+}
+
+// Options returns how the scheduler runs the tool
+func (bt *Tool) Options() scheduler.Options {
+	return scheduler.Options{
+		Logger:      bt.logger,
+		ConfigPath:  bt.configPath,
+		WatchConfig: bt.config.WatchConfig,
+		GracePeriod: bt.config.Backup.ShutdownGracePeriod,
+	}
+}
+
+// Reload builds a tool from the config file as it is now. Databases that
+// are still configured keep their schedule, last result, queued backup and
+// metrics; new databases start with an initial backup. The metrics and API
+// listeners keep their address until the daemon is restarted.
+func (bt *Tool) Reload() (*Tool, error) {
+	config, err := LoadConfig(bt.configPath, bt.overrides...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	// The new log destination is only switched to once the reload
+	// succeeded; loggers of the old config then write to it too
+	logger := bt.logger
+	var dest io.Writer
+	if config.Logging != bt.config.Logging {
+		dest = openLogDestination(config)
+		logger = setupLogger(config, bt.logOutput)
+	}
+	next, err := newTool(config, bt.configPath, logger, bt.metrics)
+	if err == nil {
+		err = next.createOutputDirs()
+	}
+	if err != nil {
+		closeLogDestination(dest)
+		return nil, err
+	}
+	if dest != nil {
+		bt.logOutput.set(dest)
+	}
+	next.logOutput = bt.logOutput
+	next.overrides = bt.overrides
+	next.dedup = bt.dedup
+	if !reflect.DeepEqual(config.Storage, bt.config.Storage) {
+		// The index cached for the old store does not describe the new one
+		next.dedup = newDedupStore()
+	}
+
+	if config.Metrics != bt.config.Metrics || config.API.ListenAddr != bt.config.API.ListenAddr {
+		logger.Warn("Changed metrics and API listeners take effect after a restart")
+	}
+
+	for _, job := range next.jobs {
+		for _, old := range bt.jobs {
+			if old.db.ID == job.db.ID {
+				job.resume(old)
+			}
+		}
+	}
+	return next, nil
+}
+
+// resume continues the schedule of old, the same database under the
+// previous config, adjusting the next run to a changed frequency. What old
+// is still running keeps the job from overlapping it.
+func (job *databaseJob) resume(old *databaseJob) {
+	job.activity = old.activity
+
+	old.mu.Lock()
+	nextRun, lastRun := old.nextRun, old.lastRun
+	old.mu.Unlock()
+
+	if !nextRun.IsZero() {
+		nextRun = nextRun.Add(job.db.Frequency - old.db.Frequency)
+	}
+	job.mu.Lock()
+	job.nextRun, job.lastRun = nextRun, lastRun
+	job.mu.Unlock()
+
+	if len(old.trigger) > 0 {
+		job.trigger <- struct{}{}
+	}
+}
+
+// createOutputDirs ensures the output directory of every database exists
+func (bt *Tool) createOutputDirs() error {
+	for _, job := range bt.jobs {
+		if err := os.MkdirAll(job.outputDir, 0755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"beackup/config"
+)
+
+func TestResumeKeepsActivity(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Backup.Overlap = config.OverlapSkip
+	bt := &Tool{config: cfg, metrics: newMetrics()}
+	db := &config.Database{ID: "app", Frequency: time.Hour}
+	dir := t.TempDir()
+	newJob := func() *databaseJob {
+		return &databaseJob{
+			db:        db,
+			logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+			outputDir: dir,
+			trigger:   make(chan struct{}, 1),
+			activity:  &jobActivity{slot: make(chan struct{}, 1)},
+		}
+	}
+
+	old := newJob()
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	go bt.withSlot(context.Background(), old, func() {
+		old.activity.mu.Lock()
+		old.activity.running = true
+		old.activity.mu.Unlock()
+		close(started)
+		<-finish
+	})
+	<-started
+	defer close(finish)
+
+	job := newJob()
+	job.resume(old)
+	if !job.status().Running {
+		t.Error("status() of the resumed job is not running")
+	}
+	ran := false
+	err := bt.withSlot(context.Background(), job, func() { ran = true })
+	if !errors.Is(err, errOverlapSkipped) || ran {
+		t.Errorf("withSlot() = %v, ran %v; want the overlap skipped", err, ran)
+	}
+
+	// A job that did not resume the old one has nothing to wait for
+	other := newJob()
+	other.outputDir = t.TempDir()
+	if err := bt.withSlot(context.Background(), other, func() { ran = true }); err != nil || !ran {
+		t.Errorf("withSlot() = %v, ran %v; want it run", err, ran)
+	}
+}
+
+func TestLogOutputSet(t *testing.T) {
+	dir := t.TempDir()
+	open := func(name string) *rotatingFile {
+		file, err := newRotatingFile(config.Logging{FilePath: filepath.Join(dir, name)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	first := open("first.log")
+	output := &logOutput{dest: first}
+	logger := slog.New(slog.NewTextHandler(output, nil))
+	logger.Info("before")
+
+	output.set(open("second.log"))
+	if _, err := first.file.Write(nil); err == nil {
+		t.Error("the previous log file was not closed")
+	}
+	logger.Info("after")
+
+	for name, want := range map[string]string{"first.log": "before", "second.log": "after"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], want) {
+			t.Errorf("%s = %q, want one line logging %q", name, data, want)
+		}
+	}
+	output.set(os.Stdout)
+}
@@ -0,0 +1,179 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"beackup/config"
+)
+
+// replicaQuery reports whether a server is a replica, the WAL position it
+// has replayed, and how far behind the primary that is: nothing once it
+// has replayed all WAL received, or the age of the last replayed
+// transaction otherwise
+const replicaQuery = "SELECT pg_is_in_recovery(), pg_last_wal_replay_lsn(), " +
+	"CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0 " +
+	"ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END"
+
+// replicaProbeTimeout bounds the status query of each server before a
+// backup, so that an unreachable replica does not hold it up
+const replicaProbeTimeout = 10 * time.Second
+
+// replicaState describes a replica probed before a backup
+type replicaState struct {
+	host   string
+	port   int
+	lag    time.Duration
+	behind int64 // bytes of WAL behind the primary, -1 if unknown
+	err    error // why the replica cannot be used
+}
+
+// address returns the replica's host and port
+func (r replicaState) address() string {
+	return net.JoinHostPort(r.host, strconv.Itoa(r.port))
+}
+
+// aheadOf reports whether r has replayed more than other, by bytes of WAL
+// if known for both and by lag otherwise
+func (r *replicaState) aheadOf(other *replicaState) bool {
+	if r.behind >= 0 && other.behind >= 0 {
+		return r.behind < other.behind
+	}
+	return r.lag < other.lag
+}
+
+// selectSource picks the server the backup of job's database is taken from
+// by its source policy. It returns the replica's address, empty if the
+// primary is used, and a copy of the database pointed at the server with
+// the resolved password, which the backup connects with so that the shared
+// config is left alone.
+func (bt *Tool) selectSource(ctx context.Context, job *databaseJob, password string, logger *slog.Logger) (string, *config.Database, error) {
+	db := *job.db
+	db.Password = password
+	if !db.Source.UsesReplicas() {
+		return "", &db, nil
+	}
+
+	replicas := probeReplicas(ctx, &db)
+	for _, r := range replicas {
+		if r.err != nil {
+			logger.Warn("Replica skipped", "replica", r.address(), "error", r.err)
+		}
+	}
+
+	best := bestReplica(replicas)
+	if best == nil {
+		if db.Source.Policy == config.SourceReplicaOnly {
+			return "", nil, fmt.Errorf("no usable replica to back up from")
+		}
+		logger.Warn("No usable replica, backing up from the primary")
+		return "", &db, nil
+	}
+
+	logger.Info("Backing up from replica", "replica", best.address(), "lag", best.lag, "behind", formatBytes(max(best.behind, 0)))
+	db.Host, db.Port = best.host, best.port
+	return best.address(), &db, nil
+}
+
+// bestReplica returns the usable replica furthest ahead, nil if none is
+func bestReplica(replicas []replicaState) *replicaState {
+	var best *replicaState
+	for i := range replicas {
+		r := &replicas[i]
+		if r.err == nil && (best == nil || r.aheadOf(best)) {
+			best = r
+		}
+	}
+	return best
+}
+
+// probeReplicas checks which of db's replicas are reachable and how far
+// they lag behind the primary. Lag in bytes is only known if the primary
+// is reachable too.
+func probeReplicas(ctx context.Context, db *config.Database) []replicaState {
+	primaryLSN := int64(-1)
+	err := onHost(ctx, db, db.Host, db.Port, func(ctx context.Context, primary *config.Database) error {
+		value, err := queryValue(ctx, primary, "SELECT pg_current_wal_lsn()")
+		if err == nil {
+			primaryLSN, err = parseLSN(value)
+		}
+		return err
+	})
+	if err != nil {
+		primaryLSN = -1
+	}
+
+	var replicas []replicaState
+	for _, replica := range db.Source.Replicas {
+		r := replicaState{host: replica.Host, port: replica.Port, behind: -1}
+		if r.port == 0 {
+			r.port = db.Port
+		}
+		r.err = onHost(ctx, db, r.host, r.port, func(ctx context.Context, replica *config.Database) error {
+			value, err := queryValue(ctx, replica, replicaQuery)
+			if err != nil {
+				return err
+			}
+			fields := strings.Split(value, "|")
+			if len(fields) != 3 {
+				return fmt.Errorf("unexpected replication status %q", value)
+			}
+			if fields[0] != "t" {
+				return fmt.Errorf("server is not a replica")
+			}
+			seconds, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil {
+				return fmt.Errorf("invalid replication lag %q", fields[2])
+			}
+			r.lag = time.Duration(seconds * float64(time.Second)).Round(time.Millisecond)
+			if replayed, err := parseLSN(fields[1]); err == nil && primaryLSN >= 0 {
+				r.behind = max(primaryLSN-replayed, 0)
+			}
+			return nil
+		})
+		if r.err == nil && db.Source.MaxLag > 0 && r.lag > db.Source.MaxLag {
+			r.err = fmt.Errorf("lagging %s behind, more than max_lag %s", r.lag, db.Source.MaxLag)
+		}
+		replicas = append(replicas, r)
+	}
+	return replicas
+}
+
+// onHost runs fn with a copy of db pointed at host and port, through an
+// SSH tunnel of its own if db is reached through one, within
+// replicaProbeTimeout
+func onHost(ctx context.Context, db *config.Database, host string, port int, fn func(ctx context.Context, db *config.Database) error) error {
+	ctx, cancel := context.WithTimeout(ctx, replicaProbeTimeout)
+	defer cancel()
+	target := *db
+	target.Host, target.Port = host, port
+
+	closeTunnel, err := openTunnel(ctx, &target)
+	if err != nil {
+		return err
+	}
+	defer closeTunnel()
+	return fn(ctx, &target)
+}
+
+// parseLSN converts a WAL position such as 16/B374D848 to a byte offset
+func parseLSN(value string) (int64, error) {
+	high, low, ok := strings.Cut(value, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid WAL position %q", value)
+	}
+	h, err := strconv.ParseUint(high, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WAL position %q", value)
+	}
+	l, err := strconv.ParseUint(low, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WAL position %q", value)
+	}
+	return int64(h<<32 | l), nil
+}
@@ -0,0 +1,138 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"beackup/config"
+)
+
+func TestBestReplica(t *testing.T) {
+	unusable := errors.New("unreachable")
+	tests := []struct {
+		name     string
+		replicas []replicaState
+		want     string // host of the best replica, empty for none
+	}{
+		{"none", nil, ""},
+		{"all unusable", []replicaState{{host: "a", behind: 0, err: unusable}}, ""},
+		{
+			name: "least WAL behind",
+			replicas: []replicaState{
+				{host: "a", behind: 300, lag: time.Second},
+				{host: "b", behind: 100, lag: 5 * time.Second},
+				{host: "c", behind: 200},
+			},
+			want: "b",
+		},
+		{
+			name: "unusable replicas are skipped even if ahead",
+			replicas: []replicaState{
+				{host: "a", behind: 0, err: unusable},
+				{host: "b", behind: 100},
+			},
+			want: "b",
+		},
+		{
+			name: "lag decides without the primary's position",
+			replicas: []replicaState{
+				{host: "a", behind: -1, lag: 3 * time.Second},
+				{host: "b", behind: -1, lag: time.Second},
+			},
+			want: "b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if best := bestReplica(tt.replicas); best != nil {
+				got = best.host
+			}
+			if got != tt.want {
+				t.Errorf("bestReplica() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectSource(t *testing.T) {
+	// A port nothing listens on, so that every probe fails
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	tests := []struct {
+		name    string
+		source  config.Source
+		wantErr string
+	}{
+		{name: "no replicas"},
+		{name: "primary policy", source: config.Source{Policy: config.SourcePrimary, Replicas: []config.Replica{{Host: "127.0.0.1", Port: closed}}}},
+		{name: "no usable replica", source: config.Source{Policy: config.SourcePreferReplica, Replicas: []config.Replica{{Host: "127.0.0.1", Port: closed}}}},
+		{
+			name:    "replica only",
+			source:  config.Source{Policy: config.SourceReplicaOnly, Replicas: []config.Replica{{Host: "127.0.0.1", Port: closed}}},
+			wantErr: "no usable replica",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &config.Database{ID: "db", Host: "127.0.0.1", Port: closed, User: "backup", Name: "app", Source: tt.source}
+			job := &databaseJob{db: db}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+			address, source, err := (&Tool{}).selectSource(context.Background(), job, "", logger)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("selectSource() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selectSource() error = %v", err)
+			}
+			if address != "" {
+				t.Errorf("selectSource() address = %q, want the primary", address)
+			}
+			if source == db {
+				t.Error("selectSource() returned the shared config instead of a copy")
+			}
+			if source.Host != db.Host || source.Port != db.Port {
+				t.Errorf("selectSource() = %s:%d, want the primary %s:%d", source.Host, source.Port, db.Host, db.Port)
+			}
+			if db.Host != "127.0.0.1" || db.Port != closed {
+				t.Errorf("selectSource() changed the shared config to %s:%d", db.Host, db.Port)
+			}
+		})
+	}
+}
+
+func TestParseLSN(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"0/0", 0, false},
+		{"0/3000060", 0x3000060, false},
+		{"16/B374D848", 0x16<<32 | 0xB374D848, false},
+		{"B374D848", 0, true},
+		{"x/1", 0, true},
+		{"1/100000000", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseLSN(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseLSN(%q) = %d, %v, want %d, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
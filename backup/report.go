@@ -0,0 +1,355 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"beackup/config"
+)
+
+// historyFile holds the notifications of a database's recent backup
+// events in its output directory, one JSON object per line
+const historyFile = ".beackup.history.jsonl"
+
+// historyRetention is how long events are kept in the history, enough for
+// a weekly report
+const historyRetention = 35 * 24 * time.Hour
+
+// maxReportErrors limits the failure messages listed per database
+const maxReportErrors = 5
+
+// summaryReport aggregates the backups of every database over a period
+type summaryReport struct {
+	Event       string           `json:"event"`    // always report, for webhook receivers
+	Schedule    string           `json:"schedule"` // daily or weekly
+	PeriodStart time.Time        `json:"period_start"`
+	PeriodEnd   time.Time        `json:"period_end"`
+	Successes   int              `json:"successes"`
+	Failures    int              `json:"failures"`
+	Removed     int              `json:"removed"`          // backups deleted by retention
+	TotalSize   int64            `json:"total_size_bytes"` // of every backup in the catalog
+	Stale       []string         `json:"stale,omitempty"`  // databases without a recent successful backup
+	Databases   []databaseReport `json:"databases"`
+}
+
+// databaseReport is the part of a summary report about one database
+type databaseReport struct {
+	Database    string     `json:"database"`
+	Successes   int        `json:"successes"`
+	Failures    int        `json:"failures"`
+	Errors      []string   `json:"errors,omitempty"` // of the latest failures
+	Removed     int        `json:"removed"`
+	Backups     int        `json:"backups"` // complete backups in the catalog
+	Size        int64      `json:"size_bytes"`
+	Oldest      *time.Time `json:"oldest_backup,omitempty"`
+	Newest      *time.Time `json:"newest_backup,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"` // of a database backup, leaving out globals
+	Stale       bool       `json:"stale"`
+}
+
+// recordEvent appends a notification to the database's history, dropping
+// events too old for any report
+func recordEvent(job *databaseJob, n notification) error {
+	path := filepath.Join(job.outputDir, historyFile)
+	events, err := loadHistory(job.outputDir, n.Time.Add(-historyRetention))
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, event := range append(events, n) {
+		if err := enc.Encode(event); err != nil {
+			return fmt.Errorf("failed to encode history: %w", err)
+		}
+	}
+	if err := os.WriteFile(path+".tmp", buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// loadHistory returns the events recorded in dir since t, oldest first
+func loadHistory(dir string, since time.Time) ([]notification, error) {
+	f, err := os.Open(filepath.Join(dir, historyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+	defer f.Close()
+
+	var events []notification
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var n notification
+		if err := json.Unmarshal(scanner.Bytes(), &n); err != nil {
+			// A line cut short by a crash loses only its own event
+			continue
+		}
+		if !n.Time.Before(since) {
+			events = append(events, n)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+	return events, nil
+}
+
+// buildReport aggregates the history and catalog of every database in cfg
+// over the report period ending at end
+func buildReport(cfg *config.Config, end time.Time) (*summaryReport, error) {
+	schedule := cfg.Reports.Schedule
+	if schedule == "" {
+		schedule = config.ReportDaily
+	}
+	report := &summaryReport{
+		Event:       eventReport,
+		Schedule:    schedule,
+		PeriodStart: end.Add(-cfg.Reports.Period()),
+		PeriodEnd:   end,
+	}
+
+	cat, err := loadCatalog(cfg.Backup.OutputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, db := range cfg.Databases {
+		r := databaseReport{Database: db.ID}
+
+		events, err := loadHistory(filepath.Join(cfg.Backup.OutputDir, db.ID), report.PeriodStart)
+		if err != nil {
+			return nil, fmt.Errorf("database %q: %w", db.ID, err)
+		}
+		for _, n := range events {
+			if n.Time.After(end) {
+				continue
+			}
+			switch n.Event {
+			case eventSuccess:
+				r.Successes++
+			case eventFailure:
+				r.Failures++
+				r.Errors = append(r.Errors, n.Error)
+			case eventCleanup:
+				r.Removed += len(n.Removed)
+			}
+		}
+		if len(r.Errors) > maxReportErrors {
+			r.Errors = r.Errors[len(r.Errors)-maxReportErrors:]
+		}
+
+		for _, m := range cat.Backups {
+			if m.Database != db.ID {
+				continue
+			}
+			r.Size += m.Size
+			if m.failed() {
+				continue
+			}
+			r.Backups++
+			created := m.CreatedAt
+			if r.Oldest == nil || created.Before(*r.Oldest) {
+				r.Oldest = &created
+			}
+			if r.Newest == nil || created.After(*r.Newest) {
+				r.Newest = &created
+			}
+			finished := m.FinishedAt
+			if m.Format != globalsFormat && (r.LastSuccess == nil || finished.After(*r.LastSuccess)) {
+				r.LastSuccess = &finished
+			}
+		}
+		r.Stale = r.LastSuccess == nil || end.Sub(*r.LastSuccess) > cfg.Reports.StaleAfter
+
+		report.Successes += r.Successes
+		report.Failures += r.Failures
+		report.Removed += r.Removed
+		report.TotalSize += r.Size
+		if r.Stale {
+			report.Stale = append(report.Stale, db.ID)
+		}
+		report.Databases = append(report.Databases, r)
+	}
+	return report, nil
+}
+
+// runReports sends a summary report on the configured schedule until ctx
+// is cancelled
+func (bt *Tool) runReports(ctx context.Context) {
+	for {
+		next := bt.config.Reports.Next(time.Now())
+		bt.logger.Debug("Scheduling summary report", "at", next)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		report, err := buildReport(bt.config, next)
+		if err != nil {
+			bt.logger.Error("Failed to build summary report", "error", err)
+			continue
+		}
+		bt.sendReport(report)
+	}
+}
+
+// reporter is implemented by the notification channels that deliver
+// summary reports
+type reporter interface {
+	Report(ctx context.Context, r *summaryReport) error
+}
+
+// sendReport delivers a report to every channel that wants reports,
+// logging rather than returning delivery failures
+func (bt *Tool) sendReport(r *summaryReport) {
+	sent := 0
+	for _, channel := range bt.notifiers {
+		rep, ok := channel.(reporter)
+		if !ok || !channel.Wants(eventReport) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+		if err := rep.Report(ctx, r); err != nil {
+			bt.logger.Warn("Failed to send summary report", "channel", channel.Name(), "error", err)
+		} else {
+			sent++
+		}
+		cancel()
+	}
+	bt.logger.Info("Sent summary report", "channels", sent, "successes", r.Successes, "failures", r.Failures, "stale", len(r.Stale))
+}
+
+// title summarizes the report in a line
+func (r *summaryReport) title() string {
+	title := fmt.Sprintf("%s%s backup report: %d succeeded, %d failed",
+		strings.ToUpper(r.Schedule[:1]), r.Schedule[1:], r.Successes, r.Failures)
+	if len(r.Stale) > 0 {
+		title += fmt.Sprintf(", %d without a recent backup", len(r.Stale))
+	}
+	return title
+}
+
+// writeText renders the report as plain text
+func (r *summaryReport) writeText(w io.Writer) error {
+	fmt.Fprintln(w, r.title())
+	fmt.Fprintf(w, "%s to %s, %d removed by retention, %s stored\n\n",
+		r.PeriodStart.Local().Format("2006-01-02 15:04"), r.PeriodEnd.Local().Format("2006-01-02 15:04"),
+		r.Removed, formatBytes(r.TotalSize))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATABASE\tSUCCEEDED\tFAILED\tREMOVED\tBACKUPS\tSIZE\tOLDEST\tNEWEST\tSTALE")
+	for _, db := range r.Databases {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\t%t\n",
+			db.Database, db.Successes, db.Failures, db.Removed, db.Backups, formatBytes(db.Size),
+			formatReportTime(db.Oldest), formatReportTime(db.Newest), db.Stale)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	heading := "\nFailures:"
+	for _, db := range r.Databases {
+		for _, e := range db.Errors {
+			fmt.Fprintln(w, heading)
+			heading = ""
+			fmt.Fprintf(w, "  %s: %s\n", db.Database, e)
+		}
+	}
+	return nil
+}
+
+// formatReportTime renders an optional time for a report
+func formatReportTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+// reportHTML renders a report for email
+var reportHTML = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+	"time":  formatReportTime,
+	"date":  func(t time.Time) string { return t.Local().Format("2006-01-02 15:04") },
+}).Parse(`<html><body style="font-family: sans-serif">
+<h2>{{.Title}}</h2>
+<p>{{date .PeriodStart}} to {{date .PeriodEnd}}: {{.Removed}} backup(s) removed by retention, {{bytes .TotalSize}} stored.</p>
+{{if .Stale}}<p style="color: #b00"><b>No successful backup recently:</b> {{range $i, $id := .Stale}}{{if $i}}, {{end}}{{$id}}{{end}}</p>{{end}}
+<table cellpadding="4" cellspacing="0" border="1" style="border-collapse: collapse">
+<tr><th>Database</th><th>Succeeded</th><th>Failed</th><th>Removed</th><th>Backups</th><th>Size</th><th>Oldest</th><th>Newest</th><th>Last success</th></tr>
+{{range .Databases}}<tr{{if .Stale}} style="background: #fdd"{{end}}><td>{{.Database}}</td><td>{{.Successes}}</td><td>{{.Failures}}</td><td>{{.Removed}}</td><td>{{.Backups}}</td><td>{{bytes .Size}}</td><td>{{time .Oldest}}</td><td>{{time .Newest}}</td><td>{{time .LastSuccess}}</td></tr>
+{{end}}</table>
+{{range .Databases}}{{if .Errors}}<h3>Failures of {{.Database}}</h3><ul>{{range .Errors}}<li>{{.}}</li>{{end}}</ul>{{end}}{{end}}
+</body></html>
+`))
+
+// html renders the report as an HTML document
+func (r *summaryReport) html() ([]byte, error) {
+	var buf bytes.Buffer
+	err := reportHTML.Execute(&buf, struct {
+		*summaryReport
+		Title string
+	}{r, r.title()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render report: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *slackNotifier) Report(ctx context.Context, r *summaryReport) error {
+	var text bytes.Buffer
+	if err := r.writeText(&text); err != nil {
+		return err
+	}
+	icon := ":bar_chart:"
+	if r.Failures > 0 || len(r.Stale) > 0 {
+		icon = ":warning:"
+	}
+	title, table, _ := strings.Cut(text.String(), "\n")
+	return postJSON(ctx, s.url, nil, map[string]string{"text": icon + " " + title + "\n```" + table + "```"})
+}
+
+func (w *webhookNotifier) Report(ctx context.Context, r *summaryReport) error {
+	return postJSON(ctx, w.url, w.headers, r)
+}
+
+func (e *emailNotifier) Report(ctx context.Context, r *summaryReport) error {
+	body, err := r.html()
+	if err != nil {
+		return err
+	}
+	return e.send(ctx, "[beackup] "+r.title(), r.PeriodEnd, "text/html", body)
+}
+
+// Report prints the summary report of the period ending now for the
+// databases in cfg, as text or as the JSON webhooks receive
+func Report(w io.Writer, cfg *config.Config, asJSON bool) error {
+	report, err := buildReport(cfg, time.Now())
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return report.writeText(w)
+}
@@ -0,0 +1,249 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"beackup/config"
+)
+
+// Restore loads a backup into its database. dbID selects the configured
+// database; when empty it is inferred from the backup's directory. With
+// tables, only the rows of those tables are replaced, which needs a backup
+// in the copy format.
+func (bt *Tool) Restore(ctx context.Context, dbID, backupPath string, tables ...string) error {
+	job, err := bt.findRestoreJob(dbID, backupPath)
+	if err != nil {
+		return err
+	}
+
+	job.logger.Info("Restoring backup", "file", backupPath, "database", job.db.Name)
+
+	db := *job.db
+	db.Password, err = bt.resolvePassword(ctx, job.db)
+	if err != nil {
+		return err
+	}
+	closeTunnel, err := openTunnel(ctx, &db)
+	if err != nil {
+		return err
+	}
+	defer closeTunnel()
+	source, cleanup, err := bt.fetchDedupBackup(ctx, job, backupPath)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if len(tables) > 0 {
+		err = bt.restoreTables(ctx, job, &db, source, tables)
+	} else {
+		err = bt.restoreBackup(ctx, job, &db, source)
+	}
+	if err != nil {
+		return err
+	}
+
+	job.logger.Info("Restore completed successfully", "file", backupPath)
+	return nil
+}
+
+// restoreBackup loads a backup of job's database into db, which is the
+// database itself, a scratch database or a clone, passing args on to the
+// restore program
+func (bt *Tool) restoreBackup(ctx context.Context, job *databaseJob, db *config.Database, backupPath string, args ...string) error {
+	info, err := os.Stat(backupPath)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+
+	if info.IsDir() && isCopyExport(backupPath) {
+		return bt.restoreCopyExport(ctx, job, db, backupPath, args...)
+	}
+
+	var cmd *exec.Cmd
+	var cleanup func()
+	var reader io.ReadCloser
+	if info.IsDir() {
+		cmd, cleanup, err = job.driver.restoreCommand(ctx, db, "directory")
+		if err != nil {
+			return err
+		}
+		if db.Jobs > 1 {
+			// Parallel restore needs a path; other backups are read from stdin
+			cmd.Args = append(cmd.Args, fmt.Sprintf("--jobs=%d", db.Jobs))
+		}
+		cmd.Args = append(cmd.Args, args...)
+		cmd.Args = append(cmd.Args, backupPath)
+	} else {
+		reader, err = bt.openBackup(backupPath)
+		if err != nil {
+			return err
+		}
+
+		cmd, cleanup, err = job.driver.restoreCommand(ctx, db, formatFromExtension(stripArtifactExtensions(backupPath)))
+		if err != nil {
+			reader.Close()
+			return err
+		}
+		cmd.Args = append(cmd.Args, args...)
+		setStdin(cmd, reader)
+	}
+	defer cleanup()
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	job.logger.Debug("Running restore", "command", redactedCommand(cmd, db))
+	runErr := cmd.Run()
+
+	// A failed decryptor or decompressor ends the stream early, which the
+	// restore command may not notice on its own
+	if reader != nil {
+		if err := reader.Close(); err != nil && runErr == nil {
+			return fmt.Errorf("failed to read backup: %w", err)
+		}
+	}
+	if runErr != nil {
+		return fmt.Errorf("%s failed: %w, output: %s", cmd.Args[0], runErr, output.String())
+	}
+	return nil
+}
+
+// fetchDedupBackup returns where to restore a backup from. A backup only
+// kept in the dedup store is reassembled into a temporary directory, which
+// cleanup removes.
+func (bt *Tool) fetchDedupBackup(ctx context.Context, job *databaseJob, backupPath string) (string, func(), error) {
+	noCleanup := func() {}
+	if _, err := os.Stat(backupPath); !os.IsNotExist(err) {
+		return backupPath, noCleanup, nil
+	}
+	data, err := os.ReadFile(manifestPath(backupPath))
+	if err != nil {
+		return backupPath, noCleanup, nil
+	}
+	var m backupManifest
+	if err := json.Unmarshal(data, &m); err != nil || !m.Uploaded || !m.Dedup {
+		return backupPath, noCleanup, nil
+	}
+	if bt.storage == nil {
+		return "", nil, fmt.Errorf("backup %s is only in the dedup store, but no storage is configured", m.File)
+	}
+
+	job.logger.Info("Fetching backup from the dedup store", "file", m.File)
+	dir, err := os.MkdirTemp("", "beackup-dedup-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	source, err := bt.fetchSnapshot(ctx, job.db.ID, m.File, dir)
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to fetch backup: %w", err)
+	}
+	return source, cleanup, nil
+}
+
+// findRestoreJob picks the database a backup should be restored into: the
+// one with id dbID, or else the one whose output directory holds the
+// backup, at any depth of the directory template. A backup kept elsewhere
+// belongs to the database its directory is named after.
+func (bt *Tool) findRestoreJob(dbID, backupPath string) (*databaseJob, error) {
+	if dbID == "" {
+		if len(bt.jobs) == 1 {
+			return bt.jobs[0], nil
+		}
+		if path, err := filepath.Abs(backupPath); err == nil {
+			for _, job := range bt.jobs {
+				if dir, err := filepath.Abs(job.outputDir); err == nil && isUnder(filepath.ToSlash(path), filepath.ToSlash(dir)) {
+					return job, nil
+				}
+			}
+		}
+		dbID = filepath.Base(filepath.Dir(filepath.Clean(backupPath)))
+	}
+
+	for _, job := range bt.jobs {
+		if job.db.ID == dbID {
+			return job, nil
+		}
+	}
+	return nil, fmt.Errorf("no configured database with id %q", dbID)
+}
+
+// openBackup opens a backup file for reading, undoing any encryption and
+// compression indicated by its extension
+func (bt *Tool) openBackup(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup: %w", err)
+	}
+	chain := newReadChain(file)
+	name := path
+
+	if encType := encryptionFromExtension(name); encType != "" {
+		decryptor, err := newDecryptor(chain.head(), encType, bt.config.Encryption)
+		if err != nil {
+			chain.Close()
+			return nil, fmt.Errorf("failed to start decryptor: %w", err)
+		}
+		chain.wrap(decryptor)
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+
+	if algorithm := compressionFromExtension(name); algorithm != "" {
+		decompressor, err := newDecompressor(chain.head(), algorithm)
+		if err != nil {
+			chain.Close()
+			return nil, fmt.Errorf("failed to start decompressor: %w", err)
+		}
+		chain.wrap(decompressor)
+	}
+
+	return chain, nil
+}
+
+// stripArtifactExtensions removes encryption and compression suffixes,
+// leaving the dump's own extension
+func stripArtifactExtensions(path string) string {
+	if encryptionFromExtension(path) != "" {
+		path = strings.TrimSuffix(path, filepath.Ext(path))
+	}
+	if compressionFromExtension(path) != "" {
+		path = strings.TrimSuffix(path, filepath.Ext(path))
+	}
+	return path
+}
+
+// formatFromExtension returns the pg_dump format a file was written in
+func formatFromExtension(path string) string {
+	switch filepath.Ext(path) {
+	case ".sql":
+		return "plain"
+	case ".tar":
+		return "tar"
+	default:
+		return "custom"
+	}
+}
+
+// buildRestoreCommand constructs the psql or pg_restore command that loads
+// a dump of the given format from standard input
+func buildRestoreCommand(ctx context.Context, db *config.Database, format string) *exec.Cmd {
+	connection := connectionArgs(db)
+
+	if format == "plain" {
+		args := append(connection, "--set", "ON_ERROR_STOP=1", "--quiet")
+		return commandContext(ctx, "psql", args...)
+	}
+
+	args := append(connection, "--verbose", "--format="+format)
+	return commandContext(ctx, "pg_restore", args...)
+}
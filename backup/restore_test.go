@@ -0,0 +1,44 @@
+package backup
+
+import (
+	"path/filepath"
+	"testing"
+
+	"beackup/config"
+)
+
+func TestFindRestoreJob(t *testing.T) {
+	outputDir := filepath.Join(t.TempDir(), "backups")
+	bt := &Tool{jobs: []*databaseJob{
+		{db: &config.Database{ID: "db1"}, outputDir: filepath.Join(outputDir, "db1")},
+		{db: &config.Database{ID: "db2"}, outputDir: filepath.Join(outputDir, "db2")},
+	}}
+
+	tests := []struct {
+		name    string
+		dbID    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "flat layout", path: filepath.Join(outputDir, "db2", "x.dump"), want: "db2"},
+		{name: "templated layout", path: filepath.Join(outputDir, "db2", "2026", "10", "x.dump"), want: "db2"},
+		{name: "copied elsewhere", path: filepath.Join(t.TempDir(), "db1", "x.dump"), want: "db1"},
+		{name: "explicit id", dbID: "db1", path: filepath.Join(outputDir, "db2", "2026", "10", "x.dump"), want: "db1"},
+		{name: "sibling directory", path: filepath.Join(outputDir, "db10", "2026", "x.dump"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job, err := bt.findRestoreJob(tt.dbID, tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("findRestoreJob() = %s, want no database", job.db.ID)
+				}
+				return
+			}
+			if err != nil || job.db.ID != tt.want {
+				t.Errorf("findRestoreJob() = %v, %v; want %s", job, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"beackup/retention"
+	"beackup/storage"
+	"beackup/tracing"
+)
+
+// applyRetention returns the backups not kept by any rule of r. manifests
+// must be sorted newest first.
+func applyRetention(r retention.Config, manifests []*backupManifest, now time.Time) []*backupManifest {
+	created := make([]time.Time, len(manifests))
+	for i, m := range manifests {
+		created[i] = m.CreatedAt
+	}
+	keep := r.Keep(created, now)
+
+	var expired []*backupManifest
+	for i, m := range manifests {
+		if !keep[i] {
+			expired = append(expired, m)
+		}
+	}
+	return expired
+}
+
+// expiredBackups returns the backups not kept by any rule. Globals dumps
+// and base backups are retained independently of the database dumps.
+// Failed backups never count toward the rules and expire once they are
+// older than every backup kept. Archived backups are left to
+// archivedBackups. manifests must be sorted newest first.
+func expiredBackups(r retention.Config, manifests []*backupManifest, now time.Time) []*backupManifest {
+	var expired, dumps, globals, bases, failed []*backupManifest
+	for _, m := range manifests {
+		switch {
+		case m.Archived:
+			continue
+		case m.failed():
+			failed = append(failed, m)
+		case m.Format == globalsFormat:
+			globals = append(globals, m)
+		case m.Format == baseBackupFormat:
+			bases = append(bases, m)
+		default:
+			dumps = append(dumps, m)
+		}
+	}
+
+	var oldestKept time.Time
+	for _, group := range [][]*backupManifest{dumps, globals, bases} {
+		groupExpired := applyRetention(r, group, now)
+		expired = append(expired, groupExpired...)
+
+		gone := make(map[*backupManifest]bool)
+		for _, m := range groupExpired {
+			gone[m] = true
+		}
+		for _, m := range group {
+			if !gone[m] && (oldestKept.IsZero() || m.CreatedAt.Before(oldestKept)) {
+				oldestKept = m.CreatedAt
+			}
+		}
+	}
+
+	for _, m := range failed {
+		if m.CreatedAt.Before(oldestKept) {
+			expired = append(expired, m)
+		}
+	}
+	return expired
+}
+
+// archivedBackups applies the archive rules of r to the backups already
+// archived and those expired, returning the expired backups to archive and
+// the backups to delete. Failed backups are never archived. manifests must
+// be sorted newest first.
+func archivedBackups(r retention.Config, expired, manifests []*backupManifest, now time.Time) (archive, remove []*backupManifest) {
+	leaving := make(map[*backupManifest]bool)
+	for _, m := range expired {
+		leaving[m] = true
+	}
+
+	var candidates []*backupManifest
+	for _, m := range manifests {
+		switch {
+		case m.Archived:
+			candidates = append(candidates, m)
+		case leaving[m] && m.failed():
+			remove = append(remove, m)
+		case leaving[m]:
+			candidates = append(candidates, m)
+		}
+	}
+
+	created := make([]time.Time, len(candidates))
+	for i, m := range candidates {
+		created[i] = m.CreatedAt
+	}
+	keep := r.Archive.Keep(created, now)
+	for i, m := range candidates {
+		switch {
+		case !keep[i]:
+			remove = append(remove, m)
+		case !m.Archived:
+			archive = append(archive, m)
+		}
+	}
+	return archive, remove
+}
+
+// unlockedBackups splits off the backups whose uploaded copy storage.lock
+// still protects, which can be neither deleted nor archived yet
+func unlockedBackups(manifests []*backupManifest, now time.Time) (unlocked, locked []*backupManifest) {
+	for _, m := range manifests {
+		if m.Uploaded && m.LockedUntil != nil && now.Before(*m.LockedUntil) {
+			locked = append(locked, m)
+		} else {
+			unlocked = append(unlocked, m)
+		}
+	}
+	return unlocked, locked
+}
+
+// cleanupOldBackups removes backups expired by the database's retention
+// policy, both locally and from remote storage, or moves them to archive
+// storage
+func (bt *Tool) cleanupOldBackups(ctx context.Context, job *databaseJob) (err error) {
+	ctx, span := tracing.Start(ctx, "cleanup")
+	defer func() { span.End(err) }()
+
+	manifests, err := loadManifests(job.outputDir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	expired := expiredBackups(job.db.Retention, manifests, now)
+	expired, locked := unlockedBackups(expired, now)
+	for _, m := range locked {
+		job.logger.Info("Keeping expired backup until its lock expires", "file", m.File, "locked_until", m.LockedUntil)
+	}
+
+	var archive []*backupManifest
+	if job.db.Retention.Archives() {
+		archive, expired = archivedBackups(job.db.Retention, expired, manifests, now)
+	}
+	var archived []string
+	for _, m := range archive {
+		if err := bt.archiveBackup(ctx, job, m); err != nil {
+			job.logger.Warn("Failed to archive old backup", "file", m.File, "error", err)
+			continue
+		}
+		job.logger.Info("Archived old backup", "file", m.File)
+		bt.metrics.observeRetentionArchive(job.db.ID)
+		archived = append(archived, m.File)
+	}
+
+	var removed []string
+	for _, m := range expired {
+		if err := bt.deleteBackup(ctx, job, m); err != nil {
+			job.logger.Warn("Failed to remove old backup", "file", m.File, "error", err)
+			continue
+		}
+		job.logger.Info("Removed old backup", "file", m.File)
+		bt.metrics.observeRetentionDeletion(job.db.ID)
+		removed = append(removed, m.File)
+	}
+
+	span.SetAttributes(tracing.Attr("beackup.removed", len(removed)), tracing.Attr("beackup.archived", len(archived)))
+	if len(removed) > 0 || len(archived) > 0 {
+		bt.notify(job, notification{Event: eventCleanup, Removed: removed, Archived: archived})
+	}
+
+	if job.db.WAL.Enabled() {
+		if err := bt.cleanupWAL(ctx, job, walBases(manifests, expired)); err != nil {
+			return fmt.Errorf("failed to clean up WAL: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// walBases returns the complete base backups whose WAL must be kept, those
+// not being removed. Archived base backups are restored with the WAL in
+// the database's storage, so they keep theirs.
+func walBases(manifests, removed []*backupManifest) []*backupManifest {
+	var bases []*backupManifest
+	for _, m := range manifests {
+		if m.Format == baseBackupFormat && !m.failed() && !slices.Contains(removed, m) {
+			bases = append(bases, m)
+		}
+	}
+	return bases
+}
+
+// deleteBackup removes a backup's local artifact, its remote or archived
+// copy, its signatures and meta file and finally its manifest
+func (bt *Tool) deleteBackup(ctx context.Context, job *databaseJob, m *backupManifest) error {
+	artifact := filepath.Join(job.outputDir, m.File)
+	if m.Archived {
+		if bt.archive == nil {
+			return fmt.Errorf("archive storage is not configured")
+		}
+		if err := bt.deleteArchived(ctx, job, m); err != nil {
+			return fmt.Errorf("failed to delete archived copy: %w", err)
+		}
+	} else if err := bt.removeCopies(ctx, job, m); err != nil {
+		return err
+	}
+
+	for _, file := range []string{signaturePath(artifact), metaPath(artifact), signaturePath(manifestPath(artifact)), manifestPath(artifact)} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	bt.recordRemoval(job, m)
+
+	// Remove the subdirectories the naming layout leaves empty
+	for dir := filepath.Dir(artifact); dir != job.outputDir && isUnder(dir, job.outputDir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// removeCopies removes a backup's local artifact and masked copy and their
+// remote copies, leaving its manifest
+func (bt *Tool) removeCopies(ctx context.Context, job *databaseJob, m *backupManifest) error {
+	if err := os.RemoveAll(filepath.Join(job.outputDir, m.File)); err != nil {
+		return err
+	}
+
+	if m.MaskedCopy != "" {
+		if err := os.Remove(filepath.Join(job.outputDir, m.MaskedCopy)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := bt.discardUploads(path.Join(job.db.ID, m.MaskedCopy)); err != nil {
+			return err
+		}
+	}
+	if err := bt.discardUploads(path.Join(job.db.ID, m.File)); err != nil {
+		return err
+	}
+
+	if m.Uploaded && bt.storage != nil {
+		var err error
+		if m.Dedup {
+			err = bt.deleteSnapshot(ctx, job, m.File)
+		} else {
+			err = bt.deleteRemote(ctx, path.Join(job.db.ID, m.File))
+		}
+		if err == nil && m.MaskedCopy != "" {
+			err = bt.deleteRemote(ctx, path.Join(job.db.ID, m.MaskedCopy))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete remote copy: %w", err)
+		}
+	}
+	return nil
+}
+
+// deleteRemote removes an uploaded backup, including every file of a
+// directory-format backup
+func (bt *Tool) deleteRemote(ctx context.Context, key string) error {
+	return deleteObjects(ctx, bt.storage, key)
+}
+
+// deleteObjects removes the object key from backend, or every object under
+// it for a directory-format backup
+func deleteObjects(ctx context.Context, backend storage.Backend, key string) error {
+	objects, err := remoteObjects(ctx, backend, key)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := backend.Delete(ctx, object.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remoteObjects lists the object key in backend, or the objects under it
+// for a directory-format backup
+func remoteObjects(ctx context.Context, backend storage.Backend, key string) ([]storage.Object, error) {
+	objects, err := backend.List(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var matching []storage.Object
+	for _, object := range objects {
+		if object.Key == key || isUnder(object.Key, key) {
+			matching = append(matching, object)
+		}
+	}
+	return matching, nil
+}
+
+// isUnder reports whether key lies inside the directory prefix dir
+func isUnder(key, dir string) bool {
+	return len(key) > len(dir) && key[:len(dir)] == dir && key[len(dir)] == '/'
+}
@@ -0,0 +1,302 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"beackup/config"
+	"beackup/retention"
+)
+
+// retentionNow is the time the retention tests run at
+var retentionNow = time.Date(2024, time.June, 10, 12, 0, 0, 0, time.UTC)
+
+// testBackup returns the manifest of a complete custom-format backup
+// created the given number of days before retentionNow
+func testBackup(file string, daysAgo int) *backupManifest {
+	return &backupManifest{File: file, Format: "custom", CreatedAt: retentionNow.AddDate(0, 0, -daysAgo)}
+}
+
+// withFormat sets the format of a test backup
+func withFormat(m *backupManifest, format string) *backupManifest {
+	m.Format = format
+	return m
+}
+
+// failedBackup marks a test backup failed
+func failedBackup(m *backupManifest) *backupManifest {
+	m.Status = statusFailed
+	return m
+}
+
+// archivedBackup marks a test backup archived
+func archivedBackup(m *backupManifest) *backupManifest {
+	m.Archived = true
+	return m
+}
+
+// lockedBackup marks a test backup uploaded and locked for the given
+// number of days after retentionNow
+func lockedBackup(m *backupManifest, days int) *backupManifest {
+	until := retentionNow.AddDate(0, 0, days)
+	m.Uploaded = true
+	m.LockedUntil = &until
+	return m
+}
+
+// files returns the file names of manifests
+func files(manifests []*backupManifest) []string {
+	names := []string{}
+	for _, m := range manifests {
+		names = append(names, m.File)
+	}
+	return names
+}
+
+func TestExpiredBackups(t *testing.T) {
+	tests := []struct {
+		name        string
+		rules       retention.Config
+		manifests   []*backupManifest
+		wantExpired []string
+	}{
+		{
+			name:  "keep last",
+			rules: retention.Config{Rules: retention.Rules{KeepLast: 2}},
+			manifests: []*backupManifest{
+				testBackup("a", 0), testBackup("b", 1), testBackup("c", 2), testBackup("d", 3),
+			},
+			wantExpired: []string{"c", "d"},
+		},
+		{
+			name:  "failed backups do not count and expire once older than every kept backup",
+			rules: retention.Config{Rules: retention.Rules{KeepLast: 2}},
+			manifests: []*backupManifest{
+				failedBackup(testBackup("a", 0)), testBackup("b", 1), failedBackup(testBackup("c", 2)),
+				testBackup("d", 3), failedBackup(testBackup("e", 4)), testBackup("f", 5),
+			},
+			wantExpired: []string{"f", "e"},
+		},
+		{
+			name:  "globals and base backups are retained on their own",
+			rules: retention.Config{Rules: retention.Rules{KeepLast: 1}},
+			manifests: []*backupManifest{
+				testBackup("a", 0), withFormat(testBackup("g1", 0), globalsFormat), withFormat(testBackup("base1", 0), baseBackupFormat),
+				testBackup("b", 1), withFormat(testBackup("g2", 1), globalsFormat), withFormat(testBackup("base2", 1), baseBackupFormat),
+			},
+			wantExpired: []string{"b", "g2", "base2"},
+		},
+		{
+			name:  "archived backups are left alone",
+			rules: retention.Config{Rules: retention.Rules{KeepLast: 1}},
+			manifests: []*backupManifest{
+				testBackup("a", 0), archivedBackup(testBackup("b", 1)), testBackup("c", 2),
+			},
+			wantExpired: []string{"c"},
+		},
+		{
+			name:  "locked backups still expire",
+			rules: retention.Config{Rules: retention.Rules{KeepLast: 1}},
+			manifests: []*backupManifest{
+				testBackup("a", 0), lockedBackup(testBackup("b", 1), 30),
+			},
+			wantExpired: []string{"b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expired := expiredBackups(tt.rules, tt.manifests, retentionNow)
+			if got := files(expired); !slices.Equal(got, tt.wantExpired) {
+				t.Errorf("expired = %v, want %v", got, tt.wantExpired)
+			}
+		})
+	}
+}
+
+func TestArchivedBackups(t *testing.T) {
+	rules := retention.Config{
+		Rules:   retention.Rules{KeepLast: 1},
+		Action:  retention.ActionArchive,
+		Archive: retention.Rules{KeepLast: 2},
+	}
+	tests := []struct {
+		name        string
+		manifests   []*backupManifest
+		wantArchive []string
+		wantRemove  []string
+	}{
+		{
+			name: "expired backups are archived",
+			manifests: []*backupManifest{
+				testBackup("a", 0), testBackup("b", 1), testBackup("c", 2),
+			},
+			wantArchive: []string{"b", "c"},
+			wantRemove:  []string{},
+		},
+		{
+			name: "archive rules delete the oldest archived backups",
+			manifests: []*backupManifest{
+				testBackup("a", 0), testBackup("b", 1), archivedBackup(testBackup("c", 2)), archivedBackup(testBackup("d", 3)),
+			},
+			wantArchive: []string{"b"},
+			wantRemove:  []string{"d"},
+		},
+		{
+			name: "expired backups the archive would not keep are deleted",
+			manifests: []*backupManifest{
+				testBackup("a", 0), testBackup("b", 1), testBackup("c", 2), testBackup("d", 3),
+			},
+			wantArchive: []string{"b", "c"},
+			wantRemove:  []string{"d"},
+		},
+		{
+			name: "failed backups are deleted, not archived",
+			manifests: []*backupManifest{
+				testBackup("a", 0), testBackup("b", 1), failedBackup(testBackup("c", 2)),
+			},
+			wantArchive: []string{"b"},
+			wantRemove:  []string{"c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expired := expiredBackups(rules, tt.manifests, retentionNow)
+			archive, remove := archivedBackups(rules, expired, tt.manifests, retentionNow)
+			if got := files(archive); !slices.Equal(got, tt.wantArchive) {
+				t.Errorf("archive = %v, want %v", got, tt.wantArchive)
+			}
+			if got := files(remove); !slices.Equal(got, tt.wantRemove) {
+				t.Errorf("remove = %v, want %v", got, tt.wantRemove)
+			}
+		})
+	}
+}
+
+func TestWALBases(t *testing.T) {
+	base := func(file string, daysAgo int) *backupManifest {
+		return withFormat(testBackup(file, daysAgo), baseBackupFormat)
+	}
+	removed := base("removed", 3)
+	manifests := []*backupManifest{
+		testBackup("dump", 0),
+		base("kept", 0),
+		archivedBackup(base("archived", 1)),
+		failedBackup(base("failed", 2)),
+		removed,
+	}
+	if got, want := files(walBases(manifests, []*backupManifest{removed})), []string{"kept", "archived"}; !slices.Equal(got, want) {
+		t.Errorf("walBases() = %v, want %v", got, want)
+	}
+}
+
+func TestArchivingKeepsWAL(t *testing.T) {
+	segments := []string{
+		"000000010000000000000001",
+		"000000010000000000000002",
+		"000000010000000000000003",
+		"000000010000000000000004",
+	}
+	tests := []struct {
+		name      string
+		retention retention.Config
+		wantWAL   []string
+	}{
+		{
+			name:      "archived base backups keep their WAL",
+			retention: retention.Config{Rules: retention.Rules{KeepLast: 1}, Action: retention.ActionArchive, Archive: retention.Rules{KeepLast: 5}},
+			wantWAL:   segments,
+		},
+		{
+			name:      "deleted base backups give up theirs",
+			retention: retention.Config{Rules: retention.Rules{KeepLast: 1}},
+			wantWAL:   segments[2:],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			job := &databaseJob{
+				db:        &config.Database{ID: "db", Retention: tt.retention, WAL: config.WAL{Mode: config.WALArchive}},
+				logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+				outputDir: dir,
+			}
+			archive := newMemBackend()
+			bt := &Tool{config: &config.Config{}, archive: archive, metrics: newMetrics()}
+
+			// The older base backup starts at the first segment, the newer
+			// one at the third
+			now := time.Now()
+			for i, walStart := range []string{segments[2], segments[0]} {
+				m := &backupManifest{
+					Database:  "db",
+					File:      fmt.Sprintf("base%d.tar", i),
+					Format:    baseBackupFormat,
+					CreatedAt: now.Add(-time.Duration(i) * time.Hour),
+					WALStart:  walStart,
+				}
+				if err := os.WriteFile(filepath.Join(dir, m.File), []byte("base"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := bt.writeManifest(dir, m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.MkdirAll(filepath.Join(dir, walDir), 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, segment := range segments {
+				if err := os.WriteFile(filepath.Join(dir, walDir, segment), []byte("wal"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := bt.cleanupOldBackups(context.Background(), job); err != nil {
+				t.Fatalf("cleanupOldBackups() error = %v", err)
+			}
+			if archived := archive.has("db/base1.tar"); archived != tt.retention.Archives() {
+				t.Errorf("older base backup archived = %v, want %v", archived, tt.retention.Archives())
+			}
+			if _, err := os.Stat(filepath.Join(dir, "base1.tar")); !os.IsNotExist(err) {
+				t.Errorf("older base backup left on local disk")
+			}
+			entries, err := os.ReadDir(filepath.Join(dir, walDir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var wal []string
+			for _, entry := range entries {
+				wal = append(wal, entry.Name())
+			}
+			if !slices.Equal(wal, tt.wantWAL) {
+				t.Errorf("WAL left = %v, want %v", wal, tt.wantWAL)
+			}
+		})
+	}
+}
+
+func TestUnlockedBackups(t *testing.T) {
+	notUploaded := lockedBackup(testBackup("local", 0), 30)
+	notUploaded.Uploaded = false
+	manifests := []*backupManifest{
+		testBackup("plain", 0),
+		lockedBackup(testBackup("locked", 0), 30),
+		lockedBackup(testBackup("expired", 40), -10),
+		lockedBackup(testBackup("ending", 30), 0),
+		notUploaded,
+	}
+
+	unlocked, locked := unlockedBackups(manifests, retentionNow)
+	if got, want := files(unlocked), []string{"plain", "expired", "ending", "local"}; !slices.Equal(got, want) {
+		t.Errorf("unlocked = %v, want %v", got, want)
+	}
+	if got, want := files(locked), []string{"locked"}; !slices.Equal(got, want) {
+		t.Errorf("locked = %v, want %v", got, want)
+	}
+}
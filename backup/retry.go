@@ -0,0 +1,109 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// retry calls fn until it succeeds, fails with an error that is not
+// transient, or the configured retries are used up
+func (bt *Tool) retry(ctx context.Context, logger *slog.Logger, operation string, fn func() error) error {
+	policy := bt.config.Backup.Retry
+	delay := policy.Backoff
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > policy.Retries || ctx.Err() != nil || !isRetryable(err) {
+			return err
+		}
+
+		logger.Warn("Transient failure, retrying", "operation", operation, "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, policy.MaxInterval)
+	}
+}
+
+// fatalMessages mark failures that retrying cannot fix, checked before
+// retryableMessages since libpq reports them as failed connections too
+var fatalMessages = []string{
+	"password authentication failed",
+	"authentication failed",
+	"no pg_hba.conf entry",
+	"permission denied",
+	"does not exist",
+	"access denied",
+	"invalid credentials",
+	"unknown database",
+}
+
+// retryableMessages mark network problems and overloaded or restarting
+// servers, as reported by libpq, the MySQL and MongoDB tools and storage
+// backends
+var retryableMessages = []string{
+	"connection refused",
+	"connection reset",
+	"connection timed out",
+	"timed out",
+	"timeout",
+	"could not connect to server",
+	"could not translate host name",
+	"server closed the connection unexpectedly",
+	"too many clients already",
+	"remaining connection slots are reserved",
+	"the database system is starting up",
+	"the database system is shutting down",
+	"the database system is in recovery mode",
+	"network is unreachable",
+	"no route to host",
+	"broken pipe",
+	"ssl syscall error",
+	"unexpected eof",
+	"can't connect to mysql server",
+	"can't connect to local mysql server",
+	"lost connection to mysql server",
+	"mysql server has gone away",
+	"too many connections",
+	"server selection error",
+	"no reachable servers",
+}
+
+// serverErrorStatus matches storage errors reporting a throttled or failed
+// request
+var serverErrorStatus = regexp.MustCompile(`status (429|5\d\d)\b`)
+
+// isRetryable reports whether err looks transient
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, fatal := range fatalMessages {
+		if strings.Contains(message, fatal) {
+			return false
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if serverErrorStatus.MatchString(message) {
+		return true
+	}
+	for _, transient := range retryableMessages {
+		if strings.Contains(message, transient) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,336 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"beackup/config"
+)
+
+// runsSchema creates the tables of the run catalog. Times are stored as
+// UTC text in sqlTimeFormat, which sorts chronologically.
+const runsSchema = `CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY,
+	run_id TEXT NOT NULL DEFAULT '',
+	database TEXT NOT NULL,
+	file TEXT NOT NULL DEFAULT '',
+	format TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	started_at TEXT NOT NULL,
+	finished_at TEXT NOT NULL,
+	duration_seconds REAL NOT NULL DEFAULT 0,
+	size INTEGER NOT NULL DEFAULT 0,
+	sha256 TEXT NOT NULL DEFAULT '',
+	verification TEXT NOT NULL DEFAULT '',
+	local_path TEXT NOT NULL DEFAULT '',
+	remote_location TEXT NOT NULL DEFAULT '',
+	removed_at TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS runs_database_started ON runs (database, started_at);
+`
+
+// sqlTimeFormat is how times are stored in the run catalog
+const sqlTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// Statuses of catalogued runs
+const (
+	runSucceeded = "success"
+	runFailed    = "failed"
+)
+
+// runRecord is a backup run in the run catalog
+type runRecord struct {
+	ID              int64   `json:"id"`
+	RunID           string  `json:"run_id"`
+	Database        string  `json:"database"`
+	File            string  `json:"file"`
+	Format          string  `json:"format"`
+	Status          string  `json:"status"`
+	Error           string  `json:"error"`
+	StartedAt       string  `json:"started_at"`
+	FinishedAt      string  `json:"finished_at"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Size            int64   `json:"size"`
+	SHA256          string  `json:"sha256"`
+	Verification    string  `json:"verification"`
+	LocalPath       string  `json:"local_path"`      // where the backup was written, empty if it never was
+	RemoteLocation  string  `json:"remote_location"` // storage type and key of the uploaded copy
+	RemovedAt       string  `json:"removed_at"`      // when retention or gc found the backup gone
+}
+
+// location returns where the backup of r can be found, preferring the
+// local copy
+func (r *runRecord) location() string {
+	if r.LocalPath != "" {
+		if _, err := os.Stat(r.LocalPath); err == nil {
+			return r.LocalPath
+		}
+	}
+	return r.RemoteLocation
+}
+
+// runSQL runs statements against the run catalog with the sqlite3 program,
+// creating its tables first, and returns the rows of the last query as
+// JSON. Concurrent writers wait for each other's locks.
+func runSQL(ctx context.Context, c config.Catalog, statements string) ([]byte, error) {
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create catalog directory: %w", err)
+	}
+	cmd := exec.CommandContext(ctx, c.Program, "-bail", "-batch", "-json", "-cmd", ".timeout 30000", c.Path)
+	cmd.Stdin = strings.NewReader(runsSchema + statements)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w, output: %s", c.Program, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// queryRuns returns the runs a query selects from the run catalog
+func queryRuns(ctx context.Context, c config.Catalog, query string) ([]runRecord, error) {
+	out, err := runSQL(ctx, c, query)
+	if err != nil {
+		return nil, err
+	}
+	runs := []runRecord{}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return runs, nil
+	}
+	if err := json.Unmarshal(out, &runs); err != nil {
+		return nil, fmt.Errorf("failed to parse catalog query result: %w", err)
+	}
+	return runs, nil
+}
+
+// sqlString renders s as an SQL string literal
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(s, "\x00", ""), "'", "''") + "'"
+}
+
+// sqlTime renders t as an SQL string literal in sqlTimeFormat
+func sqlTime(t time.Time) string {
+	return sqlString(t.UTC().Format(sqlTimeFormat))
+}
+
+// recordRun adds a finished backup run of job in format to the run
+// catalog, if enabled. m is the manifest of the backup written to
+// outputPath, or nil if the run failed before writing one.
+func (bt *Tool) recordRun(job *databaseJob, format, outputPath string, start time.Time, m *backupManifest, runErr error) {
+	c := bt.config.Catalog
+	if !c.Enabled {
+		return
+	}
+
+	finished := time.Now()
+	r := runRecord{
+		RunID:    job.currentRunID(),
+		Database: job.db.ID,
+		Format:   format,
+		Status:   runSucceeded,
+	}
+	if runErr != nil {
+		r.Status = runFailed
+		r.Error = runErr.Error()
+	}
+	if outputPath != "" {
+		r.File, _ = filepath.Rel(job.outputDir, outputPath)
+	}
+	if m != nil {
+		r.File = m.File
+		finished = m.FinishedAt
+		r.Size = m.Size
+		r.SHA256 = m.SHA256
+		r.Verification = m.Verification
+		if abs, err := filepath.Abs(filepath.Join(job.outputDir, m.File)); err == nil {
+			r.LocalPath = abs
+		}
+		r.RemoteLocation = bt.remoteLocation(job, m)
+	}
+
+	statement := fmt.Sprintf(`INSERT INTO runs (run_id, database, file, format, status, error,
+	started_at, finished_at, duration_seconds, size, sha256, verification, local_path, remote_location)
+VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %s, %d, %s, %s, %s, %s);
+`,
+		sqlString(r.RunID), sqlString(r.Database), sqlString(r.File), sqlString(r.Format), sqlString(r.Status), sqlString(r.Error),
+		sqlTime(start), sqlTime(finished), strconv.FormatFloat(finished.Sub(start).Seconds(), 'f', 3, 64), r.Size,
+		sqlString(r.SHA256), sqlString(r.Verification), sqlString(r.LocalPath), sqlString(r.RemoteLocation))
+	if _, err := runSQL(context.Background(), c, statement); err != nil {
+		job.logger.Warn("Failed to record run in catalog", "error", err)
+	}
+}
+
+// recordRemoval marks the catalogued runs of a deleted backup as removed
+func (bt *Tool) recordRemoval(job *databaseJob, m *backupManifest) {
+	c := bt.config.Catalog
+	if !c.Enabled {
+		return
+	}
+	statement := fmt.Sprintf("UPDATE runs SET removed_at = %s WHERE database = %s AND file = %s AND removed_at = '';\n",
+		sqlTime(time.Now()), sqlString(job.db.ID), sqlString(m.File))
+	if _, err := runSQL(context.Background(), c, statement); err != nil {
+		job.logger.Warn("Failed to record removal in catalog", "file", m.File, "error", err)
+	}
+}
+
+// recordArchival points the catalogued runs of a backup moved to archive
+// storage at its archived copy
+func (bt *Tool) recordArchival(job *databaseJob, m *backupManifest) {
+	c := bt.config.Catalog
+	if !c.Enabled {
+		return
+	}
+	location := bt.config.Storage.Archive.Type + ":" + path.Join(job.db.ID, filepath.ToSlash(m.File))
+	statement := fmt.Sprintf("UPDATE runs SET local_path = '', remote_location = %s WHERE database = %s AND file = %s AND removed_at = '';\n",
+		sqlString(location), sqlString(job.db.ID), sqlString(m.File))
+	if _, err := runSQL(context.Background(), c, statement); err != nil {
+		job.logger.Warn("Failed to record archival in catalog", "file", m.File, "error", err)
+	}
+}
+
+// History prints the latest runs in the run catalog of cfg, newest first,
+// of one database if db is set
+func History(ctx context.Context, w io.Writer, cfg *config.Config, db string, limit int, asJSON bool) error {
+	if !cfg.Catalog.Enabled {
+		return fmt.Errorf("the run catalog is not enabled")
+	}
+	query := "SELECT * FROM runs"
+	if db != "" {
+		query += " WHERE database = " + sqlString(db)
+	}
+	query += " ORDER BY started_at DESC, id DESC"
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+	runs, err := queryRuns(ctx, cfg.Catalog, query+";\n")
+	if err != nil {
+		return fmt.Errorf("failed to query catalog: %w", err)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(runs)
+	}
+	if len(runs) == 0 {
+		fmt.Fprintln(w, "No runs found")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATABASE\tSTARTED\tDURATION\tSTATUS\tFORMAT\tSIZE\tVERIFIED\tLOCATION")
+	for _, r := range runs {
+		started, _ := time.Parse(sqlTimeFormat, r.StartedAt)
+		location := r.location()
+		if r.RemovedAt != "" {
+			location = "(removed)"
+		}
+		status := r.Status
+		if r.Error != "" {
+			status += ": " + firstLine(r.Error)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Database, started.Local().Format("2006-01-02 15:04:05"),
+			(time.Duration(r.DurationSeconds * float64(time.Second))).Round(time.Millisecond),
+			status, valueOrDash(r.Format), formatBytes(r.Size), valueOrDash(r.Verification), valueOrDash(location))
+	}
+	return tw.Flush()
+}
+
+// Latest prints where the latest successful backup of the database db in
+// the run catalog of cfg is, or its catalog entry as JSON
+func Latest(ctx context.Context, w io.Writer, cfg *config.Config, db string, asJSON bool) error {
+	if !cfg.Catalog.Enabled {
+		return fmt.Errorf("the run catalog is not enabled")
+	}
+	query := fmt.Sprintf(`SELECT * FROM runs WHERE database = %s AND status = %s AND removed_at = '' AND format != %s
+ORDER BY started_at DESC, id DESC LIMIT 1;
+`, sqlString(db), sqlString(runSucceeded), sqlString(globalsFormat))
+	runs, err := queryRuns(ctx, cfg.Catalog, query)
+	if err != nil {
+		return fmt.Errorf("failed to query catalog: %w", err)
+	}
+	if len(runs) == 0 {
+		return fmt.Errorf("no successful backup of database %q in the catalog", db)
+	}
+
+	r := runs[0]
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+	fmt.Fprintln(w, r.location())
+	return nil
+}
+
+// GC marks the catalogued backups whose manifests are gone, deleted by
+// hand or by an earlier version, as removed, and deletes the runs of
+// removed backups and failed runs older than catalog.keep_runs. With
+// dryRun, it only prints what it would do.
+func GC(ctx context.Context, w io.Writer, cfg *config.Config, dryRun bool) error {
+	if !cfg.Catalog.Enabled {
+		return fmt.Errorf("the run catalog is not enabled")
+	}
+	now := time.Now()
+
+	runs, err := queryRuns(ctx, cfg.Catalog, "SELECT * FROM runs WHERE removed_at = '' AND local_path != '';\n")
+	if err != nil {
+		return fmt.Errorf("failed to query catalog: %w", err)
+	}
+	var statements string
+	gone := 0
+	for _, r := range runs {
+		if _, err := os.Stat(manifestPath(r.LocalPath)); !os.IsNotExist(err) {
+			continue
+		}
+		fmt.Fprintf(w, "Backup %s of database %s is gone\n", r.File, r.Database)
+		statements += fmt.Sprintf("UPDATE runs SET removed_at = %s WHERE id = %d;\n", sqlTime(now), r.ID)
+		gone++
+	}
+
+	expired := 0
+	if cfg.Catalog.KeepRuns > 0 {
+		// Failed runs that wrote no backup have nothing to remove
+		condition := fmt.Sprintf("finished_at < %s AND (removed_at != '' OR local_path = '')", sqlTime(now.Add(-cfg.Catalog.KeepRuns)))
+		out, err := runSQL(ctx, cfg.Catalog, "SELECT count(*) AS count FROM runs WHERE "+condition+";\n")
+		if err != nil {
+			return fmt.Errorf("failed to query catalog: %w", err)
+		}
+		var counts []struct{ Count int }
+		if err := json.Unmarshal(out, &counts); err != nil || len(counts) != 1 {
+			return fmt.Errorf("failed to parse catalog query result: %v", err)
+		}
+		expired = counts[0].Count
+		// Deleting first keeps the runs marked gone above until the next gc
+		statements = fmt.Sprintf("DELETE FROM runs WHERE %s;\n", condition) + statements
+	}
+
+	if dryRun {
+		fmt.Fprintf(w, "Would mark %d backups removed and delete %d runs\n", gone, expired)
+		return nil
+	}
+	if _, err := runSQL(ctx, cfg.Catalog, statements+"VACUUM;\n"); err != nil {
+		return fmt.Errorf("failed to update catalog: %w", err)
+	}
+	fmt.Fprintf(w, "Marked %d backups removed and deleted %d runs\n", gone, expired)
+	return nil
+}
+
+// firstLine returns s up to its first line break
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
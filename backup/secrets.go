@@ -0,0 +1,288 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"beackup/config"
+	"beackup/sigv4"
+)
+
+// secretProvider looks up secrets in an external store
+type secretProvider interface {
+	lookup(ctx context.Context, path, key string) (string, error)
+}
+
+// newSecretProviders creates a provider for each configured secret store
+func newSecretProviders(config config.Secrets) (map[string]secretProvider, error) {
+	providers := make(map[string]secretProvider)
+
+	if config.Vault.Address != "" || os.Getenv("VAULT_ADDR") != "" {
+		vault, err := newVault(config.Vault)
+		if err != nil {
+			return nil, fmt.Errorf("vault: %w", err)
+		}
+		providers["vault"] = vault
+	}
+	if config.AWS.Region != "" || os.Getenv("AWS_REGION") != "" || os.Getenv("AWS_DEFAULT_REGION") != "" {
+		providers["aws_secrets_manager"] = newAWSSecretsManager(config.AWS)
+	}
+
+	return providers, nil
+}
+
+// resolvePassword returns the database password, read afresh from its
+// password file or secret store so rotated credentials are used without a
+// restart. The config is left alone, as backups, WAL archiving and
+// commands may resolve the password of the same database at once.
+func (bt *Tool) resolvePassword(ctx context.Context, db *config.Database) (string, error) {
+	switch {
+	case db.PasswordSecret.Provider != "":
+		provider, ok := bt.secrets[db.PasswordSecret.Provider]
+		if !ok {
+			return "", fmt.Errorf("secret provider %q is not configured", db.PasswordSecret.Provider)
+		}
+		password, err := provider.lookup(ctx, db.PasswordSecret.Path, db.PasswordSecret.Key)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password from %s: %w", db.PasswordSecret.Provider, err)
+		}
+		return password, nil
+
+	case db.PasswordFile != "":
+		data, err := os.ReadFile(db.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return db.Password, nil
+}
+
+// vault reads secrets from Vault's KV secrets engine (version 1 or 2)
+type vault struct {
+	config config.Vault
+	client *http.Client
+}
+
+func newVault(config config.Vault) (*vault, error) {
+	if config.Address == "" {
+		config.Address = os.Getenv("VAULT_ADDR")
+	}
+	config.Address = strings.TrimSuffix(config.Address, "/")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	if config.CACert != "" {
+		pem, err := os.ReadFile(config.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CACert)
+		}
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+
+	return &vault{config: config, client: client}, nil
+}
+
+// lookup reads key from the secret at path, e.g. secret/data/orders for
+// the KV v2 engine mounted at secret/
+func (v *vault) lookup(ctx context.Context, path, key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("a key is required for vault secrets")
+	}
+
+	token, err := v.token(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := v.request(ctx, http.MethodGet, "/v1/"+strings.TrimPrefix(path, "/"), token, nil, &result); err != nil {
+		return "", err
+	}
+
+	// KV v2 nests the secret's fields under data.data
+	data := result.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	value, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %q", path, key)
+	}
+	return fmt.Sprint(value), nil
+}
+
+// token returns the configured token or logs in with AppRole
+func (v *vault) token(ctx context.Context) (string, error) {
+	if v.config.Token != "" {
+		return v.config.Token, nil
+	}
+	if v.config.TokenFile != "" {
+		data, err := os.ReadFile(v.config.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read vault token: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if v.config.RoleID == "" {
+		if token := os.Getenv("VAULT_TOKEN"); token != "" {
+			return token, nil
+		}
+		return "", fmt.Errorf("no vault token or approle credentials configured")
+	}
+
+	var result struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	body := map[string]string{"role_id": v.config.RoleID, "secret_id": v.config.SecretID}
+	if err := v.request(ctx, http.MethodPost, "/v1/auth/approle/login", "", body, &result); err != nil {
+		return "", fmt.Errorf("approle login failed: %w", err)
+	}
+	return result.Auth.ClientToken, nil
+}
+
+// request sends a Vault API request and decodes the JSON response into out
+func (v *vault) request(ctx context.Context, method, path, token string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, v.config.Address+path, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.config.Namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read vault response: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(respBody, &vaultErr)
+		return fmt.Errorf("vault request failed with status %d: %s", resp.StatusCode, strings.Join(vaultErr.Errors, "; "))
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// awsSecretsManager reads secrets with the GetSecretValue API
+type awsSecretsManager struct {
+	config config.AWSSecretsManager
+	client *http.Client
+}
+
+func newAWSSecretsManager(config config.AWSSecretsManager) *awsSecretsManager {
+	return &awsSecretsManager{config: config, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// lookup returns the secret string of the secret id, or one field of it if
+// the secret holds JSON and key is set
+func (a *awsSecretsManager) lookup(ctx context.Context, secretID, key string) (string, error) {
+	region := firstNonEmpty(a.config.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"))
+	creds := sigv4.Credentials{
+		AccessKeyID:     firstNonEmpty(a.config.AccessKeyID, os.Getenv("AWS_ACCESS_KEY_ID")),
+		SecretAccessKey: firstNonEmpty(a.config.SecretAccessKey, os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		SessionToken:    firstNonEmpty(a.config.SessionToken, os.Getenv("AWS_SESSION_TOKEN")),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return "", fmt.Errorf("aws credentials are not configured")
+	}
+	endpoint := firstNonEmpty(a.config.Endpoint, fmt.Sprintf("https://secretsmanager.%s.amazonaws.com", region))
+
+	body, err := json.Marshal(map[string]string{"SecretId": secretID})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	sigv4.Sign(req, creds, region, "secretsmanager", sigv4.HashHex(body), time.Now())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("secrets manager request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secrets manager response: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		var awsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(respBody, &awsErr)
+		return "", fmt.Errorf("secrets manager request failed with status %d: %s: %s", resp.StatusCode, awsErr.Type, awsErr.Message)
+	}
+
+	var result struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return "", fmt.Errorf("failed to parse secrets manager response: %w", err)
+	}
+	if key == "" {
+		return result.SecretString, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(result.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("secret %s is not JSON, so key %q cannot be read", secretID, key)
+	}
+	value, ok := fields[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %q", secretID, key)
+	}
+	return fmt.Sprint(value), nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
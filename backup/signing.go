@@ -0,0 +1,216 @@
+package backup
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"beackup/config"
+)
+
+// signatureSuffix is appended to a signed file's name to form its detached
+// signature
+const signatureSuffix = ".sig"
+
+// errUnsigned reports that a file has no signature to check
+var errUnsigned = errors.New("not signed")
+
+// signaturePath returns where the detached signature of a file is stored
+func signaturePath(path string) string {
+	return path + signatureSuffix
+}
+
+// signFile writes a detached signature of the file at path next to it.
+// Ed25519 signatures are Ed25519ph over the file's SHA-512, so that large
+// artifacts need not be read into memory.
+func signFile(s config.Signing, path string) error {
+	switch s.Type {
+	case "ed25519":
+		key, err := ed25519PrivateKey(s)
+		if err != nil {
+			return err
+		}
+		digest, err := fileDigest(path)
+		if err != nil {
+			return err
+		}
+		signature, err := key.Sign(nil, digest, &ed25519.Options{Hash: crypto.SHA512})
+		if err != nil {
+			return fmt.Errorf("failed to sign %s: %w", filepath.Base(path), err)
+		}
+		if err := os.WriteFile(signaturePath(path), signature, 0644); err != nil {
+			return fmt.Errorf("failed to write signature: %w", err)
+		}
+		return nil
+
+	case "gpg":
+		if !s.PrivateKey.IsSet() {
+			return fmt.Errorf("no private key is configured to sign with")
+		}
+		return withGPGKey(s.PrivateKey, func(base []string, keyDir string) error {
+			args := append(base, "--detach-sign")
+			if s.Passphrase.IsSet() {
+				passphrase, err := writeKeyFile(keyDir, "passphrase", s.Passphrase)
+				if err != nil {
+					return err
+				}
+				args = append(args, "--pinentry-mode", "loopback", "--passphrase-file", passphrase)
+			}
+			args = append(args, "--output", signaturePath(path), path)
+			if output, err := runCommand("gpg", args...); err != nil {
+				return fmt.Errorf("failed to sign %s: %w, output: %s", filepath.Base(path), err, output)
+			}
+			return nil
+		})
+
+	default:
+		return fmt.Errorf("unknown signing type %q", s.Type)
+	}
+}
+
+// verifyFile checks the detached signature of the file at path, returning
+// errUnsigned if it has none
+func verifyFile(s config.Signing, path string) error {
+	sigPath := signaturePath(path)
+	if _, err := os.Stat(sigPath); os.IsNotExist(err) {
+		return errUnsigned
+	}
+
+	switch s.Type {
+	case "ed25519":
+		key, err := ed25519PublicKey(s)
+		if err != nil {
+			return err
+		}
+		signature, err := os.ReadFile(sigPath)
+		if err != nil {
+			return fmt.Errorf("failed to read signature: %w", err)
+		}
+		digest, err := fileDigest(path)
+		if err != nil {
+			return err
+		}
+		if err := ed25519.VerifyWithOptions(key, digest, signature, &ed25519.Options{Hash: crypto.SHA512}); err != nil {
+			return fmt.Errorf("bad signature")
+		}
+		return nil
+
+	case "gpg":
+		key := s.PublicKey
+		if !key.IsSet() {
+			key = s.PrivateKey
+		}
+		return withGPGKey(key, func(base []string, keyDir string) error {
+			if output, err := runCommand("gpg", append(base, "--verify", sigPath, path)...); err != nil {
+				// gpg explains the failure on its last line
+				lines := strings.Split(strings.TrimSpace(output), "\n")
+				return fmt.Errorf("bad signature: %s", strings.TrimPrefix(lines[len(lines)-1], "gpg: "))
+			}
+			return nil
+		})
+
+	default:
+		return fmt.Errorf("unknown signing type %q", s.Type)
+	}
+}
+
+// withGPGKey imports key into a temporary GPG home and calls fn with the
+// arguments that select it
+func withGPGKey(key config.KeySource, fn func(base []string, keyDir string) error) error {
+	keyDir, err := os.MkdirTemp("", "beackup-gpg-")
+	if err != nil {
+		return fmt.Errorf("failed to create key directory: %w", err)
+	}
+	defer os.RemoveAll(keyDir)
+
+	path, err := writeKeyFile(keyDir, "signing.asc", key)
+	if err != nil {
+		return err
+	}
+	base := []string{"--batch", "--yes", "--no-tty", "--homedir", keyDir, "--trust-model", "always"}
+	if output, err := runCommand("gpg", append(base, "--import", path)...); err != nil {
+		return fmt.Errorf("failed to import gpg key: %w, output: %s", err, output)
+	}
+	return fn(base, keyDir)
+}
+
+// ed25519PrivateKey loads the PEM-encoded PKCS #8 signing key
+func ed25519PrivateKey(s config.Signing) (ed25519.PrivateKey, error) {
+	if !s.PrivateKey.IsSet() {
+		return nil, fmt.Errorf("no private key is configured to sign with")
+	}
+	block, err := loadPEM(s.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key is not an Ed25519 key")
+	}
+	return private, nil
+}
+
+// ed25519PublicKey loads the PEM-encoded public key signatures are checked
+// against, deriving it from the private key if none is configured
+func ed25519PublicKey(s config.Signing) (ed25519.PublicKey, error) {
+	if !s.PublicKey.IsSet() {
+		private, err := ed25519PrivateKey(s)
+		if err != nil {
+			return nil, err
+		}
+		return private.Public().(ed25519.PublicKey), nil
+	}
+	block, err := loadPEM(s.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not an Ed25519 key")
+	}
+	return public, nil
+}
+
+// loadPEM reads the first PEM block of key
+func loadPEM(key config.KeySource) (*pem.Block, error) {
+	data, err := key.Load()
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM-encoded key found")
+	}
+	return block, nil
+}
+
+// fileDigest returns the SHA-512 of a file's contents
+func fileDigest(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha512.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,160 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"beackup/config"
+)
+
+// sshTunnelTimeout bounds how long a tunnel may take to come up
+const sshTunnelTimeout = 30 * time.Second
+
+// sshArgs returns the ssh flags connecting to s's host
+func sshArgs(s config.SSH) []string {
+	args := []string{
+		"-p", strconv.Itoa(s.Port),
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=30",
+		"-o", "ServerAliveInterval=15",
+	}
+	if s.KeyFile != "" {
+		args = append(args, "-i", s.KeyFile)
+	}
+	if s.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+s.KnownHostsFile)
+	}
+	if s.Bastion != "" {
+		args = append(args, "-J", s.Bastion)
+	}
+	return args
+}
+
+// overSSH rewrites cmd to run on s's host. ssh streams its standard input
+// and output like the program's own. The variables cmd adds to the
+// environment are read from standard input by the remote shell, as sshd
+// does not accept them by default and the command line would show them.
+func overSSH(s config.SSH, cmd *exec.Cmd) {
+	remote := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		remote[i] = shellQuote(arg)
+	}
+	command := strings.Join(remote, " ")
+	if script := envOverStdin(cmd); script != "" {
+		command = script + "exec " + command
+	}
+
+	args := append([]string{"ssh"}, sshArgs(s)...)
+	args = append(args, s.Destination(), command)
+	path, err := exec.LookPath("ssh")
+	cmd.Path = path
+	cmd.Err = err
+	cmd.Args = args
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+./:,@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// sshTunnel forwards a local port to a database server through its SSH
+// host
+type sshTunnel struct {
+	cmd    *exec.Cmd
+	exited chan struct{}
+	local  int    // port the tunnel listens on
+	host   string // the database's own address, restored on close
+	port   int
+}
+
+// openTunnel forwards a local port through db's SSH host to its server and
+// points db at the port until the returned function is called. db should be
+// the caller's own copy of the database. Databases not reached through a
+// tunnel are left alone.
+func openTunnel(ctx context.Context, db *config.Database) (func(), error) {
+	if !db.SSH.Enabled() || db.SSH.Mode != config.SSHTunnel {
+		return noCleanup, nil
+	}
+
+	t, err := startTunnel(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	db.Host, db.Port = "127.0.0.1", t.local
+
+	return func() {
+		db.Host, db.Port = t.host, t.port
+		t.cmd.Process.Kill()
+		<-t.exited
+	}, nil
+}
+
+// startTunnel starts ssh forwarding a free local port to db's server and
+// waits until the port accepts connections
+func startTunnel(ctx context.Context, db *config.Database) (*sshTunnel, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find a free port for the ssh tunnel: %w", err)
+	}
+	local := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	// A PostgreSQL host starting with a slash is the server's socket
+	// directory on the SSH host
+	target := net.JoinHostPort(db.Host, strconv.Itoa(db.Port))
+	if db.Type == config.TypePostgres && strings.HasPrefix(db.Host, "/") {
+		target = fmt.Sprintf("%s/.s.PGSQL.%d", db.Host, db.Port)
+	}
+
+	args := append(sshArgs(db.SSH), "-N", "-o", "ExitOnForwardFailure=yes", "-L", local.String()+":"+target, db.SSH.Destination())
+	t := &sshTunnel{
+		cmd:    exec.Command("ssh", args...),
+		exited: make(chan struct{}),
+		local:  local.Port,
+		host:   db.Host,
+		port:   db.Port,
+	}
+	var stderr bytes.Buffer
+	t.cmd.Stderr = &stderr
+	if err := t.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ssh tunnel: %w", err)
+	}
+	var waitErr error
+	go func() {
+		waitErr = t.cmd.Wait()
+		close(t.exited)
+	}()
+
+	timeout := time.NewTimer(sshTunnelTimeout)
+	defer timeout.Stop()
+	for {
+		conn, err := net.DialTimeout("tcp", local.String(), time.Second)
+		if err == nil {
+			conn.Close()
+			return t, nil
+		}
+
+		select {
+		case <-t.exited:
+			return nil, fmt.Errorf("ssh tunnel failed: %v, output: %s", waitErr, strings.TrimSpace(stderr.String()))
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-timeout.C:
+			err = fmt.Errorf("ssh tunnel to %s not up after %s", db.SSH.Host, sshTunnelTimeout)
+		case <-time.After(100 * time.Millisecond):
+			continue
+		}
+		t.cmd.Process.Kill()
+		<-t.exited
+		return nil, err
+	}
+}
@@ -0,0 +1,36 @@
+package backup
+
+import (
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+
+	"beackup/config"
+)
+
+func TestOverSSH(t *testing.T) {
+	db := &config.Database{SSH: config.SSH{Host: "db.internal", Port: 22, User: "backup", Mode: config.SSHExec}}
+	cmd := secretCommand()
+	remoteCommand(db, cmd)
+	setStdin(cmd, strings.NewReader("dump data"))
+
+	checkNoSecret(t, cmd)
+	if slices.Contains(cmd.Env, "PGPASSWORD=hunter2secret") {
+		t.Error("PGPASSWORD left in the environment of ssh")
+	}
+	if cmd.Args[0] != "ssh" || cmd.Args[len(cmd.Args)-2] != "backup@db.internal" {
+		t.Fatalf("args = %q, want ssh to backup@db.internal", cmd.Args)
+	}
+
+	// Run what sshd would run on the host
+	run := exec.Command("sh", "-c", cmd.Args[len(cmd.Args)-1])
+	run.Stdin = cmd.Stdin
+	output, err := run.Output()
+	if err != nil {
+		t.Fatalf("remote command failed: %v", err)
+	}
+	if string(output) != "hunter2secret|dump data" {
+		t.Errorf("remote command printed %q, want the password and then the input", output)
+	}
+}
@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync/atomic"
+	"time"
+
+	"beackup/config"
+	"beackup/tracing"
+)
+
+// uploadedDump describes a dump piped straight into remote storage
+type uploadedDump struct {
+	size     int64
+	checksum string
+}
+
+// uploadDump runs cmd like streamDump, but pipes the compressed and
+// encrypted dump straight into remote storage under key instead of a local
+// file, adding the bytes uploaded so far to written. A failed dump fails
+// the upload, which the storage backend aborts, so nothing is left behind.
+func (bt *Tool) uploadDump(ctx context.Context, job *databaseJob, tool string, cmd *exec.Cmd, key string, compress bool, masking *config.Masking, tee io.WriteCloser, written *atomic.Int64) (output string, dump uploadedDump, err error) {
+	uploadCtx, span := tracing.Start(ctx, "upload", tracing.Attr("beackup.storage", bt.config.Storage.Type), tracing.Attr("beackup.streamed", true))
+	start := time.Now()
+
+	reader, writer := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		err := bt.storage.Put(uploadCtx, key, reader)
+		// Stops the dump if the upload gave up before reading all of it
+		reader.CloseWithError(err)
+		uploaded <- err
+	}()
+
+	job.logger.Debug("Streaming dump to storage", "key", key)
+	hash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(writer, hash), n: written}
+	output, err = bt.pipeDump(ctx, tool, cmd, counter, compress, masking, tee)
+	writer.CloseWithError(err)
+	uploadErr := <-uploaded
+
+	// A dump that failed on its own reaches the upload as a read error;
+	// otherwise the upload failing is what stopped the dump
+	if uploadErr != nil && (err == nil || !errors.Is(uploadErr, err)) {
+		err = fmt.Errorf("failed to upload %s: %w", key, uploadErr)
+	}
+	bt.metrics.observeUpload(job.db.ID, time.Since(start), err)
+	span.End(err)
+	if err != nil {
+		return output, uploadedDump{}, err
+	}
+	return output, uploadedDump{size: written.Load(), checksum: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// countingWriter passes writes on to w, adding their size to n
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// dumpVerifier verifies a dump as it is written, so that dumps streamed to
+// storage are verified without a local copy to read back
+type dumpVerifier struct {
+	writer *io.PipeWriter
+	result chan error
+}
+
+// newDumpVerifier starts verifying the dump of job written to the returned
+// verifier, a dump of format before compression and encryption
+func newDumpVerifier(ctx context.Context, job *databaseJob, format string) *dumpVerifier {
+	reader, writer := io.Pipe()
+	v := &dumpVerifier{writer: writer, result: make(chan error, 1)}
+	go func() {
+		err := job.driver.verify(ctx, job.db, reader, format)
+		// The dump keeps flowing when verification stops reading early
+		io.Copy(io.Discard, reader)
+		v.result <- err
+	}()
+	return v
+}
+
+func (v *dumpVerifier) Write(p []byte) (int, error) {
+	return v.writer.Write(p)
+}
+
+// Close marks the end of the dump; it may be called more than once
+func (v *dumpVerifier) Close() error {
+	return v.writer.Close()
+}
+
+// wait returns the verification's result once the verifier is closed
+func (v *dumpVerifier) wait() error {
+	return <-v.result
+}
@@ -0,0 +1,142 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"beackup/config"
+	"beackup/storage"
+)
+
+// rateLimiter spreads the transfers it is shared by over time so that
+// together they stay below a rate. Idle time is not saved up for bursts.
+type rateLimiter struct {
+	rate int64 // bytes per second
+
+	mu   sync.Mutex
+	next time.Time // when the bytes reserved so far are transferred at rate
+}
+
+// throttleChunk bounds how much data is passed on between waits
+const throttleChunk = 32 * 1024
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{rate: bytesPerSecond}
+}
+
+// wait reserves n bytes and blocks until the transfers reserved before them
+// have had their time
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledWriter passes writes on to w no faster than its limiter allows
+type throttledWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		if err := t.limiter.wait(t.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// throttledReader reads from r no faster than its limiter allows
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if waitErr := t.limiter.wait(t.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// throttleWriter limits the data written to w to the configured rate
+func (bt *Tool) throttleWriter(ctx context.Context, w io.Writer) io.Writer {
+	if bt.limiter == nil {
+		return w
+	}
+	return &throttledWriter{ctx: ctx, w: w, limiter: bt.limiter}
+}
+
+// throttleUpload limits the data read from r for an upload to the
+// configured rate, unless the storage backend limits uploads itself
+func (bt *Tool) throttleUpload(ctx context.Context, r io.Reader) io.Reader {
+	if _, ok := bt.storage.(storage.RateLimiter); ok || bt.limiter == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, limiter: bt.limiter}
+}
+
+// applyPriority makes cmd start its program through nice and ionice
+func applyPriority(p config.Priority, cmd *exec.Cmd) {
+	var prefix []string
+	if p.Nice != 0 {
+		prefix = append(prefix, "nice", "-n", strconv.Itoa(p.Nice))
+	}
+	switch p.IONiceClass {
+	case "idle":
+		prefix = append(prefix, "ionice", "-c", "3")
+	case "best-effort":
+		prefix = append(prefix, "ionice", "-c", "2", "-n", strconv.Itoa(p.IONiceLevel))
+	}
+	if len(prefix) == 0 {
+		return
+	}
+
+	// The wrapped program keeps the path it was resolved to
+	args := append(prefix, cmd.Path)
+	args = append(args, cmd.Args[1:]...)
+	path, err := exec.LookPath(prefix[0])
+	if err != nil && cmd.Err == nil {
+		cmd.Err = err
+	}
+	cmd.Path = path
+	cmd.Args = args
+}
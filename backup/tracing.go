@@ -0,0 +1,60 @@
+package backup
+
+import (
+	"context"
+	"log/slog"
+
+	"beackup/tracing"
+)
+
+// startRun starts the trace of a run of job, such as a backup or a restore
+// rehearsal. The trace ID is the run ID, which is added to the job's log
+// lines, manifests, notifications and hooks until endRun.
+func (bt *Tool) startRun(ctx context.Context, job *databaseJob, name string) (context.Context, *tracing.Span) {
+	ctx, span := bt.tracer.StartTrace(ctx, name,
+		tracing.Attr("beackup.database", job.db.ID),
+		tracing.Attr("db.system", job.db.Type),
+		tracing.Attr("db.name", job.db.Name),
+	)
+	job.mu.Lock()
+	job.runID = span.TraceID()
+	job.mu.Unlock()
+	return ctx, span
+}
+
+// endRun finishes the run's trace, which exports it
+func (bt *Tool) endRun(job *databaseJob, span *tracing.Span, err error) {
+	job.mu.Lock()
+	job.runID = ""
+	job.mu.Unlock()
+	span.End(err)
+}
+
+// currentRunID returns the ID of the job's running run, if any
+func (job *databaseJob) currentRunID() string {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.runID
+}
+
+// runIDHandler adds the job's current run ID to its log records
+type runIDHandler struct {
+	slog.Handler
+	job *databaseJob
+}
+
+func (h runIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := h.job.currentRunID(); id != "" {
+		r = r.Clone()
+		r.AddAttrs(slog.String("run_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h runIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return runIDHandler{Handler: h.Handler.WithAttrs(attrs), job: h.job}
+}
+
+func (h runIDHandler) WithGroup(name string) slog.Handler {
+	return runIDHandler{Handler: h.Handler.WithGroup(name), job: h.job}
+}
@@ -0,0 +1,185 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"beackup/storage"
+)
+
+// uploadStateDir holds, in output_dir, the progress of uploads sent in
+// parts, so that an interrupted upload resumes where it stopped
+const uploadStateDir = ".uploads"
+
+// uploadStatePath returns the file recording the progress of the upload of
+// key
+func (bt *Tool) uploadStatePath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(bt.config.Backup.OutputDir, uploadStateDir, hex.EncodeToString(sum[:8])+".json")
+}
+
+// putFile uploads the file at path under key, resuming an interrupted
+// earlier upload of it, checks the uploaded object and returns the file's
+// SHA-256
+func (bt *Tool) putFile(ctx context.Context, job *databaseJob, key, path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	statePath := bt.uploadStatePath(key)
+	state, err := storage.LoadUploadState(statePath)
+	if err == nil && state.Key == key && state.Size == info.Size() && state.ModTime.Equal(info.ModTime()) && len(state.Parts) > 0 {
+		job.logger.Info("Resuming interrupted upload", "key", key, "uploaded", formatBytes(int64(len(state.Parts))*state.PartSize))
+	}
+
+	throttle := func(r io.Reader) io.Reader { return bt.throttleUpload(ctx, r) }
+	sum, err := storage.PutFile(ctx, bt.storage, key, path, statePath, throttle)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	if err := bt.verifyUpload(ctx, key, info.Size(), sum); err != nil {
+		return "", err
+	}
+	return sum, nil
+}
+
+// verifyUpload checks the object uploaded under key against the size of
+// the file it was uploaded from, and reads it back to compare its SHA-256
+// too if storage.verify_uploads is set
+func (bt *Tool) verifyUpload(ctx context.Context, key string, size int64, sum string) error {
+	objects, err := bt.storage.List(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to verify upload of %s: %w", key, err)
+	}
+	found := false
+	for _, object := range objects {
+		if object.Key != key {
+			continue
+		}
+		if object.Size != size {
+			return fmt.Errorf("uploaded %s has %d bytes instead of %d", key, object.Size, size)
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("uploaded %s is missing from storage", key)
+	}
+	if !bt.config.Storage.VerifyUploads {
+		return nil
+	}
+
+	body, err := bt.storage.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to verify upload of %s: %w", key, err)
+	}
+	defer body.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return fmt.Errorf("failed to verify upload of %s: %w", key, err)
+	}
+	if remote := hex.EncodeToString(hash.Sum(nil)); remote != sum {
+		return fmt.Errorf("uploaded %s has checksum %s instead of %s", key, remote, sum)
+	}
+	return nil
+}
+
+// pendingUploads returns the upload states in output_dir by the key they
+// upload
+func (bt *Tool) pendingUploads() map[string]string {
+	dir := filepath.Join(bt.config.Backup.OutputDir, uploadStateDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	pending := make(map[string]string)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		statePath := filepath.Join(dir, entry.Name())
+		if state, err := storage.LoadUploadState(statePath); err == nil {
+			pending[state.Key] = statePath
+		}
+	}
+	return pending
+}
+
+// resumeUploads finishes the interrupted uploads of earlier backups of job,
+// such as one cut short by a crash or by running out of retries, and
+// discards the progress of uploads whose file is gone
+func (bt *Tool) resumeUploads(ctx context.Context, job *databaseJob) {
+	pending := bt.pendingUploads()
+	if bt.storage == nil || len(pending) == 0 {
+		return
+	}
+	manifests, err := loadManifests(job.outputDir)
+	if err != nil {
+		job.logger.Warn("Failed to resume uploads", "error", err)
+		return
+	}
+
+	for _, m := range manifests {
+		if m.Uploaded || m.failed() || m.Archived || !hasPendingUpload(pending, path.Join(job.db.ID, m.File)) {
+			continue
+		}
+		artifact := filepath.Join(job.outputDir, m.File)
+		if _, err := os.Stat(artifact); err != nil {
+			continue
+		}
+		job.logger.Info("Resuming upload of earlier backup", "file", m.File)
+		err := bt.uploadBackup(ctx, job, artifact, m.SHA256, nil)
+		if err == nil && m.MaskedCopy != "" {
+			err = bt.uploadBackup(ctx, job, filepath.Join(job.outputDir, m.MaskedCopy), "", nil)
+		}
+		if err == nil {
+			m.Uploaded = true
+			err = bt.writeManifest(job.outputDir, m)
+		}
+		if err != nil {
+			job.logger.Warn("Failed to resume upload", "file", m.File, "error", err)
+		}
+	}
+
+	for key, statePath := range pending {
+		if !isUnder(key, job.db.ID) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(bt.config.Backup.OutputDir, filepath.FromSlash(key))); os.IsNotExist(err) {
+			if err := storage.DiscardUpload(bt.storage, statePath); err != nil {
+				job.logger.Warn("Failed to discard upload", "key", key, "error", err)
+			}
+		}
+	}
+}
+
+// hasPendingUpload reports whether an upload of key, or of a file under it
+// for a directory-format backup, is pending
+func hasPendingUpload(pending map[string]string, key string) bool {
+	for pendingKey := range pending {
+		if pendingKey == key || isUnder(pendingKey, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// discardUploads abandons the pending uploads of key, or of the files under
+// it for a directory-format backup
+func (bt *Tool) discardUploads(key string) error {
+	for pendingKey, statePath := range bt.pendingUploads() {
+		if pendingKey != key && !isUnder(pendingKey, key) {
+			continue
+		}
+		if err := storage.DiscardUpload(bt.storage, statePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Verification outcomes
+const (
+	verifyPassed  = "passed"
+	verifyFailed  = "failed"
+	verifySkipped = "skipped"
+)
+
+// errVerifySkipped is returned when a backup cannot be verified on this host
+var errVerifySkipped = errors.New("verification skipped")
+
+// verifyBackup checks that a finished backup can be read back: pg_restore
+// must be able to list archive formats, plain dumps must look complete,
+// base backups must be readable tar archives and copy exports must have
+// every table file they index. Other database types are checked by their
+// driver.
+func (bt *Tool) verifyBackup(ctx context.Context, job *databaseJob, path string) error {
+	if encryptionFromExtension(path) != "" && !bt.config.Encryption.PrivateKey.IsSet() {
+		return fmt.Errorf("%w: backup is encrypted and no private key is configured", errVerifySkipped)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat backup: %w", err)
+	}
+	if info.IsDir() && IsBaseBackup(path) {
+		return bt.verifyBaseBackupDir(path)
+	}
+	if info.IsDir() && isCopyExport(path) {
+		return bt.verifyCopyExport(ctx, path)
+	}
+	if info.IsDir() {
+		return verifyArchive(commandContext(ctx, "pg_restore", "--list", "--format=directory", path))
+	}
+
+	reader, err := bt.openBackup(path)
+	if err != nil {
+		return err
+	}
+
+	if IsBaseBackup(path) {
+		err = verifyBaseBackup(reader)
+	} else {
+		err = job.driver.verify(ctx, job.db, reader, formatFromExtension(stripArtifactExtensions(path)))
+	}
+
+	if closeErr := reader.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("failed to read backup: %w", closeErr)
+	}
+	return err
+}
+
+// verifyDump verifies the backup at path, or returns the result of verifier
+// if the dump was verified as it was streamed to storage
+func (bt *Tool) verifyDump(ctx context.Context, job *databaseJob, path string, verifier *dumpVerifier) error {
+	if verifier != nil {
+		return verifier.wait()
+	}
+	return bt.verifyBackup(ctx, job, path)
+}
+
+// verifyArchive runs a pg_restore --list command and checks it found entries
+func verifyArchive(cmd *exec.Cmd) error {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_restore --list failed: %w, output: %s", err, stderr.String())
+	}
+
+	// Every entry line starts with its dump ID; comment lines start with ';'
+	entries := 0
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, ";") {
+			entries++
+		}
+	}
+	if entries == 0 {
+		return fmt.Errorf("archive contains no entries")
+	}
+	return nil
+}
+
+// verifyPlainDump checks that a plain SQL dump is non-empty, carries the
+// pg_dump or pg_dumpall header and completion trailer, and has no
+// unterminated COPY block
+func verifyPlainDump(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	var lines int
+	var sawHeader, sawTrailer, inCopy bool
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		lines++
+
+		if lines <= 10 && (strings.Contains(line, "PostgreSQL database dump") || strings.Contains(line, "PostgreSQL database cluster dump")) {
+			sawHeader = true
+		}
+
+		switch {
+		case inCopy && line == `\.`:
+			inCopy = false
+		case !inCopy && strings.HasPrefix(line, "COPY ") && strings.HasSuffix(line, "FROM stdin;"):
+			inCopy = true
+		}
+
+		// The trailer may only be followed by comments and pg_dump's
+		// closing \unrestrict meta-command
+		if strings.Contains(line, "PostgreSQL database dump complete") || strings.Contains(line, "PostgreSQL database cluster dump complete") {
+			sawTrailer = true
+		} else if strings.TrimSpace(line) != "" && !strings.HasPrefix(line, "--") && !strings.HasPrefix(line, `\unrestrict`) {
+			sawTrailer = false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read dump: %w", err)
+	}
+
+	switch {
+	case lines == 0:
+		return fmt.Errorf("dump is empty")
+	case !sawHeader:
+		return fmt.Errorf("dump does not start with a pg_dump header")
+	case inCopy:
+		return fmt.Errorf("dump ends inside a COPY block")
+	case !sawTrailer:
+		return fmt.Errorf("dump is missing the completion trailer")
+	}
+	return nil
+}
+
+// checkDump looks for signs that a dump its program reported as successful
+// is incomplete: an empty artifact, a fatal error in the program's output
+// or, for plain text dumps, a missing completion trailer. The trailer is
+// left to verifyBackup when verification is enabled.
+func (bt *Tool) checkDump(ctx context.Context, job *databaseJob, path string, size int64, output string, verifier *dumpVerifier) error {
+	if size == 0 {
+		return fmt.Errorf("backup is empty")
+	}
+	if line := fatalOutput(output, job.driver.fatalPatterns()); line != "" {
+		return fmt.Errorf("%s reported an error: %s", job.driver.tool(job.db), line)
+	}
+
+	if bt.config.Backup.Verify || !isTextFormat(job.db.Format) {
+		return nil
+	}
+	if err := bt.verifyDump(ctx, job, path, verifier); err != nil && !errors.Is(err, errVerifySkipped) {
+		return fmt.Errorf("backup is truncated: %w", err)
+	}
+	return nil
+}
+
+// fatalOutput returns the first line of output containing one of patterns
+func fatalOutput(output string, patterns []string) string {
+	for _, line := range strings.Split(output, "\n") {
+		for _, pattern := range patterns {
+			if strings.Contains(line, pattern) {
+				return strings.TrimSpace(line)
+			}
+		}
+	}
+	return ""
+}
+
+// isTextFormat reports whether dumps of format are SQL scripts, which end
+// with a completion trailer
+func isTextFormat(format string) bool {
+	return format == "plain" || format == "sql"
+}
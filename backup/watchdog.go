@@ -0,0 +1,74 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errDumpAborted marks dumps aborted by the timeout or the watchdog
+var errDumpAborted = errors.New("dump aborted")
+
+// limitDump returns a context for the dump of a backup that is cancelled
+// once the dump has run longer than backup.timeout
+func (bt *Tool) limitDump(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := bt.config.Backup.Timeout
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, fmt.Errorf("%w: exceeded the timeout of %s", errDumpAborted, timeout))
+}
+
+// watchDump returns a context for a dump attempt that is cancelled once
+// progress, the size of its output so far, has not grown for
+// backup.stall_timeout. Progress is checked every tenth of the stall
+// timeout, and the watchdog stops when the returned function is called.
+func (bt *Tool) watchDump(ctx context.Context, progress func() int64) (context.Context, func()) {
+	stall := bt.config.Backup.StallTimeout
+	if stall == 0 {
+		return ctx, noCleanup
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(max(stall/10, time.Second))
+		defer ticker.Stop()
+		size := progress()
+		grown := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				current := progress()
+				if current != size {
+					size, grown = current, now
+				} else if now.Sub(grown) >= stall {
+					cancel(fmt.Errorf("%w: no output for %s", errDumpAborted, stall))
+					return
+				}
+			}
+		}
+	}()
+	return ctx, func() {
+		close(done)
+		cancel(nil)
+	}
+}
+
+// dumpAborted returns why ctx, a dump context from limitDump or watchDump,
+// aborted the dump, or err if the dump failed on its own or ctx was only
+// cancelled along with parent
+func dumpAborted(parent, ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, errDumpAborted) {
+		return err
+	}
+	cause := context.Cause(ctx)
+	if cause == context.Cause(parent) {
+		return err
+	}
+	return fmt.Errorf("%w, %v", cause, err)
+}
@@ -0,0 +1,13 @@
+package config
+
+// Metrics configures the Prometheus metrics endpoint
+type Metrics struct {
+	ListenAddr string `yaml:"listen_addr"` // e.g. ":9187", empty disables the endpoint
+	Path       string `yaml:"path"`
+}
+
+// API configures the admin HTTP API
+type API struct {
+	ListenAddr string `yaml:"listen_addr"` // e.g. "127.0.0.1:8080", empty disables the API
+	Token      string `yaml:"token"`       // required as a bearer token if set
+}
@@ -0,0 +1,27 @@
+package config
+
+import (
+	"fmt"
+
+	"beackup/storage"
+)
+
+// Archive is the storage retention moves expired backups to when its
+// action is archive, typically cheaper storage such as an S3 bucket with
+// the GLACIER storage class
+type Archive struct {
+	Type  string              `yaml:"type"` // s3, gcs, azure or sftp
+	S3    storage.S3Config    `yaml:"s3"`
+	GCS   storage.GCSConfig   `yaml:"gcs"`
+	Azure storage.AzureConfig `yaml:"azure"`
+	SFTP  storage.SFTPConfig  `yaml:"sftp"`
+}
+
+func (a Archive) validate() error {
+	switch a.Type {
+	case "", "s3", "gcs", "azure", "sftp":
+		return nil
+	default:
+		return fmt.Errorf("unknown archive storage type %q", a.Type)
+	}
+}
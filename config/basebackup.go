@@ -0,0 +1,36 @@
+package config
+
+import (
+	"fmt"
+)
+
+// BaseBackup holds the pg_basebackup options of the basebackup format
+type BaseBackup struct {
+	Output      string `yaml:"output"`      // tar (default) or plain
+	WALMethod   string `yaml:"wal_method"`  // stream (default), fetch or none
+	Compression string `yaml:"compression"` // pg_basebackup --compress value, defaults to backup.compression for tar output
+}
+
+// IsZero reports whether no option is set
+func (b BaseBackup) IsZero() bool {
+	return b == BaseBackup{}
+}
+
+// validate checks the options and fills in defaults
+func (b *BaseBackup) validate() error {
+	switch b.Output {
+	case "":
+		b.Output = "tar"
+	case "tar", "plain":
+	default:
+		return fmt.Errorf("unknown basebackup output %q", b.Output)
+	}
+	switch b.WALMethod {
+	case "":
+		b.WALMethod = "stream"
+	case "stream", "fetch", "none":
+	default:
+		return fmt.Errorf("unknown basebackup wal_method %q", b.WALMethod)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// catalogDatabase is the default name of the run catalog in the output
+// directory
+const catalogDatabase = "catalog.db"
+
+// Catalog records every backup run, failed ones included, in a SQLite
+// database that the history, latest and gc commands query. The database is
+// written with the sqlite3 program, which must be installed.
+type Catalog struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path"`    // defaults to catalog.db in the output directory
+	Program string `yaml:"program"` // defaults to sqlite3
+	// KeepRuns is how long gc keeps the runs of backups that are gone, 0
+	// to keep them forever
+	KeepRuns time.Duration `yaml:"keep_runs"`
+}
+
+// validate fills in defaults and checks the settings
+func (c *Catalog) validate(outputDir string) error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Path == "" {
+		c.Path = filepath.Join(outputDir, catalogDatabase)
+	}
+	if c.Program == "" {
+		c.Program = "sqlite3"
+	}
+	if c.KeepRuns < 0 {
+		return fmt.Errorf("keep_runs must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"compress/gzip"
+	"fmt"
+)
+
+// Compression selects how backup artifacts are compressed
+type Compression struct {
+	Algorithm string `yaml:"algorithm"` // gzip, zstd, or empty for none
+	Level     int    `yaml:"level"`
+}
+
+// Enabled reports whether any compression is configured
+func (c Compression) Enabled() bool {
+	return c.Algorithm != "" && c.Algorithm != "none"
+}
+
+// validate checks the algorithm and fills in its default level
+func (c *Compression) validate() error {
+	switch c.Algorithm {
+	case "", "none":
+		return nil
+	case "gzip":
+		if c.Level == 0 {
+			c.Level = gzip.DefaultCompression
+		}
+		if c.Level != gzip.DefaultCompression && (c.Level < gzip.BestSpeed || c.Level > gzip.BestCompression) {
+			return fmt.Errorf("gzip level must be between 1 and 9")
+		}
+	case "zstd":
+		if c.Level == 0 {
+			c.Level = 3
+		}
+		if c.Level < 1 || c.Level > 22 {
+			return fmt.Errorf("zstd level must be between 1 and 22")
+		}
+	default:
+		return fmt.Errorf("unknown compression algorithm %q", c.Algorithm)
+	}
+	return nil
+}
+
+// Extension returns the file suffix for artifacts compressed with c
+func (c Compression) Extension() string {
+	switch c.Algorithm {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,494 @@
+// Package config defines the beackup configuration file and loads it,
+// filling in defaults and rejecting invalid settings. The settings of each
+// database type are checked by the drivers in package backup.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"beackup/retention"
+	"beackup/storage"
+	"beackup/tracing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Overlap policies, deciding what happens to a backup that is due while the
+// previous backup of the same database is still running
+const (
+	OverlapQueue = "queue" // run it once the previous backup finished
+	OverlapSkip  = "skip"  // drop it and wait for the next scheduled run
+	OverlapFail  = "fail"  // drop it and report it as failed
+)
+
+// Database types
+const (
+	TypePostgres = "postgres"
+	TypeMySQL    = "mysql"
+	TypeMongoDB  = "mongodb"
+)
+
+// Config represents the backup configuration
+type Config struct {
+	// Database is the single-database form, kept for existing configs
+	Database  Database   `yaml:"database"`
+	Databases []Database `yaml:"databases"`
+	Backup    struct {
+		OutputDir       string           `yaml:"output_dir"`
+		Frequency       time.Duration    `yaml:"frequency"`
+		Retention       int              `yaml:"retention_days"` // used when no retention rules are set
+		RetentionPolicy retention.Config `yaml:"retention"`
+		Format          string           `yaml:"format"` // custom, plain, tar, directory, basebackup, copy
+		BaseBackup      BaseBackup       `yaml:"basebackup"`
+		Copy            Copy             `yaml:"copy"`
+		PgDump          PgDump           `yaml:"pg_dump"`
+		Compression     Compression      `yaml:"compression"`
+		Verify          bool             `yaml:"verify"`
+		Retry           Retry            `yaml:",inline"`
+		Jobs            int              `yaml:"jobs"` // parallel pg_dump/pg_restore jobs for the directory format, COPY workers for the copy format
+		// MaxConcurrent limits how many databases are backed up at the same
+		// time, 0 for no limit
+		MaxConcurrent int `yaml:"max_concurrent"`
+		// IncludeGlobals also dumps roles and tablespaces with pg_dumpall,
+		// alongside every backup or every GlobalsFrequency if set
+		IncludeGlobals   bool          `yaml:"include_globals"`
+		GlobalsFrequency time.Duration `yaml:"globals_frequency"`
+		// Overlap decides what happens to a backup due while the previous
+		// one of the same database is still running, in this or another
+		// process: queue (default), skip or fail
+		Overlap string `yaml:"overlap"`
+		// RateLimit caps the bytes per second read from streamed dumps and
+		// sent to remote storage, shared by all backups; 0 for no limit
+		RateLimit ByteSize `yaml:"rate_limit"`
+		Priority  Priority `yaml:",inline"`
+		// Disk quotas checked before each backup, 0 for none
+		MinFreeSpace ByteSize `yaml:"min_free_space"` // free space to leave on the output file system
+		MaxTotalSize ByteSize `yaml:"max_total_size"` // total size of the output directory
+		// QuotaCleanup runs retention early when a backup would break a quota
+		QuotaCleanup bool   `yaml:"quota_cleanup"`
+		Naming       Naming `yaml:",inline"`
+		// How long running backups may continue after a shutdown signal
+		ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period"`
+		// Timeout aborts a dump running longer, retries included, and
+		// StallTimeout one whose output has not grown for as long; 0 for
+		// no limit
+		Timeout      time.Duration `yaml:"timeout"`
+		StallTimeout time.Duration `yaml:"stall_timeout"`
+	} `yaml:"backup"`
+	Hooks         Hooks          `yaml:"hooks"`
+	Logging       Logging        `yaml:"logging"`
+	Encryption    Encryption     `yaml:"encryption"`
+	Signing       Signing        `yaml:"signing"`
+	Metrics       Metrics        `yaml:"metrics"`
+	Tracing       tracing.Config `yaml:"tracing"`
+	API           API            `yaml:"api"`
+	Notifications Notifications  `yaml:"notifications"`
+	Heartbeat     Heartbeat      `yaml:"heartbeat"`
+	Schedule      Schedule       `yaml:"schedule"`
+	Reports       Reports        `yaml:"reports"`
+	Catalog       Catalog        `yaml:"catalog"`
+	Secrets       Secrets        `yaml:"secrets"`
+	VerifyRestore Rehearsal      `yaml:"verify_restore"`
+	Storage       struct {
+		Type          string              `yaml:"type"` // s3, gcs, azure, sftp, or empty to keep backups on local disk only
+		DeleteLocal   bool                `yaml:"delete_local"`
+		Stream        bool                `yaml:"stream"`         // pipe dumps straight into storage without writing them to output_dir
+		VerifyUploads bool                `yaml:"verify_uploads"` // read uploaded files back and compare their checksums
+		Dedup         Dedup               `yaml:"dedup"`          // upload dumps as deduplicated chunks
+		Archive       Archive             `yaml:"archive"`        // where retention archives expired backups
+		Lock          storage.Lock        `yaml:"lock"`           // object lock applied to uploads, s3 and gcs only
+		S3            storage.S3Config    `yaml:"s3"`
+		GCS           storage.GCSConfig   `yaml:"gcs"`
+		Azure         storage.AzureConfig `yaml:"azure"`
+		SFTP          storage.SFTPConfig  `yaml:"sftp"`
+	} `yaml:"storage"`
+	// WatchConfig reloads the config when the file changes, as on SIGHUP
+	WatchConfig bool `yaml:"watch_config"`
+}
+
+// Database describes a single database to back up
+type Database struct {
+	ID             string           `yaml:"id"`   // used for log prefixes and the output subdirectory, defaults to name
+	Type           string           `yaml:"type"` // postgres (default), mysql or mongodb
+	DSN            string           `yaml:"dsn"`  // postgres:// URL used instead of host, port, user, password and name
+	Host           string           `yaml:"host"`
+	Port           int              `yaml:"port"`
+	Name           string           `yaml:"name"`
+	User           string           `yaml:"user"`
+	Password       string           `yaml:"password"`
+	PasswordFile   string           `yaml:"password_file"`   // read before every backup
+	PasswordSecret SecretRef        `yaml:"password_secret"` // looked up before every backup
+	Format         string           `yaml:"format"`          // defaults to backup.format
+	Frequency      time.Duration    `yaml:"frequency"`       // defaults to backup.frequency
+	Schedule       Schedule         `yaml:"schedule"`        // defaults to schedule
+	Jobs           int              `yaml:"jobs"`            // defaults to backup.jobs
+	Retention      retention.Config `yaml:"retention"`       // defaults to backup.retention
+	Hooks          Hooks            `yaml:"hooks"`           // defaults to hooks
+	Heartbeat      Heartbeat        `yaml:"heartbeat"`       // defaults to heartbeat
+	MySQL          MySQL            `yaml:"mysql"`           // mysqldump settings for type mysql
+	MongoDB        MongoDB          `yaml:"mongodb"`         // mongodump settings for type mongodb
+	WAL            WAL              `yaml:"wal"`             // continuous archiving for point-in-time recovery
+	BaseBackup     BaseBackup       `yaml:"basebackup"`      // defaults to backup.basebackup
+	Copy           Copy             `yaml:"copy"`            // defaults to backup.copy
+	PgDump         PgDump           `yaml:"pg_dump"`         // defaults to backup.pg_dump
+	SSL            SSL              `yaml:",inline"`         // sslmode, sslrootcert, sslcert and sslkey
+	Exec           ExecTarget       `yaml:",inline"`         // connection, container, namespace and pod
+	SSH            SSH              `yaml:"ssh"`             // tunnel to the database or run its programs over SSH
+	Source         Source           `yaml:"source"`          // replicas to take postgres backups from instead
+	Masking        Masking          `yaml:"masking"`         // mask column values in plain-format dumps
+
+	// Schema and table patterns passed to pg_dump; * and ? match like in
+	// psql. MySQL databases only take exact table names.
+	IncludeSchemas []string `yaml:"include_schemas"`
+	ExcludeSchemas []string `yaml:"exclude_schemas"`
+	IncludeTables  []string `yaml:"include_tables"`
+	ExcludeTables  []string `yaml:"exclude_tables"`
+
+	// DSNEnv is the libpq environment for the remaining DSN parameters
+	DSNEnv []string `yaml:"-"`
+}
+
+// Load reads, parses and validates the configuration file, which is YAML,
+// or JSON or TOML by its extension. BEACKUP_* environment variables and
+// then the given overrides take precedence over the file.
+func Load(configPath string, overrides ...Override) (*Config, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var config Config
+	if err := decode(configPath, data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	for _, override := range append(envOverrides(), overrides...) {
+		if err := override.apply(&config); err != nil {
+			return nil, err
+		}
+	}
+	if err := interpolateEnv(&config); err != nil {
+		return nil, fmt.Errorf("failed to interpolate config: %w", err)
+	}
+
+	// Fall back to the single-database form
+	if len(config.Databases) == 0 && config.Database.Name != "" {
+		config.Databases = []Database{config.Database}
+	}
+	if len(config.Databases) == 0 {
+		return nil, fmt.Errorf("no databases configured")
+	}
+
+	// Set defaults
+	if config.Backup.Format == "" {
+		config.Backup.Format = "custom"
+	}
+	if config.Backup.Retention == 0 {
+		config.Backup.Retention = 7
+	}
+	if err := config.Logging.validate(); err != nil {
+		return nil, fmt.Errorf("invalid logging config: %w", err)
+	}
+	if err := config.Backup.Compression.validate(); err != nil {
+		return nil, fmt.Errorf("invalid compression config: %w", err)
+	}
+	if err := config.Encryption.validate(); err != nil {
+		return nil, fmt.Errorf("invalid encryption config: %w", err)
+	}
+	if err := config.Tracing.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid tracing config: %w", err)
+	}
+	if err := config.Backup.Retry.validate(); err != nil {
+		return nil, fmt.Errorf("invalid retry config: %w", err)
+	}
+	if config.Backup.GlobalsFrequency < 0 {
+		return nil, fmt.Errorf("globals_frequency must not be negative")
+	}
+	if config.Backup.Timeout < 0 || config.Backup.StallTimeout < 0 {
+		return nil, fmt.Errorf("timeout and stall_timeout must not be negative")
+	}
+	switch config.Backup.Overlap {
+	case "":
+		config.Backup.Overlap = OverlapQueue
+	case OverlapQueue, OverlapSkip, OverlapFail:
+	default:
+		return nil, fmt.Errorf("unknown overlap policy %q", config.Backup.Overlap)
+	}
+	if err := config.Backup.Naming.validate(); err != nil {
+		return nil, err
+	}
+	if config.Backup.MinFreeSpace < 0 || config.Backup.MaxTotalSize < 0 {
+		return nil, fmt.Errorf("min_free_space and max_total_size must not be negative")
+	}
+	if config.Backup.RateLimit < 0 {
+		return nil, fmt.Errorf("rate_limit must not be negative")
+	}
+	if err := config.Backup.Priority.validate(); err != nil {
+		return nil, fmt.Errorf("invalid priority config: %w", err)
+	}
+	if config.Backup.Jobs < 0 || config.Backup.MaxConcurrent < 0 {
+		return nil, fmt.Errorf("jobs and max_concurrent must not be negative")
+	}
+	if config.Storage.Stream {
+		if config.Storage.Type != "s3" && config.Storage.Type != "gcs" && config.Storage.Type != "azure" {
+			return nil, fmt.Errorf("storage.stream needs s3, gcs or azure storage")
+		}
+		if config.Storage.Dedup.Enabled {
+			return nil, fmt.Errorf("storage.stream cannot be combined with storage.dedup")
+		}
+	}
+	if config.Storage.Dedup.Enabled {
+		if config.Storage.Type == "" {
+			return nil, fmt.Errorf("storage.dedup needs remote storage")
+		}
+		if err := config.Storage.Dedup.validate(); err != nil {
+			return nil, fmt.Errorf("invalid dedup config: %w", err)
+		}
+	}
+
+	if config.Storage.Lock != (storage.Lock{}) {
+		if err := validateLock(&config.Storage.Lock, config.Storage.Type); err != nil {
+			return nil, fmt.Errorf("invalid storage.lock config: %w", err)
+		}
+		if config.Storage.Dedup.Enabled {
+			return nil, fmt.Errorf("storage.lock cannot be combined with storage.dedup")
+		}
+	}
+	if err := config.Storage.Archive.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Signing.validate(); err != nil {
+		return nil, fmt.Errorf("invalid signing config: %w", err)
+	}
+	if err := config.Heartbeat.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Schedule.validate(); err != nil {
+		return nil, fmt.Errorf("invalid schedule config: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for i := range config.Databases {
+		db := &config.Databases[i]
+		if db.DSN != "" {
+			if db.Type != "" && db.Type != TypePostgres {
+				return nil, fmt.Errorf("database %d: dsn only applies to postgres, use mongodb.uri or host settings", i+1)
+			}
+			if err := parseDSN(db); err != nil {
+				return nil, fmt.Errorf("database %d: %w", i+1, err)
+			}
+		}
+		if db.Name == "" {
+			return nil, fmt.Errorf("database %d has no name", i+1)
+		}
+		if db.ID == "" {
+			db.ID = db.Name
+		}
+		if seen[db.ID] {
+			return nil, fmt.Errorf("duplicate database id %q", db.ID)
+		}
+		seen[db.ID] = true
+
+		if db.Host == "" {
+			db.Host = "localhost"
+		}
+		sources := 0
+		for _, set := range []bool{db.Password != "", db.PasswordFile != "", db.PasswordSecret.Provider != "", db.MySQL.OptionsFile != ""} {
+			if set {
+				sources++
+			}
+		}
+		if sources > 1 {
+			return nil, fmt.Errorf("database %q: only one of password, password_file, password_secret and mysql.options_file may be set", db.ID)
+		}
+		switch db.PasswordSecret.Provider {
+		case "", "vault", "aws_secrets_manager":
+		default:
+			return nil, fmt.Errorf("database %q: unknown secret provider %q", db.ID, db.PasswordSecret.Provider)
+		}
+		if db.PasswordSecret.Provider != "" && db.PasswordSecret.Path == "" {
+			return nil, fmt.Errorf("database %q: password_secret needs a path", db.ID)
+		}
+		switch db.Type {
+		case "":
+			db.Type = TypePostgres
+		case TypePostgres, TypeMySQL, TypeMongoDB:
+		default:
+			return nil, fmt.Errorf("database %q: unknown database type %q", db.ID, db.Type)
+		}
+		if db.Type != TypePostgres && (db.WAL.Enabled() || !db.BaseBackup.IsZero() || !db.Copy.IsZero()) {
+			return nil, fmt.Errorf("database %q: wal, basebackup and copy settings only apply to postgres", db.ID)
+		}
+		if db.Type != TypePostgres && !db.PgDump.IsZero() {
+			return nil, fmt.Errorf("database %q: pg_dump settings only apply to postgres", db.ID)
+		}
+		if db.Type != TypePostgres && !db.Source.IsZero() {
+			return nil, fmt.Errorf("database %q: source settings only apply to postgres", db.ID)
+		}
+		if db.Type != TypePostgres && db.SSL != (SSL{}) {
+			return nil, fmt.Errorf("database %q: ssl settings only apply to postgres", db.ID)
+		}
+		if err := db.SSL.validate(); err != nil {
+			return nil, fmt.Errorf("database %q: %w", db.ID, err)
+		}
+		if err := db.Exec.validate(); err != nil {
+			return nil, fmt.Errorf("database %q: %w", db.ID, err)
+		}
+		if err := db.SSH.validate(); err != nil {
+			return nil, fmt.Errorf("database %q: %w", db.ID, err)
+		}
+		if db.SSH.Enabled() && db.SSH.Mode == SSHTunnel && db.Exec.InContainer() {
+			return nil, fmt.Errorf("database %q: an ssh tunnel cannot reach a database in a container, use ssh mode exec", db.ID)
+		}
+		if db.SSH.Enabled() && db.SSH.Mode == SSHTunnel && db.MongoDB.URI != "" {
+			return nil, fmt.Errorf("database %q: an ssh tunnel needs host and port instead of mongodb.uri", db.ID)
+		}
+		if (db.RemotePrograms() || db.SSH.Enabled() && db.WAL.Mode == WALReceive) && db.WAL.Enabled() {
+			return nil, fmt.Errorf("database %q: wal archiving does not support this connection", db.ID)
+		}
+		if err := db.Source.validate(); err != nil {
+			return nil, fmt.Errorf("database %q: %w", db.ID, err)
+		}
+		if db.Source.UsesReplicas() && db.Exec.InContainer() {
+			return nil, fmt.Errorf("database %q: replicas cannot be used with a database in a container", db.ID)
+		}
+		if db.Source.UsesReplicas() && (db.WAL.Enabled() || db.Format == "basebackup" || db.Format == "" && config.Backup.Format == "basebackup") {
+			return nil, fmt.Errorf("database %q: wal archiving and base backups need the primary, they cannot be combined with replicas", db.ID)
+		}
+		if db.RemotePrograms() && db.Type == TypeMongoDB && (db.Password != "" || db.PasswordFile != "" || db.PasswordSecret.Provider != "") {
+			return nil, fmt.Errorf("database %q: mongodb databases whose programs run remotely take their credentials in mongodb.uri", db.ID)
+		}
+		if err := db.Masking.validate(); err != nil {
+			return nil, fmt.Errorf("database %q: invalid masking config: %w", db.ID, err)
+		}
+		if db.Masking.Enabled() && config.Storage.Dedup.Enabled {
+			return nil, fmt.Errorf("database %q: masking cannot be combined with storage.dedup", db.ID)
+		}
+		if db.Masking.Mode == MaskCopy && config.Storage.Stream {
+			return nil, fmt.Errorf("database %q: a masked copy cannot be written with storage.stream, use masking mode replace", db.ID)
+		}
+		if db.Type != TypeMySQL && db.MySQL != (MySQL{}) {
+			return nil, fmt.Errorf("database %q: mysql settings need type: mysql", db.ID)
+		}
+		if db.Type != TypeMongoDB && !db.MongoDB.IsZero() {
+			return nil, fmt.Errorf("database %q: mongodb settings need type: mongodb", db.ID)
+		}
+		if db.BaseBackup.IsZero() {
+			db.BaseBackup = config.Backup.BaseBackup
+		}
+		if err := db.BaseBackup.validate(); err != nil {
+			return nil, fmt.Errorf("database %q: %w", db.ID, err)
+		}
+		if db.Type == TypePostgres && db.Copy.IsZero() {
+			db.Copy = config.Backup.Copy
+		}
+		if err := db.Copy.validate(); err != nil {
+			return nil, fmt.Errorf("database %q: %w", db.ID, err)
+		}
+		if db.Type == TypePostgres && db.PgDump.IsZero() {
+			db.PgDump = config.Backup.PgDump
+		}
+		if err := db.PgDump.validate(); err != nil {
+			return nil, fmt.Errorf("database %q: invalid pg_dump config: %w", db.ID, err)
+		}
+		if db.Frequency == 0 {
+			db.Frequency = config.Backup.Frequency
+		}
+		if db.Frequency <= 0 {
+			return nil, fmt.Errorf("database %q has no backup frequency", db.ID)
+		}
+		if db.Schedule.IsZero() {
+			db.Schedule = config.Schedule
+		}
+		if err := db.Schedule.validate(); err != nil {
+			return nil, fmt.Errorf("database %q: invalid schedule config: %w", db.ID, err)
+		}
+		if db.Jobs == 0 {
+			db.Jobs = config.Backup.Jobs
+		}
+		if db.Jobs < 0 {
+			return nil, fmt.Errorf("database %q: jobs must not be negative", db.ID)
+		}
+		if db.Retention.IsZero() {
+			db.Retention = config.Backup.RetentionPolicy
+		}
+		if db.Retention.Rules == (retention.Rules{}) {
+			db.Retention.KeepWithinDays = config.Backup.Retention
+		}
+		if err := db.Retention.Validate(); err != nil {
+			return nil, fmt.Errorf("database %q: %w", db.ID, err)
+		}
+		if db.Retention.Archives() && config.Storage.Archive.Type == "" {
+			return nil, fmt.Errorf("database %q: retention action archive needs storage.archive", db.ID)
+		}
+		if db.Retention.Archives() && config.Storage.Dedup.Enabled {
+			return nil, fmt.Errorf("database %q: retention action archive cannot be combined with storage.dedup", db.ID)
+		}
+		for _, patterns := range [][]string{db.IncludeSchemas, db.ExcludeSchemas, db.IncludeTables, db.ExcludeTables} {
+			for _, pattern := range patterns {
+				if strings.TrimSpace(pattern) == "" {
+					return nil, fmt.Errorf("database %q: empty schema or table pattern", db.ID)
+				}
+			}
+		}
+		if err := db.WAL.validate(); err != nil {
+			return nil, fmt.Errorf("database %q: %w", db.ID, err)
+		}
+		if db.Hooks.IsZero() {
+			db.Hooks = config.Hooks
+		}
+		if db.Heartbeat.IsZero() {
+			db.Heartbeat = config.Heartbeat
+		}
+		if err := db.Heartbeat.validate(); err != nil {
+			return nil, fmt.Errorf("database %q: %w", db.ID, err)
+		}
+		if db.Hooks.Timeout == 0 {
+			db.Hooks.Timeout = config.Hooks.Timeout
+		}
+		if db.Hooks.Timeout == 0 {
+			db.Hooks.Timeout = defaultHookTimeout
+		}
+		if db.Hooks.Timeout < 0 {
+			return nil, fmt.Errorf("database %q: hook timeout must not be negative", db.ID)
+		}
+	}
+
+	if err := config.VerifyRestore.validate(config.Databases); err != nil {
+		return nil, fmt.Errorf("invalid verify_restore config: %w", err)
+	}
+	if err := config.Reports.validate(); err != nil {
+		return nil, fmt.Errorf("invalid reports config: %w", err)
+	}
+	if err := config.Catalog.validate(config.Backup.OutputDir); err != nil {
+		return nil, fmt.Errorf("invalid catalog config: %w", err)
+	}
+
+	return &config, nil
+}
+
+// decode parses the config file in the format its extension names. JSON
+// and TOML documents are read into the same YAML fields.
+func decode(configPath string, data []byte, config *Config) error {
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".json":
+		// YAML accepts JSON, but also much that is not
+		var document interface{}
+		if err := json.Unmarshal(data, &document); err != nil {
+			return err
+		}
+	case ".toml":
+		document, err := parseTOML(data)
+		if err != nil {
+			return err
+		}
+		if data, err = yaml.Marshal(document); err != nil {
+			return err
+		}
+	}
+	return yaml.Unmarshal(data, config)
+}
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"fmt"
+)
+
+// Copy holds the options of the copy format, which exports every table
+// with COPY in parallel alongside a pg_dump of the schema
+type Copy struct {
+	Format string `yaml:"format"` // csv (default) or binary, the COPY format of the table files
+}
+
+// IsZero reports whether no option is set
+func (c Copy) IsZero() bool {
+	return c == Copy{}
+}
+
+// validate checks the options and fills in defaults
+func (c *Copy) validate() error {
+	switch c.Format {
+	case "":
+		c.Format = "csv"
+	case "csv", "binary":
+	default:
+		return fmt.Errorf("unknown copy format %q (expected csv or binary)", c.Format)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"fmt"
+)
+
+// Default chunk sizes of the dedup store
+const (
+	defaultMinChunkSize = 256 << 10
+	defaultAvgChunkSize = 1 << 20
+	defaultMaxChunkSize = 4 << 20
+)
+
+// Dedup uploads database dumps to remote storage as content-defined
+// chunks, storing each distinct chunk once across all backups
+type Dedup struct {
+	Enabled bool `yaml:"enabled"`
+	// Chunk boundaries are placed by content so that unchanged data yields
+	// the same chunks; the average size must be a power of two
+	MinChunkSize ByteSize `yaml:"min_chunk_size"` // defaults to 256KiB
+	AvgChunkSize ByteSize `yaml:"avg_chunk_size"` // defaults to 1MiB
+	MaxChunkSize ByteSize `yaml:"max_chunk_size"` // defaults to 4MiB
+}
+
+// validate fills in the default chunk sizes and checks they are ordered
+func (d *Dedup) validate() error {
+	if d.MinChunkSize == 0 {
+		d.MinChunkSize = defaultMinChunkSize
+	}
+	if d.AvgChunkSize == 0 {
+		d.AvgChunkSize = defaultAvgChunkSize
+	}
+	if d.MaxChunkSize == 0 {
+		d.MaxChunkSize = defaultMaxChunkSize
+	}
+	if d.MinChunkSize < 0 || d.MinChunkSize >= d.AvgChunkSize || d.AvgChunkSize >= d.MaxChunkSize {
+		return fmt.Errorf("chunk sizes must satisfy 0 < min_chunk_size < avg_chunk_size < max_chunk_size")
+	}
+	if d.AvgChunkSize&(d.AvgChunkSize-1) != 0 {
+		return fmt.Errorf("avg_chunk_size must be a power of two")
+	}
+	if d.MaxChunkSize > 1<<30 {
+		return fmt.Errorf("max_chunk_size must not exceed 1GiB")
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+	"os"
+)
+
+// Encryption selects how backup artifacts are encrypted before they
+// are written to disk
+type Encryption struct {
+	Type string `yaml:"type"` // age, gpg, or empty for none
+
+	// Recipients lists age recipients inline
+	Recipients []string `yaml:"recipients"`
+	// PublicKeys holds age recipient lists or armored GPG public keys
+	PublicKeys []KeySource `yaml:"public_keys"`
+	// PrivateKey holds the age identity or GPG secret key used for restores
+	PrivateKey KeySource `yaml:"private_key"`
+	// Passphrase unlocks a protected GPG secret key
+	Passphrase KeySource `yaml:"passphrase"`
+}
+
+// KeySource locates key material in a file or an environment variable
+type KeySource struct {
+	File string `yaml:"file"`
+	Env  string `yaml:"env"`
+}
+
+// IsSet reports whether a location has been configured
+func (k KeySource) IsSet() bool {
+	return k.File != "" || k.Env != ""
+}
+
+// Load reads the key material
+func (k KeySource) Load() ([]byte, error) {
+	if k.File != "" {
+		data, err := os.ReadFile(k.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		return data, nil
+	}
+	if k.Env != "" {
+		value, ok := os.LookupEnv(k.Env)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", k.Env)
+		}
+		return []byte(value), nil
+	}
+	return nil, fmt.Errorf("no key file or environment variable configured")
+}
+
+// Enabled reports whether encryption is configured
+func (e Encryption) Enabled() bool {
+	return e.Type != "" && e.Type != "none"
+}
+
+// validate checks that enough keys are configured to encrypt
+func (e Encryption) validate() error {
+	switch e.Type {
+	case "", "none":
+		return nil
+	case "age":
+		if len(e.Recipients) == 0 && len(e.PublicKeys) == 0 {
+			return fmt.Errorf("age encryption needs at least one recipient")
+		}
+	case "gpg":
+		if len(e.PublicKeys) == 0 {
+			return fmt.Errorf("gpg encryption needs at least one public key")
+		}
+	default:
+		return fmt.Errorf("unknown encryption type %q", e.Type)
+	}
+	return nil
+}
+
+// Extension returns the file suffix for artifacts encrypted with e
+func (e Encryption) Extension() string {
+	switch e.Type {
+	case "age":
+		return ".age"
+	case "gpg":
+		return ".gpg"
+	default:
+		return ""
+	}
+}
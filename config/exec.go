@@ -0,0 +1,60 @@
+package config
+
+import "fmt"
+
+// Connections to a database
+const (
+	ConnectionDirect     = "direct"     // client programs run on this host
+	ConnectionDocker     = "docker"     // client programs run in a container via docker exec
+	ConnectionKubernetes = "kubernetes" // client programs run in a pod via kubectl exec
+)
+
+// ExecTarget runs a database's client programs inside the container the
+// database runs in, for databases that are not reachable over TCP from
+// this host. Dumps are streamed back to this host.
+type ExecTarget struct {
+	Connection string `yaml:"connection"` // direct (default), docker or kubernetes
+	Container  string `yaml:"container"`  // docker container name or id, or the pod's container
+	Namespace  string `yaml:"namespace"`  // pod namespace, defaults to kubectl's current one
+	Pod        string `yaml:"pod"`
+}
+
+// InContainer reports whether the client programs run in a container
+func (e ExecTarget) InContainer() bool {
+	return e.Connection == ConnectionDocker || e.Connection == ConnectionKubernetes
+}
+
+// RemotePrograms reports whether db's client programs run elsewhere than on
+// this host: in its container or on its SSH host
+func (db *Database) RemotePrograms() bool {
+	return db.Exec.InContainer() || db.SSH.Enabled() && db.SSH.Mode == SSHExec
+}
+
+func (e *ExecTarget) validate() error {
+	switch e.Connection {
+	case "":
+		e.Connection = ConnectionDirect
+	case ConnectionDirect, ConnectionDocker, ConnectionKubernetes:
+	default:
+		return fmt.Errorf("unknown connection %q (expected direct, docker or kubernetes)", e.Connection)
+	}
+
+	switch e.Connection {
+	case ConnectionDirect:
+		if *e != (ExecTarget{Connection: ConnectionDirect}) {
+			return fmt.Errorf("container, namespace and pod need connection: docker or kubernetes")
+		}
+	case ConnectionDocker:
+		if e.Container == "" {
+			return fmt.Errorf("connection docker needs a container")
+		}
+		if e.Namespace != "" || e.Pod != "" {
+			return fmt.Errorf("namespace and pod need connection: kubernetes")
+		}
+	case ConnectionKubernetes:
+		if e.Pod == "" {
+			return fmt.Errorf("connection kubernetes needs a pod")
+		}
+	}
+	return nil
+}
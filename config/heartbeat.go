@@ -0,0 +1,36 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Heartbeat pings a dead man's switch service such as healthchecks.io or
+// Dead Man's Snitch after every successful backup, so that it alerts when
+// backups stop happening altogether, even if the whole host is down
+type Heartbeat struct {
+	URL string `yaml:"url"`
+	// Start and Fail also ping the URL with /start appended when a backup
+	// starts and /fail when it fails, as healthchecks.io expects
+	Start bool `yaml:"start"`
+	Fail  bool `yaml:"fail"`
+}
+
+// IsZero reports whether no heartbeat is configured
+func (h Heartbeat) IsZero() bool {
+	return h == Heartbeat{}
+}
+
+func (h Heartbeat) validate() error {
+	if h.URL == "" {
+		if h.Start || h.Fail {
+			return fmt.Errorf("heartbeat start and fail need a url")
+		}
+		return nil
+	}
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("heartbeat url must be an http or https URL")
+	}
+	return nil
+}
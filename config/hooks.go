@@ -0,0 +1,40 @@
+package config
+
+import (
+	"time"
+)
+
+// defaultHookTimeout bounds each hook command when no timeout is configured
+const defaultHookTimeout = 10 * time.Minute
+
+// Hooks lists shell commands run around each backup. Commands get the
+// backup described in BEACKUP_* environment variables.
+type Hooks struct {
+	PreBackup  HookCommands  `yaml:"pre_backup"`  // a failing command aborts the backup
+	PostBackup HookCommands  `yaml:"post_backup"` // run after a successful backup
+	OnFailure  HookCommands  `yaml:"on_failure"`  // run after a failed backup
+	Timeout    time.Duration `yaml:"timeout"`     // per command, defaults to 10m
+}
+
+// IsZero reports whether no hook commands are configured
+func (h Hooks) IsZero() bool {
+	return len(h.PreBackup) == 0 && len(h.PostBackup) == 0 && len(h.OnFailure) == 0
+}
+
+// HookCommands is a list of commands that may also be written as a single
+// string in the config
+type HookCommands []string
+
+func (h *HookCommands) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*h = HookCommands{single}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*h = list
+	return nil
+}
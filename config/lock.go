@@ -0,0 +1,25 @@
+package config
+
+import (
+	"fmt"
+
+	"beackup/storage"
+)
+
+// validateLock checks the object lock of storageType and fills in defaults
+func validateLock(l *storage.Lock, storageType string) error {
+	if storageType != "s3" && storageType != "gcs" {
+		return fmt.Errorf("object lock needs s3 or gcs storage")
+	}
+	if l.Days <= 0 {
+		return fmt.Errorf("days must be positive")
+	}
+	switch l.Mode {
+	case "":
+		l.Mode = "governance"
+	case "governance", "compliance":
+	default:
+		return fmt.Errorf("unknown mode %q (expected governance or compliance)", l.Mode)
+	}
+	return nil
+}
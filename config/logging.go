@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Logging configures log output
+type Logging struct {
+	Level    string `yaml:"level"`  // debug, info, warn, error
+	Format   string `yaml:"format"` // text or json
+	FilePath string `yaml:"file_path"`
+	Output   string `yaml:"output"` // stdout (default) or stderr, when not logging to a file
+
+	// Rotation of the log file; zero values disable each trigger
+	MaxSizeMB  int           `yaml:"max_size_mb"`
+	MaxAge     time.Duration `yaml:"max_age"`
+	MaxBackups int           `yaml:"max_backups"` // rotated files to keep, 0 keeps all
+}
+
+// ParseLevel converts a configured level name to a slog level
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q", level)
+	}
+}
+
+// validate checks the level and format
+func (c Logging) validate() error {
+	if _, err := ParseLevel(c.Level); err != nil {
+		return err
+	}
+	switch c.Format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("unknown log format %q", c.Format)
+	}
+	switch c.Output {
+	case "", "stdout", "stderr":
+	default:
+		return fmt.Errorf("unknown log output %q (expected stdout or stderr)", c.Output)
+	}
+	if c.MaxSizeMB < 0 || c.MaxBackups < 0 || c.MaxAge < 0 {
+		return fmt.Errorf("log rotation limits must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Masking modes
+const (
+	MaskReplace = "replace" // mask the backup itself
+	MaskCopy    = "copy"    // write a masked copy alongside the raw backup
+)
+
+// Masking actions
+const (
+	MaskHash    = "hash"    // replace values with a salted hash, keeping equal values equal
+	MaskNullify = "nullify" // replace values with NULL
+	MaskFake    = "fake"    // replace values with a fixed value
+	MaskRegex   = "replace" // replace matches of a regular expression
+)
+
+// Masking rewrites column values in the COPY data of plain-format postgres
+// dumps as they are written, to restore production backups into staging
+// without their personal data
+type Masking struct {
+	Mode string `yaml:"mode"` // replace (default) or copy
+	// Salt is hashed with each value so that hashes cannot be matched
+	// against hashes of guessed values
+	Salt string `yaml:"salt"`
+	// Tables maps tables, as schema.table or just table for any schema, to
+	// the rules for their columns by column name
+	Tables map[string]map[string]MaskRule `yaml:"tables"`
+}
+
+// MaskRule is how the values of one column are masked. NULL values stay
+// NULL except under nullify.
+type MaskRule struct {
+	Action string `yaml:"action"` // hash, nullify, fake or replace
+	// Value is the fake value, in which {row} is replaced by the row's
+	// number to keep values unique
+	Value       string `yaml:"value"`
+	Pattern     string `yaml:"pattern"`     // regular expression for replace
+	Replacement string `yaml:"replacement"` // for replace, may refer to groups as $1
+}
+
+// Enabled reports whether any column is masked
+func (m Masking) Enabled() bool {
+	return len(m.Tables) > 0
+}
+
+// validate fills in defaults and checks the settings
+func (m *Masking) validate() error {
+	if !m.Enabled() {
+		if m.Mode != "" || m.Salt != "" {
+			return fmt.Errorf("masking needs tables")
+		}
+		return nil
+	}
+	if m.Mode == "" {
+		m.Mode = MaskReplace
+	}
+	switch m.Mode {
+	case MaskReplace, MaskCopy:
+	default:
+		return fmt.Errorf("unknown masking mode %q (expected replace or copy)", m.Mode)
+	}
+
+	for table, columns := range m.Tables {
+		for column, rule := range columns {
+			switch rule.Action {
+			case MaskHash, MaskNullify, MaskFake:
+			case MaskRegex:
+				if _, err := regexp.Compile(rule.Pattern); err != nil {
+					return fmt.Errorf("invalid pattern for %s.%s: %w", table, column, err)
+				}
+			default:
+				return fmt.Errorf("unknown masking action %q for %s.%s (expected hash, nullify, fake or replace)", rule.Action, table, column)
+			}
+		}
+	}
+	return nil
+}
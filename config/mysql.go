@@ -0,0 +1,15 @@
+package config
+
+// MySQL holds the settings of MySQL and MariaDB databases
+type MySQL struct {
+	// OptionsFile is a client option file holding the credentials, passed
+	// as --defaults-extra-file instead of a configured password
+	OptionsFile string `yaml:"options_file"`
+	// LockTables locks all tables for the dump, needed for a consistent dump
+	// of non-transactional tables such as MyISAM. By default InnoDB tables
+	// are dumped from a single transaction without locking.
+	LockTables bool `yaml:"lock_tables"`
+	Routines   bool `yaml:"routines"` // include stored procedures and functions
+	Events     bool `yaml:"events"`   // include scheduled events
+	HexBlob    bool `yaml:"hex_blob"` // dump binary columns in hexadecimal
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Default naming, which gives backups names like mydb_2006-01-02_15-04-05
+const (
+	defaultFilenameTemplate = "{{.Database}}_{{.Timestamp}}"
+	defaultTimestampFormat  = "2006-01-02_15-04-05"
+)
+
+// Naming decides how backups are named and laid out within their
+// database's output directory. The file name extensions are always added
+// by beackup, since restores and verification rely on them.
+type Naming struct {
+	// FilenameTemplate is a Go template for the file name of a backup
+	FilenameTemplate string `yaml:"filename_template"`
+	// DirectoryTemplate is a Go template for a subdirectory, such as
+	// "{{.Year}}/{{.Month}}", the backup is written to; empty for none
+	DirectoryTemplate string `yaml:"directory_template"`
+	// TimestampFormat is the Go time layout of {{.Timestamp}}
+	TimestampFormat string `yaml:"timestamp_format"`
+
+	filename  *template.Template
+	directory *template.Template
+}
+
+// nameFields are the fields available to the naming templates
+type nameFields struct {
+	Database  string // database name
+	ID        string // database id, unique within the config
+	Type      string // postgres, mysql or mongodb
+	Host      string
+	Format    string // dump format, or globals or basebackup
+	Timestamp string // start time in the configured layout
+	Year      string
+	Month     string
+	Day       string
+	Hour      string
+}
+
+// validate fills in the defaults and parses the templates, rendering a
+// sample name to catch unknown fields and invalid names early
+func (n *Naming) validate() error {
+	if n.FilenameTemplate == "" {
+		n.FilenameTemplate = defaultFilenameTemplate
+	}
+	if n.TimestampFormat == "" {
+		n.TimestampFormat = defaultTimestampFormat
+	}
+
+	var err error
+	if n.filename, err = template.New("filename_template").Option("missingkey=error").Parse(n.FilenameTemplate); err != nil {
+		return fmt.Errorf("invalid filename_template: %w", err)
+	}
+	if n.directory, err = template.New("directory_template").Option("missingkey=error").Parse(n.DirectoryTemplate); err != nil {
+		return fmt.Errorf("invalid directory_template: %w", err)
+	}
+
+	sample := &Database{ID: "id", Name: "name", Type: TypePostgres, Host: "localhost", Format: "custom"}
+	_, err = n.Name(sample, sample.Format, time.Now())
+	return err
+}
+
+// Name renders the name of a backup of db in format started at t, relative
+// to the database's output directory and without extensions
+func (n *Naming) Name(db *Database, format string, t time.Time) (string, error) {
+	fields := nameFields{
+		Database:  db.Name,
+		ID:        db.ID,
+		Type:      db.Type,
+		Host:      db.Host,
+		Format:    format,
+		Timestamp: t.Format(n.TimestampFormat),
+		Year:      t.Format("2006"),
+		Month:     t.Format("01"),
+		Day:       t.Format("02"),
+		Hour:      t.Format("15"),
+	}
+
+	var filename, directory strings.Builder
+	if err := n.filename.Execute(&filename, fields); err != nil {
+		return "", fmt.Errorf("failed to render filename_template: %w", err)
+	}
+	if err := n.directory.Execute(&directory, fields); err != nil {
+		return "", fmt.Errorf("failed to render directory_template: %w", err)
+	}
+
+	file := filename.String()
+	if file == "" || file == "." || file == ".." || strings.ContainsAny(file, `/\`) {
+		return "", fmt.Errorf("filename_template gives the invalid file name %q", file)
+	}
+	dir := strings.Trim(directory.String(), "/")
+	if dir != "" && (path.Clean(dir) != dir || dir == ".." || strings.HasPrefix(dir, "../") || strings.Contains(dir, `\`)) {
+		return "", fmt.Errorf("directory_template gives the invalid directory %q", dir)
+	}
+	return path.Join(dir, file), nil
+}
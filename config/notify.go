@@ -0,0 +1,23 @@
+package config
+
+// Notifications configures where backup events are reported
+type Notifications struct {
+	Slack struct {
+		WebhookURL string   `yaml:"webhook_url"`
+		Events     []string `yaml:"events"`
+	} `yaml:"slack"`
+	Email struct {
+		Host     string   `yaml:"smtp_host"`
+		Port     int      `yaml:"smtp_port"`
+		Username string   `yaml:"username"`
+		Password string   `yaml:"password"`
+		From     string   `yaml:"from"`
+		To       []string `yaml:"to"`
+		Events   []string `yaml:"events"`
+	} `yaml:"email"`
+	Webhook struct {
+		URL     string            `yaml:"url"`
+		Headers map[string]string `yaml:"headers"`
+		Events  []string          `yaml:"events"`
+	} `yaml:"webhook"`
+}
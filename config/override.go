@@ -0,0 +1,253 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix starts the environment variables that override config fields
+const envPrefix = "BEACKUP_"
+
+// Override sets the config field at Path, the dot-separated YAML keys with
+// list indexes such as databases.0.host, to Value. Values are parsed as
+// YAML, except that string fields take them verbatim and an empty value
+// resets the field.
+type Override struct {
+	Path  string
+	Value string
+}
+
+// ParseOverrides takes the --<field>=<value> flags naming config fields
+// out of args, returning them and the remaining arguments. A flag without
+// a value sets a boolean field or takes the next argument. Flags that name
+// no field are left for the command, unless they contain a dot and so can
+// only have been meant as a config field.
+func ParseOverrides(args []string) ([]Override, []string, error) {
+	var overrides []Override
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			rest = append(rest, arg)
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		var scratch Config
+		field, err := lookupField(reflect.ValueOf(&scratch).Elem(), name)
+		if err != nil {
+			if strings.Contains(name, ".") {
+				return nil, nil, err
+			}
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			switch {
+			case field.Kind() == reflect.Bool:
+				value = "true"
+			case i+1 < len(args):
+				i++
+				value = args[i]
+			default:
+				return nil, nil, fmt.Errorf("flag %s needs a value", arg)
+			}
+		}
+		overrides = append(overrides, Override{Path: name, Value: value})
+	}
+	return overrides, rest, nil
+}
+
+// apply sets the overridden field in config
+func (o Override) apply(config *Config) error {
+	field, err := lookupField(reflect.ValueOf(config).Elem(), o.Path)
+	if err != nil {
+		return err
+	}
+	if err := setField(field, o.Value); err != nil {
+		return fmt.Errorf("invalid value for %s: %w", o.Path, err)
+	}
+	return nil
+}
+
+// envOverrides returns the overrides set by BEACKUP_* environment
+// variables, whose names are the field path in upper case with dots
+// replaced by underscores, such as BEACKUP_BACKUP_OUTPUT_DIR or
+// BEACKUP_DATABASES_0_HOST. Variables naming no field, like the ones
+// passed to hooks, are ignored.
+func envOverrides() []Override {
+	var overrides []Override
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		words := strings.Split(strings.ToLower(strings.TrimPrefix(name, envPrefix)), "_")
+		if path, ok := envPath(reflect.TypeOf(Config{}), words); ok {
+			overrides = append(overrides, Override{Path: strings.Join(path, "."), Value: value})
+		}
+	}
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].Path < overrides[j].Path })
+	return overrides
+}
+
+// envPath matches the words of an environment variable name against the
+// fields of t, trying every way the underscores can split field names
+func envPath(t reflect.Type, words []string) ([]string, bool) {
+	if isLeaf(t) {
+		return nil, len(words) == 0
+	}
+	if len(words) == 0 {
+		return nil, false
+	}
+
+	if t.Kind() == reflect.Slice {
+		if _, err := strconv.Atoi(words[0]); err != nil {
+			return nil, false
+		}
+		path, ok := envPath(t.Elem(), words[1:])
+		return append([]string{words[0]}, path...), ok
+	}
+
+	for _, f := range schemaFields(t) {
+		parts := strings.Split(f.name, "_")
+		if len(parts) > len(words) || strings.Join(words[:len(parts)], "_") != f.name {
+			continue
+		}
+		if path, ok := envPath(f.typ, words[len(parts):]); ok {
+			return append([]string{f.name}, path...), true
+		}
+	}
+	return nil, false
+}
+
+// lookupField returns the field at the dot-separated path below v, growing
+// lists to reach the indexes it names
+func lookupField(v reflect.Value, path string) (reflect.Value, error) {
+	for _, key := range strings.Split(path, ".") {
+		switch {
+		case isLeaf(v.Type()):
+			return reflect.Value{}, fmt.Errorf("unknown config field %s", path)
+		case v.Kind() == reflect.Slice:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 {
+				return reflect.Value{}, fmt.Errorf("unknown config field %s: %s is not a list index", path, key)
+			}
+			if index >= v.Len() {
+				grown := reflect.MakeSlice(v.Type(), index+1, index+1)
+				reflect.Copy(grown, v)
+				v.Set(grown)
+			}
+			v = v.Index(index)
+		default:
+			field, ok := structField(v, key)
+			if !ok {
+				return reflect.Value{}, fmt.Errorf("unknown config field %s", path)
+			}
+			v = field
+		}
+	}
+	if !isLeaf(v.Type()) {
+		return reflect.Value{}, fmt.Errorf("config field %s is a section, set the fields within it", path)
+	}
+	return v, nil
+}
+
+// setField parses value into field
+func setField(field reflect.Value, value string) error {
+	target := reflect.New(field.Type())
+	if _, ok := target.Interface().(yaml.Unmarshaler); !ok && field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+
+	err := yaml.Unmarshal([]byte(value), target.Interface())
+	// Lists may also be given as comma-separated values
+	if err != nil && field.Kind() == reflect.Slice {
+		target = reflect.New(field.Type())
+		err = yaml.Unmarshal([]byte("["+value+"]"), target.Interface())
+	}
+	// Values YAML reads as something else, like "yes" or "1:2", may still
+	// be what a string-based type such as a size expects
+	if err != nil {
+		target = reflect.New(field.Type())
+		if yaml.Unmarshal([]byte(strconv.Quote(value)), target.Interface()) == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	field.Set(target.Elem())
+	return nil
+}
+
+// schemaField is a config field with its YAML key, with the fields of
+// inline structs listed as their own
+type schemaField struct {
+	name  string
+	index []int
+	typ   reflect.Type
+}
+
+// schemaFields lists the config fields of struct type t
+func schemaFields(t reflect.Type) []schemaField {
+	var fields []schemaField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if options == "inline" {
+			for _, inner := range schemaFields(f.Type) {
+				inner.index = append([]int{i}, inner.index...)
+				fields = append(fields, inner)
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields = append(fields, schemaField{name: name, index: []int{i}, typ: f.Type})
+	}
+	return fields
+}
+
+// structField returns the field of struct v with the YAML key name
+func structField(v reflect.Value, name string) (reflect.Value, bool) {
+	for _, f := range schemaFields(v.Type()) {
+		if f.name == name {
+			return v.FieldByIndex(f.index), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// isLeaf reports whether t is set as a whole rather than through its
+// fields or list entries
+func isLeaf(t reflect.Type) bool {
+	if reflect.PointerTo(t).Implements(reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		return false
+	case reflect.Slice:
+		return t.Elem().Kind() != reflect.Struct
+	}
+	return true
+}
@@ -0,0 +1,174 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOverrides(t *testing.T) {
+	tests := []struct {
+		name          string
+		args          []string
+		wantOverrides []Override
+		wantRest      []string
+		wantErr       string
+	}{
+		{
+			name:     "no flags",
+			args:     []string{"backup", "config.yaml"},
+			wantRest: []string{"backup", "config.yaml"},
+		},
+		{
+			name:          "value after equals",
+			args:          []string{"--backup.output_dir=/srv/backups", "backup", "config.yaml"},
+			wantOverrides: []Override{{Path: "backup.output_dir", Value: "/srv/backups"}},
+			wantRest:      []string{"backup", "config.yaml"},
+		},
+		{
+			name:          "value as the next argument",
+			args:          []string{"backup", "-databases.0.host", "db.internal", "config.yaml"},
+			wantOverrides: []Override{{Path: "databases.0.host", Value: "db.internal"}},
+			wantRest:      []string{"backup", "config.yaml"},
+		},
+		{
+			name:          "boolean without a value",
+			args:          []string{"--storage.delete_local", "backup"},
+			wantOverrides: []Override{{Path: "storage.delete_local", Value: "true"}},
+			wantRest:      []string{"backup"},
+		},
+		{
+			name:          "empty value",
+			args:          []string{"--backup.jobs=", "backup"},
+			wantOverrides: []Override{{Path: "backup.jobs", Value: ""}},
+			wantRest:      []string{"backup"},
+		},
+		{
+			name:          "top-level field",
+			args:          []string{"--watch_config", "daemon"},
+			wantOverrides: []Override{{Path: "watch_config", Value: "true"}},
+			wantRest:      []string{"daemon"},
+		},
+		{
+			name:     "command flags are left alone",
+			args:     []string{"audit", "-output", "json", "-", "config.yaml"},
+			wantRest: []string{"audit", "-output", "json", "-", "config.yaml"},
+		},
+		{
+			name:     "sections are left alone",
+			args:     []string{"--backup", "config.yaml"},
+			wantRest: []string{"--backup", "config.yaml"},
+		},
+		{
+			name:          "nothing after a double dash",
+			args:          []string{"--backup.jobs=2", "restore", "--", "--backup.jobs=3"},
+			wantOverrides: []Override{{Path: "backup.jobs", Value: "2"}},
+			wantRest:      []string{"restore", "--", "--backup.jobs=3"},
+		},
+		{
+			name:    "unknown dotted field",
+			args:    []string{"--backup.output_directory=/srv"},
+			wantErr: "unknown config field backup.output_directory",
+		},
+		{
+			name:    "missing value",
+			args:    []string{"backup", "--backup.output_dir"},
+			wantErr: "flag --backup.output_dir needs a value",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			overrides, rest, err := ParseOverrides(tt.args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ParseOverrides() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseOverrides() error = %v", err)
+			}
+			if !reflect.DeepEqual(overrides, tt.wantOverrides) {
+				t.Errorf("overrides = %v, want %v", overrides, tt.wantOverrides)
+			}
+			if !reflect.DeepEqual(rest, tt.wantRest) {
+				t.Errorf("rest = %q, want %q", rest, tt.wantRest)
+			}
+		})
+	}
+}
+
+func TestOverrideApply(t *testing.T) {
+	tests := []struct {
+		override Override
+		check    func(c *Config) bool
+		wantErr  string
+	}{
+		{Override{"backup.jobs", "4"}, func(c *Config) bool { return c.Backup.Jobs == 4 }, ""},
+		{Override{"backup.jobs", ""}, func(c *Config) bool { return c.Backup.Jobs == 0 }, ""},
+		{Override{"backup.frequency", "90m"}, func(c *Config) bool { return c.Backup.Frequency == 90*time.Minute }, ""},
+		{Override{"backup.rate_limit", "10MB"}, func(c *Config) bool { return c.Backup.RateLimit > 0 }, ""},
+		{Override{"backup.retention.keep_last", "3"}, func(c *Config) bool { return c.Backup.RetentionPolicy.KeepLast == 3 }, ""},
+		{Override{"storage.type", "yes"}, func(c *Config) bool { return c.Storage.Type == "yes" }, ""},
+		{Override{"storage.delete_local", "true"}, func(c *Config) bool { return c.Storage.DeleteLocal }, ""},
+		{Override{"databases.1.host", "db2"}, func(c *Config) bool { return len(c.Databases) == 2 && c.Databases[1].Host == "db2" }, ""},
+		{Override{"database.include_tables", "a,b"}, func(c *Config) bool { return reflect.DeepEqual(c.Database.IncludeTables, []string{"a", "b"}) }, ""},
+		{Override{"database.include_tables", "[c, d]"}, func(c *Config) bool { return reflect.DeepEqual(c.Database.IncludeTables, []string{"c", "d"}) }, ""},
+		{Override{"database.port", "abc"}, nil, "invalid value for database.port"},
+		{Override{"storage.s3", "x"}, nil, "is a section"},
+		{Override{"databases.x.host", "db"}, nil, "x is not a list index"},
+		{Override{"backup.output_dir.sub", "x"}, nil, "unknown config field"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.override.Path+"="+tt.override.Value, func(t *testing.T) {
+			config := &Config{Databases: []Database{{Host: "db1"}}}
+			err := tt.override.apply(config)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("apply() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("apply() error = %v", err)
+			}
+			if !tt.check(config) {
+				t.Errorf("apply() did not set %s to %q", tt.override.Path, tt.override.Value)
+			}
+		})
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	// Start from an environment without other overrides
+	for _, env := range os.Environ() {
+		if name, _, _ := strings.Cut(env, "="); strings.HasPrefix(name, envPrefix) {
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+	t.Setenv("BEACKUP_BACKUP_OUTPUT_DIR", "/srv/backups")
+	t.Setenv("BEACKUP_DATABASES_0_HOST", "db.internal")
+	t.Setenv("BEACKUP_STORAGE_S3_PART_SIZE_MB", "32")
+	t.Setenv("BEACKUP_BACKUP_RETENTION_KEEP_LAST", "5")
+	t.Setenv("BEACKUP_WATCH_CONFIG", "true")
+	// Set for hooks, naming no field
+	t.Setenv("BEACKUP_DB_NAME", "app")
+	t.Setenv("BEACKUP_STATUS", "success")
+	// Sections and partial names are no fields either
+	t.Setenv("BEACKUP_STORAGE_S3", "x")
+	t.Setenv("BEACKUP_DATABASES_HOST", "x")
+
+	want := []Override{
+		{Path: "backup.output_dir", Value: "/srv/backups"},
+		{Path: "backup.retention.keep_last", Value: "5"},
+		{Path: "databases.0.host", Value: "db.internal"},
+		{Path: "storage.s3.part_size_mb", Value: "32"},
+		{Path: "watch_config", Value: "true"},
+	}
+	if got := envOverrides(); !reflect.DeepEqual(got, want) {
+		t.Errorf("envOverrides() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PgDump holds pg_dump options of postgres logical dumps
+type PgDump struct {
+	NoOwner      bool `yaml:"no_owner"`      // --no-owner
+	NoPrivileges bool `yaml:"no_privileges"` // --no-privileges
+	Blobs        bool `yaml:"blobs"`         // --blobs, include large objects in filtered dumps
+	// SerializableDeferrable waits for a snapshot that cannot conflict with
+	// other transactions, for dumps of busy databases
+	SerializableDeferrable bool `yaml:"serializable_deferrable"`
+	// LockWaitTimeout fails the dump instead of waiting longer than this
+	// for a table lock, 0 to wait indefinitely
+	LockWaitTimeout time.Duration `yaml:"lock_wait_timeout"`
+	// ExtraArgs are appended verbatim to the pg_dump command, followed by
+	// FormatArgs for the format being dumped
+	ExtraArgs  []string            `yaml:"extra_args"`
+	FormatArgs map[string][]string `yaml:"format_args"`
+}
+
+// IsZero reports whether no option is configured
+func (p PgDump) IsZero() bool {
+	return !p.NoOwner && !p.NoPrivileges && !p.Blobs && !p.SerializableDeferrable && p.LockWaitTimeout == 0 &&
+		len(p.ExtraArgs) == 0 && len(p.FormatArgs) == 0
+}
+
+// Args returns the pg_dump arguments for a dump of format
+func (p PgDump) Args(format string) []string {
+	var args []string
+	if p.NoOwner {
+		args = append(args, "--no-owner")
+	}
+	if p.NoPrivileges {
+		args = append(args, "--no-privileges")
+	}
+	if p.Blobs {
+		args = append(args, "--blobs")
+	}
+	if p.SerializableDeferrable {
+		args = append(args, "--serializable-deferrable")
+	}
+	if p.LockWaitTimeout > 0 {
+		args = append(args, fmt.Sprintf("--lock-wait-timeout=%d", p.LockWaitTimeout.Milliseconds()))
+	}
+	args = append(args, p.ExtraArgs...)
+	return append(args, p.FormatArgs[format]...)
+}
+
+// reservedPgDumpArgs are set by beackup and would break its handling of the
+// dump if overridden
+var reservedPgDumpArgs = []string{"-f", "--file", "-F", "--format", "-Z", "--compress", "-j", "--jobs"}
+
+func (p PgDump) validate() error {
+	if p.LockWaitTimeout < 0 {
+		return fmt.Errorf("lock_wait_timeout must not be negative")
+	}
+	if p.LockWaitTimeout > 0 && p.LockWaitTimeout < time.Millisecond {
+		return fmt.Errorf("lock_wait_timeout must be at least 1ms")
+	}
+	for format, args := range p.FormatArgs {
+		switch format {
+		case "custom", "plain", "tar", "directory", "copy":
+		default:
+			return fmt.Errorf("format_args: unknown format %q", format)
+		}
+		if err := checkPgDumpArgs(args); err != nil {
+			return err
+		}
+	}
+	return checkPgDumpArgs(p.ExtraArgs)
+}
+
+// checkPgDumpArgs rejects arguments controlling the output beackup reads
+func checkPgDumpArgs(args []string) error {
+	for _, arg := range args {
+		for _, reserved := range reservedPgDumpArgs {
+			if arg == reserved || strings.HasPrefix(arg, reserved+"=") ||
+				len(reserved) == 2 && strings.HasPrefix(arg, reserved) {
+				return fmt.Errorf("pg_dump argument %q is set by beackup", arg)
+			}
+		}
+	}
+	return nil
+}
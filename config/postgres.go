@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SSL holds the TLS settings of PostgreSQL connections, passed to the
+// client programs as PGSSLMODE, PGSSLROOTCERT, PGSSLCERT and PGSSLKEY
+type SSL struct {
+	Mode     string `yaml:"sslmode"`     // disable, allow, prefer, require, verify-ca or verify-full
+	RootCert string `yaml:"sslrootcert"` // CA certificate checked by verify-ca and verify-full
+	Cert     string `yaml:"sslcert"`     // client certificate
+	Key      string `yaml:"sslkey"`      // client key, must only be readable by the current user
+}
+
+func (s SSL) validate() error {
+	switch s.Mode {
+	case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		return fmt.Errorf("unknown sslmode %q", s.Mode)
+	}
+	if (s.Cert == "") != (s.Key == "") {
+		return fmt.Errorf("sslcert and sslkey must be set together")
+	}
+	for _, path := range []string{s.RootCert, s.Cert, s.Key} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("failed to access ssl file: %w", err)
+		}
+	}
+	return nil
+}
+
+// dsnParameters maps the connection URL parameters beackup passes on to the
+// libpq environment variables setting them. The SSL parameters are kept in
+// the SSL settings instead.
+var dsnParameters = map[string]string{
+	"application_name":     "PGAPPNAME",
+	"channel_binding":      "PGCHANNELBINDING",
+	"connect_timeout":      "PGCONNECT_TIMEOUT",
+	"gssencmode":           "PGGSSENCMODE",
+	"options":              "PGOPTIONS",
+	"sslcrl":               "PGSSLCRL",
+	"sslnegotiation":       "PGSSLNEGOTIATION",
+	"target_session_attrs": "PGTARGETSESSIONATTRS",
+}
+
+// parseDSN fills in db's connection settings from its postgres:// URL, as
+// handed out by managed providers. Settings may come from the URL or the
+// separate fields, but not both.
+func parseDSN(db *Database) error {
+	dsn, err := url.Parse(db.DSN)
+	if err != nil || (dsn.Scheme != "postgres" && dsn.Scheme != "postgresql") {
+		return fmt.Errorf("dsn must be a postgres:// or postgresql:// URL")
+	}
+	if db.Host != "" || db.Port != 0 || db.User != "" || db.Password != "" || db.Name != "" {
+		return fmt.Errorf("dsn cannot be combined with host, port, user, password or name")
+	}
+	if strings.Contains(dsn.Host, ",") {
+		return fmt.Errorf("dsn with several hosts is not supported")
+	}
+
+	db.Host = dsn.Hostname()
+	if port := dsn.Port(); port != "" {
+		if db.Port, err = strconv.Atoi(port); err != nil {
+			return fmt.Errorf("invalid dsn port %q", port)
+		}
+	}
+	if dsn.User != nil {
+		db.User = dsn.User.Username()
+		db.Password, _ = dsn.User.Password()
+	}
+	db.Name = strings.TrimPrefix(dsn.Path, "/")
+
+	for name, values := range dsn.Query() {
+		value := values[len(values)-1]
+		var field *string
+		switch name {
+		case "sslmode":
+			field = &db.SSL.Mode
+		case "sslrootcert":
+			field = &db.SSL.RootCert
+		case "sslcert":
+			field = &db.SSL.Cert
+		case "sslkey":
+			field = &db.SSL.Key
+		}
+		if field != nil {
+			if *field != "" {
+				return fmt.Errorf("%s is set both in the dsn and separately", name)
+			}
+			*field = value
+			continue
+		}
+		variable, ok := dsnParameters[name]
+		if !ok {
+			return fmt.Errorf("unsupported dsn parameter %q", name)
+		}
+		db.DSNEnv = append(db.DSNEnv, variable+"="+value)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// Priority lowers the CPU and I/O priority of the dump programs, so
+// that backups compete less with other work on the host
+type Priority struct {
+	Nice        int    `yaml:"nice"`         // 1 (slightly lower) to 19 (lowest), 0 leaves it unchanged
+	IONiceClass string `yaml:"ionice_class"` // idle or best-effort, empty leaves it unchanged
+	IONiceLevel int    `yaml:"ionice_level"` // 0 (highest) to 7 (lowest) within best-effort
+}
+
+func (p Priority) validate() error {
+	if p.Nice < 0 || p.Nice > 19 {
+		return fmt.Errorf("nice must be between 0 and 19")
+	}
+	switch p.IONiceClass {
+	case "", "idle":
+		if p.IONiceLevel != 0 {
+			return fmt.Errorf("ionice_level only applies to the best-effort class")
+		}
+	case "best-effort":
+		if p.IONiceLevel < 0 || p.IONiceLevel > 7 {
+			return fmt.Errorf("ionice_level must be between 0 and 7")
+		}
+	default:
+		return fmt.Errorf("unknown ionice_class %q, use idle or best-effort", p.IONiceClass)
+	}
+	for _, program := range p.Programs() {
+		if _, err := exec.LookPath(program); err != nil {
+			return fmt.Errorf("%s not found: %w", program, err)
+		}
+	}
+	return nil
+}
+
+// programs returns the programs the dump programs are started through
+func (p Priority) Programs() []string {
+	var programs []string
+	if p.Nice != 0 {
+		programs = append(programs, "nice")
+	}
+	if p.IONiceClass != "" {
+		programs = append(programs, "ionice")
+	}
+	return programs
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Rehearsal schedules restore rehearsals: the latest backup of a
+// database is restored into a scratch database, checked with the
+// validation queries and its row counts, and dropped again
+type Rehearsal struct {
+	Frequency time.Duration `yaml:"frequency"` // e.g. 168h for weekly, 0 disables rehearsals
+	Databases []string      `yaml:"databases"` // ids of the databases to rehearse, empty for all
+	// Server the scratch database is created on, defaulting to each
+	// database's own server and credentials
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// Prefix of the scratch database names, followed by the database name
+	// and the time of the rehearsal
+	Prefix string `yaml:"prefix"`
+	// Queries run against the restored database; one that fails fails the
+	// rehearsal, and the results are reported
+	Queries []string `yaml:"queries"`
+}
+
+// defaultRehearsalPrefix prefixes scratch database names
+const defaultRehearsalPrefix = "beackup_rehearsal"
+
+// Enabled reports whether rehearsals are scheduled
+func (r Rehearsal) Enabled() bool {
+	return r.Frequency > 0
+}
+
+// validate fills in defaults and checks that every rehearsed database
+// exists
+func (r *Rehearsal) validate(databases []Database) error {
+	if r.Frequency < 0 {
+		return fmt.Errorf("frequency must not be negative")
+	}
+	if r.Prefix == "" {
+		r.Prefix = defaultRehearsalPrefix
+	}
+	if strings.Trim(r.Prefix, "abcdefghijklmnopqrstuvwxyz0123456789_") != "" {
+		return fmt.Errorf("prefix may only hold lowercase letters, digits and underscores")
+	}
+	for _, id := range r.Databases {
+		if !slices.ContainsFunc(databases, func(db Database) bool { return db.ID == id }) {
+			return fmt.Errorf("unknown database %q", id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Report schedules
+const (
+	ReportDaily  = "daily"
+	ReportWeekly = "weekly"
+)
+
+// Defaults for summary reports
+const (
+	defaultReportAt         = "08:00"
+	defaultReportWeekday    = "monday"
+	defaultReportStaleAfter = 24 * time.Hour
+)
+
+// Reports schedules summary reports of the backups of every database,
+// delivered to the email and webhook notification channels
+type Reports struct {
+	Schedule string `yaml:"schedule"` // daily or weekly, empty to send no reports
+	At       string `yaml:"at"`       // local time of day the report is sent, HH:MM
+	Weekday  string `yaml:"weekday"`  // day weekly reports are sent on
+	// StaleAfter flags databases without a successful backup for this long
+	StaleAfter time.Duration `yaml:"stale_after"`
+}
+
+// Enabled reports whether summary reports are scheduled
+func (r Reports) Enabled() bool {
+	return r.Schedule != ""
+}
+
+// Period returns how long a report covers
+func (r Reports) Period() time.Duration {
+	if r.Schedule == ReportWeekly {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// Next returns when the first report after t is due
+func (r Reports) Next(t time.Time) time.Time {
+	clock, _ := time.Parse("15:04", r.At)
+	next := time.Date(t.Year(), t.Month(), t.Day(), clock.Hour(), clock.Minute(), 0, 0, t.Location())
+	days := 1
+	if r.Schedule == ReportWeekly {
+		weekday, _ := parseWeekday(r.Weekday)
+		next = next.AddDate(0, 0, (int(weekday)-int(next.Weekday())+7)%7)
+		days = 7
+	}
+	for !next.After(t) {
+		next = next.AddDate(0, 0, days)
+	}
+	return next
+}
+
+// validate fills in defaults and checks the schedule
+func (r *Reports) validate() error {
+	if r.At == "" {
+		r.At = defaultReportAt
+	}
+	if r.Weekday == "" {
+		r.Weekday = defaultReportWeekday
+	}
+	if r.StaleAfter == 0 {
+		r.StaleAfter = defaultReportStaleAfter
+	}
+
+	switch r.Schedule {
+	case "", ReportDaily, ReportWeekly:
+	default:
+		return fmt.Errorf("unknown schedule %q (expected daily or weekly)", r.Schedule)
+	}
+	if _, err := time.Parse("15:04", r.At); err != nil {
+		return fmt.Errorf("at must be a time of day such as 08:00")
+	}
+	if _, err := parseWeekday(r.Weekday); err != nil {
+		return err
+	}
+	if r.StaleAfter < 0 {
+		return fmt.Errorf("stale_after must not be negative")
+	}
+	return nil
+}
+
+// parseWeekday parses the English name of a day of the week
+func parseWeekday(name string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(name, d.String()) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", name)
+}
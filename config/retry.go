@@ -0,0 +1,28 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Retry controls how transient failures of pg_dump and uploads are
+// retried
+type Retry struct {
+	Retries     int           `yaml:"retries"`            // 0 disables retrying
+	Backoff     time.Duration `yaml:"retry_backoff"`      // delay before the first retry, doubled after each
+	MaxInterval time.Duration `yaml:"retry_max_interval"` // upper bound for the delay
+}
+
+// validate rejects negative values and fills in default delays
+func (r *Retry) validate() error {
+	if r.Retries < 0 || r.Backoff < 0 || r.MaxInterval < 0 {
+		return fmt.Errorf("retry settings must not be negative")
+	}
+	if r.Backoff == 0 {
+		r.Backoff = 5 * time.Second
+	}
+	if r.MaxInterval == 0 {
+		r.MaxInterval = 5 * time.Minute
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Policies for scheduled runs due outside the run window or during a
+// blackout
+const (
+	MissedDelay = "delay" // run it once the schedule allows it
+	MissedSkip  = "skip"  // drop it and wait for the next scheduled run
+)
+
+// maxHold bounds how far ahead Hold looks for a time a run is allowed
+const maxHold = 366 * 24 * time.Hour
+
+// Layouts of the dates and times in blackouts
+const (
+	dateLayout     = "2006-01-02"
+	dateTimeLayout = "2006-01-02 15:04"
+)
+
+// Schedule restricts when scheduled backups may start, in local time.
+// Backups requested through the API are not restricted.
+type Schedule struct {
+	Window   Window     `yaml:"window"`
+	Blackout []Blackout `yaml:"blackout"`
+	// Missed decides what happens to a run due while the schedule does not
+	// allow it: delay (default) or skip
+	Missed string `yaml:"missed"`
+}
+
+// Window is the time of day backups may start in, which may span midnight
+// such as 22:00 to 04:00
+type Window struct {
+	Start string `yaml:"start"` // HH:MM
+	End   string `yaml:"end"`   // HH:MM
+}
+
+// Blackout is a period backups may not start in: either a single period
+// from From to To, or the hours from Start to End, the whole day if unset,
+// of every day matching Days and Weekdays
+type Blackout struct {
+	Name string `yaml:"name"`
+	From string `yaml:"from"` // YYYY-MM-DD or YYYY-MM-DD HH:MM
+	To   string `yaml:"to"`   // a date alone includes that whole day
+	// Days of the month, counting back from the end when negative: -1 is
+	// the last day
+	Days     []int    `yaml:"days"`
+	Weekdays []string `yaml:"weekdays"`
+	Start    string   `yaml:"start"` // HH:MM
+	End      string   `yaml:"end"`   // HH:MM
+}
+
+// IsZero reports whether no schedule restrictions are configured
+func (s Schedule) IsZero() bool {
+	return s.Window == Window{} && len(s.Blackout) == 0 && s.Missed == ""
+}
+
+// Hold returns when a run due at t may start, t itself if the schedule
+// allows it, along with why it is held otherwise. The time is zero if the
+// schedule allows no run within a year.
+func (s Schedule) Hold(t time.Time) (time.Time, string) {
+	reason := ""
+	for at := t; at.Sub(t) < maxHold; {
+		reopen, why := s.closed(at)
+		if why == "" {
+			return at, reason
+		}
+		if reason == "" {
+			reason = why
+		}
+		at = reopen
+	}
+	return time.Time{}, reason
+}
+
+// closed returns why runs may not start at t, empty if they may, and when
+// that reason ends
+func (s Schedule) closed(t time.Time) (time.Time, string) {
+	if s.Window.Start != "" {
+		start, end := clockOn(t, s.Window.Start), clockOn(t, s.Window.End)
+		var open bool
+		if start.Before(end) {
+			open = !t.Before(start) && t.Before(end)
+		} else {
+			open = !t.Before(start) || t.Before(end)
+		}
+		if !open {
+			if !start.After(t) {
+				start = clockOn(t.AddDate(0, 0, 1), s.Window.Start)
+			}
+			return start, fmt.Sprintf("outside the run window %s-%s", s.Window.Start, s.Window.End)
+		}
+	}
+
+	for i, b := range s.Blackout {
+		if end, ok := b.covers(t); ok {
+			name := b.Name
+			if name == "" {
+				name = fmt.Sprintf("%d", i+1)
+			}
+			return end, fmt.Sprintf("during blackout %s", name)
+		}
+	}
+	return t, ""
+}
+
+// covers reports whether the blackout covers t, and when that period ends
+func (b Blackout) covers(t time.Time) (time.Time, bool) {
+	if b.From != "" {
+		from, _ := parseBlackoutTime(b.From, t.Location(), false)
+		to, _ := parseBlackoutTime(b.To, t.Location(), true)
+		return to, !t.Before(from) && t.Before(to)
+	}
+
+	if len(b.Days) > 0 {
+		last := time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day()
+		match := false
+		for _, day := range b.Days {
+			if day == t.Day() || day < 0 && last+1+day == t.Day() {
+				match = true
+			}
+		}
+		if !match {
+			return time.Time{}, false
+		}
+	}
+	if len(b.Weekdays) > 0 {
+		match := false
+		for _, name := range b.Weekdays {
+			if weekday, _ := parseWeekday(name); weekday == t.Weekday() {
+				match = true
+			}
+		}
+		if !match {
+			return time.Time{}, false
+		}
+	}
+
+	start := clockOn(t, "00:00")
+	end := start.AddDate(0, 0, 1)
+	if b.Start != "" {
+		start = clockOn(t, b.Start)
+	}
+	if b.End != "" {
+		end = clockOn(t, b.End)
+	}
+	return end, !t.Before(start) && t.Before(end)
+}
+
+// validate fills in the default policy and checks the settings
+func (s *Schedule) validate() error {
+	if s.Missed == "" {
+		s.Missed = MissedDelay
+	}
+	if s.Missed != MissedDelay && s.Missed != MissedSkip {
+		return fmt.Errorf("unknown missed policy %q (expected delay or skip)", s.Missed)
+	}
+
+	if s.Window.Start != "" || s.Window.End != "" {
+		start, err := parseClock(s.Window.Start)
+		if err != nil {
+			return fmt.Errorf("window start: %w", err)
+		}
+		end, err := parseClock(s.Window.End)
+		if err != nil {
+			return fmt.Errorf("window end: %w", err)
+		}
+		if start == end {
+			return fmt.Errorf("window start and end must differ")
+		}
+	}
+
+	for i, b := range s.Blackout {
+		if err := b.validate(); err != nil {
+			return fmt.Errorf("blackout %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// validate checks a blackout
+func (b Blackout) validate() error {
+	if b.From != "" || b.To != "" {
+		if len(b.Days) > 0 || len(b.Weekdays) > 0 || b.Start != "" || b.End != "" {
+			return fmt.Errorf("from and to cannot be combined with days, weekdays, start or end")
+		}
+		from, err := parseBlackoutTime(b.From, time.Local, false)
+		if err != nil {
+			return fmt.Errorf("from: %w", err)
+		}
+		to, err := parseBlackoutTime(b.To, time.Local, true)
+		if err != nil {
+			return fmt.Errorf("to: %w", err)
+		}
+		if !to.After(from) {
+			return fmt.Errorf("to must be after from")
+		}
+		return nil
+	}
+
+	if len(b.Days) == 0 && len(b.Weekdays) == 0 && b.Start == "" && b.End == "" {
+		return fmt.Errorf("no dates or times set")
+	}
+	for _, day := range b.Days {
+		if day == 0 || day < -31 || day > 31 {
+			return fmt.Errorf("invalid day of the month %d", day)
+		}
+	}
+	for _, name := range b.Weekdays {
+		if _, err := parseWeekday(name); err != nil {
+			return err
+		}
+	}
+	start, end := 0, 24*60
+	var err error
+	if b.Start != "" {
+		if start, err = parseClock(b.Start); err != nil {
+			return fmt.Errorf("start: %w", err)
+		}
+	}
+	if b.End != "" {
+		if end, err = parseClock(b.End); err != nil {
+			return fmt.Errorf("end: %w", err)
+		}
+	}
+	if start >= end {
+		return fmt.Errorf("start must be before end, use two blackouts to span midnight")
+	}
+	return nil
+}
+
+// parseClock parses a time of day, returning minutes since midnight
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day such as 01:00", value)
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// clockOn returns the time of day value on the day of t
+func clockOn(t time.Time, value string) time.Time {
+	minutes, _ := parseClock(value)
+	return time.Date(t.Year(), t.Month(), t.Day(), minutes/60, minutes%60, 0, 0, t.Location())
+}
+
+// parseBlackoutTime parses a blackout's from or to in loc. A date alone is
+// the start of that day, or the end of it if end is set.
+func parseBlackoutTime(value string, loc *time.Location, end bool) (time.Time, error) {
+	if t, err := time.ParseInLocation(dateTimeLayout, value, loc); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(dateLayout, value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a date such as 2026-12-24 or 2026-12-24 18:00", value)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
@@ -0,0 +1,168 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// on returns the given time on a day of 2026 in UTC
+func on(month time.Month, day, hour, minute int) time.Time {
+	return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestScheduleHold(t *testing.T) {
+	everyDay := []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+	tests := []struct {
+		name       string
+		schedule   Schedule
+		due        time.Time
+		want       time.Time
+		wantReason string
+	}{
+		{
+			name: "no restrictions",
+			due:  on(time.March, 4, 12, 0),
+			want: on(time.March, 4, 12, 0),
+		},
+		{
+			name:     "inside the window",
+			schedule: Schedule{Window: Window{Start: "01:00", End: "05:00"}},
+			due:      on(time.March, 4, 3, 0),
+			want:     on(time.March, 4, 3, 0),
+		},
+		{
+			name:       "before the window",
+			schedule:   Schedule{Window: Window{Start: "01:00", End: "05:00"}},
+			due:        on(time.March, 4, 0, 30),
+			want:       on(time.March, 4, 1, 0),
+			wantReason: "outside the run window 01:00-05:00",
+		},
+		{
+			name:       "at the end of the window",
+			schedule:   Schedule{Window: Window{Start: "01:00", End: "05:00"}},
+			due:        on(time.March, 4, 5, 0),
+			want:       on(time.March, 5, 1, 0),
+			wantReason: "outside the run window 01:00-05:00",
+		},
+		{
+			name:     "window spanning midnight, before midnight",
+			schedule: Schedule{Window: Window{Start: "22:00", End: "04:00"}},
+			due:      on(time.March, 4, 23, 0),
+			want:     on(time.March, 4, 23, 0),
+		},
+		{
+			name:     "window spanning midnight, after midnight",
+			schedule: Schedule{Window: Window{Start: "22:00", End: "04:00"}},
+			due:      on(time.March, 4, 2, 0),
+			want:     on(time.March, 4, 2, 0),
+		},
+		{
+			name:       "outside a window spanning midnight",
+			schedule:   Schedule{Window: Window{Start: "22:00", End: "04:00"}},
+			due:        on(time.March, 4, 12, 0),
+			want:       on(time.March, 4, 22, 0),
+			wantReason: "outside the run window 22:00-04:00",
+		},
+		{
+			name:       "blackout of whole dates",
+			schedule:   Schedule{Blackout: []Blackout{{Name: "holidays", From: "2026-12-24", To: "2026-12-26"}}},
+			due:        on(time.December, 25, 10, 0),
+			want:       on(time.December, 27, 0, 0),
+			wantReason: "during blackout holidays",
+		},
+		{
+			name:     "before a blackout of dates and times",
+			schedule: Schedule{Blackout: []Blackout{{From: "2026-06-01 18:00", To: "2026-06-02 06:00"}}},
+			due:      on(time.June, 1, 17, 59),
+			want:     on(time.June, 1, 17, 59),
+		},
+		{
+			name:       "blackout of dates and times",
+			schedule:   Schedule{Blackout: []Blackout{{From: "2026-06-01 18:00", To: "2026-06-02 06:00"}}},
+			due:        on(time.June, 1, 18, 0),
+			want:       on(time.June, 2, 6, 0),
+			wantReason: "during blackout 1",
+		},
+		{
+			// March 7, 2026 is a Saturday
+			name:       "weekend blackout",
+			schedule:   Schedule{Blackout: []Blackout{{Name: "weekend", Weekdays: []string{"Saturday", "sunday"}}}},
+			due:        on(time.March, 7, 9, 0),
+			want:       on(time.March, 9, 0, 0),
+			wantReason: "during blackout weekend",
+		},
+		{
+			name:       "hours on the last day of the month",
+			schedule:   Schedule{Blackout: []Blackout{{Days: []int{-1}, Start: "00:00", End: "06:00"}}},
+			due:        on(time.February, 28, 2, 0),
+			want:       on(time.February, 28, 6, 0),
+			wantReason: "during blackout 1",
+		},
+		{
+			name:     "negative days count from the end of the month",
+			schedule: Schedule{Blackout: []Blackout{{Days: []int{-1}}}},
+			due:      on(time.March, 28, 2, 0),
+			want:     on(time.March, 28, 2, 0),
+		},
+		{
+			name: "blackout then window",
+			schedule: Schedule{
+				Window:   Window{Start: "01:00", End: "05:00"},
+				Blackout: []Blackout{{Name: "ides", Days: []int{15}}},
+			},
+			due:        on(time.March, 15, 2, 0),
+			want:       on(time.March, 16, 1, 0),
+			wantReason: "during blackout ides",
+		},
+		{
+			name:       "never allowed",
+			schedule:   Schedule{Blackout: []Blackout{{Name: "always", Weekdays: everyDay}}},
+			due:        on(time.March, 4, 12, 0),
+			wantReason: "during blackout always",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := tt.schedule.Hold(tt.due)
+			if !got.Equal(tt.want) || reason != tt.wantReason {
+				t.Errorf("Hold() = %v, %q, want %v, %q", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule Schedule
+		wantErr  string
+	}{
+		{name: "empty"},
+		{name: "window", schedule: Schedule{Window: Window{Start: "22:00", End: "04:00"}}},
+		{name: "unknown policy", schedule: Schedule{Missed: "later"}, wantErr: "unknown missed policy"},
+		{name: "window without end", schedule: Schedule{Window: Window{Start: "22:00"}}, wantErr: "window end"},
+		{name: "empty window", schedule: Schedule{Window: Window{Start: "22:00", End: "22:00"}}, wantErr: "must differ"},
+		{name: "invalid time", schedule: Schedule{Window: Window{Start: "25:00", End: "04:00"}}, wantErr: "window start"},
+		{name: "dates", schedule: Schedule{Blackout: []Blackout{{From: "2026-12-24", To: "2026-12-24"}}}},
+		{name: "dates out of order", schedule: Schedule{Blackout: []Blackout{{From: "2026-12-24 18:00", To: "2026-12-24 08:00"}}}, wantErr: "blackout 1: to must be after from"},
+		{name: "invalid date", schedule: Schedule{Blackout: []Blackout{{From: "24.12.2026", To: "2026-12-25"}}}, wantErr: "from:"},
+		{name: "dates with weekdays", schedule: Schedule{Blackout: []Blackout{{From: "2026-12-24", To: "2026-12-25", Weekdays: []string{"monday"}}}}, wantErr: "cannot be combined"},
+		{name: "nothing set", schedule: Schedule{Blackout: []Blackout{{Name: "empty"}}}, wantErr: "no dates or times set"},
+		{name: "day zero", schedule: Schedule{Blackout: []Blackout{{Days: []int{0}}}}, wantErr: "invalid day of the month 0"},
+		{name: "unknown weekday", schedule: Schedule{Blackout: []Blackout{{Weekdays: []string{"caturday"}}}}, wantErr: "unknown weekday"},
+		{name: "hours spanning midnight", schedule: Schedule{Blackout: []Blackout{{Start: "22:00", End: "02:00"}}}, wantErr: "use two blackouts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.schedule.validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("validate() error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("validate() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Secrets configures the secret stores database passwords can be read
+// from
+type Secrets struct {
+	Vault Vault             `yaml:"vault"`
+	AWS   AWSSecretsManager `yaml:"aws_secrets_manager"`
+}
+
+// SecretRef points at a secret in one of the configured stores
+type SecretRef struct {
+	Provider string `yaml:"provider"` // vault or aws_secrets_manager
+	Path     string `yaml:"path"`     // Vault API path or Secrets Manager secret id
+	Key      string `yaml:"key"`      // field within the secret; empty uses a plain Secrets Manager string
+}
+
+// Vault configures access to a HashiCorp Vault server. Without a
+// token, the AppRole credentials are used to log in.
+type Vault struct {
+	Address   string `yaml:"address"` // defaults to VAULT_ADDR
+	Token     string `yaml:"token"`   // defaults to VAULT_TOKEN
+	TokenFile string `yaml:"token_file"`
+	Namespace string `yaml:"namespace"`
+	RoleID    string `yaml:"role_id"`
+	SecretID  string `yaml:"secret_id"`
+	CACert    string `yaml:"ca_cert"` // PEM bundle to verify the server with
+}
+
+// AWSSecretsManager configures access to AWS Secrets Manager.
+// Region and credentials fall back to the standard AWS environment
+// variables.
+type AWSSecretsManager struct {
+	Region          string `yaml:"region"`
+	Endpoint        string `yaml:"endpoint"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	SessionToken    string `yaml:"session_token"`
+}
+
+// envReference matches ${NAME}; $${ escapes a literal ${
+var envReference = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// interpolateEnv replaces ${NAME} in every string value of v, which must be
+// a pointer, with the named environment variable
+func interpolateEnv(v interface{}) error {
+	var missing []string
+	expand := func(s string) string {
+		return envReference.ReplaceAllStringFunc(s, func(ref string) string {
+			if strings.HasPrefix(ref, "$$") {
+				return ref[1:]
+			}
+			name := ref[2 : len(ref)-1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return value
+		})
+	}
+
+	interpolateValue(reflect.ValueOf(v), expand)
+
+	if len(missing) > 0 {
+		return fmt.Errorf("environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// interpolateValue applies expand to every string reachable from v
+func interpolateValue(v reflect.Value, expand func(string) string) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			interpolateValue(v.Elem(), expand)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				interpolateValue(v.Field(i), expand)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			interpolateValue(v.Index(i), expand)
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return
+		}
+		for _, key := range v.MapKeys() {
+			v.SetMapIndex(key, reflect.ValueOf(expand(v.MapIndex(key).String())).Convert(v.Type().Elem()))
+		}
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(expand(v.String()))
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"fmt"
+)
+
+// Signing selects how manifests, and optionally artifacts, are signed so
+// that tampering with backups can be detected
+type Signing struct {
+	Type string `yaml:"type"` // ed25519, gpg, or empty for none
+
+	// PrivateKey holds the PEM (PKCS #8) Ed25519 key or armored GPG secret
+	// key backups are signed with
+	PrivateKey KeySource `yaml:"private_key"`
+	// PublicKey holds the PEM Ed25519 or armored GPG public key signatures
+	// are checked against, so that audits do not need the private key
+	PublicKey KeySource `yaml:"public_key"`
+	// Passphrase unlocks a protected GPG secret key
+	Passphrase KeySource `yaml:"passphrase"`
+	// Artifacts signs each backup file too, not just its manifest
+	Artifacts bool `yaml:"artifacts"`
+}
+
+// Enabled reports whether signing is configured
+func (s Signing) Enabled() bool {
+	return s.Type != "" && s.Type != "none"
+}
+
+// validate checks that a key is configured to sign or verify with
+func (s Signing) validate() error {
+	switch s.Type {
+	case "", "none":
+		return nil
+	case "ed25519", "gpg":
+		if !s.PrivateKey.IsSet() && !s.PublicKey.IsSet() {
+			return fmt.Errorf("%s signing needs a private or public key", s.Type)
+		}
+	default:
+		return fmt.Errorf("unknown signing type %q", s.Type)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a number of bytes, configured either as a plain number or
+// with a unit such as "500KB", "10MiB" or "2GB"
+type ByteSize int64
+
+// byteUnits maps unit suffixes to their multipliers; KB, MB, ... are
+// decimal and KiB, MiB, ... binary
+var byteUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"KB":  1e3,
+	"MB":  1e6,
+	"GB":  1e9,
+	"TB":  1e12,
+	"KIB": 1 << 10,
+	"MIB": 1 << 20,
+	"GIB": 1 << 30,
+	"TIB": 1 << 40,
+}
+
+// UnmarshalYAML parses a size with an optional unit
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	size, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// parseByteSize parses a size such as "1500", "1.5GB" or "512 MiB"
+func parseByteSize(value string) (ByteSize, error) {
+	value = strings.TrimSpace(value)
+	i := strings.IndexFunc(value, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(value)
+	}
+	number, err := strconv.ParseFloat(value[:i], 64)
+	unit, ok := byteUnits[strings.ToUpper(strings.TrimSpace(value[i:]))]
+	if err != nil || !ok || number < 0 {
+		return 0, fmt.Errorf("invalid size %q, use bytes or a unit such as MB or GiB", value)
+	}
+	return ByteSize(number * float64(unit)), nil
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// redactedValue replaces secrets in snapshots
+const redactedValue = "******"
+
+// secretKeys are the settings whose values Snapshot redacts. URLs such as
+// webhooks carry their credentials in the path.
+var secretKeys = map[string]bool{
+	"password":          true,
+	"token":             true,
+	"secret_id":         true,
+	"secret_access_key": true,
+	"session_token":     true,
+	"account_key":       true,
+	"connection_string": true,
+	"url":               true,
+	"webhook_url":       true,
+}
+
+// secretMapKeys are the maps whose values Snapshot redacts, keeping their
+// keys. HTTP headers commonly carry tokens and API keys.
+var secretMapKeys = map[string]bool{
+	"headers": true,
+}
+
+// Snapshot returns the settings in effect for the database with id dbID,
+// with defaults filled in, secrets redacted and unset settings left out
+func (c *Config) Snapshot(dbID string) yaml.MapSlice {
+	snapshot := *c
+	snapshot.Database = Database{}
+	snapshot.Databases = nil
+	for _, db := range c.Databases {
+		if db.ID == dbID {
+			snapshot.Databases = append(snapshot.Databases, db)
+		}
+	}
+	return snapshotValue(reflect.ValueOf(snapshot)).(yaml.MapSlice)
+}
+
+// snapshotValue converts v to what Snapshot writes for it
+func snapshotValue(v reflect.Value) interface{} {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		return time.Duration(v.Int()).String()
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return snapshotValue(v.Elem())
+	case reflect.Struct:
+		fields := yaml.MapSlice{}
+		snapshotFields(v, &fields)
+		return fields
+	case reflect.Slice, reflect.Array:
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = snapshotValue(v.Index(i))
+		}
+		return items
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		entries := yaml.MapSlice{}
+		for _, key := range keys {
+			entries = append(entries, yaml.MapItem{Key: key.Interface(), Value: snapshotValue(v.MapIndex(key))})
+		}
+		return entries
+	case reflect.String:
+		return redactURL(v.String())
+	default:
+		return v.Interface()
+	}
+}
+
+// snapshotFields appends the set fields of the struct v to fields under
+// their YAML names, merging inline structs
+func snapshotFields(v reflect.Value, fields *yaml.MapSlice) {
+	t := v.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		value := v.Field(i)
+		if options == "inline" {
+			snapshotFields(value, fields)
+			continue
+		}
+		if value.IsZero() {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		if secretKeys[name] {
+			*fields = append(*fields, yaml.MapItem{Key: name, Value: redactedValue})
+			continue
+		}
+		if secretMapKeys[name] && value.Kind() == reflect.Map {
+			*fields = append(*fields, yaml.MapItem{Key: name, Value: redactedMap(value)})
+			continue
+		}
+		*fields = append(*fields, yaml.MapItem{Key: name, Value: snapshotValue(value)})
+	}
+}
+
+// redactedMap returns the keys of the map v in order, each with its value
+// redacted
+func redactedMap(v reflect.Value) yaml.MapSlice {
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+	})
+	entries := yaml.MapSlice{}
+	for _, key := range keys {
+		entries = append(entries, yaml.MapItem{Key: key.Interface(), Value: redactedValue})
+	}
+	return entries
+}
+
+// redactURL redacts the password of a URL such as a DSN, returning other
+// values unchanged
+func redactURL(value string) string {
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+	return u.Redacted()
+}
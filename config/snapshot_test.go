@@ -0,0 +1,45 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestSnapshotRedactsSecrets(t *testing.T) {
+	config := &Config{Databases: []Database{
+		{ID: "app", Host: "db1", Password: "db-password"},
+		{ID: "other", Host: "db2"},
+	}}
+	config.Storage.Type = "azure"
+	config.Storage.Azure.Container = "backups"
+	config.Storage.Azure.ConnectionString = "DefaultEndpointsProtocol=https;AccountName=acct;AccountKey=azure-primary-key"
+	config.Storage.Archive.Type = "azure"
+	config.Storage.Archive.Azure.ConnectionString = "DefaultEndpointsProtocol=https;AccountName=cold;AccountKey=azure-archive-key"
+	config.Notifications.Webhook.Headers = map[string]string{
+		"Authorization": "Bearer webhook-token",
+		"X-Api-Key":     "webhook-api-key",
+	}
+	config.Tracing.Headers = map[string]string{"api-key": "tracing-api-key"}
+
+	data, err := yaml.Marshal(config.Snapshot("app"))
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	snapshot := string(data)
+
+	for _, secret := range []string{"db-password", "azure-primary-key", "azure-archive-key", "webhook-token", "webhook-api-key", "tracing-api-key"} {
+		if strings.Contains(snapshot, secret) {
+			t.Errorf("snapshot contains secret %q:\n%s", secret, snapshot)
+		}
+	}
+	for _, kept := range []string{"container: backups", "Authorization: '******'", "X-Api-Key: '******'", "api-key: '******'", "host: db1"} {
+		if !strings.Contains(snapshot, kept) {
+			t.Errorf("snapshot does not contain %q:\n%s", kept, snapshot)
+		}
+	}
+	if strings.Contains(snapshot, "db2") {
+		t.Errorf("snapshot contains another database:\n%s", snapshot)
+	}
+}
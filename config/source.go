@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Source policies, picking the server a database is dumped from
+const (
+	SourcePrimary       = "primary"        // always host and port
+	SourcePreferReplica = "prefer_replica" // the least lagging replica, else the primary
+	SourceReplicaOnly   = "replica_only"   // the least lagging replica, else fail the backup
+)
+
+// Source lists streaming replicas of a postgres database that backups can
+// be taken from instead of the primary configured by host and port
+type Source struct {
+	Policy   string    `yaml:"policy"` // defaults to prefer_replica when replicas are listed
+	Replicas []Replica `yaml:"replicas"`
+	// MaxLag skips replicas replaying changes further behind than this, 0
+	// for no limit
+	MaxLag time.Duration `yaml:"max_lag"`
+}
+
+// Replica is a server holding a streaming replica of the database
+type Replica struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"` // defaults to the database's port
+}
+
+// IsZero reports whether no source settings are configured
+func (s Source) IsZero() bool {
+	return s.Policy == "" && len(s.Replicas) == 0 && s.MaxLag == 0
+}
+
+// UsesReplicas reports whether backups may be taken from a replica
+func (s Source) UsesReplicas() bool {
+	return len(s.Replicas) > 0 && s.Policy != SourcePrimary
+}
+
+// validate fills in the default policy and checks the settings
+func (s *Source) validate() error {
+	if s.Policy == "" && len(s.Replicas) > 0 {
+		s.Policy = SourcePreferReplica
+	}
+	switch s.Policy {
+	case "", SourcePrimary:
+	case SourcePreferReplica, SourceReplicaOnly:
+		if len(s.Replicas) == 0 {
+			return fmt.Errorf("source policy %s needs replicas", s.Policy)
+		}
+	default:
+		return fmt.Errorf("unknown source policy %q (expected primary, prefer_replica or replica_only)", s.Policy)
+	}
+	if s.MaxLag < 0 {
+		return fmt.Errorf("source max_lag must not be negative")
+	}
+	for i, replica := range s.Replicas {
+		if replica.Host == "" {
+			return fmt.Errorf("source replica %d has no host", i+1)
+		}
+		if strings.HasPrefix(replica.Host, "-") {
+			return fmt.Errorf("invalid source replica host %q", replica.Host)
+		}
+		if replica.Port < 0 || replica.Port > 65535 {
+			return fmt.Errorf("invalid port %d of source replica %s", replica.Port, replica.Host)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SSH modes
+const (
+	SSHTunnel = "tunnel" // forward a local port to the database through the SSH host
+	SSHExec   = "exec"   // run the client programs on the SSH host
+)
+
+// SSH reaches a database through an SSH host, optionally via a bastion,
+// using the OpenSSH client in batch mode
+type SSH struct {
+	Host           string `yaml:"host"`
+	Port           int    `yaml:"port"` // defaults to 22
+	User           string `yaml:"user"`
+	KeyFile        string `yaml:"key_file"`
+	KnownHostsFile string `yaml:"known_hosts_file"`
+	// Bastion is a jump host, [user@]host[:port], the SSH host is reached
+	// through, as for ssh -J
+	Bastion string `yaml:"bastion"`
+	Mode    string `yaml:"mode"` // tunnel (default) or exec
+}
+
+// Enabled reports whether the database is reached over SSH
+func (s SSH) Enabled() bool {
+	return s.Host != ""
+}
+
+// Destination returns the SSH host as [user@]host
+func (s SSH) Destination() string {
+	if s.User != "" {
+		return s.User + "@" + s.Host
+	}
+	return s.Host
+}
+
+// validate fills in defaults and checks the settings
+func (s *SSH) validate() error {
+	if !s.Enabled() {
+		if *s != (SSH{}) {
+			return fmt.Errorf("ssh needs a host")
+		}
+		return nil
+	}
+	if s.Port == 0 {
+		s.Port = 22
+	}
+	if s.Mode == "" {
+		s.Mode = SSHTunnel
+	}
+	switch s.Mode {
+	case SSHTunnel, SSHExec:
+	default:
+		return fmt.Errorf("unknown ssh mode %q (expected tunnel or exec)", s.Mode)
+	}
+	if strings.HasPrefix(s.Host, "-") || strings.HasPrefix(s.Bastion, "-") {
+		return fmt.Errorf("invalid ssh host")
+	}
+	return nil
+}
@@ -0,0 +1,582 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// TOML number and date syntax; underscores may only separate digits
+var (
+	tomlInteger  = regexp.MustCompile(`^[+-]?(0|[1-9](_?[0-9])*)$`)
+	tomlHex      = regexp.MustCompile(`^0x[0-9A-Fa-f](_?[0-9A-Fa-f])*$`)
+	tomlOctal    = regexp.MustCompile(`^0o[0-7](_?[0-7])*$`)
+	tomlBinary   = regexp.MustCompile(`^0b[01](_?[01])*$`)
+	tomlFloat    = regexp.MustCompile(`^[+-]?(0|[1-9](_?[0-9])*)(\.[0-9](_?[0-9])*)?([eE][+-]?[0-9](_?[0-9])*)?$`)
+	tomlDateTime = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}([Tt ]\d{2}:\d{2}:\d{2}(\.\d+)?([Zz]|[+-]\d{2}:\d{2})?)?|\d{2}:\d{2}:\d{2}(\.\d+)?)$`)
+)
+
+// tomlParser parses a TOML document into nested maps, the way YAML
+// documents are decoded, so that the YAML field names and types apply to
+// TOML configs as well. Dates and times are kept as strings.
+type tomlParser struct {
+	src  string
+	pos  int
+	line int
+
+	root        map[string]interface{}
+	current     map[string]interface{} // table key/value pairs are added to
+	currentPath string                 // key path of current
+	// Tables and arrays are recorded by their key path, see tomlPath
+	defined map[string]bool // tables defined by a header or inline
+	inline  map[string]bool // inline tables and static arrays, complete as written
+}
+
+// parseTOML parses a TOML document
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("toml: document is not valid UTF-8")
+	}
+	p := &tomlParser{
+		src:     strings.TrimPrefix(string(data), "\ufeff"),
+		line:    1,
+		root:    make(map[string]interface{}),
+		defined: make(map[string]bool),
+		inline:  make(map[string]bool),
+	}
+	p.current = p.root
+	if err := p.parse(); err != nil {
+		return nil, fmt.Errorf("toml: line %d: %w", p.line, err)
+	}
+	return p.root, nil
+}
+
+// parse reads the document line by line
+func (p *tomlParser) parse() error {
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return nil
+		}
+		switch c := p.peek(); {
+		case c == '#' || c == '\n' || c == '\r':
+		case c == '[':
+			if err := p.parseHeader(); err != nil {
+				return err
+			}
+		default:
+			if err := p.parseKeyValue(p.current, p.currentPath); err != nil {
+				return err
+			}
+		}
+		if err := p.endOfLine(); err != nil {
+			return err
+		}
+	}
+}
+
+// parseHeader reads a [table] or [[array of tables]] header
+func (p *tomlParser) parseHeader() error {
+	p.pos++
+	array := p.consume("[")
+	p.skipSpace()
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	p.skipSpace()
+	closing := "]"
+	if array {
+		closing = "]]"
+	}
+	if !p.consume(closing) {
+		return fmt.Errorf("expected %s after table name", closing)
+	}
+
+	parent, parentPath, err := p.descend(p.root, "", keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	path := tomlPath(parentPath, last)
+	table := make(map[string]interface{})
+
+	if array {
+		switch existing := parent[last].(type) {
+		case nil:
+			parent[last] = []interface{}{table}
+			path = tomlIndex(path, 0)
+		case []interface{}:
+			if len(existing) == 0 || !isTable(existing[0]) || p.inline[path] {
+				return fmt.Errorf("%s is not an array of tables", strings.Join(keys, "."))
+			}
+			parent[last] = append(existing, table)
+			path = tomlIndex(path, len(existing))
+		default:
+			return fmt.Errorf("%s is already defined", strings.Join(keys, "."))
+		}
+	} else {
+		switch existing := parent[last].(type) {
+		case nil:
+			parent[last] = table
+		case map[string]interface{}:
+			// A table created implicitly by a dotted header may be defined
+			// once later
+			table = existing
+		default:
+			return fmt.Errorf("%s is already defined", strings.Join(keys, "."))
+		}
+		if p.defined[path] {
+			return fmt.Errorf("table %s is defined twice", strings.Join(keys, "."))
+		}
+	}
+	p.defined[path] = true
+	p.current = table
+	p.currentPath = path
+	return nil
+}
+
+// parseKeyValue reads key = value into table, found at the key path base
+func (p *tomlParser) parseKeyValue(table map[string]interface{}, base string) error {
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	p.skipSpace()
+	if !p.consume("=") {
+		return fmt.Errorf("expected = after key %s", strings.Join(keys, "."))
+	}
+	p.skipSpace()
+
+	parent, parentPath, err := p.descend(table, base, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if _, ok := parent[last]; ok {
+		return fmt.Errorf("key %s is defined twice", strings.Join(keys, "."))
+	}
+	value, err := p.parseValue(tomlPath(parentPath, last))
+	if err != nil {
+		return err
+	}
+	parent[last] = value
+	return nil
+}
+
+// descend returns the table the dotted keys name below table, found at the
+// key path base, and its key path, creating the missing tables. Through an
+// array of tables, its last table is used.
+func (p *tomlParser) descend(table map[string]interface{}, base string, keys []string) (map[string]interface{}, string, error) {
+	path := base
+	for i, key := range keys {
+		path = tomlPath(path, key)
+		switch next := table[key].(type) {
+		case nil:
+			created := make(map[string]interface{})
+			table[key] = created
+			table = created
+		case map[string]interface{}:
+			if p.inline[path] {
+				return nil, "", fmt.Errorf("%s is not a table", strings.Join(keys[:i+1], "."))
+			}
+			table = next
+		case []interface{}:
+			if len(next) == 0 || !isTable(next[len(next)-1]) || p.inline[path] {
+				return nil, "", fmt.Errorf("%s is not a table", strings.Join(keys[:i+1], "."))
+			}
+			table = next[len(next)-1].(map[string]interface{})
+			path = tomlIndex(path, len(next)-1)
+		default:
+			return nil, "", fmt.Errorf("%s is not a table", strings.Join(keys[:i+1], "."))
+		}
+	}
+	return table, path, nil
+}
+
+// parseKey reads a bare, quoted or dotted key
+func (p *tomlParser) parseKey() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpace()
+		var key string
+		switch c := p.peek(); {
+		case c == '"':
+			s, err := p.parseBasicString()
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		case c == '\'':
+			s, err := p.parseLiteralString()
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		default:
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			if p.pos == start {
+				return nil, fmt.Errorf("expected a key")
+			}
+			key = p.src[start:p.pos]
+		}
+		keys = append(keys, key)
+
+		p.skipSpace()
+		if !p.consume(".") {
+			return keys, nil
+		}
+	}
+}
+
+// parseValue reads a string, number, boolean, date, array or inline table
+// to be stored at the key path
+func (p *tomlParser) parseValue(path string) (interface{}, error) {
+	switch {
+	case p.eof():
+		return nil, fmt.Errorf("expected a value")
+	case strings.HasPrefix(p.src[p.pos:], `"""`):
+		return p.parseMultilineString(`"""`)
+	case strings.HasPrefix(p.src[p.pos:], `'''`):
+		return p.parseMultilineString(`'''`)
+	case p.peek() == '"':
+		return p.parseBasicString()
+	case p.peek() == '\'':
+		return p.parseLiteralString()
+	case p.peek() == '[':
+		return p.parseArray(path)
+	case p.peek() == '{':
+		return p.parseInlineTable(path)
+	}
+
+	start := p.pos
+	for !p.eof() && isScalarChar(p.peek()) {
+		p.pos++
+	}
+	// A space may separate the date and time of a date-time
+	if p.pos-start == 10 && strings.Count(p.src[start:p.pos], "-") == 2 &&
+		p.pos+1 < len(p.src) && p.src[p.pos] == ' ' && isDigit(p.src[p.pos+1]) {
+		p.pos++
+		for !p.eof() && isScalarChar(p.peek()) {
+			p.pos++
+		}
+	}
+	return parseTOMLScalar(p.src[start:p.pos])
+}
+
+// parseTOMLScalar converts a boolean, number or date
+func parseTOMLScalar(token string) (interface{}, error) {
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan", "+nan", "-nan":
+		return math.NaN(), nil
+	case "":
+		return nil, fmt.Errorf("expected a value")
+	}
+
+	digits := strings.ReplaceAll(token, "_", "")
+	switch {
+	case tomlInteger.MatchString(token):
+		return strconv.ParseInt(digits, 10, 64)
+	case tomlHex.MatchString(token):
+		return strconv.ParseInt(digits[2:], 16, 64)
+	case tomlOctal.MatchString(token):
+		return strconv.ParseInt(digits[2:], 8, 64)
+	case tomlBinary.MatchString(token):
+		return strconv.ParseInt(digits[2:], 2, 64)
+	case tomlFloat.MatchString(token):
+		return strconv.ParseFloat(digits, 64)
+	case tomlDateTime.MatchString(token):
+		return token, nil
+	}
+	return nil, fmt.Errorf("invalid value %q", token)
+}
+
+// parseArray reads an array, which may span several lines
+func (p *tomlParser) parseArray(path string) (interface{}, error) {
+	p.pos++
+	values := []interface{}{}
+	p.inline[path] = true
+	for {
+		p.skipBlank()
+		if p.consume("]") {
+			return values, nil
+		}
+		value, err := p.parseValue(tomlIndex(path, len(values)))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		p.skipBlank()
+		if p.consume("]") {
+			return values, nil
+		}
+		if !p.consume(",") {
+			return nil, fmt.Errorf("expected , or ] in array")
+		}
+	}
+}
+
+// parseInlineTable reads a { key = value, ... } table on one line
+func (p *tomlParser) parseInlineTable(path string) (interface{}, error) {
+	p.pos++
+	table := make(map[string]interface{})
+	p.skipSpace()
+	if p.consume("}") {
+		p.defined[path] = true
+		p.inline[path] = true
+		return table, nil
+	}
+	for {
+		if err := p.parseKeyValue(table, path); err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.consume("}") {
+			p.defined[path] = true
+			p.inline[path] = true
+			return table, nil
+		}
+		if !p.consume(",") {
+			return nil, fmt.Errorf("expected , or } in inline table")
+		}
+		p.skipSpace()
+	}
+}
+
+// parseBasicString reads a "string" with escapes
+func (p *tomlParser) parseBasicString() (string, error) {
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", fmt.Errorf("unterminated string")
+		}
+		c := p.src[p.pos]
+		switch c {
+		case '"':
+			p.pos++
+			return b.String(), nil
+		case '\\':
+			if err := p.parseEscape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+// parseLiteralString reads a 'string' without escapes
+func (p *tomlParser) parseLiteralString() (string, error) {
+	p.pos++
+	end := strings.IndexAny(p.src[p.pos:], "'\n")
+	if end < 0 || p.src[p.pos+end] != '\'' {
+		return "", fmt.Errorf("unterminated string")
+	}
+	s := p.src[p.pos : p.pos+end]
+	p.pos += end + 1
+	return s, nil
+}
+
+// parseMultilineString reads a multi-line basic or literal string. A
+// newline right after the opening quotes is dropped, and in basic strings
+// a backslash at the end of a line joins it with the next non-blank text.
+func (p *tomlParser) parseMultilineString(quotes string) (string, error) {
+	p.pos += 3
+	if p.consume("\r\n") || p.consume("\n") {
+		p.line++
+	}
+
+	var b strings.Builder
+	for {
+		if p.eof() {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if strings.HasPrefix(p.src[p.pos:], quotes) {
+			// Up to two quotes may directly precede the closing ones
+			n := 3
+			for n < 5 && p.pos+n < len(p.src) && p.src[p.pos+n] == quotes[0] {
+				n++
+			}
+			b.WriteString(p.src[p.pos : p.pos+n-3])
+			p.pos += n
+			return b.String(), nil
+		}
+
+		c := p.src[p.pos]
+		switch {
+		case c == '\\' && quotes == `"""`:
+			rest := strings.TrimLeft(p.src[p.pos+1:], " \t")
+			if strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r\n") {
+				p.pos = len(p.src) - len(rest)
+				for !p.eof() && strings.ContainsRune(" \t\r\n", rune(p.peek())) {
+					if p.peek() == '\n' {
+						p.line++
+					}
+					p.pos++
+				}
+				continue
+			}
+			if err := p.parseEscape(&b); err != nil {
+				return "", err
+			}
+		default:
+			if c == '\n' {
+				p.line++
+			}
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+// parseEscape reads the escape sequence at a backslash in a basic string
+func (p *tomlParser) parseEscape(b *strings.Builder) error {
+	if p.pos+1 >= len(p.src) {
+		return fmt.Errorf("unterminated string")
+	}
+	c := p.src[p.pos+1]
+	p.pos += 2
+	switch c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case 'e':
+		b.WriteByte(0x1b)
+	case '"':
+		b.WriteByte('"')
+	case '\\':
+		b.WriteByte('\\')
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.src) {
+			return fmt.Errorf("invalid unicode escape")
+		}
+		code, err := strconv.ParseUint(p.src[p.pos:p.pos+n], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return fmt.Errorf("invalid unicode escape \\%c%s", c, p.src[p.pos:p.pos+n])
+		}
+		b.WriteRune(rune(code))
+		p.pos += n
+	default:
+		return fmt.Errorf("invalid escape \\%c", c)
+	}
+	return nil
+}
+
+// endOfLine checks that only a comment follows on the current line and
+// moves to the next one
+func (p *tomlParser) endOfLine() error {
+	p.skipSpace()
+	if !p.eof() && p.peek() == '#' {
+		for !p.eof() && p.peek() != '\n' {
+			p.pos++
+		}
+	}
+	switch {
+	case p.eof():
+		return nil
+	case p.consume("\r\n"), p.consume("\n"):
+		p.line++
+		return nil
+	}
+	return fmt.Errorf("unexpected %q", p.peek())
+}
+
+// skipSpace skips spaces and tabs
+func (p *tomlParser) skipSpace() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+// skipBlank skips whitespace, newlines and comments, as allowed in arrays
+func (p *tomlParser) skipBlank() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r':
+			p.pos++
+		case '\n':
+			p.line++
+			p.pos++
+		case '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *tomlParser) peek() byte {
+	return p.src[p.pos]
+}
+
+// consume skips s if the input continues with it
+func (p *tomlParser) consume(s string) bool {
+	if strings.HasPrefix(p.src[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || isDigit(c) || c == '_' || c == '-'
+}
+
+func isScalarChar(c byte) bool {
+	return isBareKeyChar(c) || c == '+' || c == '.' || c == ':'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isTable reports whether v is a table
+func isTable(v interface{}) bool {
+	_, ok := v.(map[string]interface{})
+	return ok
+}
+
+// tomlPath appends a key to a key path. Paths identify tables and arrays
+// for the record of definitions, which cannot be redefined or extended.
+func tomlPath(base, key string) string {
+	return base + "." + strconv.Quote(key)
+}
+
+// tomlIndex appends an array index to a key path
+func tomlIndex(base string, i int) string {
+	return base + "[" + strconv.Itoa(i) + "]"
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want map[string]interface{}
+	}{
+		{
+			name: "empty",
+			doc:  "# only a comment\n\n",
+			want: map[string]interface{}{},
+		},
+		{
+			name: "scalars",
+			doc: `bool = true
+int = -1_000
+hex = 0xff
+octal = 0o17
+binary = 0b101
+float = 1.5e3
+date = 2024-01-02
+datetime = 2024-01-02 03:04:05Z
+time = 07:08:09
+`,
+			want: map[string]interface{}{
+				"bool": true, "int": int64(-1000), "hex": int64(255), "octal": int64(15), "binary": int64(5),
+				"float": 1500.0, "date": "2024-01-02", "datetime": "2024-01-02 03:04:05Z", "time": "07:08:09",
+			},
+		},
+		{
+			name: "strings",
+			doc: `basic = "a\tb \u00e9 \"q\""
+literal = 'C:\path'
+multi = """
+one \
+    two"""
+raw = '''
+line
+'''
+quotes = """say ""hi"""""
+`,
+			want: map[string]interface{}{
+				"basic": "a\tb é \"q\"", "literal": `C:\path`, "multi": "one two", "raw": "line\n", "quotes": `say ""hi""`,
+			},
+		},
+		{
+			name: "dotted and quoted keys",
+			doc:  "a.b = 1\na.\"c d\" = 2\n'e.f' = 3\n",
+			want: map[string]interface{}{
+				"a":   map[string]interface{}{"b": int64(1), "c d": int64(2)},
+				"e.f": int64(3),
+			},
+		},
+		{
+			name: "tables",
+			doc:  "top = 1\n[storage]\ntype = \"s3\"\n[storage.s3]\nbucket = \"b\" # comment\n",
+			want: map[string]interface{}{
+				"top": int64(1),
+				"storage": map[string]interface{}{
+					"type": "s3",
+					"s3":   map[string]interface{}{"bucket": "b"},
+				},
+			},
+		},
+		{
+			name: "implicit table defined later",
+			doc:  "[a.b]\nx = 1\n[a]\ny = 2\n",
+			want: map[string]interface{}{
+				"a": map[string]interface{}{"b": map[string]interface{}{"x": int64(1)}, "y": int64(2)},
+			},
+		},
+		{
+			name: "arrays of tables",
+			doc:  "[[databases]]\nname = \"a\"\n[databases.pg_dump]\nno_owner = true\n[[databases]]\nname = \"b\"\n",
+			want: map[string]interface{}{
+				"databases": []interface{}{
+					map[string]interface{}{"name": "a", "pg_dump": map[string]interface{}{"no_owner": true}},
+					map[string]interface{}{"name": "b"},
+				},
+			},
+		},
+		{
+			name: "arrays and inline tables",
+			doc:  "list = [\n  1, # one\n  2,\n]\nempty = []\nnested = [[1], ['x']]\npoint = { x = 1, y.z = 2 }\n",
+			want: map[string]interface{}{
+				"list":   []interface{}{int64(1), int64(2)},
+				"empty":  []interface{}{},
+				"nested": []interface{}{[]interface{}{int64(1)}, []interface{}{"x"}},
+				"point":  map[string]interface{}{"x": int64(1), "y": map[string]interface{}{"z": int64(2)}},
+			},
+		},
+		{
+			name: "arrays of tables next to empty arrays",
+			doc:  "a = []\nb = []\n[[c]]\nx = []\n[[c]]\nx = 1\n[c.d]\ny = 2\n",
+			want: map[string]interface{}{
+				"a": []interface{}{},
+				"b": []interface{}{},
+				"c": []interface{}{
+					map[string]interface{}{"x": []interface{}{}},
+					map[string]interface{}{"x": int64(1), "d": map[string]interface{}{"y": int64(2)}},
+				},
+			},
+		},
+		{
+			name: "byte order mark and CRLF",
+			doc:  "\ufeffa = 1\r\nb = 2\r\n",
+			want: map[string]interface{}{"a": int64(1), "b": int64(2)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML([]byte(tt.doc))
+			if err != nil {
+				t.Fatalf("parseTOML() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTOML() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLSpecialFloats(t *testing.T) {
+	got, err := parseTOML([]byte("a = inf\nb = -inf\nc = nan\n"))
+	if err != nil {
+		t.Fatalf("parseTOML() error = %v", err)
+	}
+	if !math.IsInf(got["a"].(float64), 1) || !math.IsInf(got["b"].(float64), -1) || !math.IsNaN(got["c"].(float64)) {
+		t.Errorf("parseTOML() = %v, want inf, -inf and nan", got)
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{"invalid UTF-8", "a = \"\xff\"", "not valid UTF-8"},
+		{"duplicate key", "a = 1\na = 2\n", "line 2: key a is defined twice"},
+		{"duplicate table", "[a]\n[a]\n", "table a is defined twice"},
+		{"key over table", "a = 1\n[a]\n", "a is already defined"},
+		{"extending an inline table", "a = { b = 1 }\n[a.c]\n", "a is not a table"},
+		{"extending a static array", "a = [{ b = 1 }]\n[[a]]\n", "a is not an array of tables"},
+		{"extending a static array with a trailing comma", "a = [{ b = 1 },]\n[a.c]\n", "a is not a table"},
+		{"extending an inline table by a dotted key", "a = { b = 1 }\na.c = 2\n", "a is not a table"},
+		{"extending an empty static array", "a = []\nb = []\n[[b]]\n", "b is not an array of tables"},
+		{"extending a nested inline table", "a = { b = { c = 1 } }\n[a.b.d]\n", "a is not a table"},
+		{"extending an inline table within one", "a = { b = { c = 1 }, b.d = 2 }\n", "b is not a table"},
+		{"redefining an inline table in an array of tables", "[[a]]\nb = {}\n[[a]]\nb = {}\n[a.b]\n", "table a.b is defined twice"},
+		{"missing equals", "a 1\n", "expected = after key a"},
+		{"missing value", "a =\n", "expected a value"},
+		{"leading zero", "a = 01\n", `invalid value "01"`},
+		{"stray underscore", "a = 1__0\n", `invalid value "1__0"`},
+		{"unterminated string", "a = \"abc\nb = 1\n", "unterminated string"},
+		{"unterminated multi-line string", "a = '''abc\n", "unterminated string"},
+		{"invalid escape", `a = "\q"`, `invalid escape \q`},
+		{"invalid unicode escape", `a = "\uD800"`, "invalid unicode escape"},
+		{"unclosed header", "[a\n", "expected ] after table name"},
+		{"trailing text", "a = 1 b\n", `unexpected 'b'`},
+		{"unclosed array", "a = [1 2]\n", "expected , or ] in array"},
+		{"unclosed inline table", "a = { b = 1 c }\n", "expected , or } in inline table"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTOML([]byte(tt.doc))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseTOML() error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
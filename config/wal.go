@@ -0,0 +1,52 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// WAL archiving modes
+const (
+	WALReceive = "receivewal" // stream WAL with pg_receivewal
+	WALArchive = "archive"    // pick up segments archive_command copies into a directory
+)
+
+// WAL enables continuous WAL archiving alongside periodic base
+// backups, allowing a restore to any point in time covered by the archive
+type WAL struct {
+	Mode                string        `yaml:"mode"`                  // receivewal or archive, empty disables WAL archiving
+	Slot                string        `yaml:"slot"`                  // replication slot for pg_receivewal, created if missing
+	ArchiveDir          string        `yaml:"archive_dir"`           // where archive_command puts segments in archive mode
+	BaseBackupFrequency time.Duration `yaml:"base_backup_frequency"` // defaults to 24h
+	PollInterval        time.Duration `yaml:"poll_interval"`         // how often new segments are archived, defaults to 10s
+}
+
+// Enabled reports whether WAL archiving is configured
+func (w WAL) Enabled() bool {
+	return w.Mode != ""
+}
+
+// validate checks the mode and fills in defaults
+func (w *WAL) validate() error {
+	switch w.Mode {
+	case "":
+		return nil
+	case WALReceive:
+	case WALArchive:
+		if w.ArchiveDir == "" {
+			return fmt.Errorf("wal archive mode needs an archive_dir")
+		}
+	default:
+		return fmt.Errorf("unknown wal mode %q", w.Mode)
+	}
+	if w.BaseBackupFrequency < 0 || w.PollInterval < 0 {
+		return fmt.Errorf("wal intervals must not be negative")
+	}
+	if w.BaseBackupFrequency == 0 {
+		w.BaseBackupFrequency = 24 * time.Hour
+	}
+	if w.PollInterval == 0 {
+		w.PollInterval = 10 * time.Second
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Install writes s's systemd unit file, to the system's unit directory or
+// the current user's, and prints how to enable it
+func Install(w io.Writer, s Service) error {
+	dir := "/etc/systemd/system"
+	systemctl := "systemctl"
+	if s.PerUser {
+		config, err := os.UserConfigDir()
+		if err != nil {
+			return err
+		}
+		dir = filepath.Join(config, "systemd", "user")
+		systemctl = "systemctl --user"
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create unit directory: %w", err)
+	}
+
+	path := filepath.Join(dir, s.Name+".service")
+	if err := os.WriteFile(path, []byte(SystemdUnit(s)), 0644); err != nil {
+		return fmt.Errorf("failed to write unit file: %w", err)
+	}
+	fmt.Fprintf(w, "Wrote %s\nEnable and start it with:\n  %s daemon-reload\n  %s enable --now %s\n", path, systemctl, systemctl, s.Name)
+	return nil
+}
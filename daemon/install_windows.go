@@ -0,0 +1,43 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Install registers s with the Windows service control manager, starting
+// automatically and restarting after failures, and prints how to start it
+func Install(w io.Writer, s Service) error {
+	quoted := make([]string, len(s.Args))
+	for i, arg := range s.Args {
+		quoted[i] = syscall.EscapeArg(arg)
+	}
+
+	create := []string{"create", s.Name, "binPath=", strings.Join(quoted, " "), "start=", "auto", "DisplayName=", s.Description}
+	if s.User != "" {
+		create = append(create, "obj=", s.User)
+	}
+	if err := sc(create...); err != nil {
+		return err
+	}
+	if err := sc("description", s.Name, s.Description); err != nil {
+		return err
+	}
+	if err := sc("failure", s.Name, "reset=", "86400", "actions=", "restart/30000/restart/30000/restart/30000"); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Registered service %s\nStart it with:\n  sc.exe start %s\n", s.Name, s.Name)
+	return nil
+}
+
+// sc runs sc.exe with args
+func sc(args ...string) error {
+	out, err := exec.Command("sc.exe", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("sc.exe %s failed: %w, output: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
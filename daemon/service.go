@@ -0,0 +1,62 @@
+package daemon
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// watchdogTimeout is how long systemd waits for a WATCHDOG=1 notification
+// before restarting a generated unit
+const watchdogTimeout = 2 * time.Minute
+
+// Service describes how a service manager runs beackup
+type Service struct {
+	Name        string
+	Description string
+	Args        []string      // absolute path of the program and its arguments
+	User        string        // account a system service runs as, empty for the manager's default
+	PerUser     bool          // a systemd user service rather than a system one
+	StopTimeout time.Duration // how long stopping may take before the process is killed
+}
+
+// SystemdUnit renders a unit file running s with Type=notify. Only the main
+// process is signalled on stop, so running dumps are left to finish within
+// the grace period rather than being terminated along with it.
+func SystemdUnit(s Service) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\nDescription=%s\n", s.Description)
+	if !s.PerUser {
+		b.WriteString("Wants=network-online.target\nAfter=network-online.target\n")
+	}
+
+	quoted := make([]string, len(s.Args))
+	for i, arg := range s.Args {
+		quoted[i] = systemdQuote(arg)
+	}
+	b.WriteString("\n[Service]\nType=notify\nNotifyAccess=main\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(quoted, " "))
+	b.WriteString("ExecReload=/bin/kill -HUP $MAINPID\n")
+	if s.User != "" && !s.PerUser {
+		fmt.Fprintf(&b, "User=%s\n", s.User)
+	}
+	b.WriteString("Restart=on-failure\nRestartSec=30s\n")
+	fmt.Fprintf(&b, "WatchdogSec=%d\n", int(watchdogTimeout.Seconds()))
+	b.WriteString("KillMode=mixed\n")
+	fmt.Fprintf(&b, "TimeoutStopSec=%d\n", int(s.StopTimeout.Seconds()))
+
+	b.WriteString("\n[Install]\n")
+	if s.PerUser {
+		b.WriteString("WantedBy=default.target\n")
+	} else {
+		b.WriteString("WantedBy=multi-user.target\n")
+	}
+	return b.String()
+}
+
+// systemdQuote quotes s as a single word of a systemd command line, with
+// specifiers and variables escaped
+func systemdQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(s)
+	return `"` + s + `"`
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package daemon
+
+import (
+	"context"
+	"time"
+)
+
+// RunService reports that the process was not started by the Windows
+// service control manager, which it never is on this platform
+func RunService(name string, stopTimeout time.Duration, run func(context.Context) error) (bool, error) {
+	return false, nil
+}
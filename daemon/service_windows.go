@@ -0,0 +1,149 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	advapi32                          = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerExW = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus              = advapi32.NewProc("SetServiceStatus")
+)
+
+// Service control manager constants, from winsvc.h and winerror.h
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped     = 1
+	serviceStopPending = 3
+	serviceRunning     = 4
+
+	serviceAcceptStop     = 0x1
+	serviceAcceptShutdown = 0x4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+
+	errorCallNotImplemented             = 120
+	errorServiceSpecificError           = 1066
+	errorFailedServiceControllerConnect = syscall.Errno(1063)
+)
+
+// serviceStatus is SERVICE_STATUS
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+// serviceTableEntry is SERVICE_TABLE_ENTRYW
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// windowsService is the service being run. The control manager's callbacks
+// cannot carry Go values, so there is one per process.
+type windowsService struct {
+	name        string
+	stopTimeout time.Duration
+	run         func(context.Context) error
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	mu     sync.Mutex
+	handle uintptr
+	err    error
+}
+
+var current *windowsService
+
+// RunService runs run as the Windows service name if the process was
+// started by the service control manager, returning false otherwise. run's
+// context is cancelled when the service is stopped or the system shuts
+// down, and stopping may take up to stopTimeout.
+func RunService(name string, stopTimeout time.Duration, run func(context.Context) error) (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	current = &windowsService{name: name, stopTimeout: stopTimeout, run: run, ctx: ctx, cancel: cancel}
+
+	namePtr, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return false, err
+	}
+	table := []serviceTableEntry{
+		{name: namePtr, proc: syscall.NewCallback(serviceMain)},
+		{},
+	}
+	// Blocks until the service has stopped
+	r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0])))
+	if r == 0 {
+		if errors.Is(err, errorFailedServiceControllerConnect) {
+			return false, nil
+		}
+		return true, fmt.Errorf("failed to start service dispatcher: %w", err)
+	}
+	return true, current.err
+}
+
+// serviceMain is the ServiceMain function of the service
+func serviceMain(argc, argv uintptr) uintptr {
+	s := current
+	namePtr, _ := syscall.UTF16PtrFromString(s.name)
+	handle, _, err := procRegisterServiceCtrlHandlerExW.Call(uintptr(unsafe.Pointer(namePtr)), syscall.NewCallback(serviceHandler), 0)
+	if handle == 0 {
+		s.err = fmt.Errorf("failed to register service control handler: %w", err)
+		return 0
+	}
+	s.mu.Lock()
+	s.handle = handle
+	s.mu.Unlock()
+
+	s.setStatus(serviceRunning, serviceAcceptStop|serviceAcceptShutdown, 0)
+	s.err = s.run(s.ctx)
+	s.setStatus(serviceStopped, 0, 0)
+	return 0
+}
+
+// serviceHandler is the HandlerEx function of the service
+func serviceHandler(control, eventType, eventData, context uintptr) uintptr {
+	s := current
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		s.setStatus(serviceStopPending, 0, s.stopTimeout)
+		s.cancel()
+	case serviceControlInterrogate:
+	default:
+		return errorCallNotImplemented
+	}
+	return 0
+}
+
+// setStatus reports the service's state to the control manager
+func (s *windowsService) setStatus(state, accepted uint32, waitHint time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := serviceStatus{
+		serviceType:      serviceWin32OwnProcess,
+		currentState:     state,
+		controlsAccepted: accepted,
+		waitHint:         uint32(waitHint.Milliseconds()),
+	}
+	if state == serviceStopped && s.err != nil {
+		status.win32ExitCode = errorServiceSpecificError
+		status.serviceSpecificExitCode = 1
+	}
+	procSetServiceStatus.Call(s.handle, uintptr(unsafe.Pointer(&status)))
+}
@@ -1,258 +1,708 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
-	"gopkg.in/yaml.v2"
+	"beackup/backup"
+	"beackup/config"
+	"beackup/daemon"
 )
 
-// Config represents the backup configuration
-type Config struct {
-	Database struct {
-		Host     string `yaml:"host"`
-		Port     int    `yaml:"port"`
-		Name     string `yaml:"name"`
-		User     string `yaml:"user"`
-		Password string `yaml:"password"`
-	} `yaml:"database"`
-	Backup struct {
-		OutputDir string        `yaml:"output_dir"`
-		Frequency time.Duration `yaml:"frequency"`
-		Retention int           `yaml:"retention_days"`
-		Format    string        `yaml:"format"` // custom, plain, tar, directory
-	} `yaml:"backup"`
-	Logging struct {
-		Level    string `yaml:"level"`
-		FilePath string `yaml:"file_path"`
-	} `yaml:"logging"`
-}
+// serviceName is the default name of the installed service
+const serviceName = "beackup"
+
+// serviceStopMargin is how much longer than the shutdown grace period a
+// service manager waits for beackup to stop
+const serviceStopMargin = time.Minute
+
+// Exit codes of the commands, documented in usage
+const (
+	exitFailure       = 1
+	exitConfigInvalid = 2
+	exitDumpFailed    = 3
+	exitUploadFailed  = 4
+	exitVerifyFailed  = 5
+)
+
+const usage = `Usage: beackup [-dry-run] <config-file>
+       beackup backup [-db <id>] [-output json] <config-file>
+       beackup check [-output json] <config-file>
+       beackup list [-output json] <config-file>
+       beackup info <config-file> <backup>
+       beackup show-config <config-file> <backup>
+       beackup audit [-output json] <config-file>
+       beackup diff <config-file> <backup-a> <backup-b>
+       beackup report [-json] <config-file>
+       beackup history [-db <id>] [-limit <n>] [-json] <config-file>
+       beackup latest [-json] <config-file> <db-id>
+       beackup gc [-dry-run] <config-file>
+       beackup restore [-db <id>] [-data-dir <dir> [-target-time <time>]] [-table <name>]... [-output json] <config-file> <backup>
+       beackup clone [-backup <name>] [-keep-existing] [-no-owner] [-no-privileges] [-role-map <old>=<new>]... <config-file> <source-db-id> <target-db-id>
+       beackup wal-fetch <config-file> <db-id> <wal-file> <destination>
+       beackup install-service [-name <name>] [-user] [-run-as <account>] [-print] <config-file>
+
+The config file is YAML, or JSON or TOML by its extension. Any config field
+can be overridden with a --<field>=<value> flag, such as --backup.output_dir
+or --databases.0.host, or a BEACKUP_<FIELD> environment variable, such as
+BEACKUP_BACKUP_OUTPUT_DIR. Flags take precedence over the environment.
+
+"beackup audit" checks the signatures and checksums of every backup in
+the catalog, and fails when signing is configured and the catalog or its
+signature is missing or bad. The catalog is rebuilt from the manifests on
+disk after each backup, so once another backup ran, a backup deleted along
+with its manifest is no longer listed and the audit cannot report it.
+
+"beackup backup" backs up every database, or the one given, once and
+exits. With -output json, backup, check, list, audit and restore print their
+results as JSON on standard output and log to standard error. Commands
+exit with status
+  0  on success
+  1  on usage errors, failed checks, failed restores and other failures
+  2  if the config is invalid
+  3  if a dump failed or was incomplete
+  4  if an upload failed
+  5  if a backup failed verification or an audit
+When backups of several databases fail differently, the lowest of 3, 4
+and 5 applies.`
+
+func main() {
+	overrides, args, err := config.ParseOverrides(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(args) < 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "backup":
+		runBackupCommand(args[1:], overrides)
+		return
+	case "list":
+		runListCommand(args[1:], overrides)
+		return
+	case "info":
+		runInfoCommand(args[1:], overrides)
+		return
+	case "show-config":
+		runShowConfigCommand(args[1:], overrides)
+		return
+	case "audit":
+		runAuditCommand(args[1:], overrides)
+		return
+	case "diff":
+		runDiffCommand(args[1:], overrides)
+		return
+	case "report":
+		runReportCommand(args[1:], overrides)
+		return
+	case "history":
+		runHistoryCommand(args[1:], overrides)
+		return
+	case "latest":
+		runLatestCommand(args[1:], overrides)
+		return
+	case "gc":
+		runGCCommand(args[1:], overrides)
+		return
+	case "restore":
+		runRestoreCommand(args[1:], overrides)
+		return
+	case "clone":
+		runCloneCommand(args[1:], overrides)
+		return
+	case "wal-fetch":
+		runWALFetchCommand(args[1:], overrides)
+		return
+	case "check":
+		runCheckCommand(args[1:], overrides)
+		return
+	case "install-service":
+		runInstallServiceCommand(args[1:], overrides)
+		return
+	}
+
+	flags := flag.NewFlagSet("beackup", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print what the next backups would do without running them")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	configPath := flags.Arg(0)
+
+	tool, err := backup.New(configPath, overrides...)
+	if err != nil {
+		exit(false, exitConfigInvalid, "Failed to create backup tool", err)
+	}
+
+	// Under the Windows service control manager, stopping the service
+	// shuts down like a signal does
+	stopTimeout := tool.Options().GracePeriod + serviceStopMargin
+	if ran, err := daemon.RunService(serviceName, stopTimeout, tool.Start); ran {
+		if err != nil {
+			log.Fatalf("Backup tool failed: %v", err)
+		}
+		return
+	}
 
-// BackupTool handles the backup operations
-type BackupTool struct {
-	config *Config
-	logger *log.Logger
+	// Handle graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *dryRun {
+		if err := tool.DryRun(ctx, os.Stdout); err != nil {
+			log.Fatalf("Dry run failed: %v", err)
+		}
+		return
+	}
+
+	if err := tool.Start(ctx); err != nil {
+		log.Fatalf("Backup tool failed: %v", err)
+	}
 }
 
-// NewBackupTool creates a new backup tool instance
-func NewBackupTool(configPath string) (*BackupTool, error) {
-	config, err := loadConfig(configPath)
+// runBackupCommand implements the backup subcommand
+func runBackupCommand(args []string, overrides []config.Override) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	dbID := flags.String("db", "", "id of the database to back up instead of all")
+	output := outputFlag(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Println(usage)
+		os.Exit(exitFailure)
+	}
+	asJSON := parseOutput(*output)
+
+	tool, err := backup.New(flags.Arg(0), jsonOverrides(asJSON, overrides)...)
+	if err != nil {
+		exit(asJSON, exitConfigInvalid, "Failed to create backup tool", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	results, err := tool.RunOnce(ctx, *dbID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load config: %w", err)
+		exit(asJSON, exitFailure, "Backup failed", err)
 	}
+	if err := backup.PrintBackupResults(os.Stdout, results, asJSON); err != nil {
+		log.Fatal(err)
+	}
+
+	var errs []error
+	for _, r := range results {
+		errs = append(errs, r.Err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		os.Exit(backupExitCode(err))
+	}
+}
 
-	logger := setupLogger(config)
+// runListCommand implements the list subcommand
+func runListCommand(args []string, overrides []config.Override) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	output := outputFlag(flags)
+	flags.Parse(args)
 
-	return &BackupTool{
-		config: config,
-		logger: logger,
-	}, nil
+	if flags.NArg() != 1 {
+		fmt.Println(usage)
+		os.Exit(exitFailure)
+	}
+	asJSON := parseOutput(*output)
+
+	cfg, err := backup.LoadConfig(flags.Arg(0), overrides...)
+	if err != nil {
+		exit(asJSON, exitConfigInvalid, "Failed to load config", err)
+	}
+	if err := backup.List(os.Stdout, cfg, asJSON); err != nil {
+		exit(asJSON, exitFailure, "List failed", err)
+	}
 }
 
-// loadConfig reads and parses the configuration file
-func loadConfig(configPath string) (*Config, error) {
-	data, err := os.ReadFile(configPath)
+// runInfoCommand implements the info subcommand
+func runInfoCommand(args []string, overrides []config.Override) {
+	if len(args) != 2 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	cfg, err := backup.LoadConfig(args[0], overrides...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+		exit(false, exitConfigInvalid, "Failed to load config", err)
+	}
+	if err := backup.Info(os.Stdout, cfg, args[1]); err != nil {
+		log.Fatal(err)
 	}
+}
 
-	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config: %w", err)
+// runShowConfigCommand implements the show-config subcommand, which prints
+// the versions and configuration a backup was made with
+func runShowConfigCommand(args []string, overrides []config.Override) {
+	if len(args) != 2 {
+		fmt.Println(usage)
+		os.Exit(1)
 	}
 
-	// Set defaults
-	if config.Database.Host == "" {
-		config.Database.Host = "localhost"
+	cfg, err := backup.LoadConfig(args[0], overrides...)
+	if err != nil {
+		exit(false, exitConfigInvalid, "Failed to load config", err)
 	}
-	if config.Database.Port == 0 {
-		config.Database.Port = 5432
+	if err := backup.ShowConfig(os.Stdout, cfg, args[1]); err != nil {
+		log.Fatal(err)
 	}
-	if config.Backup.Format == "" {
-		config.Backup.Format = "custom"
+}
+
+// runAuditCommand implements the audit subcommand, which checks the
+// signatures and checksums of every backup in the catalog
+func runAuditCommand(args []string, overrides []config.Override) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	output := outputFlag(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Println(usage)
+		os.Exit(exitFailure)
 	}
-	if config.Backup.Retention == 0 {
-		config.Backup.Retention = 7
+	asJSON := parseOutput(*output)
+
+	tool, err := backup.New(flags.Arg(0), jsonOverrides(asJSON, overrides)...)
+	if err != nil {
+		exit(asJSON, exitConfigInvalid, "Failed to create backup tool", err)
 	}
 
-	return &config, nil
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = tool.Audit(ctx, os.Stdout, asJSON)
+	switch {
+	case errors.Is(err, backup.ErrAuditFailed) && asJSON:
+		// The problems are part of the results printed
+		os.Exit(exitVerifyFailed)
+	case errors.Is(err, backup.ErrAuditFailed), errors.Is(err, backup.ErrCatalogUnverified):
+		exit(asJSON, exitVerifyFailed, "Audit failed", err)
+	case err != nil:
+		exit(asJSON, exitFailure, "Audit failed", err)
+	}
 }
 
-// setupLogger configures logging based on config
-func setupLogger(config *Config) *log.Logger {
-	var output *os.File = os.Stdout
+// runDiffCommand implements the diff subcommand
+func runDiffCommand(args []string, overrides []config.Override) {
+	if len(args) != 3 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
 
-	if config.Logging.FilePath != "" {
-		var err error
-		output, err = os.OpenFile(config.Logging.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-		if err != nil {
-			log.Printf("Failed to open log file, using stdout: %v", err)
-			output = os.Stdout
-		}
+	tool, err := backup.New(args[0], overrides...)
+	if err != nil {
+		exit(false, exitConfigInvalid, "Failed to create backup tool", err)
 	}
 
-	return log.New(output, "[BACKUP] ", log.LstdFlags|log.Lshortfile)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := tool.Diff(ctx, os.Stdout, args[1], args[2]); err != nil {
+		log.Fatalf("Diff failed: %v", err)
+	}
 }
 
-// Start begins the periodic backup process
-func (bt *BackupTool) Start() error {
-	bt.logger.Println("Starting backup tool...")
+// runReportCommand implements the report subcommand
+func runReportCommand(args []string, overrides []config.Override) {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the report as the JSON webhooks receive")
+	flags.Parse(args)
 
-	// Ensure output directory exists
-	if err := os.MkdirAll(bt.config.Backup.OutputDir, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
+	if flags.NArg() != 1 {
+		fmt.Println(usage)
+		os.Exit(1)
 	}
 
-	// Run initial backup
-	if err := bt.performBackup(); err != nil {
-		bt.logger.Printf("Initial backup failed: %v", err)
+	cfg, err := backup.LoadConfig(flags.Arg(0), overrides...)
+	if err != nil {
+		exit(false, exitConfigInvalid, "Failed to load config", err)
 	}
+	if err := backup.Report(os.Stdout, cfg, *asJSON); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	// Set up periodic backups
-	ticker := time.NewTicker(bt.config.Backup.Frequency)
-	defer ticker.Stop()
+// runHistoryCommand implements the history subcommand
+func runHistoryCommand(args []string, overrides []config.Override) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	db := flags.String("db", "", "only show the runs of the database with this id")
+	limit := flags.Int("limit", 50, "show at most this many runs, 0 for all")
+	asJSON := flags.Bool("json", false, "print the runs as JSON")
+	flags.Parse(args)
 
-	for range ticker.C {
-		if err := bt.performBackup(); err != nil {
-			bt.logger.Printf("Backup failed: %v", err)
-		}
+	if flags.NArg() != 1 {
+		fmt.Println(usage)
+		os.Exit(1)
 	}
 
-	return nil
+	cfg, err := backup.LoadConfig(flags.Arg(0), overrides...)
+	if err != nil {
+		exit(false, exitConfigInvalid, "Failed to load config", err)
+	}
+	if err := backup.History(context.Background(), os.Stdout, cfg, *db, *limit, *asJSON); err != nil {
+		log.Fatal(err)
+	}
 }
 
-// performBackup executes a single backup operation
-func (bt *BackupTool) performBackup() error {
-	bt.logger.Println("Starting backup...")
+// runLatestCommand implements the latest subcommand
+func runLatestCommand(args []string, overrides []config.Override) {
+	flags := flag.NewFlagSet("latest", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the run's catalog entry as JSON instead of its location")
+	flags.Parse(args)
 
-	// Generate backup filename
-	timestamp := time.Now().Format("2006-01-02_15-04-05")
-	var filename string
-	var extension string
+	if flags.NArg() != 2 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
 
-	switch bt.config.Backup.Format {
-	case "plain":
-		extension = ".sql"
-	case "tar":
-		extension = ".tar"
-	case "directory":
-		extension = ""
-	default: // custom
-		extension = ".dump"
+	cfg, err := backup.LoadConfig(flags.Arg(0), overrides...)
+	if err != nil {
+		exit(false, exitConfigInvalid, "Failed to load config", err)
+	}
+	if err := backup.Latest(context.Background(), os.Stdout, cfg, flags.Arg(1), *asJSON); err != nil {
+		log.Fatal(err)
 	}
+}
 
-	filename = fmt.Sprintf("%s_%s%s", bt.config.Database.Name, timestamp, extension)
-	outputPath := filepath.Join(bt.config.Backup.OutputDir, filename)
+// runGCCommand implements the gc subcommand
+func runGCCommand(args []string, overrides []config.Override) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print what would change without changing the catalog")
+	flags.Parse(args)
 
-	// Build pg_dump command
-	cmd := bt.buildPgDumpCommand(outputPath)
+	if flags.NArg() != 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
 
-	// Set environment variables for authentication
-	cmd.Env = append(os.Environ(),
-		fmt.Sprintf("PGPASSWORD=%s", bt.config.Database.Password),
-	)
+	cfg, err := backup.LoadConfig(flags.Arg(0), overrides...)
+	if err != nil {
+		exit(false, exitConfigInvalid, "Failed to load config", err)
+	}
+	if err := backup.GC(context.Background(), os.Stdout, cfg, *dryRun); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	bt.logger.Printf("Running: %s", cmd.String())
+// runInstallServiceCommand implements the install-service subcommand
+func runInstallServiceCommand(args []string, overrides []config.Override) {
+	flags := flag.NewFlagSet("install-service", flag.ExitOnError)
+	name := flags.String("name", serviceName, "name of the service")
+	perUser := flags.Bool("user", false, "install a systemd user service instead of a system one")
+	runAs := flags.String("run-as", "", "account the service runs as, for system services")
+	printUnit := flags.Bool("print", false, "print the systemd unit instead of installing the service")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	if len(overrides) > 0 {
+		log.Fatal("Overrides are not passed on to the service, put them in the config file")
+	}
 
-	// Execute backup
-	output, err := cmd.CombinedOutput()
+	configPath, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg, err := backup.LoadConfig(configPath)
+	if err != nil {
+		exit(false, exitConfigInvalid, "Failed to load config", err)
+	}
+	executable, err := os.Executable()
 	if err != nil {
-		return fmt.Errorf("pg_dump failed: %w, output: %s", err, string(output))
+		log.Fatalf("Failed to locate beackup: %v", err)
 	}
 
-	bt.logger.Printf("Backup completed successfully: %s", outputPath)
+	service := daemon.Service{
+		Name:        *name,
+		Description: "beackup database backups",
+		Args:        []string{executable, configPath},
+		User:        *runAs,
+		PerUser:     *perUser,
+		StopTimeout: cfg.Backup.ShutdownGracePeriod + serviceStopMargin,
+	}
+	if *printUnit {
+		fmt.Print(daemon.SystemdUnit(service))
+		return
+	}
+	if err := daemon.Install(os.Stdout, service); err != nil {
+		log.Fatalf("Failed to install service: %v", err)
+	}
+}
+
+// runCheckCommand implements the check subcommand
+func runCheckCommand(args []string, overrides []config.Override) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	output := outputFlag(flags)
+	flags.Parse(args)
 
-	// Clean up old backups
-	if err := bt.cleanupOldBackups(); err != nil {
-		bt.logger.Printf("Warning: Failed to cleanup old backups: %v", err)
+	if flags.NArg() != 1 {
+		fmt.Println(usage)
+		os.Exit(exitFailure)
 	}
+	asJSON := parseOutput(*output)
 
-	return nil
+	tool, err := backup.New(flags.Arg(0), jsonOverrides(asJSON, overrides)...)
+	if err != nil {
+		exit(asJSON, exitConfigInvalid, "Config is invalid", err)
+	}
+	if !asJSON {
+		fmt.Printf("Config %s is valid\n", flags.Arg(0))
+	}
+
+	if err := tool.Check(context.Background(), os.Stdout, asJSON); err != nil {
+		os.Exit(exitFailure)
+	}
 }
 
-// buildPgDumpCommand constructs the pg_dump command with appropriate flags
-func (bt *BackupTool) buildPgDumpCommand(outputPath string) *exec.Cmd {
-	args := []string{
-		"pg_dump",
-		"-h", bt.config.Database.Host,
-		"-p", fmt.Sprintf("%d", bt.config.Database.Port),
-		"-U", bt.config.Database.User,
-		"-d", bt.config.Database.Name,
-		"--verbose",
-		"--no-password",
-	}
-
-	// Add format-specific flags
-	switch bt.config.Backup.Format {
-	case "plain":
-		args = append(args, "--format=plain")
-	case "tar":
-		args = append(args, "--format=tar")
-	case "directory":
-		args = append(args, "--format=directory")
-	default: // custom
-		args = append(args, "--format=custom")
-	}
-
-	// Add output file/directory
-	if bt.config.Backup.Format == "directory" {
-		args = append(args, "--file", outputPath)
+// runRestoreCommand implements the restore subcommand
+func runRestoreCommand(args []string, overrides []config.Override) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbID := flags.String("db", "", "id of the database to restore into")
+	dataDir := flags.String("data-dir", "", "directory to extract a base backup into")
+	targetTime := flags.String("target-time", "", "RFC 3339 time to replay WAL up to after restoring a base backup")
+	var tables tableList
+	flags.Var(&tables, "table", "replace only the rows of this table from a copy-format backup (repeatable)")
+	output := outputFlag(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		fmt.Println(usage)
+		os.Exit(exitFailure)
+	}
+	asJSON := parseOutput(*output)
+
+	// Base backups are physical copies of the cluster and can only be
+	// restored into a data directory
+	isBaseBackup := backup.IsBaseBackup(flags.Arg(1))
+	if isBaseBackup && *dataDir == "" {
+		exit(asJSON, exitFailure, "Restore failed", errors.New("restoring a base backup needs -data-dir"))
+	}
+	if !isBaseBackup && (*dataDir != "" || *targetTime != "") {
+		exit(asJSON, exitFailure, "Restore failed", errors.New("-data-dir and -target-time only apply to base backups"))
+	}
+	if isBaseBackup && len(tables) > 0 {
+		exit(asJSON, exitFailure, "Restore failed", errors.New("-table only applies to copy-format backups"))
+	}
+
+	tool, err := backup.New(flags.Arg(0), jsonOverrides(asJSON, overrides)...)
+	if err != nil {
+		exit(asJSON, exitConfigInvalid, "Failed to create backup tool", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	started := time.Now()
+	if isBaseBackup {
+		err = tool.RestoreBaseBackup(ctx, *dbID, flags.Arg(1), *dataDir, *targetTime)
 	} else {
-		args = append(args, "--file", outputPath)
+		err = tool.Restore(ctx, *dbID, flags.Arg(1), tables...)
 	}
+	if !asJSON {
+		if err != nil {
+			log.Fatalf("Restore failed: %v", err)
+		}
+		return
+	}
+
+	result := restoreResult{
+		Backup:          flags.Arg(1),
+		Database:        *dbID,
+		DataDir:         *dataDir,
+		Status:          "success",
+		DurationSeconds: time.Since(started).Seconds(),
+	}
+	if err != nil {
+		result.Status = "failure"
+		result.Error = err.Error()
+	}
+	printJSON(result)
+	if err != nil {
+		os.Exit(exitFailure)
+	}
+}
 
-	return exec.Command(args[0], args[1:]...)
+// restoreResult is the outcome of the restore subcommand in JSON
+type restoreResult struct {
+	Backup          string  `json:"backup"`
+	Database        string  `json:"database,omitempty"` // as given with -db
+	DataDir         string  `json:"data_dir,omitempty"`
+	Status          string  `json:"status"` // success or failure
+	DurationSeconds float64 `json:"duration_seconds"`
+	Error           string  `json:"error,omitempty"`
 }
 
-// cleanupOldBackups removes backups older than the retention period
-func (bt *BackupTool) cleanupOldBackups() error {
-	entries, err := os.ReadDir(bt.config.Backup.OutputDir)
+// runCloneCommand implements the clone subcommand
+func runCloneCommand(args []string, overrides []config.Override) {
+	flags := flag.NewFlagSet("clone", flag.ExitOnError)
+	var opts backup.CloneOptions
+	flags.StringVar(&opts.Backup, "backup", "", "backup to clone instead of the source database's newest")
+	flags.BoolVar(&opts.KeepExisting, "keep-existing", false, "restore into the target database without dropping and recreating it")
+	flags.BoolVar(&opts.NoOwner, "no-owner", false, "do not restore object owners")
+	flags.BoolVar(&opts.NoPrivileges, "no-privileges", false, "do not restore grants")
+	roles := roleMap{}
+	flags.Var(roles, "role-map", "rename a role owning or granted objects, as old=new (repeatable)")
+	flags.Parse(args)
+
+	if flags.NArg() != 3 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	opts.RoleMap = roles
+
+	tool, err := backup.New(flags.Arg(0), overrides...)
 	if err != nil {
-		return fmt.Errorf("failed to read backup directory: %w", err)
+		exit(false, exitConfigInvalid, "Failed to create backup tool", err)
 	}
 
-	cutoff := time.Now().AddDate(0, 0, -bt.config.Backup.Retention)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
+	if err := tool.Clone(ctx, flags.Arg(1), flags.Arg(2), opts); err != nil {
+		log.Fatalf("Clone failed: %v", err)
+	}
+}
 
-		info, err := entry.Info()
-		if err != nil {
-			continue
-		}
+// roleMap collects old=new role renames from repeated flags
+type roleMap map[string]string
 
-		if info.ModTime().Before(cutoff) {
-			path := filepath.Join(bt.config.Backup.OutputDir, entry.Name())
-			if err := os.Remove(path); err != nil {
-				bt.logger.Printf("Failed to remove old backup %s: %v", path, err)
-			} else {
-				bt.logger.Printf("Removed old backup: %s", path)
-			}
-		}
+func (m roleMap) String() string {
+	var pairs []string
+	for old, renamed := range m {
+		pairs = append(pairs, old+"="+renamed)
 	}
+	return strings.Join(pairs, ",")
+}
 
+func (m roleMap) Set(value string) error {
+	old, renamed, ok := strings.Cut(value, "=")
+	if !ok || old == "" || renamed == "" {
+		return fmt.Errorf("expected old=new, got %q", value)
+	}
+	m[old] = renamed
 	return nil
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: beackup <config-file>")
+// tableList collects table names from repeated flags
+type tableList []string
+
+func (l *tableList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *tableList) Set(value string) error {
+	if value == "" {
+		return fmt.Errorf("expected a table name")
+	}
+	*l = append(*l, value)
+	return nil
+}
+
+// runWALFetchCommand implements the wal-fetch subcommand used as
+// restore_command. It exits with status 1 for files missing from the
+// archive, which PostgreSQL treats as the end of the available WAL.
+func runWALFetchCommand(args []string, overrides []config.Override) {
+	if len(args) != 4 {
+		fmt.Println(usage)
 		os.Exit(1)
 	}
 
-	configPath := os.Args[1]
+	tool, err := backup.New(args[0], overrides...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create backup tool: %v\n", err)
+		os.Exit(2)
+	}
 
-	tool, err := NewBackupTool(configPath)
+	err = tool.FetchWAL(context.Background(), args[1], args[2], args[3])
+	if errors.Is(err, backup.ErrWALNotFound) {
+		os.Exit(1)
+	}
 	if err != nil {
-		log.Fatalf("Failed to create backup tool: %v", err)
+		os.Exit(2)
 	}
+}
 
-	// Handle graceful shutdown
-	tool.Start()
+// outputFlag adds the -output flag of the commands with machine-readable
+// results
+func outputFlag(flags *flag.FlagSet) *string {
+	return flags.String("output", "text", "print the results as text or json")
+}
+
+// parseOutput checks the -output flag and reports whether it asks for JSON
+func parseOutput(output string) bool {
+	switch output {
+	case "text":
+		return false
+	case "json":
+		return true
+	}
+	fmt.Println(usage)
+	os.Exit(exitFailure)
+	return false
+}
+
+// jsonOverrides sends the logs to standard error when the results are
+// printed as JSON on standard output
+func jsonOverrides(asJSON bool, overrides []config.Override) []config.Override {
+	if !asJSON {
+		return overrides
+	}
+	return append(overrides, config.Override{Path: "logging.output", Value: "stderr"})
+}
+
+// printJSON prints v as indented JSON on standard output
+func printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// exit ends a command that failed before it had results to print, with the
+// error printed as JSON if asJSON is set and logged after msg otherwise
+func exit(asJSON bool, code int, msg string, err error) {
+	if asJSON {
+		printJSON(struct {
+			Error    string `json:"error"`
+			ExitCode int    `json:"exit_code"`
+		}{err.Error(), code})
+	} else {
+		log.Printf("%s: %v", msg, err)
+	}
+	os.Exit(code)
+}
+
+// backupExitCode returns the exit code for the failed backups of err
+func backupExitCode(err error) int {
+	switch {
+	case errors.Is(err, backup.ErrDumpFailed):
+		return exitDumpFailed
+	case errors.Is(err, backup.ErrUploadFailed):
+		return exitUploadFailed
+	case errors.Is(err, backup.ErrVerifyFailed):
+		return exitVerifyFailed
+	default:
+		return exitFailure
+	}
 }
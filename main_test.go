@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"beackup/backup"
+)
+
+func TestBackupExitCode(t *testing.T) {
+	other := errors.New("disk full")
+	dump := fmt.Errorf("backup of app: %w", backup.ErrDumpFailed)
+	upload := fmt.Errorf("backup of app: %w", backup.ErrUploadFailed)
+	verify := fmt.Errorf("backup of app: %w", backup.ErrVerifyFailed)
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"other", other, exitFailure},
+		{"dump", dump, exitDumpFailed},
+		{"upload", upload, exitUploadFailed},
+		{"verification", verify, exitVerifyFailed},
+		// Of several failed backups, the earliest stage decides
+		{"upload and dump", errors.Join(upload, other, dump), exitDumpFailed},
+		{"verification and upload", errors.Join(verify, upload), exitUploadFailed},
+		{"verification and other", errors.Join(other, verify), exitVerifyFailed},
+	}
+	for _, tt := range tests {
+		if got := backupExitCode(tt.err); got != tt.want {
+			t.Errorf("backupExitCode(%s) = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,534 @@
+// Package pgwire is a minimal client of the PostgreSQL frontend/backend
+// protocol, version 3. It runs simple queries and COPY in both directions,
+// which is all beackup needs to talk to a server without psql.
+package pgwire
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// protocolVersion is version 3.0 of the protocol, as sent at startup
+const protocolVersion = 3 << 16
+
+// copyChunkSize is how much of a COPY FROM STDIN input is sent per message
+const copyChunkSize = 64 << 10
+
+// Config describes how to connect to a server
+type Config struct {
+	Host     string // host name, IP address or directory of a Unix socket
+	Port     int
+	User     string
+	Password string
+	Database string
+	SSL      SSL
+
+	// Params are run-time parameters set at startup, such as
+	// application_name or client_encoding
+	Params map[string]string
+
+	// ConnectTimeout limits connecting and authenticating, 0 for no limit
+	ConnectTimeout time.Duration
+}
+
+// Error is an error reported by the server
+type Error struct {
+	Severity string
+	Code     string // SQLSTATE
+	Message  string
+	Detail   string
+	Hint     string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s: %s (SQLSTATE %s)", e.Severity, e.Message, e.Code)
+	if e.Detail != "" {
+		msg += ", detail: " + e.Detail
+	}
+	if e.Hint != "" {
+		msg += ", hint: " + e.Hint
+	}
+	return msg
+}
+
+// errBroken is returned by a connection that an earlier failure left in an
+// unknown state
+var errBroken = errors.New("connection is broken by an earlier failure")
+
+// Conn is a connection to a server. It runs one query at a time.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	buf    []byte // holds the message being read
+	broken bool
+
+	// Parameters reports the run-time parameters the server announced,
+	// such as server_version
+	Parameters map[string]string
+}
+
+// Connect opens a connection to the server and authenticates
+func Connect(ctx context.Context, config Config) (*Conn, error) {
+	if config.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.ConnectTimeout)
+		defer cancel()
+	}
+
+	mode := config.SSL.Mode
+	if mode == "" {
+		mode = "prefer"
+	}
+	c, err := connect(ctx, config, mode != "disable" && mode != "allow")
+	var serverErr *Error
+	if mode == "allow" && errors.As(err, &serverErr) {
+		// The server may only accept encrypted connections
+		c, err = connect(ctx, config, true)
+	}
+	return c, err
+}
+
+// connect opens a connection, asking the server to encrypt it if useTLS is
+// set. Unix sockets are never encrypted.
+func connect(ctx context.Context, config Config, useTLS bool) (*Conn, error) {
+	network, address := "tcp", net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	if strings.HasPrefix(config.Host, "/") {
+		network, address = "unix", filepath.Join(config.Host, ".s.PGSQL."+strconv.Itoa(config.Port))
+		useTLS = false
+	}
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+
+	c := &Conn{conn: netConn, Parameters: make(map[string]string)}
+	stop := c.watch(ctx)
+	err = c.startup(ctx, config, useTLS)
+	if stopErr := stop(); stopErr != nil {
+		err = stopErr
+	}
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// startup negotiates encryption, sends the startup message and
+// authenticates
+func (c *Conn) startup(ctx context.Context, config Config, useTLS bool) error {
+	if useTLS {
+		if err := c.startTLS(ctx, config); err != nil {
+			return err
+		}
+	}
+	c.reader = bufio.NewReader(c.conn)
+
+	msg := binary.BigEndian.AppendUint32(make([]byte, 4), protocolVersion)
+	params := map[string]string{"user": config.User, "database": config.Database}
+	for name, value := range config.Params {
+		params[name] = value
+	}
+	for name, value := range params {
+		if value != "" {
+			msg = append(append(append(msg, name...), 0), append([]byte(value), 0)...)
+		}
+	}
+	msg = append(msg, 0)
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)))
+	if _, err := c.conn.Write(msg); err != nil {
+		return fmt.Errorf("failed to send startup message: %w", err)
+	}
+
+	if err := c.authenticate(config); err != nil {
+		return err
+	}
+	for {
+		typ, body, err := c.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'K': // BackendKeyData, only needed to cancel queries
+		case 'Z':
+			return nil
+		case 'E':
+			return parseError(body)
+		default:
+			return fmt.Errorf("unexpected message %q during startup", typ)
+		}
+	}
+}
+
+// authenticate answers the server's authentication requests until it
+// accepts the connection
+func (c *Conn) authenticate(config Config) error {
+	var scram *scramClient
+	for {
+		typ, body, err := c.receive()
+		if err != nil {
+			return err
+		}
+		if typ == 'E' {
+			return parseError(body)
+		}
+		if typ != 'R' || len(body) < 4 {
+			return fmt.Errorf("unexpected message %q during authentication", typ)
+		}
+
+		request, data := binary.BigEndian.Uint32(body), body[4:]
+		switch request {
+		case 0: // AuthenticationOk
+			return nil
+		case 3: // AuthenticationCleartextPassword
+			err = c.send('p', append([]byte(config.Password), 0))
+		case 5: // AuthenticationMD5Password
+			if len(data) < 4 {
+				return fmt.Errorf("malformed MD5 password request")
+			}
+			err = c.send('p', append([]byte(md5Password(config.User, config.Password, data[:4])), 0))
+		case 10: // AuthenticationSASL
+			if !hasMechanism(data, scramMechanism) {
+				return fmt.Errorf("server offers no supported SASL mechanism")
+			}
+			scram, err = newSCRAMClient(config.Password)
+			if err != nil {
+				return err
+			}
+			first := scram.firstMessage()
+			msg := append([]byte(scramMechanism), 0)
+			msg = binary.BigEndian.AppendUint32(msg, uint32(len(first)))
+			err = c.send('p', append(msg, first...))
+		case 11: // AuthenticationSASLContinue
+			if scram == nil {
+				return fmt.Errorf("unexpected SASL continuation")
+			}
+			var final []byte
+			if final, err = scram.finalMessage(data); err == nil {
+				err = c.send('p', final)
+			}
+		case 12: // AuthenticationSASLFinal
+			if scram == nil {
+				return fmt.Errorf("unexpected SASL completion")
+			}
+			err = scram.verifyServer(data)
+		default:
+			return fmt.Errorf("unsupported authentication method %d", request)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// md5Password returns the response to an MD5 password request
+func md5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// hasMechanism reports whether the null-terminated list of SASL mechanisms
+// includes name
+func hasMechanism(list []byte, name string) bool {
+	for _, mechanism := range strings.Split(string(list), "\x00") {
+		if mechanism == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Query runs the statements in sql and returns the rows they produce, with
+// NULL values as empty strings
+func (c *Conn) Query(ctx context.Context, sql string) ([][]string, error) {
+	var rows [][]string
+	err := c.simpleQuery(ctx, sql, func(typ byte, body []byte) error {
+		switch typ {
+		case 'D':
+			row, err := parseDataRow(body)
+			if err != nil {
+				return err
+			}
+			rows = append(rows, row)
+		case 'T', 'C', 'I':
+		case 'G', 'H':
+			return fmt.Errorf("COPY cannot be run as a query")
+		default:
+			return fmt.Errorf("unexpected message %q", typ)
+		}
+		return nil
+	})
+	return rows, err
+}
+
+// Exec runs the statements in sql, discarding any rows
+func (c *Conn) Exec(ctx context.Context, sql string) error {
+	_, err := c.Query(ctx, sql)
+	return err
+}
+
+// CopyOut runs a COPY ... TO STDOUT statement, writing the data to w, and
+// returns how many bytes were written
+func (c *Conn) CopyOut(ctx context.Context, sql string, w io.Writer) (int64, error) {
+	var written int64
+	started := false
+	err := c.simpleQuery(ctx, sql, func(typ byte, body []byte) error {
+		switch typ {
+		case 'H':
+			started = true
+		case 'd':
+			if !started {
+				return fmt.Errorf("unexpected COPY data")
+			}
+			n, err := w.Write(body)
+			written += int64(n)
+			return err
+		case 'c', 'C':
+		default:
+			return fmt.Errorf("not a COPY TO STDOUT statement, got message %q", typ)
+		}
+		return nil
+	})
+	return written, err
+}
+
+// CopyIn runs a COPY ... FROM STDIN statement, sending the data read from r,
+// and returns how many bytes were sent. If reading r fails, the COPY is
+// aborted and the read error returned.
+func (c *Conn) CopyIn(ctx context.Context, sql string, r io.Reader) (int64, error) {
+	var sent int64
+	var readErr error
+	err := c.simpleQuery(ctx, sql, func(typ byte, body []byte) error {
+		switch typ {
+		case 'G':
+		case 'C':
+			return nil
+		default:
+			return fmt.Errorf("not a COPY FROM STDIN statement, got message %q", typ)
+		}
+
+		buf := make([]byte, copyChunkSize)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				if err := c.send('d', buf[:n]); err != nil {
+					return err
+				}
+				sent += int64(n)
+			}
+			switch {
+			case err == io.EOF:
+				return c.send('c', nil)
+			case err != nil:
+				readErr = err
+				return c.send('f', append([]byte(err.Error()), 0))
+			}
+		}
+	})
+	if readErr != nil && !c.broken {
+		// The server's error only reports the abort
+		return sent, readErr
+	}
+	return sent, err
+}
+
+// simpleQuery sends sql as a simple query and passes each response up to
+// the end of the query to handle. The first error the server reports is
+// returned once the query ended; an error from handle leaves the
+// connection broken.
+func (c *Conn) simpleQuery(ctx context.Context, sql string, handle func(typ byte, body []byte) error) (err error) {
+	if c.broken {
+		return errBroken
+	}
+	stop := c.watch(ctx)
+	defer func() {
+		if stopErr := stop(); stopErr != nil {
+			err = stopErr
+		}
+		if err != nil {
+			var serverErr *Error
+			c.broken = c.broken || !errors.As(err, &serverErr)
+		}
+	}()
+
+	if err := c.send('Q', append([]byte(sql), 0)); err != nil {
+		return err
+	}
+	var queryErr error
+	for {
+		typ, body, err := c.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'Z':
+			return queryErr
+		case 'E':
+			if queryErr == nil {
+				queryErr = parseError(body)
+			}
+		default:
+			if queryErr != nil {
+				// Rows of a statement before the failing one
+				continue
+			}
+			if err := handle(typ, body); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// watch makes reads and writes fail once ctx is done, until the returned
+// function is called. That function returns ctx's error if it ended the
+// operation early.
+func (c *Conn) watch(ctx context.Context) func() error {
+	if ctx.Done() == nil {
+		return func() error { return nil }
+	}
+	conn := c.conn
+	var mu sync.Mutex
+	interrupted := false
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			interrupted = true
+			mu.Unlock()
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() error {
+		close(done)
+		<-exited
+		mu.Lock()
+		defer mu.Unlock()
+		if interrupted {
+			c.broken = true
+			return ctx.Err()
+		}
+		return nil
+	}
+}
+
+// send writes a message of type typ
+func (c *Conn) send(typ byte, body []byte) error {
+	msg := make([]byte, 5, 5+len(body))
+	msg[0] = typ
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	if _, err := c.conn.Write(append(msg, body...)); err != nil {
+		c.broken = true
+		return fmt.Errorf("failed to send to server: %w", err)
+	}
+	return nil
+}
+
+// receive reads the next message, skipping notices and other messages the
+// server sends at any time. The body is only valid until the next call.
+func (c *Conn) receive() (byte, []byte, error) {
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			c.broken = true
+			return 0, nil, fmt.Errorf("failed to read from server: %w", err)
+		}
+		size := int(binary.BigEndian.Uint32(header[1:])) - 4
+		if size < 0 {
+			c.broken = true
+			return 0, nil, fmt.Errorf("malformed message from server")
+		}
+		if cap(c.buf) < size {
+			c.buf = make([]byte, size)
+		}
+		body := c.buf[:size]
+		if _, err := io.ReadFull(c.reader, body); err != nil {
+			c.broken = true
+			return 0, nil, fmt.Errorf("failed to read from server: %w", err)
+		}
+
+		switch header[0] {
+		case 'N', 'A': // NoticeResponse, NotificationResponse
+		case 'S': // ParameterStatus
+			if name, value, ok := strings.Cut(strings.TrimSuffix(string(body), "\x00"), "\x00"); ok {
+				c.Parameters[name] = value
+			}
+		default:
+			return header[0], body, nil
+		}
+	}
+}
+
+// Close ends the session and closes the connection
+func (c *Conn) Close() error {
+	if !c.broken {
+		c.send('X', nil)
+	}
+	return c.conn.Close()
+}
+
+// parseError decodes an ErrorResponse
+func parseError(body []byte) error {
+	e := &Error{}
+	for _, field := range strings.Split(string(body), "\x00") {
+		if field == "" {
+			continue
+		}
+		value := field[1:]
+		switch field[0] {
+		case 'S':
+			e.Severity = value
+		case 'C':
+			e.Code = value
+		case 'M':
+			e.Message = value
+		case 'D':
+			e.Detail = value
+		case 'H':
+			e.Hint = value
+		}
+	}
+	return e
+}
+
+// parseDataRow decodes the values of a DataRow
+func parseDataRow(body []byte) ([]string, error) {
+	if len(body) < 2 {
+		return nil, fmt.Errorf("malformed data row")
+	}
+	row := make([]string, binary.BigEndian.Uint16(body))
+	body = body[2:]
+	for i := range row {
+		if len(body) < 4 {
+			return nil, fmt.Errorf("malformed data row")
+		}
+		size := int32(binary.BigEndian.Uint32(body))
+		body = body[4:]
+		if size < 0 {
+			continue // NULL
+		}
+		if int(size) > len(body) {
+			return nil, fmt.Errorf("malformed data row")
+		}
+		row[i] = string(body[:size])
+		body = body[size:]
+	}
+	return row, nil
+}
@@ -0,0 +1,232 @@
+package pgwire
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"beackup/pgwire/pgwiretest"
+)
+
+// dial connects to server as user app with password secret
+func dial(t *testing.T, server *pgwiretest.Server) *Conn {
+	t.Helper()
+	conn, err := Connect(context.Background(), serverConfig(server))
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func serverConfig(server *pgwiretest.Server) Config {
+	return Config{Host: server.Host, Port: server.Port, User: "app", Password: "secret", Database: "appdb"}
+}
+
+func TestConnectAuth(t *testing.T) {
+	for _, auth := range []string{pgwiretest.AuthTrust, pgwiretest.AuthMD5, pgwiretest.AuthSCRAM} {
+		t.Run(cmp.Or(auth, "trust"), func(t *testing.T) {
+			server := pgwiretest.NewServer(t, func(s *pgwiretest.Session, query string) {})
+			server.Auth, server.User, server.Password = auth, "app", "secret"
+
+			conn := dial(t, server)
+			if got := conn.Parameters["server_version"]; got != "17.0" {
+				t.Errorf("server_version = %q, want 17.0", got)
+			}
+			startup := server.Startup()[0]
+			if startup["user"] != "app" || startup["database"] != "appdb" {
+				t.Errorf("startup parameters = %v", startup)
+			}
+
+			if auth == pgwiretest.AuthTrust {
+				return
+			}
+			config := serverConfig(server)
+			config.Password = "wrong"
+			_, err := Connect(context.Background(), config)
+			var serverErr *Error
+			if !errors.As(err, &serverErr) || serverErr.Code != "28P01" {
+				t.Errorf("Connect() with a wrong password error = %v, want SQLSTATE 28P01", err)
+			}
+		})
+	}
+}
+
+func TestSCRAMExchange(t *testing.T) {
+	// The example exchange of RFC 7677
+	s := &scramClient{password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO", firstBare: "n=user,r=rOprNGfwEbeRWgbNEkqO"}
+	final, err := s.finalMessage([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if string(final) != want {
+		t.Errorf("finalMessage() = %s, want %s", final, want)
+	}
+	if err := s.verifyServer([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err != nil {
+		t.Errorf("verifyServer() error = %v", err)
+	}
+	if err := s.verifyServer([]byte("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err == nil {
+		t.Error("verifyServer() accepted a wrong signature")
+	}
+
+	if _, err := s.finalMessage([]byte("r=otherNonce,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")); err == nil {
+		t.Error("finalMessage() accepted a nonce the client did not start")
+	}
+}
+
+func TestHi(t *testing.T) {
+	// PBKDF2-HMAC-SHA-256 test vector of RFC 7914
+	got := hex.EncodeToString(hi([]byte("passwd"), []byte("salt"), 1))
+	if want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"; got != want {
+		t.Errorf("hi() = %s, want %s", got, want)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	server := pgwiretest.NewServer(t, func(s *pgwiretest.Session, query string) {
+		switch query {
+		case "SELECT 1":
+			s.Notice("skipped")
+			s.Rows([]string{"a", "b"}, [][]*string{
+				{pgwiretest.Value("x"), nil},
+				{pgwiretest.Value(""), pgwiretest.Value("y\tz")},
+			})
+		case "BAD":
+			s.Error("42601", "syntax error")
+		}
+	})
+	conn := dial(t, server)
+
+	rows, err := conn.Query(context.Background(), "SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"x", ""}, {"", "y\tz"}}
+	if !slices.EqualFunc(rows, want, slices.Equal) {
+		t.Errorf("Query() = %q, want %q", rows, want)
+	}
+
+	err = conn.Exec(context.Background(), "BAD")
+	var serverErr *Error
+	if !errors.As(err, &serverErr) || serverErr.Code != "42601" || serverErr.Message != "syntax error" {
+		t.Errorf("Exec() error = %v, want the syntax error", err)
+	}
+	// A failed query leaves the connection usable
+	if err := conn.Exec(context.Background(), "SELECT 2"); err != nil {
+		t.Errorf("Exec() after a failed query error = %v", err)
+	}
+}
+
+func TestCopyOut(t *testing.T) {
+	server := pgwiretest.NewServer(t, func(s *pgwiretest.Session, query string) {
+		s.CopyOut("1,a\n", "2,b\n")
+	})
+	conn := dial(t, server)
+
+	var buf bytes.Buffer
+	n, err := conn.CopyOut(context.Background(), "COPY t TO STDOUT (FORMAT csv)", &buf)
+	if err != nil || n != 8 || buf.String() != "1,a\n2,b\n" {
+		t.Errorf("CopyOut() = %d, %v, wrote %q", n, err, buf.String())
+	}
+}
+
+func TestCopyIn(t *testing.T) {
+	received := make(chan string, 2)
+	server := pgwiretest.NewServer(t, func(s *pgwiretest.Session, query string) {
+		if strings.HasPrefix(query, "COPY") {
+			data, _ := s.CopyIn()
+			received <- data
+		}
+	})
+	conn := dial(t, server)
+
+	rows := strings.Repeat("1,a\n", copyChunkSize/4+10)
+	n, err := conn.CopyIn(context.Background(), "COPY t FROM STDIN (FORMAT csv)", strings.NewReader(rows))
+	if err != nil || n != int64(len(rows)) {
+		t.Errorf("CopyIn() = %d, %v", n, err)
+	}
+	if got := <-received; got != rows {
+		t.Errorf("server received %d bytes, want %d", len(got), len(rows))
+	}
+
+	// A failure reading the input aborts the COPY, leaving the connection usable
+	readErr := errors.New("disk on fire")
+	_, err = conn.CopyIn(context.Background(), "COPY t FROM STDIN (FORMAT csv)", &failingReader{data: "1,a\n", err: readErr})
+	if !errors.Is(err, readErr) {
+		t.Errorf("CopyIn() with a failing reader error = %v, want %v", err, readErr)
+	}
+	if got := <-received; got != "1,a\n" {
+		t.Errorf("server received %q before the failure", got)
+	}
+	if err := conn.Exec(context.Background(), "SELECT 1"); err != nil {
+		t.Errorf("Exec() after an aborted COPY error = %v", err)
+	}
+}
+
+// failingReader returns data, then err
+type failingReader struct {
+	data string
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestCancel(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	server := pgwiretest.NewServer(t, func(s *pgwiretest.Session, query string) {
+		<-release
+	})
+	conn := dial(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := conn.Exec(ctx, "SELECT pg_sleep(60)"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Exec() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := conn.Exec(context.Background(), "SELECT 1"); !errors.Is(err, errBroken) {
+		t.Errorf("Exec() after a cancelled query error = %v, want %v", err, errBroken)
+	}
+}
+
+func TestPassFilePassword(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pgpass")
+	lines := "# comment\n" +
+		"db.example.com:5432:other:app:wrong\n" +
+		`db.example.com:5432:*:app:p\:w\\d` + "\n" +
+		"*:*:*:*:fallback\n"
+	if err := os.WriteFile(path, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PGPASSFILE", path)
+
+	tests := []struct {
+		config Config
+		want   string
+	}{
+		{Config{Host: "db.example.com", Port: 5432, Database: "appdb", User: "app"}, `p:w\d`},
+		{Config{Host: "db.example.com", Port: 5432, Database: "other", User: "app"}, "wrong"},
+		{Config{Host: "localhost", Port: 5433, Database: "appdb", User: "app"}, "fallback"},
+	}
+	for _, tt := range tests {
+		if got := PassFilePassword(tt.config); got != tt.want {
+			t.Errorf("PassFilePassword(%+v) = %q, want %q", tt.config, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package pgwire
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PassFilePassword looks the password of config up in the libpq password
+// file: PGPASSFILE, or ~/.pgpass. It returns an empty string if the file or
+// a matching line is missing.
+func PassFilePassword(config Config) string {
+	path := os.Getenv("PGPASSFILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		path = filepath.Join(home, ".pgpass")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	host := config.Host
+	if strings.HasPrefix(host, "/") {
+		// libpq matches socket connections as localhost
+		host = "localhost"
+	}
+	want := []string{host, strconv.Itoa(config.Port), config.Database, config.User}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := splitPassLine(line)
+		if len(fields) != 5 {
+			continue
+		}
+		matches := true
+		for i, value := range want {
+			if fields[i] != "*" && fields[i] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return fields[4]
+		}
+	}
+	return ""
+}
+
+// splitPassLine splits a line of the password file at its unescaped
+// colons, removing the backslashes escaping colons and backslashes
+func splitPassLine(line string) []string {
+	var fields []string
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case line[i] == ':':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(line[i])
+		}
+	}
+	return append(fields, field.String())
+}
@@ -0,0 +1,386 @@
+// Package pgwiretest runs a fake PostgreSQL server for tests of code that
+// talks to one with pgwire
+package pgwiretest
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Authentication methods a Server asks for
+const (
+	AuthTrust = ""
+	AuthMD5   = "md5"
+	AuthSCRAM = "scram-sha-256"
+)
+
+// Handler answers a query. Returning without writing a result completes
+// the query without rows.
+type Handler func(s *Session, query string)
+
+// Server accepts connections on a local port until the test ends
+type Server struct {
+	Host string
+	Port int
+
+	Auth     string // how clients authenticate
+	User     string // the user a client must connect as, any if empty
+	Password string
+
+	handler  Handler
+	listener net.Listener
+	mu       sync.Mutex
+	queries  []string
+	startup  []map[string]string
+}
+
+// NewServer starts a server answering queries with handler
+func NewServer(t testing.TB, handler Handler) *Server {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	s := &Server{Host: "127.0.0.1", Port: addr.Port, handler: handler, listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go s.accept()
+	return s
+}
+
+// Queries returns the queries received so far, in order
+func (s *Server) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+// Startup returns the startup parameters of each connection so far
+func (s *Server) Startup() []map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]map[string]string(nil), s.startup...)
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+// serve runs one session
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	session := &Session{reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+	if err := s.handshake(session); err != nil {
+		session.Error("28P01", err.Error())
+		session.writer.Flush()
+		return
+	}
+	session.message('Z', []byte{'I'})
+	session.writer.Flush()
+
+	for {
+		typ, body, err := session.read()
+		if err != nil || typ == 'X' {
+			return
+		}
+		if typ != 'Q' {
+			session.Error("08P01", fmt.Sprintf("unexpected message %q", typ))
+		} else {
+			query := strings.TrimSuffix(string(body), "\x00")
+			s.mu.Lock()
+			s.queries = append(s.queries, query)
+			s.mu.Unlock()
+			session.done = false
+			s.handler(session, query)
+			if !session.done {
+				session.Complete("OK")
+			}
+		}
+		session.message('Z', []byte{'I'})
+		if err := session.writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// handshake declines SSL, reads the startup message and authenticates
+func (s *Server) handshake(session *Session) error {
+	var params map[string]string
+	for params == nil {
+		var header [8]byte
+		if _, err := io.ReadFull(session.reader, header[:]); err != nil {
+			return err
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header[:4])-8)
+		if _, err := io.ReadFull(session.reader, body); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(header[4:]) == 80877103 {
+			session.writer.WriteByte('N')
+			session.writer.Flush()
+			continue
+		}
+		params = make(map[string]string)
+		fields := strings.Split(string(body), "\x00")
+		for i := 0; i+1 < len(fields); i += 2 {
+			params[fields[i]] = fields[i+1]
+		}
+	}
+	s.mu.Lock()
+	s.startup = append(s.startup, params)
+	s.mu.Unlock()
+
+	if s.User != "" && params["user"] != s.User {
+		return fmt.Errorf("role %q does not exist", params["user"])
+	}
+	switch s.Auth {
+	case AuthMD5:
+		if err := s.authMD5(session, params["user"]); err != nil {
+			return err
+		}
+	case AuthSCRAM:
+		if err := s.authSCRAM(session); err != nil {
+			return err
+		}
+	}
+	session.message('R', binary.BigEndian.AppendUint32(nil, 0))
+	session.message('S', []byte("server_version\x0017.0\x00"))
+	return nil
+}
+
+func (s *Server) authMD5(session *Session, user string) error {
+	salt := []byte{1, 2, 3, 4}
+	session.message('R', append(binary.BigEndian.AppendUint32(nil, 5), salt...))
+	session.writer.Flush()
+	_, body, err := session.read()
+	if err != nil {
+		return err
+	}
+	inner := md5.Sum([]byte(s.Password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	if strings.TrimSuffix(string(body), "\x00") != "md5"+hex.EncodeToString(outer[:]) {
+		return fmt.Errorf("password authentication failed")
+	}
+	return nil
+}
+
+// authSCRAM runs the server side of SCRAM-SHA-256
+func (s *Server) authSCRAM(session *Session) error {
+	session.message('R', append(binary.BigEndian.AppendUint32(nil, 10), "SCRAM-SHA-256\x00\x00"...))
+	session.writer.Flush()
+	_, body, err := session.read()
+	if err != nil {
+		return err
+	}
+	mechanism, rest, _ := strings.Cut(string(body), "\x00")
+	if mechanism != "SCRAM-SHA-256" || len(rest) < 4 {
+		return fmt.Errorf("unexpected SASL mechanism %q", mechanism)
+	}
+	clientFirst := rest[4:]
+	firstBare, ok := strings.CutPrefix(clientFirst, "n,,")
+	if !ok {
+		return fmt.Errorf("unexpected GS2 header in %q", clientFirst)
+	}
+	clientNonce := attribute(firstBare, "r")
+
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	nonce := clientNonce + "server"
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce, base64.StdEncoding.EncodeToString(salt), 4096)
+	session.message('R', append(binary.BigEndian.AppendUint32(nil, 11), serverFirst...))
+	session.writer.Flush()
+
+	_, body, err = session.read()
+	if err != nil {
+		return err
+	}
+	clientFinal := string(body)
+	withoutProof, proof64, _ := strings.Cut(clientFinal, ",p=")
+	if attribute(withoutProof, "r") != nonce {
+		return fmt.Errorf("SCRAM nonce mismatch")
+	}
+	proof, _ := base64.StdEncoding.DecodeString(proof64)
+
+	salted := pbkdf2([]byte(s.Password), salt, 4096)
+	clientKey := mac(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	authMessage := firstBare + "," + serverFirst + "," + withoutProof
+	signature := mac(storedKey[:], authMessage)
+	if len(proof) != len(signature) {
+		return fmt.Errorf("password authentication failed")
+	}
+	for i := range proof {
+		proof[i] ^= signature[i]
+	}
+	if sum := sha256.Sum256(proof); !hmac.Equal(sum[:], storedKey[:]) {
+		return fmt.Errorf("password authentication failed")
+	}
+
+	serverSignature := mac(mac(salted, "Server Key"), authMessage)
+	session.message('R', append(binary.BigEndian.AppendUint32(nil, 12), "v="+base64.StdEncoding.EncodeToString(serverSignature)...))
+	return nil
+}
+
+// attribute returns the value of a SCRAM message's attribute
+func attribute(msg, name string) string {
+	for _, attr := range strings.Split(msg, ",") {
+		if value, ok := strings.CutPrefix(attr, name+"="); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// pbkdf2 derives a 32-byte key with PBKDF2-HMAC-SHA-256
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	u := mac(password, string(salt)+"\x00\x00\x00\x01")
+	result := append([]byte(nil), u...)
+	for range iterations - 1 {
+		u = mac(password, string(u))
+		for i := range result {
+			result[i] ^= u[i]
+		}
+	}
+	return result
+}
+
+func mac(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// Session is a client's connection to a Server
+type Session struct {
+	reader *bufio.Reader
+	writer *bufio.Writer
+	done   bool // the query has been completed or failed
+}
+
+// Rows answers the query with rows of text values; nil values are NULL
+func (s *Session) Rows(columns []string, rows [][]*string) {
+	desc := binary.BigEndian.AppendUint16(nil, uint16(len(columns)))
+	for _, column := range columns {
+		desc = append(desc, column...)
+		desc = append(desc, 0)
+		// Table and column number, type text, size, modifier and format
+		desc = binary.BigEndian.AppendUint32(desc, 0)
+		desc = binary.BigEndian.AppendUint16(desc, 0)
+		desc = binary.BigEndian.AppendUint32(desc, 25)
+		desc = binary.BigEndian.AppendUint16(desc, 0xffff)
+		desc = binary.BigEndian.AppendUint32(desc, 0xffffffff)
+		desc = binary.BigEndian.AppendUint16(desc, 0)
+	}
+	s.message('T', desc)
+	for _, row := range rows {
+		data := binary.BigEndian.AppendUint16(nil, uint16(len(row)))
+		for _, value := range row {
+			if value == nil {
+				data = binary.BigEndian.AppendUint32(data, 0xffffffff)
+				continue
+			}
+			data = binary.BigEndian.AppendUint32(data, uint32(len(*value)))
+			data = append(data, *value...)
+		}
+		s.message('D', data)
+	}
+	s.Complete("SELECT " + strconv.Itoa(len(rows)))
+}
+
+// CopyOut answers a COPY TO STDOUT with data, one message per chunk
+func (s *Session) CopyOut(chunks ...string) {
+	s.message('H', []byte{0, 0, 0})
+	for _, chunk := range chunks {
+		s.message('d', []byte(chunk))
+	}
+	s.message('c', nil)
+	s.Complete("COPY")
+}
+
+// CopyIn answers a COPY FROM STDIN, returning the data the client sent. If
+// the client aborts the COPY, the query fails and ok is false.
+func (s *Session) CopyIn() (data string, ok bool) {
+	s.message('G', []byte{0, 0, 0})
+	s.writer.Flush()
+	var received strings.Builder
+	for {
+		typ, body, err := s.read()
+		if err != nil {
+			s.done = true
+			return received.String(), false
+		}
+		switch typ {
+		case 'd':
+			received.Write(body)
+		case 'c':
+			s.Complete("COPY")
+			return received.String(), true
+		case 'f':
+			s.Error("57014", "COPY from stdin failed: "+strings.TrimSuffix(string(body), "\x00"))
+			return received.String(), false
+		}
+	}
+}
+
+// Complete completes the query with a command tag
+func (s *Session) Complete(tag string) {
+	s.message('C', append([]byte(tag), 0))
+	s.done = true
+}
+
+// Error fails the query
+func (s *Session) Error(code, message string) {
+	var body []byte
+	for _, field := range []string{"SERROR", "VERROR", "C" + code, "M" + message} {
+		body = append(append(body, field...), 0)
+	}
+	s.message('E', append(body, 0))
+	s.done = true
+}
+
+// Notice sends a notice, which clients must skip
+func (s *Session) Notice(message string) {
+	s.message('N', []byte("SNOTICE\x00M"+message+"\x00\x00"))
+}
+
+func (s *Session) message(typ byte, body []byte) {
+	s.writer.WriteByte(typ)
+	s.writer.Write(binary.BigEndian.AppendUint32(nil, uint32(4+len(body))))
+	s.writer.Write(body)
+}
+
+func (s *Session) read() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(s.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+	if _, err := io.ReadFull(s.reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+// Value returns a pointer to v, for the values of Rows
+func Value(v string) *string {
+	return &v
+}
@@ -0,0 +1,127 @@
+package pgwire
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// scramMechanism is the SASL mechanism used to authenticate. Channel
+// binding, the -PLUS variant, is not supported.
+const scramMechanism = "SCRAM-SHA-256"
+
+// scramClient performs a SCRAM-SHA-256 exchange (RFC 5802 and 7677).
+// Passwords are not normalised with SASLprep, which leaves ASCII passwords
+// unchanged.
+type scramClient struct {
+	password    string
+	nonce       string
+	firstBare   string // client-first-message-bare
+	authMessage string
+	salted      []byte // SaltedPassword
+}
+
+func newSCRAMClient(password string) (*scramClient, error) {
+	raw := make([]byte, 18)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	nonce := base64.StdEncoding.EncodeToString(raw)
+	// The server takes the user name from the startup message
+	return &scramClient{password: password, nonce: nonce, firstBare: "n=,r=" + nonce}, nil
+}
+
+// firstMessage returns the client-first-message, which announces that
+// channel binding is not supported
+func (s *scramClient) firstMessage() []byte {
+	return []byte("n,," + s.firstBare)
+}
+
+// finalMessage returns the client-final-message answering the
+// server-first-message, with the proof that the client knows the password
+func (s *scramClient) finalMessage(serverFirst []byte) ([]byte, error) {
+	attrs := scramAttributes(string(serverFirst))
+	nonce, salt64, iterations := attrs["r"], attrs["s"], attrs["i"]
+	if !strings.HasPrefix(nonce, s.nonce) || len(nonce) == len(s.nonce) {
+		return nil, fmt.Errorf("server sent an invalid SCRAM nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return nil, fmt.Errorf("server sent an invalid SCRAM salt")
+	}
+	count, err := strconv.Atoi(iterations)
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("server sent an invalid SCRAM iteration count")
+	}
+
+	s.salted = hi([]byte(s.password), salt, count)
+	clientKey := hmacSHA256(s.salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + nonce // biws is "n,," in base64
+	s.authMessage = s.firstBare + "," + string(serverFirst) + "," + withoutProof
+	proof := hmacSHA256(storedKey[:], s.authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verifyServer checks the server-final-message, which proves that the
+// server knows the password too
+func (s *scramClient) verifyServer(serverFinal []byte) error {
+	attrs := scramAttributes(string(serverFinal))
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("SCRAM authentication failed: %s", e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil {
+		return fmt.Errorf("server sent an invalid SCRAM signature")
+	}
+	serverKey := hmacSHA256(s.salted, "Server Key")
+	if subtle.ConstantTimeCompare(signature, hmacSHA256(serverKey, s.authMessage)) != 1 {
+		return fmt.Errorf("server failed to prove it knows the password")
+	}
+	return nil
+}
+
+// scramAttributes splits a SCRAM message into its attributes
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if name, value, ok := strings.Cut(attr, "="); ok {
+			attrs[name] = value
+		}
+	}
+	return attrs
+}
+
+// hi is PBKDF2 with HMAC-SHA-256 for a single block, which is all the
+// 32-byte SaltedPassword takes
+func hi(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for range iterations - 1 {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for i := range result {
+			result[i] ^= u[i]
+		}
+	}
+	return result
+}
+
+// hmacSHA256 returns the HMAC-SHA-256 of msg
+func hmacSHA256(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
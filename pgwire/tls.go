@@ -0,0 +1,110 @@
+package pgwire
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// sslRequestCode asks the server to switch to TLS
+const sslRequestCode = 80877103
+
+// SSL holds the libpq SSL settings
+type SSL struct {
+	Mode     string // disable, allow, prefer (the default), require, verify-ca or verify-full
+	RootCert string // CA certificates checked by verify-ca and verify-full, the system's if empty
+	Cert     string // client certificate
+	Key      string // client key
+}
+
+// startTLS asks the server to encrypt the connection and performs the
+// handshake. Only the prefer mode carries on unencrypted if the server
+// declines.
+func (c *Conn) startTLS(ctx context.Context, config Config) error {
+	request := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), sslRequestCode)
+	if _, err := c.conn.Write(request); err != nil {
+		return fmt.Errorf("failed to request SSL: %w", err)
+	}
+	var answer [1]byte
+	if _, err := io.ReadFull(c.conn, answer[:]); err != nil {
+		return fmt.Errorf("failed to request SSL: %w", err)
+	}
+	switch answer[0] {
+	case 'S':
+	case 'N':
+		if config.SSL.Mode == "" || config.SSL.Mode == "prefer" {
+			return nil
+		}
+		return fmt.Errorf("server does not support SSL")
+	default:
+		return fmt.Errorf("unexpected answer %q to the SSL request", answer[0])
+	}
+
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return err
+	}
+	conn := tls.Client(c.conn, tlsConfig)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("SSL handshake failed: %w", err)
+	}
+	c.conn = conn
+	return nil
+}
+
+// newTLSConfig returns the TLS settings of config's SSL mode. As with libpq,
+// require checks the server certificate like verify-ca if a root
+// certificate is configured.
+func newTLSConfig(config Config) (*tls.Config, error) {
+	ssl := config.SSL
+	tlsConfig := &tls.Config{ServerName: config.Host}
+	if ssl.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(ssl.Cert, ssl.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	var roots *x509.CertPool
+	if ssl.RootCert != "" {
+		data, err := os.ReadFile(ssl.RootCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read root certificate: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", ssl.RootCert)
+		}
+	}
+
+	mode := ssl.Mode
+	if mode == "require" && roots != nil {
+		mode = "verify-ca"
+	}
+	switch mode {
+	case "verify-full":
+		tlsConfig.RootCAs = roots
+	case "verify-ca":
+		// The chain is checked, but not the host name
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("server sent no certificate")
+			}
+			options := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+			for _, cert := range state.PeerCertificates[1:] {
+				options.Intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(options)
+			return err
+		}
+	default:
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
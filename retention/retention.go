@@ -0,0 +1,127 @@
+// Package retention implements the rules deciding which backups are kept
+package retention
+
+import (
+	"fmt"
+	"time"
+)
+
+// Actions for the backups no rule keeps
+const (
+	ActionDelete  = "delete"
+	ActionArchive = "archive" // move to archive storage, kept by the archive rules
+)
+
+// Config decides which backups are kept. A backup is kept if any rule
+// selects it; everything else is deleted, or archived with action archive.
+type Config struct {
+	Rules  `yaml:",inline"`
+	Action string `yaml:"action"` // delete (default) or archive
+	// Archive decides which archived backups are kept, deleting the rest.
+	// Expired backups it would not keep are deleted without archiving.
+	Archive Rules `yaml:"archive"`
+}
+
+// Rules select the backups to keep
+type Rules struct {
+	// KeepLast keeps the N most recent backups
+	KeepLast int `yaml:"keep_last"`
+	// KeepDaily, KeepWeekly, KeepMonthly and KeepYearly keep the newest
+	// backup of each of the last N days, weeks, months and years that
+	// have backups (grandfather-father-son rotation)
+	KeepDaily   int `yaml:"keep_daily"`
+	KeepWeekly  int `yaml:"keep_weekly"`
+	KeepMonthly int `yaml:"keep_monthly"`
+	KeepYearly  int `yaml:"keep_yearly"`
+	// KeepWithinDays keeps every backup younger than N days
+	KeepWithinDays int `yaml:"keep_within_days"`
+}
+
+// IsZero reports whether no rule is configured
+func (r Config) IsZero() bool {
+	return r == Config{}
+}
+
+// Archives reports whether expired backups are archived rather than deleted
+func (r Config) Archives() bool {
+	return r.Action == ActionArchive
+}
+
+// Validate rejects negative counts and unknown actions, and checks that
+// archiving has rules of its own
+func (r Config) Validate() error {
+	if err := r.Rules.validate(); err != nil {
+		return err
+	}
+	if err := r.Archive.validate(); err != nil {
+		return err
+	}
+	switch r.Action {
+	case "", ActionDelete:
+		if r.Archive != (Rules{}) {
+			return fmt.Errorf("archive retention rules need action archive")
+		}
+	case ActionArchive:
+		if r.Archive == (Rules{}) {
+			return fmt.Errorf("action archive needs archive retention rules")
+		}
+	default:
+		return fmt.Errorf("unknown retention action %q (expected delete or archive)", r.Action)
+	}
+	return nil
+}
+
+func (r Rules) validate() error {
+	for _, n := range []int{r.KeepLast, r.KeepDaily, r.KeepWeekly, r.KeepMonthly, r.KeepYearly, r.KeepWithinDays} {
+		if n < 0 {
+			return fmt.Errorf("retention counts must not be negative")
+		}
+	}
+	return nil
+}
+
+// Keep reports for each backup, given the times they were created at,
+// whether any rule keeps it. created must be sorted newest first.
+func (r Rules) Keep(created []time.Time, now time.Time) []bool {
+	keep := make([]bool, len(created))
+
+	for i, t := range created {
+		if i < r.KeepLast {
+			keep[i] = true
+		}
+		if r.KeepWithinDays > 0 && t.After(now.AddDate(0, 0, -r.KeepWithinDays)) {
+			keep[i] = true
+		}
+	}
+
+	keepPeriods(created, r.KeepDaily, keep, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepPeriods(created, r.KeepWeekly, keep, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	})
+	keepPeriods(created, r.KeepMonthly, keep, func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+	keepPeriods(created, r.KeepYearly, keep, func(t time.Time) string {
+		return t.Format("2006")
+	})
+	return keep
+}
+
+// keepPeriods marks the newest backup in each of the n most recent periods.
+// created must be sorted newest first.
+func keepPeriods(created []time.Time, n int, keep []bool, period func(time.Time) string) {
+	seen := make(map[string]bool)
+	for i, t := range created {
+		if len(seen) >= n {
+			return
+		}
+		p := period(t.Local())
+		if !seen[p] {
+			seen[p] = true
+			keep[i] = true
+		}
+	}
+}
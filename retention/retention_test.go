@@ -0,0 +1,147 @@
+package retention
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// at returns noon local time on the given day, as keepPeriods groups
+// backups by local dates
+func at(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 12, 0, 0, 0, time.Local)
+}
+
+func TestRulesKeep(t *testing.T) {
+	now := at(2024, time.March, 15)
+	// Newest first: two backups on March 15, one each on the 14th and
+	// 11th, then the last days of February, January and December
+	created := []time.Time{
+		now,
+		now.Add(-6 * time.Hour),
+		at(2024, time.March, 14),
+		at(2024, time.March, 11),
+		at(2024, time.February, 29),
+		at(2024, time.February, 28),
+		at(2024, time.January, 31),
+		at(2023, time.December, 31),
+	}
+
+	tests := []struct {
+		name  string
+		rules Rules
+		want  []bool
+	}{
+		{
+			name:  "no rules",
+			rules: Rules{},
+			want:  []bool{false, false, false, false, false, false, false, false},
+		},
+		{
+			name:  "keep last",
+			rules: Rules{KeepLast: 3},
+			want:  []bool{true, true, true, false, false, false, false, false},
+		},
+		{
+			name:  "keep last beyond the backups",
+			rules: Rules{KeepLast: 20},
+			want:  []bool{true, true, true, true, true, true, true, true},
+		},
+		{
+			name:  "keep within days",
+			rules: Rules{KeepWithinDays: 4},
+			want:  []bool{true, true, true, false, false, false, false, false},
+		},
+		{
+			name:  "daily keeps the newest of each day",
+			rules: Rules{KeepDaily: 3},
+			want:  []bool{true, false, true, true, false, false, false, false},
+		},
+		{
+			// March 11 to 15 fall in one week, so the second is February's
+			name:  "weekly",
+			rules: Rules{KeepWeekly: 2},
+			want:  []bool{true, false, false, false, true, false, false, false},
+		},
+		{
+			name:  "monthly",
+			rules: Rules{KeepMonthly: 3},
+			want:  []bool{true, false, false, false, true, false, true, false},
+		},
+		{
+			name:  "yearly",
+			rules: Rules{KeepYearly: 5},
+			want:  []bool{true, false, false, false, false, false, false, true},
+		},
+		{
+			name:  "rules add up",
+			rules: Rules{KeepLast: 1, KeepDaily: 2, KeepMonthly: 2, KeepYearly: 2},
+			want:  []bool{true, false, true, false, true, false, false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.rules.Keep(created, now)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Keep() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeepPeriods(t *testing.T) {
+	day := func(t time.Time) string { return t.Format("2006-01-02") }
+	created := []time.Time{
+		at(2024, time.May, 3),
+		at(2024, time.May, 3).Add(-time.Hour),
+		at(2024, time.May, 2),
+		at(2024, time.May, 2).Add(-time.Hour),
+		at(2024, time.April, 30),
+	}
+
+	tests := []struct {
+		name    string
+		n       int
+		initial []bool
+		want    []bool
+	}{
+		{"none", 0, nil, []bool{false, false, false, false, false}},
+		{"one period", 1, nil, []bool{true, false, false, false, false}},
+		{"periods without backups are skipped", 3, nil, []bool{true, false, true, false, true}},
+		{"more periods than backups", 10, nil, []bool{true, false, true, false, true}},
+		{"keeps what other rules kept", 1, []bool{false, false, false, true, false}, []bool{true, false, false, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep := make([]bool, len(created))
+			copy(keep, tt.initial)
+			keepPeriods(created, tt.n, keep, day)
+			if !slices.Equal(keep, tt.want) {
+				t.Errorf("keepPeriods() = %v, want %v", keep, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"empty", Config{}, false},
+		{"delete", Config{Rules: Rules{KeepLast: 3}, Action: ActionDelete}, false},
+		{"negative count", Config{Rules: Rules{KeepDaily: -1}}, true},
+		{"archive with rules", Config{Rules: Rules{KeepLast: 3}, Action: ActionArchive, Archive: Rules{KeepMonthly: 12}}, false},
+		{"archive without rules", Config{Rules: Rules{KeepLast: 3}, Action: ActionArchive}, true},
+		{"archive rules without archiving", Config{Archive: Rules{KeepMonthly: 12}}, true},
+		{"unknown action", Config{Action: "shred"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
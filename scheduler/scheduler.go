@@ -0,0 +1,240 @@
+// Package scheduler runs a daemon whose config can be reloaded. Each loaded
+// config is scheduled as a generation; a reload stops the current
+// generation from starting work and starts a new one, while the work the
+// old one is running finishes undisturbed.
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"beackup/daemon"
+)
+
+// shutdownMargin is how long stopping may take beyond the grace period, for
+// aborted work to clean up
+const shutdownMargin = time.Minute
+
+// Task schedules work until ctx is cancelled, running the work itself under
+// runCtx
+type Task func(ctx, runCtx context.Context)
+
+// Generation is the scheduling of one loaded config
+type Generation struct {
+	stop  context.CancelFunc // stops scheduling new work
+	abort context.CancelFunc // aborts the running work
+	done  chan struct{}      // closed once scheduling stopped and work finished
+}
+
+// Start runs tasks in a new generation. Their scheduling stops when ctx is
+// cancelled or the generation is stopped.
+func Start(ctx context.Context, tasks []Task) *Generation {
+	// In-flight work runs under its own context so that a shutdown signal
+	// stops scheduling immediately but only aborts running work once the
+	// grace period has passed
+	scheduleCtx, stop := context.WithCancel(ctx)
+	runCtx, abort := context.WithCancel(context.Background())
+	g := &Generation{stop: stop, abort: abort, done: make(chan struct{})}
+
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		wg.Add(1)
+		go func(task Task) {
+			defer wg.Done()
+			task(scheduleCtx, runCtx)
+		}(task)
+	}
+	go func() {
+		wg.Wait()
+		stop()
+		abort()
+		close(g.done)
+	}()
+	return g
+}
+
+// Stop stops the generation from scheduling new work
+func (g *Generation) Stop() {
+	g.stop()
+}
+
+// Abort cancels the work the generation is running
+func (g *Generation) Abort() {
+	g.abort()
+}
+
+// Done is closed once the generation stopped and its work finished
+func (g *Generation) Done() <-chan struct{} {
+	return g.done
+}
+
+// Options are the settings of a loaded config that decide how it is run
+type Options struct {
+	Logger      *slog.Logger
+	ConfigPath  string
+	WatchConfig bool          // reload when the config file changes
+	GracePeriod time.Duration // how long running work may continue after a shutdown signal
+}
+
+// Engine is the work scheduled for one loaded config
+type Engine[E any] interface {
+	// Schedule starts the engine's tasks in a new generation
+	Schedule(ctx context.Context) *Generation
+	// Reload returns an engine for the config file as it is now
+	Reload() (E, error)
+	// Options returns how the engine is run
+	Options() Options
+}
+
+// Run schedules engine until ctx is cancelled. SIGHUP, or a change to the
+// config file if the engine watches it, replaces it with a reloaded engine,
+// which is passed to reloaded. Work still running at shutdown is given the
+// grace period to finish before it is aborted. Under systemd, readiness,
+// reloads and shutdown are notified, and the watchdog is fed while this
+// loop runs.
+func Run[E Engine[E]](ctx context.Context, engine E, reloaded func(E)) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var watchdog <-chan time.Time
+	if interval := daemon.WatchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
+	current := engine
+	generations := []*Generation{engine.Schedule(ctx)}
+	watched := readConfigFile(engine.Options().ConfigPath)
+	notify(engine.Options().Logger, "READY=1", "STATUS=Scheduling backups")
+	var watch *watcher
+	defer func() {
+		if watch != nil {
+			watch.close()
+		}
+	}()
+	var changes <-chan struct{}
+	var settle <-chan time.Time
+	for {
+		options := current.Options()
+		switch {
+		case !options.WatchConfig && watch != nil:
+			watch.close()
+			watch, changes, settle = nil, nil, nil
+		case options.WatchConfig && watch == nil:
+			watch = watchConfig(options.ConfigPath, options.Logger)
+			changes = watch.changes
+		}
+
+		select {
+		case <-ctx.Done():
+			shutdown(options, generations, watchdog)
+			return
+		case <-watchdog:
+			notify(options.Logger, "WATCHDOG=1")
+			continue
+		case <-hangup:
+			options.Logger.Info("Reloading config", "reason", "SIGHUP")
+		case <-changes:
+			settle = time.After(configSettleDelay)
+			continue
+		case <-settle:
+			settle = nil
+			data := readConfigFile(options.ConfigPath)
+			if bytes.Equal(data, watched) {
+				continue
+			}
+			options.Logger.Info("Reloading config", "reason", "config file changed")
+		}
+
+		notify(options.Logger, "RELOADING=1")
+		watched = readConfigFile(options.ConfigPath)
+		next, err := current.Reload()
+		if err != nil {
+			options.Logger.Error("Failed to reload config, keeping the current one", "error", err)
+			notify(options.Logger, "READY=1")
+			continue
+		}
+
+		// Work already running finishes under the old generation, which
+		// stops scheduling more
+		generations[len(generations)-1].Stop()
+		current = next
+		generations = append(prune(generations), next.Schedule(ctx))
+		reloaded(next)
+		notify(next.Options().Logger, "READY=1")
+	}
+}
+
+// shutdown waits for the work of every generation to finish, aborting it
+// once the grace period has passed. systemd is told to wait that long.
+func shutdown(options Options, generations []*Generation, watchdog <-chan time.Time) {
+	logger := options.Logger
+	logger.Info("Shutting down, waiting for running backups", "grace_period", options.GracePeriod)
+	notify(logger, "STOPPING=1", "STATUS=Waiting for running backups",
+		fmt.Sprintf("EXTEND_TIMEOUT_USEC=%d", (options.GracePeriod+shutdownMargin).Microseconds()))
+
+	done := make(chan struct{})
+	go func() {
+		for _, g := range generations {
+			<-g.done
+		}
+		close(done)
+	}()
+
+	timer := time.NewTimer(options.GracePeriod)
+	defer timer.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		case <-watchdog:
+			notify(logger, "WATCHDOG=1")
+		case <-timer.C:
+			logger.Warn("Grace period expired, aborting running backups")
+			notify(logger, "STATUS=Aborting running backups")
+			for _, g := range generations {
+				g.abort()
+			}
+			<-done
+			waiting = false
+		}
+	}
+
+	logger.Info("Shutdown complete")
+}
+
+// notify sends states to systemd, logging failures
+func notify(logger *slog.Logger, states ...string) {
+	if err := daemon.Notify(states...); err != nil {
+		logger.Warn("Failed to notify systemd", "error", err)
+	}
+}
+
+// prune drops the generations that have finished
+func prune(generations []*Generation) []*Generation {
+	var running []*Generation
+	for _, g := range generations {
+		select {
+		case <-g.done:
+		default:
+			running = append(running, g)
+		}
+	}
+	return running
+}
+
+// readConfigFile returns the contents of the config file, or nil if it
+// cannot be read
+func readConfigFile(path string) []byte {
+	data, _ := os.ReadFile(path)
+	return data
+}
@@ -0,0 +1,64 @@
+package scheduler
+
+import (
+	"log/slog"
+	"time"
+)
+
+// configPollInterval is how often the config file is checked for changes
+// where it cannot be watched
+const configPollInterval = 5 * time.Second
+
+// configSettleDelay is how long a change to the config file is left to
+// settle before the file is read, as editors often write it in several steps
+const configSettleDelay = 500 * time.Millisecond
+
+// watcher reports possible changes to the config file until it is closed.
+// Reports may be spurious; the file's contents tell whether it changed.
+type watcher struct {
+	changes chan struct{}
+	close   func()
+}
+
+// watchConfig watches the config file at path, polling it where the file
+// system cannot be watched
+func watchConfig(path string, logger *slog.Logger) *watcher {
+	w, err := watchFile(path)
+	if err != nil {
+		logger.Warn("Failed to watch the config file, polling it instead", "error", err, "interval", configPollInterval)
+		return pollFile()
+	}
+	return w
+}
+
+// pollFile reports a possible change every configPollInterval
+func pollFile() *watcher {
+	ticker := time.NewTicker(configPollInterval)
+	done := make(chan struct{})
+	w := &watcher{
+		changes: make(chan struct{}, 1),
+		close: func() {
+			ticker.Stop()
+			close(done)
+		},
+	}
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				w.report()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// report queues a change unless one is already queued
+func (w *watcher) report() {
+	select {
+	case w.changes <- struct{}{}:
+	default:
+	}
+}
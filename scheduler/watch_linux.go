@@ -0,0 +1,44 @@
+package scheduler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// watchFile watches the directory of the config file with inotify. Every
+// change in the directory is reported, as editors and config management
+// replace files by renaming them or swapping symlinks rather than writing
+// them in place.
+func watchFile(path string) (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up inotify: %w", err)
+	}
+	dir := filepath.Dir(path)
+	const mask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+		syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+
+	// As the descriptor is non-blocking, reads wait in the runtime poller
+	// and closing the file ends them
+	file := os.NewFile(uintptr(fd), "inotify")
+	w := &watcher{
+		changes: make(chan struct{}, 1),
+		close:   func() { file.Close() },
+	}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := file.Read(buf); err != nil {
+				return
+			}
+			w.report()
+		}
+	}()
+	return w, nil
+}
@@ -0,0 +1,49 @@
+package scheduler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("a: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := watchFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+
+	expectChange := func(what string) {
+		t.Helper()
+		select {
+		case <-w.changes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no change reported after %s", what)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("a: 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectChange("writing the file")
+
+	// Editors save by writing a new file and renaming it over the old one
+	tmp := filepath.Join(dir, ".config.yaml.swp")
+	if err := os.WriteFile(tmp, []byte("a: 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	for len(w.changes) > 0 {
+		<-w.changes
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	expectChange("renaming a file over it")
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package scheduler
+
+// watchFile polls the config file, as it is only watched on Linux
+func watchFile(path string) (*watcher, error) {
+	return pollFile(), nil
+}
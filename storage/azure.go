@@ -0,0 +1,499 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// azureAPIVersion is the Blob service REST API version requests are made
+// against
+const azureAPIVersion = "2021-08-06"
+
+// AzureConfig configures an Azure Blob Storage container destination.
+// Credentials are taken from, in order: a connection string, an account
+// key, or the managed identity of the host.
+type AzureConfig struct {
+	Account   string `yaml:"account"`
+	Container string `yaml:"container"`
+	// Prefix is prepended to every blob name, e.g. so lifecycle management
+	// rules can target backups
+	Prefix           string `yaml:"prefix"`
+	ConnectionString string `yaml:"connection_string"`
+	AccountKey       string `yaml:"account_key"`
+	ManagedIdentity  bool   `yaml:"managed_identity"`
+	ClientID         string `yaml:"client_id"` // user-assigned managed identity
+	Endpoint         string `yaml:"endpoint"`  // custom endpoint, e.g. Azurite
+	BlockSizeMB      int    `yaml:"block_size_mb"`
+}
+
+// Azure stores backups in an Azure Blob Storage container
+type Azure struct {
+	config    AzureConfig
+	endpoint  *url.URL
+	key       []byte       // shared key, if authenticating with one
+	sas       url.Values   // shared access signature, if given one
+	tokens    *tokenSource // managed identity tokens otherwise
+	blockSize int
+	client    *http.Client
+}
+
+// NewAzure creates an Azure Blob backend, falling back to the standard
+// AZURE_STORAGE_* environment variables for credentials
+func NewAzure(config AzureConfig) (*Azure, error) {
+	if config.Container == "" {
+		return nil, fmt.Errorf("azure container is required")
+	}
+
+	a := &Azure{
+		config:    config,
+		blockSize: defaultPartSize,
+		client:    &http.Client{},
+	}
+	if config.BlockSizeMB > 0 {
+		a.blockSize = config.BlockSizeMB << 20
+	}
+
+	endpoint := config.Endpoint
+	connectionString := firstNonEmpty(config.ConnectionString, os.Getenv("AZURE_STORAGE_CONNECTION_STRING"))
+	switch {
+	case connectionString != "":
+		settings := parseConnectionString(connectionString)
+		a.config.Account = firstNonEmpty(settings["AccountName"], config.Account)
+		if settings["SharedAccessSignature"] != "" {
+			sas, err := url.ParseQuery(strings.TrimPrefix(settings["SharedAccessSignature"], "?"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid azure shared access signature: %w", err)
+			}
+			a.sas = sas
+		} else if err := a.setKey(settings["AccountKey"]); err != nil {
+			return nil, err
+		}
+		if endpoint == "" {
+			endpoint = settings["BlobEndpoint"]
+		}
+		if endpoint == "" && settings["EndpointSuffix"] != "" {
+			endpoint = fmt.Sprintf("%s://%s.blob.%s",
+				firstNonEmpty(settings["DefaultEndpointsProtocol"], "https"), a.config.Account, settings["EndpointSuffix"])
+		}
+
+	case firstNonEmpty(config.AccountKey, os.Getenv("AZURE_STORAGE_KEY")) != "":
+		a.config.Account = firstNonEmpty(config.Account, os.Getenv("AZURE_STORAGE_ACCOUNT"))
+		if err := a.setKey(firstNonEmpty(config.AccountKey, os.Getenv("AZURE_STORAGE_KEY"))); err != nil {
+			return nil, err
+		}
+
+	case config.ManagedIdentity:
+		a.config.Account = firstNonEmpty(config.Account, os.Getenv("AZURE_STORAGE_ACCOUNT"))
+		a.tokens = &tokenSource{fetch: func(ctx context.Context) (accessToken, error) {
+			return managedIdentityToken(ctx, a.client, config.ClientID)
+		}}
+
+	default:
+		return nil, fmt.Errorf("azure credentials are not configured")
+	}
+
+	if a.config.Account == "" {
+		return nil, fmt.Errorf("azure storage account is required")
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", a.config.Account)
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid azure endpoint: %w", err)
+	}
+	a.endpoint = u
+	return a, nil
+}
+
+// setKey decodes a base64 account key
+func (a *Azure) setKey(encoded string) error {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) == 0 {
+		return fmt.Errorf("invalid azure account key")
+	}
+	a.key = key
+	return nil
+}
+
+// parseConnectionString splits an Azure Storage connection string into its
+// settings
+func parseConnectionString(s string) map[string]string {
+	settings := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			settings[name] = value
+		}
+	}
+	return settings
+}
+
+// Put uploads r, staging it as several blocks when it exceeds one block
+func (a *Azure) Put(ctx context.Context, key string, r io.Reader) error {
+	buf := make([]byte, a.blockSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return a.putBlob(ctx, key, buf[:n])
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read upload data: %w", err)
+	}
+
+	return a.putBlocks(ctx, key, buf, r)
+}
+
+// putBlob uploads data with a single request
+func (a *Azure) putBlob(ctx context.Context, key string, data []byte) error {
+	headers := map[string]string{"x-ms-blob-type": "BlockBlob"}
+	resp, err := a.do(ctx, http.MethodPut, a.blobName(key), nil, headers, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// putBlocks stages first followed by the remainder of r as blocks and then
+// commits them. Blocks that are never committed are discarded by the
+// service after a week.
+func (a *Azure) putBlocks(ctx context.Context, key string, first []byte, r io.Reader) error {
+	blob := a.blobName(key)
+	var blockIDs []string
+	data := first
+
+	for i := 0; ; i++ {
+		blockID := blockID(i)
+		query := url.Values{"comp": {"block"}, "blockid": {blockID}}
+		resp, err := a.do(ctx, http.MethodPut, blob, query, nil, data)
+		if err != nil {
+			return fmt.Errorf("failed to upload block %d: %w", i, err)
+		}
+		resp.Body.Close()
+		blockIDs = append(blockIDs, blockID)
+
+		buf := make([]byte, a.blockSize)
+		n, err := io.ReadFull(r, buf)
+		if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to read upload data: %w", err)
+		}
+		data = buf[:n]
+	}
+
+	return a.commitBlocks(ctx, blob, blockIDs)
+}
+
+// blockID returns the id of the block at index i of a blob; ids must all
+// have the same length
+func blockID(i int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", i)))
+}
+
+// commitBlocks makes the staged blocks the content of blob, in order
+func (a *Azure) commitBlocks(ctx context.Context, blob string, blockIDs []string) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{Latest: blockIDs})
+	if err != nil {
+		return fmt.Errorf("failed to encode block list: %w", err)
+	}
+	resp, err := a.do(ctx, http.MethodPut, blob, url.Values{"comp": {"blocklist"}}, nil, append([]byte(xml.Header), body...))
+	if err != nil {
+		if strings.Contains(err.Error(), "InvalidBlockList") {
+			err = uploadNotFoundError{err}
+		}
+		return fmt.Errorf("failed to commit block list: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// PartSize returns the block size
+func (a *Azure) PartSize() int64 {
+	return int64(a.blockSize)
+}
+
+// StartUpload does nothing, as staged blocks need no upload to belong to.
+// Blocks are named by their position, so a later upload of the blob
+// replaces them.
+func (a *Azure) StartUpload(ctx context.Context, key string) (string, error) {
+	return "", nil
+}
+
+// UploadPart stages one block, which Azure checks against the block's MD5
+func (a *Azure) UploadPart(ctx context.Context, key, uploadID string, part UploadedPart, data []byte, total int64) (string, error) {
+	query := url.Values{"comp": {"block"}, "blockid": {blockID(part.Number - 1)}}
+	resp, err := a.do(ctx, http.MethodPut, a.blobName(key), query, map[string]string{"Content-MD5": part.MD5}, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload block %d: %w", part.Number-1, err)
+	}
+	resp.Body.Close()
+	return "", nil
+}
+
+// CompleteUpload commits the staged blocks. Blocks the service discarded
+// in the meantime fail the commit with ErrUploadNotFound.
+func (a *Azure) CompleteUpload(ctx context.Context, key, uploadID string, parts []UploadedPart) error {
+	blockIDs := make([]string, len(parts))
+	for i, part := range parts {
+		blockIDs[i] = blockID(part.Number - 1)
+	}
+	return a.commitBlocks(ctx, a.blobName(key), blockIDs)
+}
+
+// AbortUpload does nothing, as the service discards blocks that are never
+// committed after a week
+func (a *Azure) AbortUpload(key, uploadID string) {}
+
+// Get opens a blob for reading
+func (a *Azure) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := a.do(ctx, http.MethodGet, a.blobName(key), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// List returns all blobs under prefix, relative to the configured prefix
+func (a *Azure) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	marker := ""
+
+	for {
+		query := url.Values{
+			"restype": {"container"},
+			"comp":    {"list"},
+			"prefix":  {a.blobName(prefix)},
+		}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+
+		resp, err := a.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Blobs []struct {
+				Name       string `xml:"Name"`
+				Properties struct {
+					ContentLength int64  `xml:"Content-Length"`
+					LastModified  string `xml:"Last-Modified"`
+				} `xml:"Properties"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse list response: %w", err)
+		}
+
+		for _, blob := range result.Blobs {
+			modTime, _ := time.Parse(http.TimeFormat, blob.Properties.LastModified)
+			objects = append(objects, Object{
+				Key:     withoutPrefix(a.config.Prefix, blob.Name),
+				Size:    blob.Properties.ContentLength,
+				ModTime: modTime,
+			})
+		}
+
+		if result.NextMarker == "" {
+			return objects, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+// Delete removes a blob
+func (a *Azure) Delete(ctx context.Context, key string) error {
+	resp, err := a.do(ctx, http.MethodDelete, a.blobName(key), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// blobName prepends the configured prefix to key
+func (a *Azure) blobName(key string) string {
+	return withPrefix(a.config.Prefix, key)
+}
+
+// requestURL builds the URL of a blob, or of the container when blob is
+// empty
+func (a *Azure) requestURL(blob string, query url.Values) *url.URL {
+	u := *a.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + a.config.Container
+	if blob != "" {
+		u.Path += "/" + blob
+	}
+
+	all := url.Values{}
+	for name, values := range a.sas {
+		all[name] = values
+	}
+	for name, values := range query {
+		all[name] = values
+	}
+	u.RawQuery = all.Encode()
+	return &u
+}
+
+// do sends an authorized request and returns the response if it succeeded
+func (a *Azure) do(ctx context.Context, method, blob string, query url.Values, headers map[string]string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, a.requestURL(blob, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.ContentLength = int64(len(body))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+
+	switch {
+	case a.key != nil:
+		a.signSharedKey(req, query)
+	case a.tokens != nil:
+		token, err := a.tokens.get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get azure access token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("azure request failed: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, parseAzureError(resp.StatusCode, respBody)
+	}
+	return resp, nil
+}
+
+// signSharedKey adds a Shared Key authorization header to req
+func (a *Azure) signSharedKey(req *http.Request, query url.Values) {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var msHeaders []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower+":"+strings.TrimSpace(req.Header.Get(name))+"\n")
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + a.config.Account + req.URL.EscapedPath()
+	var params []string
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + strings.Join(msHeaders, "") + resource
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(stringToSign))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	req.Header.Set("Authorization", "SharedKey "+a.config.Account+":"+signature)
+}
+
+// parseAzureError extracts the error code and message from a Blob service
+// error response
+func parseAzureError(status int, body []byte) error {
+	var azureErr struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.Unmarshal(body, &azureErr); err != nil || azureErr.Code == "" {
+		return fmt.Errorf("azure request failed with status %d", status)
+	}
+	return fmt.Errorf("azure request failed with status %d: %s: %s", status, azureErr.Code, strings.TrimSpace(azureErr.Message))
+}
+
+// managedIdentityToken fetches a storage access token for the host's
+// managed identity, from App Service's identity endpoint when present and
+// from the instance metadata service otherwise
+func managedIdentityToken(ctx context.Context, client *http.Client, clientID string) (accessToken, error) {
+	const resource = "https://storage.azure.com/"
+
+	query := url.Values{"resource": {resource}}
+	if clientID != "" {
+		query.Set("client_id", clientID)
+	}
+
+	var req *http.Request
+	var err error
+	if endpoint := os.Getenv("IDENTITY_ENDPOINT"); endpoint != "" {
+		query.Set("api-version", "2019-08-01")
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			return accessToken{}, err
+		}
+		req.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+	} else {
+		query.Set("api-version", "2018-02-01")
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet,
+			"http://169.254.169.254/metadata/identity/oauth2/token?"+query.Encode(), nil)
+		if err != nil {
+			return accessToken{}, err
+		}
+		req.Header.Set("Metadata", "true")
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := fetchJSON(client, req, &result); err != nil {
+		return accessToken{}, fmt.Errorf("failed to get managed identity token: %w", err)
+	}
+	expiresOn, err := strconv.ParseInt(result.ExpiresOn, 10, 64)
+	if err != nil {
+		return accessToken{}, fmt.Errorf("invalid managed identity token expiry %q", result.ExpiresOn)
+	}
+	return accessToken{value: result.AccessToken, expires: time.Unix(expiresOn, 0)}, nil
+}
@@ -0,0 +1,538 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultChunkSize is the resumable upload chunk size used when none is
+// configured. GCS requires a multiple of 256 KiB.
+const defaultChunkSize = 16 << 20
+
+// gcsScope is the OAuth scope needed to read and write objects
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// GCSConfig configures a Google Cloud Storage bucket destination
+type GCSConfig struct {
+	Bucket string `yaml:"bucket"`
+	// Prefix is prepended to every object name, e.g. so bucket lifecycle
+	// rules can target backups
+	Prefix string `yaml:"prefix"`
+	// CredentialsFile is a service account JSON key. Without one,
+	// GOOGLE_APPLICATION_CREDENTIALS and then the metadata server of the
+	// instance are used.
+	CredentialsFile string `yaml:"credentials_file"`
+	Endpoint        string `yaml:"endpoint"` // custom endpoint, e.g. an emulator
+	ChunkSizeMB     int    `yaml:"chunk_size_mb"`
+}
+
+// GCS stores backups in a Google Cloud Storage bucket using the JSON API
+type GCS struct {
+	config    GCSConfig
+	endpoint  string
+	chunkSize int
+	tokens    *tokenSource
+	client    *http.Client
+	lock      Lock
+}
+
+// NewGCS creates a GCS backend
+func NewGCS(config GCSConfig) (*GCS, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("gcs bucket is required")
+	}
+
+	g := &GCS{
+		config:    config,
+		endpoint:  strings.TrimSuffix(firstNonEmpty(config.Endpoint, "https://storage.googleapis.com"), "/"),
+		chunkSize: defaultChunkSize,
+		client:    &http.Client{},
+	}
+	if config.ChunkSizeMB > 0 {
+		g.chunkSize = config.ChunkSizeMB << 20
+	}
+
+	credentialsFile := firstNonEmpty(config.CredentialsFile, os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+	if credentialsFile != "" {
+		account, err := loadServiceAccount(credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		g.tokens = &tokenSource{fetch: func(ctx context.Context) (accessToken, error) {
+			return account.token(ctx, g.client)
+		}}
+	} else {
+		g.tokens = &tokenSource{fetch: func(ctx context.Context) (accessToken, error) {
+			return metadataToken(ctx, g.client)
+		}}
+	}
+	return g, nil
+}
+
+// Put uploads r, switching to a resumable upload when it exceeds one chunk
+func (g *GCS) Put(ctx context.Context, key string, r io.Reader) error {
+	buf := make([]byte, g.chunkSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return g.putObject(ctx, key, buf[:n])
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read upload data: %w", err)
+	}
+
+	return g.putResumable(ctx, key, buf, r)
+}
+
+// putObject uploads data with a single request, along with the object's
+// metadata when it is locked
+func (g *GCS) putObject(ctx context.Context, key string, data []byte) error {
+	if g.lock.Enabled() {
+		return g.putMultipart(ctx, key, data)
+	}
+	query := url.Values{"uploadType": {"media"}, "name": {g.objectName(key)}}
+	resp, err := g.do(ctx, http.MethodPost, g.uploadURL(query), nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// putMultipart uploads data and the object's metadata in one multipart
+// request
+func (g *GCS) putMultipart(ctx context.Context, key string, data []byte) error {
+	metadata, err := g.uploadMetadata(key)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		data        []byte
+	}{{"application/json; charset=UTF-8", metadata}, {"application/octet-stream", data}} {
+		pw, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+		if err != nil {
+			return fmt.Errorf("failed to encode upload: %w", err)
+		}
+		pw.Write(part.data)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to encode upload: %w", err)
+	}
+
+	query := url.Values{"uploadType": {"multipart"}}
+	headers := map[string]string{"Content-Type": "multipart/related; boundary=" + w.Boundary()}
+	resp, err := g.do(ctx, http.MethodPost, g.uploadURL(query), headers, body.Bytes())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// putResumable uploads first followed by the remainder of r in chunks
+// through a resumable upload session
+func (g *GCS) putResumable(ctx context.Context, key string, first []byte, r io.Reader) error {
+	session, err := g.StartUpload(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if err := g.uploadChunks(ctx, session, first, r); err != nil {
+		g.cancelResumable(session)
+		return err
+	}
+	return nil
+}
+
+func (g *GCS) uploadChunks(ctx context.Context, session string, first []byte, r io.Reader) error {
+	data := first
+	var offset int64
+
+	for {
+		// Read ahead so the last chunk can be sent with the total size
+		next := make([]byte, g.chunkSize)
+		n, err := io.ReadFull(r, next)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to read upload data: %w", err)
+		}
+		last := n == 0
+
+		end := offset + int64(len(data)) - 1
+		total := "*"
+		if last {
+			total = fmt.Sprint(end + 1)
+		}
+		headers := map[string]string{"Content-Range": fmt.Sprintf("bytes %d-%d/%s", offset, end, total)}
+
+		resp, err := g.do(ctx, http.MethodPut, session, headers, data)
+		if err != nil {
+			return fmt.Errorf("failed to upload chunk at offset %d: %w", offset, err)
+		}
+		resp.Body.Close()
+
+		if last {
+			return nil
+		}
+		offset = end + 1
+		data = next[:n]
+	}
+}
+
+// cancelResumable discards a failed resumable upload session
+func (g *GCS) cancelResumable(session string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := g.do(ctx, http.MethodDelete, session, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// uploadMetadata returns the metadata of a new locked object, which sets
+// its retention. Compliance locks, like GCS locked retentions, cannot be
+// shortened or removed.
+func (g *GCS) uploadMetadata(key string) ([]byte, error) {
+	mode := "Unlocked"
+	if g.lock.Mode == "compliance" {
+		mode = "Locked"
+	}
+	type retention struct {
+		Mode            string `json:"mode"`
+		RetainUntilTime string `json:"retainUntilTime"`
+	}
+	data, err := json.Marshal(struct {
+		Name      string    `json:"name"`
+		Retention retention `json:"retention"`
+	}{g.objectName(key), retention{mode, g.lock.Until(time.Now()).Format(time.RFC3339)}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode object metadata: %w", err)
+	}
+	return data, nil
+}
+
+// SetLock locks every object uploaded from now on with a GCS object
+// retention, which must be enabled on the bucket
+func (g *GCS) SetLock(lock Lock) {
+	g.lock = lock
+}
+
+// PartSize returns the resumable upload chunk size
+func (g *GCS) PartSize() int64 {
+	return int64(g.chunkSize)
+}
+
+// StartUpload begins a resumable upload of key and returns its session URL
+func (g *GCS) StartUpload(ctx context.Context, key string) (string, error) {
+	query := url.Values{"uploadType": {"resumable"}, "name": {g.objectName(key)}}
+	var headers map[string]string
+	var metadata []byte
+	if g.lock.Enabled() {
+		var err error
+		if metadata, err = g.uploadMetadata(key); err != nil {
+			return "", err
+		}
+		headers = map[string]string{"Content-Type": "application/json; charset=UTF-8"}
+	}
+	resp, err := g.do(ctx, http.MethodPost, g.uploadURL(query), headers, metadata)
+	if err != nil {
+		return "", fmt.Errorf("failed to start resumable upload: %w", err)
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return "", fmt.Errorf("failed to start resumable upload: no session URL returned")
+	}
+	return session, nil
+}
+
+// expiredSession matches the errors GCS reports for a resumable upload
+// session that no longer exists
+var expiredSession = regexp.MustCompile(`status (404|410)\b`)
+
+// UploadPart uploads one chunk of a resumable upload, checking that GCS
+// persisted all of it. The last chunk completes the upload.
+func (g *GCS) UploadPart(ctx context.Context, key, session string, part UploadedPart, data []byte, total int64) (string, error) {
+	end := part.Offset + part.Size - 1
+	headers := map[string]string{"Content-Range": fmt.Sprintf("bytes %d-%d/%d", part.Offset, end, total)}
+	resp, err := g.do(ctx, http.MethodPut, session, headers, data)
+	if err != nil {
+		if expiredSession.MatchString(err.Error()) {
+			err = uploadNotFoundError{err}
+		}
+		return "", fmt.Errorf("failed to upload chunk at offset %d: %w", part.Offset, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPermanentRedirect {
+		if persisted := resp.Header.Get("Range"); persisted != fmt.Sprintf("bytes=0-%d", end) {
+			return "", fmt.Errorf("failed to upload chunk at offset %d: gcs persisted %q", part.Offset, persisted)
+		}
+	}
+	return "", nil
+}
+
+// CompleteUpload does nothing, as GCS completes a resumable upload with
+// its last chunk
+func (g *GCS) CompleteUpload(ctx context.Context, key, session string, parts []UploadedPart) error {
+	return nil
+}
+
+// AbortUpload discards an unfinished resumable upload
+func (g *GCS) AbortUpload(key, session string) {
+	g.cancelResumable(session)
+}
+
+// Get opens an object for reading
+func (g *GCS) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := g.do(ctx, http.MethodGet, g.objectURL(key)+"?alt=media", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// List returns all objects under prefix, relative to the configured prefix
+func (g *GCS) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	pageToken := ""
+
+	for {
+		query := url.Values{"prefix": {g.objectName(prefix)}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		resp, err := g.do(ctx, http.MethodGet, g.bucketURL()+"/o?"+query.Encode(), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Items []struct {
+				Name    string    `json:"name"`
+				Size    int64     `json:"size,string"`
+				Updated time.Time `json:"updated"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse list response: %w", err)
+		}
+
+		for _, item := range result.Items {
+			objects = append(objects, Object{
+				Key:     withoutPrefix(g.config.Prefix, item.Name),
+				Size:    item.Size,
+				ModTime: item.Updated,
+			})
+		}
+
+		if result.NextPageToken == "" {
+			return objects, nil
+		}
+		pageToken = result.NextPageToken
+	}
+}
+
+// Delete removes an object
+func (g *GCS) Delete(ctx context.Context, key string) error {
+	resp, err := g.do(ctx, http.MethodDelete, g.objectURL(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// objectName prepends the configured prefix to key
+func (g *GCS) objectName(key string) string {
+	return withPrefix(g.config.Prefix, key)
+}
+
+func (g *GCS) bucketURL() string {
+	return g.endpoint + "/storage/v1/b/" + url.PathEscape(g.config.Bucket)
+}
+
+// objectURL returns the metadata URL of an object; the name is escaped as
+// a single path segment as the JSON API requires
+func (g *GCS) objectURL(key string) string {
+	return g.bucketURL() + "/o/" + url.PathEscape(g.objectName(key))
+}
+
+func (g *GCS) uploadURL(query url.Values) string {
+	return g.endpoint + "/upload/storage/v1/b/" + url.PathEscape(g.config.Bucket) + "/o?" + query.Encode()
+}
+
+// do sends an authorized request and returns the response if it succeeded.
+// 308 counts as success as it acknowledges a resumable upload chunk.
+func (g *GCS) do(ctx context.Context, method, rawURL string, headers map[string]string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.ContentLength = int64(len(body))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	token, err := g.tokens.get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gcs access token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("gcs request failed: %w", err)
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusPermanentRedirect {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, parseGCSError(resp.StatusCode, respBody)
+	}
+	return resp, nil
+}
+
+// parseGCSError extracts the message from a JSON API error response
+func parseGCSError(status int, body []byte) error {
+	var gcsErr struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &gcsErr); err != nil || gcsErr.Error.Message == "" {
+		return fmt.Errorf("gcs request failed with status %d", status)
+	}
+	return fmt.Errorf("gcs request failed with status %d: %s", status, gcsErr.Error.Message)
+}
+
+// serviceAccount holds the fields of a service account key file needed to
+// obtain access tokens
+type serviceAccount struct {
+	Type        string `json:"type"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+}
+
+// loadServiceAccount reads and parses a service account JSON key
+func loadServiceAccount(path string) (*serviceAccount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gcs credentials: %w", err)
+	}
+
+	var account serviceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("failed to parse gcs credentials: %w", err)
+	}
+	if account.Type != "service_account" {
+		return nil, fmt.Errorf("gcs credentials must be a service account key, got %q", account.Type)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("gcs credentials contain no private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse gcs private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("gcs private key is not an RSA key")
+	}
+	account.key = rsaKey
+	return &account, nil
+}
+
+// token exchanges a signed JWT assertion for an access token
+func (a *serviceAccount) token(ctx context.Context, client *http.Client) (accessToken, error) {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]any{
+		"iss":   a.ClientEmail,
+		"scope": gcsScope,
+		"aud":   a.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return accessToken{}, err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return accessToken{}, fmt.Errorf("failed to sign token request: %w", err)
+	}
+	assertion := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return accessToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := fetchJSON(client, req, &result); err != nil {
+		return accessToken{}, err
+	}
+	return accessToken{value: result.AccessToken, expires: now.Add(time.Duration(result.ExpiresIn) * time.Second)}, nil
+}
+
+// metadataToken fetches an access token for the instance's service account
+// from the GCE metadata server
+func metadataToken(ctx context.Context, client *http.Client) (accessToken, error) {
+	host := firstNonEmpty(os.Getenv("GCE_METADATA_HOST"), "metadata.google.internal")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return accessToken{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := fetchJSON(client, req, &result); err != nil {
+		return accessToken{}, fmt.Errorf("no gcs credentials configured and metadata server unavailable: %w", err)
+	}
+	return accessToken{value: result.AccessToken, expires: time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)}, nil
+}
@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"time"
+)
+
+// Lock makes uploaded objects immutable for a while, so that neither a
+// mistake nor stolen credentials can overwrite or delete them
+type Lock struct {
+	// Mode is governance, which principals allowed to bypass it can lift,
+	// or compliance, which nobody can lift before it expires
+	Mode string `yaml:"mode"`
+	Days int    `yaml:"days"` // how long each object stays locked after its upload
+}
+
+// Enabled reports whether objects are locked
+func (l Lock) Enabled() bool {
+	return l.Days > 0
+}
+
+// Until returns when an object uploaded at t stops being locked
+func (l Lock) Until(t time.Time) time.Time {
+	return t.AddDate(0, 0, l.Days).UTC().Truncate(time.Second)
+}
+
+// Locker is implemented by backends that can lock the objects they upload
+type Locker interface {
+	// SetLock locks every object uploaded from now on
+	SetLock(lock Lock)
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PartUploader is implemented by backends that upload large objects as
+// separately sent parts, so that an interrupted upload can be resumed
+// where it stopped instead of starting over
+type PartUploader interface {
+	// PartSize returns the size of every part but the last
+	PartSize() int64
+	// StartUpload begins an upload of key and returns its id
+	StartUpload(ctx context.Context, key string) (string, error)
+	// UploadPart sends one part of an upload of total bytes and returns the
+	// tag CompleteUpload needs for it
+	UploadPart(ctx context.Context, key, uploadID string, part UploadedPart, data []byte, total int64) (string, error)
+	// CompleteUpload assembles the uploaded parts into the object
+	CompleteUpload(ctx context.Context, key, uploadID string, parts []UploadedPart) error
+	// AbortUpload discards the parts of an unfinished upload
+	AbortUpload(key, uploadID string)
+}
+
+// ErrUploadNotFound is returned by a PartUploader when the upload to resume
+// no longer exists, e.g. because the service expired it
+var ErrUploadNotFound = errors.New("upload no longer exists")
+
+// maxParts is the most parts an upload can have, the limit of S3, which
+// allows the fewest
+const maxParts = 10000
+
+// errPartChanged means the file no longer matches the parts uploaded so far
+var errPartChanged = errors.New("file changed since the upload started")
+
+// UploadState records the progress of an upload by PutFile, so that it can
+// be resumed by a later call
+type UploadState struct {
+	Key      string         `json:"key"`
+	UploadID string         `json:"upload_id"`
+	Size     int64          `json:"size"` // of the file being uploaded
+	ModTime  time.Time      `json:"mod_time"`
+	PartSize int64          `json:"part_size"`
+	Parts    []UploadedPart `json:"parts"` // uploaded so far, in order
+}
+
+// UploadedPart describes one part of an upload
+type UploadedPart struct {
+	Number int    `json:"number"` // from 1
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	MD5    string `json:"md5"`    // base64, checked by the service where it supports it
+	SHA256 string `json:"sha256"` // hex, compared with the file before resuming
+	ETag   string `json:"etag,omitempty"`
+}
+
+// LoadUploadState reads the upload state saved at path
+func LoadUploadState(path string) (*UploadState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state UploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse upload state %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// save writes the state to path, replacing it atomically
+func (s *UploadState) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode upload state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to write upload state: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write upload state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write upload state: %w", err)
+	}
+	return nil
+}
+
+// DiscardUpload aborts the upload recorded at statePath, if any, and
+// removes the state
+func DiscardUpload(backend Backend, statePath string) error {
+	state, err := LoadUploadState(statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if u, ok := backend.(PartUploader); ok && err == nil {
+		u.AbortUpload(state.Key, state.UploadID)
+	}
+	if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// PutFile uploads the file at path under key and returns its hex SHA-256.
+// Files larger than a part of a PartUploader are uploaded part by part,
+// each recorded in statePath once sent; a later call for the same file
+// resumes from the last recorded part after checking the parts before it
+// still match, and the state is removed once the upload completes. wrap,
+// if set, is applied to the data read for each part sent.
+func PutFile(ctx context.Context, backend Backend, key, path, statePath string, wrap func(io.Reader) io.Reader) (string, error) {
+	if wrap == nil {
+		wrap = func(r io.Reader) io.Reader { return r }
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	u, ok := backend.(PartUploader)
+	if !ok || info.Size() <= u.PartSize() {
+		// Hashed in a read of its own so that backends still get the file
+		// itself, which SFTP hands to sftp without copying it
+		hash := sha256.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			return "", fmt.Errorf("failed to read upload data: %w", err)
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return "", fmt.Errorf("failed to read upload data: %w", err)
+		}
+		if err := backend.Put(ctx, key, wrap(file)); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+	partSize := filePartSize(u, info.Size())
+
+	state, err := LoadUploadState(statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if state != nil && (state.Key != key || state.Size != info.Size() || !state.ModTime.Equal(info.ModTime()) || state.PartSize != partSize) {
+		if err := DiscardUpload(backend, statePath); err != nil {
+			return "", err
+		}
+		state = nil
+	}
+
+	for restarted := false; ; restarted = true {
+		if state == nil {
+			uploadID, err := u.StartUpload(ctx, key)
+			if err != nil {
+				return "", err
+			}
+			state = &UploadState{Key: key, UploadID: uploadID, Size: info.Size(), ModTime: info.ModTime(), PartSize: partSize}
+			if err := state.save(statePath); err != nil {
+				u.AbortUpload(key, uploadID)
+				return "", err
+			}
+		}
+
+		sum, err := uploadFileParts(ctx, u, state, file, statePath, wrap)
+		if err == nil {
+			if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+				return "", err
+			}
+			return sum, nil
+		}
+		// Start over once if the upload expired or the file changed under it
+		if restarted || !errors.Is(err, ErrUploadNotFound) && !errors.Is(err, errPartChanged) {
+			return "", err
+		}
+		if err := DiscardUpload(backend, statePath); err != nil {
+			return "", err
+		}
+		state = nil
+	}
+}
+
+// filePartSize returns the size of the parts a file of size bytes is
+// uploaded in: the part size of u, or a multiple of it if the file would
+// otherwise need more than maxParts parts
+func filePartSize(u PartUploader, size int64) int64 {
+	partSize := u.PartSize()
+	if limit := partSize * maxParts; size > limit {
+		partSize *= (size + limit - 1) / limit
+	}
+	return partSize
+}
+
+// uploadFileParts sends the parts of file not recorded in state yet and
+// completes the upload, returning the file's hex SHA-256
+func uploadFileParts(ctx context.Context, u PartUploader, state *UploadState, file *os.File, statePath string, wrap func(io.Reader) io.Reader) (string, error) {
+	uploaded := state.Parts
+	state.Parts = nil
+	whole := sha256.New()
+
+	for number, offset := 1, int64(0); offset < state.Size; number, offset = number+1, offset+state.PartSize {
+		size := min(state.PartSize, state.Size-offset)
+		section := io.NewSectionReader(file, offset, size)
+
+		if number <= len(uploaded) {
+			recorded := uploaded[number-1]
+			sum, err := hashPart(section, whole, sha256.New())
+			if err != nil {
+				return "", fmt.Errorf("failed to read upload data: %w", err)
+			}
+			if recorded.Number != number || recorded.Offset != offset || recorded.Size != size || recorded.SHA256 != sum {
+				return "", fmt.Errorf("part %d: %w", number, errPartChanged)
+			}
+			state.Parts = append(state.Parts, recorded)
+			continue
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(wrap(section), data); err != nil {
+			return "", fmt.Errorf("failed to read upload data: %w", err)
+		}
+		whole.Write(data)
+		md5Sum := md5.Sum(data)
+		shaSum := sha256.Sum256(data)
+		part := UploadedPart{
+			Number: number,
+			Offset: offset,
+			Size:   size,
+			MD5:    base64.StdEncoding.EncodeToString(md5Sum[:]),
+			SHA256: hex.EncodeToString(shaSum[:]),
+		}
+		etag, err := u.UploadPart(ctx, state.Key, state.UploadID, part, data, state.Size)
+		if err != nil {
+			return "", err
+		}
+		part.ETag = etag
+		state.Parts = append(state.Parts, part)
+		if err := state.save(statePath); err != nil {
+			return "", err
+		}
+	}
+
+	if err := u.CompleteUpload(ctx, state.Key, state.UploadID, state.Parts); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(whole.Sum(nil)), nil
+}
+
+// hashPart reads r into whole and part, returning the hex sum of part
+func hashPart(r io.Reader, whole, part hash.Hash) (string, error) {
+	if _, err := io.Copy(io.MultiWriter(whole, part), r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(part.Sum(nil)), nil
+}
+
+// uploadNotFoundError marks a service error as reporting an upload that no
+// longer exists
+type uploadNotFoundError struct {
+	err error
+}
+
+func (e uploadNotFoundError) Error() string {
+	return e.err.Error()
+}
+
+func (e uploadNotFoundError) Unwrap() []error {
+	return []error{e.err, ErrUploadNotFound}
+}
@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// partBackend keeps objects and part uploads in memory
+type partBackend struct {
+	partSize int64
+	failPart int // UploadPart fails for this part number once
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	started  int
+	sent     int // parts uploaded
+	aborted  []string
+}
+
+func newPartBackend(partSize int64) *partBackend {
+	return &partBackend{partSize: partSize, objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+}
+
+func (b *partBackend) Put(ctx context.Context, key string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.objects[key] = data
+	return nil
+}
+
+func (b *partBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(b.objects[key])), nil
+}
+
+func (b *partBackend) List(ctx context.Context, prefix string) ([]Object, error) {
+	return nil, nil
+}
+
+func (b *partBackend) Delete(ctx context.Context, key string) error {
+	delete(b.objects, key)
+	return nil
+}
+
+func (b *partBackend) PartSize() int64 {
+	return b.partSize
+}
+
+func (b *partBackend) StartUpload(ctx context.Context, key string) (string, error) {
+	b.started++
+	id := fmt.Sprintf("upload-%d", b.started)
+	b.uploads[id] = make(map[int][]byte)
+	return id, nil
+}
+
+func (b *partBackend) UploadPart(ctx context.Context, key, uploadID string, part UploadedPart, data []byte, total int64) (string, error) {
+	if part.Number == b.failPart {
+		b.failPart = 0
+		return "", errors.New("connection reset")
+	}
+	parts, ok := b.uploads[uploadID]
+	if !ok {
+		return "", uploadNotFoundError{errors.New("NoSuchUpload")}
+	}
+	parts[part.Number] = bytes.Clone(data)
+	b.sent++
+	return fmt.Sprintf("etag-%d", part.Number), nil
+}
+
+func (b *partBackend) CompleteUpload(ctx context.Context, key, uploadID string, parts []UploadedPart) error {
+	uploaded, ok := b.uploads[uploadID]
+	if !ok {
+		return uploadNotFoundError{errors.New("NoSuchUpload")}
+	}
+	var object []byte
+	for _, part := range parts {
+		object = append(object, uploaded[part.Number]...)
+	}
+	b.objects[key] = object
+	delete(b.uploads, uploadID)
+	return nil
+}
+
+func (b *partBackend) AbortUpload(key, uploadID string) {
+	b.aborted = append(b.aborted, uploadID)
+	delete(b.uploads, uploadID)
+}
+
+// writeUpload writes a file of size bytes to upload
+func writeUpload(t *testing.T, size int) (path string, data []byte) {
+	t.Helper()
+	data = make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	path = filepath.Join(t.TempDir(), "backup.dump")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func checkUploaded(t *testing.T, b *partBackend, sum string, data []byte, statePath string) {
+	t.Helper()
+	want := sha256.Sum256(data)
+	if sum != hex.EncodeToString(want[:]) {
+		t.Errorf("PutFile() = %s, want the file's SHA-256", sum)
+	}
+	if !bytes.Equal(b.objects["db/backup.dump"], data) {
+		t.Errorf("uploaded object differs from the file")
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Errorf("upload state was not removed: %v", err)
+	}
+}
+
+func TestFilePartSize(t *testing.T) {
+	b := newPartBackend(8)
+	tests := []struct {
+		size int64
+		want int64
+	}{
+		{100, 8},
+		{8 * maxParts, 8},
+		{8*maxParts + 1, 16},
+		{8*maxParts*3 - 1, 24},
+	}
+	for _, tt := range tests {
+		got := filePartSize(b, tt.size)
+		if got != tt.want {
+			t.Errorf("filePartSize(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+		if parts := (tt.size + got - 1) / got; parts > maxParts {
+			t.Errorf("a file of %d bytes takes %d parts", tt.size, parts)
+		}
+	}
+}
+
+func TestPutFileResume(t *testing.T) {
+	b := newPartBackend(8)
+	b.failPart = 3
+	path, data := writeUpload(t, 8*4+5)
+	statePath := filepath.Join(t.TempDir(), "upload.json")
+	ctx := context.Background()
+
+	if _, err := PutFile(ctx, b, "db/backup.dump", path, statePath, nil); err == nil {
+		t.Fatal("PutFile() with a failing part succeeded")
+	}
+	state, err := LoadUploadState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Parts) != 2 || state.PartSize != 8 {
+		t.Fatalf("state after the failure = %+v, want 2 parts of 8 bytes", state)
+	}
+
+	sum, err := PutFile(ctx, b, "db/backup.dump", path, statePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkUploaded(t, b, sum, data, statePath)
+	if b.started != 1 || b.sent != 5 {
+		t.Errorf("started %d uploads and sent %d parts, want the upload resumed with 3 more parts", b.started, b.sent)
+	}
+}
+
+func TestPutFileRestart(t *testing.T) {
+	ctx := context.Background()
+	interrupted := func(t *testing.T) (*partBackend, string, string) {
+		b := newPartBackend(8)
+		b.failPart = 2
+		path, _ := writeUpload(t, 8*3)
+		statePath := filepath.Join(t.TempDir(), "upload.json")
+		if _, err := PutFile(ctx, b, "db/backup.dump", path, statePath, nil); err == nil {
+			t.Fatal("PutFile() with a failing part succeeded")
+		}
+		return b, path, statePath
+	}
+
+	t.Run("expired", func(t *testing.T) {
+		b, path, statePath := interrupted(t)
+		delete(b.uploads, "upload-1")
+		sum, err := PutFile(ctx, b, "db/backup.dump", path, statePath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := os.ReadFile(path)
+		checkUploaded(t, b, sum, data, statePath)
+		if b.started != 2 {
+			t.Errorf("started %d uploads, want a new one", b.started)
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		b, path, statePath := interrupted(t)
+		data := bytes.Repeat([]byte{'x'}, 8*3)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Same size and time, so only the recorded part hashes tell
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, err := LoadUploadState(statePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, time.Time{}, state.ModTime); err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != state.Size {
+			t.Fatalf("file size %d, state %d", info.Size(), state.Size)
+		}
+
+		sum, err := PutFile(ctx, b, "db/backup.dump", path, statePath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkUploaded(t, b, sum, data, statePath)
+		if len(b.aborted) != 1 || b.aborted[0] != "upload-1" {
+			t.Errorf("aborted %v, want the stale upload", b.aborted)
+		}
+	})
+}
+
+func TestPutFileSmall(t *testing.T) {
+	b := newPartBackend(8)
+	path, data := writeUpload(t, 8)
+	statePath := filepath.Join(t.TempDir(), "upload.json")
+	sum, err := PutFile(context.Background(), b, "db/backup.dump", path, statePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkUploaded(t, b, sum, data, statePath)
+	if b.started != 0 {
+		t.Errorf("a file of one part was uploaded in parts")
+	}
+}
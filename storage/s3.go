@@ -0,0 +1,465 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"beackup/sigv4"
+)
+
+// defaultPartSize is the multipart chunk size used when none is configured
+const defaultPartSize = 16 << 20
+
+// maxPartSize is the largest part S3 accepts
+const maxPartSize = 5 << 30
+
+// partGrowth is how many parts of an upload of unknown size are sent
+// before the part size doubles
+const partGrowth = 1000
+
+// S3Config configures an S3 (or S3-compatible) bucket destination
+type S3Config struct {
+	Bucket          string `yaml:"bucket"`
+	Region          string `yaml:"region"`
+	Prefix          string `yaml:"prefix"`
+	StorageClass    string `yaml:"storage_class"` // e.g. STANDARD, STANDARD_IA, GLACIER
+	Endpoint        string `yaml:"endpoint"`      // custom endpoint for S3-compatible services
+	ForcePathStyle  bool   `yaml:"force_path_style"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	SessionToken    string `yaml:"session_token"`
+	PartSizeMB      int    `yaml:"part_size_mb"`
+}
+
+// S3 stores backups in an S3 bucket
+type S3 struct {
+	config   S3Config
+	creds    sigv4.Credentials
+	endpoint *url.URL
+	partSize int
+	client   *http.Client
+	lock     Lock
+}
+
+// NewS3 creates an S3 backend, falling back to the standard AWS
+// environment variables for region and credentials
+func NewS3(config S3Config) (*S3, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is required")
+	}
+	if config.Region == "" {
+		config.Region = firstNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	}
+
+	creds := sigv4.Credentials{
+		AccessKeyID:     firstNonEmpty(config.AccessKeyID, os.Getenv("AWS_ACCESS_KEY_ID")),
+		SecretAccessKey: firstNonEmpty(config.SecretAccessKey, os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		SessionToken:    firstNonEmpty(config.SessionToken, os.Getenv("AWS_SESSION_TOKEN")),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("s3 credentials are not configured")
+	}
+
+	rawEndpoint := config.Endpoint
+	if rawEndpoint == "" {
+		rawEndpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", config.Region)
+	}
+	endpoint, err := url.Parse(rawEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+
+	partSize := defaultPartSize
+	if config.PartSizeMB > 0 {
+		partSize = config.PartSizeMB << 20
+	}
+
+	return &S3{
+		config:   config,
+		creds:    creds,
+		endpoint: endpoint,
+		partSize: partSize,
+		client:   &http.Client{},
+	}, nil
+}
+
+// Put uploads r, switching to a multipart upload when it exceeds one part
+func (s *S3) Put(ctx context.Context, key string, r io.Reader) error {
+	buf := make([]byte, s.partSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return s.putObject(ctx, key, buf[:n])
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read upload data: %w", err)
+	}
+
+	return s.putMultipart(ctx, key, buf, r)
+}
+
+// putObject uploads data with a single PUT request
+func (s *S3) putObject(ctx context.Context, key string, data []byte) error {
+	headers := s.uploadHeaders()
+	s.addLockChecksum(headers, data)
+
+	resp, err := s.do(ctx, http.MethodPut, s.objectKey(key), nil, headers, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// addLockChecksum adds the MD5 of data to headers if objects are locked, as
+// S3 only accepts locked objects and their parts along with it
+func (s *S3) addLockChecksum(headers map[string]string, data []byte) {
+	if s.lock.Enabled() {
+		sum := md5.Sum(data)
+		headers["Content-MD5"] = base64.StdEncoding.EncodeToString(sum[:])
+	}
+}
+
+// uploadHeaders returns the headers that set the storage class and object
+// lock of new objects
+func (s *S3) uploadHeaders() map[string]string {
+	headers := map[string]string{}
+	if s.config.StorageClass != "" {
+		headers["X-Amz-Storage-Class"] = s.config.StorageClass
+	}
+	if s.lock.Enabled() {
+		headers["X-Amz-Object-Lock-Mode"] = strings.ToUpper(s.lock.Mode)
+		headers["X-Amz-Object-Lock-Retain-Until-Date"] = s.lock.Until(time.Now()).Format(time.RFC3339)
+	}
+	return headers
+}
+
+// SetLock locks every object uploaded from now on with S3 Object Lock,
+// which must be enabled on the bucket
+func (s *S3) SetLock(lock Lock) {
+	s.lock = lock
+}
+
+// putMultipart uploads first followed by the remainder of r in parts
+func (s *S3) putMultipart(ctx context.Context, key string, first []byte, r io.Reader) error {
+	objectKey := s.objectKey(key)
+	uploadID, err := s.StartUpload(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	parts, err := s.uploadParts(ctx, objectKey, uploadID, first, r)
+	if err != nil {
+		s.abortMultipart(objectKey, uploadID)
+		return err
+	}
+
+	if err := s.completeMultipart(ctx, objectKey, uploadID, parts); err != nil {
+		s.abortMultipart(objectKey, uploadID)
+		return err
+	}
+	return nil
+}
+
+// PartSize returns the multipart upload part size
+func (s *S3) PartSize() int64 {
+	return int64(s.partSize)
+}
+
+// StartUpload begins a multipart upload of key
+func (s *S3) StartUpload(ctx context.Context, key string) (string, error) {
+	resp, err := s.do(ctx, http.MethodPost, s.objectKey(key), url.Values{"uploads": {""}}, s.uploadHeaders(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to parse multipart upload response: %w", err)
+	}
+	return initiated.UploadID, nil
+}
+
+// UploadPart uploads one part of a multipart upload, which S3 checks
+// against the part's MD5
+func (s *S3) UploadPart(ctx context.Context, key, uploadID string, part UploadedPart, data []byte, total int64) (string, error) {
+	query := url.Values{
+		"partNumber": {strconv.Itoa(part.Number)},
+		"uploadId":   {uploadID},
+	}
+	resp, err := s.do(ctx, http.MethodPut, s.objectKey(key), query, map[string]string{"Content-MD5": part.MD5}, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload part %d: %w", part.Number, err)
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// CompleteUpload assembles the parts of a multipart upload into the object
+func (s *S3) CompleteUpload(ctx context.Context, key, uploadID string, parts []UploadedPart) error {
+	completed := make([]completedPart, len(parts))
+	for i, part := range parts {
+		completed[i] = completedPart{PartNumber: part.Number, ETag: part.ETag}
+	}
+	return s.completeMultipart(ctx, s.objectKey(key), uploadID, completed)
+}
+
+// AbortUpload discards the parts of an unfinished multipart upload
+func (s *S3) AbortUpload(key, uploadID string) {
+	s.abortMultipart(s.objectKey(key), uploadID)
+}
+
+// completedPart records an uploaded part for CompleteMultipartUpload
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *S3) uploadParts(ctx context.Context, objectKey, uploadID string, first []byte, r io.Reader) ([]completedPart, error) {
+	var parts []completedPart
+	data := first
+
+	for partNumber := 1; ; partNumber++ {
+		if partNumber > maxParts {
+			return nil, fmt.Errorf("upload exceeds the %d parts S3 allows, raise part_size_mb", maxParts)
+		}
+		query := url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {uploadID},
+		}
+		headers := map[string]string{}
+		s.addLockChecksum(headers, data)
+		resp, err := s.do(ctx, http.MethodPut, objectKey, query, headers, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+
+		buf := make([]byte, s.streamPartSize(partNumber+1))
+		n, err := io.ReadFull(r, buf)
+		if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			return parts, nil
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("failed to read upload data: %w", err)
+		}
+		data = buf[:n]
+	}
+}
+
+// streamPartSize returns the size of part partNumber of an upload whose
+// size is not known up front. The part size doubles every partGrowth parts,
+// up to the largest S3 accepts, so that the parts S3 allows hold about 13
+// TiB with the default part size.
+func (s *S3) streamPartSize(partNumber int) int {
+	size := s.partSize
+	for range (partNumber - 1) / partGrowth {
+		if size >= maxPartSize/2 {
+			return maxPartSize
+		}
+		size *= 2
+	}
+	return size
+}
+
+func (s *S3) completeMultipart(ctx context.Context, objectKey, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return fmt.Errorf("failed to encode multipart completion: %w", err)
+	}
+
+	resp, err := s.do(ctx, http.MethodPost, objectKey, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// S3 may report a failure inside a 200 response once it starts streaming
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read multipart completion response: %w", err)
+	}
+	if bytes.Contains(respBody, []byte("<Error>")) {
+		return parseS3Error(resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// abortMultipart discards uploaded parts so they are not billed indefinitely
+func (s *S3) abortMultipart(objectKey, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := s.do(ctx, http.MethodDelete, objectKey, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// Get opens an object for reading
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.objectKey(key), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// List returns all objects under prefix, relative to the configured prefix
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	continuation := ""
+
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.objectKey(prefix)},
+		}
+		if continuation != "" {
+			query.Set("continuation-token", continuation)
+		}
+
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse list response: %w", err)
+		}
+
+		for _, item := range result.Contents {
+			objects = append(objects, Object{
+				Key:     s.relativeKey(item.Key),
+				Size:    item.Size,
+				ModTime: item.LastModified,
+			})
+		}
+
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		continuation = result.NextContinuationToken
+	}
+}
+
+// Delete removes an object
+func (s *S3) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.objectKey(key), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// objectKey prepends the configured prefix to key
+func (s *S3) objectKey(key string) string {
+	return withPrefix(s.config.Prefix, key)
+}
+
+// relativeKey strips the configured prefix from an object key
+func (s *S3) relativeKey(key string) string {
+	return withoutPrefix(s.config.Prefix, key)
+}
+
+// requestURL builds the URL for an object key in the configured bucket
+func (s *S3) requestURL(objectKey string, query url.Values) *url.URL {
+	u := *s.endpoint
+	if s.config.ForcePathStyle || !s.usesVirtualHost() {
+		u.Path = path.Join("/", s.config.Bucket, objectKey)
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+		u.Path = "/" + objectKey
+	}
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// usesVirtualHost reports whether the endpoint is an AWS endpoint that
+// supports virtual-hosted-style addressing
+func (s *S3) usesVirtualHost() bool {
+	return strings.HasSuffix(s.endpoint.Hostname(), ".amazonaws.com")
+}
+
+// do sends a signed request and returns the response if it succeeded
+func (s *S3) do(ctx context.Context, method, objectKey string, query url.Values, headers map[string]string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.requestURL(objectKey, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.ContentLength = int64(len(body))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	payloadHash := sigv4.EmptyPayloadHash
+	if len(body) > 0 {
+		payloadHash = sigv4.HashHex(body)
+	}
+	sigv4.Sign(req, s.creds, s.config.Region, "s3", payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 request failed: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, parseS3Error(resp.StatusCode, respBody)
+	}
+	return resp, nil
+}
+
+// parseS3Error extracts the error code and message from an S3 error response
+func parseS3Error(status int, body []byte) error {
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.Unmarshal(body, &s3Err); err != nil || s3Err.Code == "" {
+		return fmt.Errorf("s3 request failed with status %d", status)
+	}
+	err := fmt.Errorf("s3 request failed with status %d: %s: %s", status, s3Err.Code, s3Err.Message)
+	if s3Err.Code == "NoSuchUpload" {
+		return uploadNotFoundError{err}
+	}
+	return err
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,35 @@
+package storage
+
+import "testing"
+
+func TestStreamPartSize(t *testing.T) {
+	s := &S3{partSize: defaultPartSize}
+	tests := []struct {
+		part int
+		want int
+	}{
+		{1, defaultPartSize},
+		{partGrowth, defaultPartSize},
+		{partGrowth + 1, 2 * defaultPartSize},
+		{3*partGrowth + 1, 8 * defaultPartSize},
+		{maxParts, maxPartSize},
+	}
+	for _, tt := range tests {
+		if got := s.streamPartSize(tt.part); got != tt.want {
+			t.Errorf("streamPartSize(%d) = %d, want %d", tt.part, got, tt.want)
+		}
+	}
+
+	// The parts S3 allows hold more than 10 TiB
+	var total int64
+	for part := 1; part <= maxParts; part++ {
+		size := s.streamPartSize(part)
+		if size > maxPartSize {
+			t.Fatalf("streamPartSize(%d) = %d, over the %d S3 accepts", part, size, maxPartSize)
+		}
+		total += int64(size)
+	}
+	if total < 10<<40 {
+		t.Errorf("%d parts hold %d bytes, want at least 10 TiB", maxParts, total)
+	}
+}
@@ -0,0 +1,410 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSFTPRetries is how often a failed transfer is retried when no
+// limit is configured
+const defaultSFTPRetries = 3
+
+// SFTPConfig configures an SFTP destination reached over SSH
+type SFTPConfig struct {
+	Host           string `yaml:"host"`
+	Port           int    `yaml:"port"`
+	User           string `yaml:"user"`
+	KeyFile        string `yaml:"key_file"`
+	KnownHostsFile string `yaml:"known_hosts_file"`
+	Path           string `yaml:"path"`    // remote directory backups are stored under
+	Retries        int    `yaml:"retries"` // attempts after a transient failure
+}
+
+// SFTP stores backups on a remote host using the OpenSSH sftp client in
+// batch mode, so authentication follows the usual ssh configuration
+type SFTP struct {
+	config    SFTPConfig
+	retries   int
+	rateLimit int64 // bytes per second, 0 for no limit
+}
+
+// NewSFTP creates an SFTP backend
+func NewSFTP(config SFTPConfig) (*SFTP, error) {
+	if config.Host == "" {
+		return nil, fmt.Errorf("sftp host is required")
+	}
+	if config.Retries < 0 {
+		return nil, fmt.Errorf("sftp retries must not be negative")
+	}
+	if _, err := exec.LookPath("sftp"); err != nil {
+		return nil, fmt.Errorf("sftp client not found: %w", err)
+	}
+	if config.Port == 0 {
+		config.Port = 22
+	}
+	if config.Path == "" {
+		config.Path = "."
+	}
+
+	retries := config.Retries
+	if retries == 0 {
+		retries = defaultSFTPRetries
+	}
+	return &SFTP{config: config, retries: retries}, nil
+}
+
+// SetRateLimit passes the limit to sftp -l. sftp reads local files itself,
+// so throttling the data handed to Put would not slow the transfer.
+func (s *SFTP) SetRateLimit(bytesPerSecond int64) {
+	s.rateLimit = bytesPerSecond
+}
+
+// Put uploads r to a temporary name and renames it into place once
+// complete. After a transient failure the upload is resumed from where the
+// partial file ends.
+func (s *SFTP) Put(ctx context.Context, key string, r io.Reader) error {
+	local, cleanup, err := localFile(r)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	info, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+
+	remote := s.remotePath(key)
+	partial := remote + ".part"
+
+	return s.retry(ctx, func(attempt int) error {
+		commands := mkdirCommands(path.Dir(remote))
+
+		transfer := "put"
+		if attempt > 0 {
+			size, err := s.remoteSize(ctx, partial)
+			if err != nil {
+				return err
+			}
+			switch {
+			case size == info.Size():
+				transfer = "" // only the rename is left
+			case size > 0 && size < info.Size():
+				transfer = "reput"
+			}
+		}
+		if transfer != "" {
+			commands = append(commands, fmt.Sprintf("%s %s %s", transfer, quote(local), quote(partial)))
+		}
+
+		commands = append(commands,
+			"-rm "+quote(remote),
+			fmt.Sprintf("rename %s %s", quote(partial), quote(remote)),
+		)
+		_, err := s.run(ctx, commands...)
+		return err
+	})
+}
+
+// Get downloads an object to a temporary file, resuming interrupted
+// transfers, and opens it for reading. The file is removed on Close.
+func (s *SFTP) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	tmp, err := os.CreateTemp("", "beackup-sftp-*")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+
+	err = s.retry(ctx, func(attempt int) error {
+		transfer := "get"
+		if info, err := os.Stat(tmp.Name()); attempt > 0 && err == nil && info.Size() > 0 {
+			transfer = "reget"
+		}
+		_, err := s.run(ctx, fmt.Sprintf("%s %s %s", transfer, quote(s.remotePath(key)), quote(tmp.Name())))
+		return err
+	})
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	file, err := os.Open(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &tempFile{file}, nil
+}
+
+// List returns all files under prefix, descending into directories
+func (s *SFTP) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	if err := s.walk(ctx, path.Dir(prefix), prefix, &objects); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// walk lists dir and appends the files whose key starts with prefix
+func (s *SFTP) walk(ctx context.Context, dir, prefix string, objects *[]Object) error {
+	entries, err := s.list(ctx, s.remotePath(dir))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		key := path.Join(dir, entry.name)
+		if entry.dir {
+			if strings.HasPrefix(key, prefix) || strings.HasPrefix(prefix, key+"/") {
+				if err := s.walk(ctx, key, prefix, objects); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(key, prefix) {
+			*objects = append(*objects, Object{Key: key, Size: entry.size, ModTime: entry.modTime})
+		}
+	}
+	return nil
+}
+
+// Delete removes a file
+func (s *SFTP) Delete(ctx context.Context, key string) error {
+	return s.retry(ctx, func(int) error {
+		_, err := s.run(ctx, "rm "+quote(s.remotePath(key)))
+		return err
+	})
+}
+
+// remotePath maps a key to its path on the remote host
+func (s *SFTP) remotePath(key string) string {
+	return path.Join(s.config.Path, key)
+}
+
+// remoteSize returns the size of a remote file, or 0 if it does not exist
+func (s *SFTP) remoteSize(ctx context.Context, p string) (int64, error) {
+	entries, err := s.list(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if !entry.dir && entry.name == path.Base(p) {
+			return entry.size, nil
+		}
+	}
+	return 0, nil
+}
+
+// listEntry is a line of an sftp long listing
+type listEntry struct {
+	name    string
+	dir     bool
+	size    int64
+	modTime time.Time
+}
+
+// listLine matches the permissions, link count, owner, group, size, date
+// and name columns printed by ls -ln
+var listLine = regexp.MustCompile(`^([-dlcbps][-rwxsStT]{9})\S*\s+\S+\s+\S+\s+\S+\s+(\d+)\s+(\S+\s+\S+\s+\S+)\s(.+)$`)
+
+// list returns the entries of a remote directory, or the file itself when p
+// is a file. A missing path yields no entries.
+func (s *SFTP) list(ctx context.Context, p string) ([]listEntry, error) {
+	// The leading dash keeps a missing path from failing the session
+	output, err := s.run(ctx, "-ls -ln "+quote(p))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []listEntry
+	for _, line := range strings.Split(output, "\n") {
+		match := listLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		name := path.Base(match[4])
+		if name == "." || name == ".." {
+			continue
+		}
+		size, _ := strconv.ParseInt(match[2], 10, 64)
+		entries = append(entries, listEntry{
+			name:    name,
+			dir:     match[1][0] == 'd',
+			size:    size,
+			modTime: parseListTime(match[3], time.Now()),
+		})
+	}
+	return entries, nil
+}
+
+// parseListTime parses the date column of a long listing, which shows the
+// time of day for recent files and the year for older ones
+func parseListTime(value string, now time.Time) time.Time {
+	value = strings.Join(strings.Fields(value), " ")
+	if t, err := time.ParseInLocation("Jan 2 2006", value, time.Local); err == nil {
+		return t
+	}
+	t, err := time.ParseInLocation("Jan 2 15:04", value, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
+
+// run executes batch commands in a single sftp session and returns its
+// output. sftp stops at the first failing command unless it starts with a
+// dash.
+func (s *SFTP) run(ctx context.Context, commands ...string) (string, error) {
+	args := []string{
+		"-b", "-",
+		"-q",
+		"-P", strconv.Itoa(s.config.Port),
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=30",
+		"-o", "ServerAliveInterval=15",
+	}
+	if s.config.KeyFile != "" {
+		args = append(args, "-i", s.config.KeyFile)
+	}
+	if s.rateLimit > 0 {
+		// sftp takes the limit in Kbit/s
+		args = append(args, "-l", strconv.FormatInt(max(s.rateLimit*8/1000, 1), 10))
+	}
+	if s.config.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+s.config.KnownHostsFile)
+	}
+	destination := s.config.Host
+	if s.config.User != "" {
+		destination = s.config.User + "@" + destination
+	}
+	args = append(args, destination)
+
+	cmd := exec.CommandContext(ctx, "sftp", args...)
+	cmd.Stdin = strings.NewReader(strings.Join(commands, "\n") + "\n")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("sftp failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+		if isTransient(cmd, string(output)) {
+			return "", &transientError{err}
+		}
+		return "", err
+	}
+	return string(output), nil
+}
+
+// isTransient reports whether a failed sftp session is worth retrying:
+// dropped or refused connections are, authentication and file errors are
+// not
+func isTransient(cmd *exec.Cmd, output string) bool {
+	// ssh exits with 255 for connection failures, including rejected
+	// credentials
+	if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == 255 {
+		return !strings.Contains(output, "Permission denied") &&
+			!strings.Contains(output, "Host key verification failed")
+	}
+	for _, transient := range []string{"Connection closed", "Connection reset", "Connection refused", "Broken pipe", "timed out"} {
+		if strings.Contains(output, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// transientError marks a failure that may succeed when retried
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+// retry calls fn until it succeeds, fails permanently or the retries are
+// used up, backing off exponentially between attempts
+func (s *SFTP) retry(ctx context.Context, fn func(attempt int) error) error {
+	backoff := 2 * time.Second
+	for attempt := 0; ; attempt++ {
+		err := fn(attempt)
+		var transient *transientError
+		if err == nil || !errors.As(err, &transient) || attempt >= s.retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// mkdirCommands creates dir and its parents, ignoring those that exist
+func mkdirCommands(dir string) []string {
+	var commands []string
+	current := ""
+	if strings.HasPrefix(dir, "/") {
+		current = "/"
+	}
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		current = path.Join(current, part)
+		commands = append(commands, "-mkdir "+quote(current))
+	}
+	return commands
+}
+
+// quote wraps a path in double quotes for the sftp command parser
+func quote(p string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(p) + `"`
+}
+
+// localFile returns a local path holding the contents of r, spooling them
+// to a temporary file unless r already is a file
+func localFile(r io.Reader) (string, func(), error) {
+	if file, ok := r.(*os.File); ok {
+		return file.Name(), func() {}, nil
+	}
+
+	tmp, err := os.CreateTemp("", "beackup-sftp-*")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to spool upload data: %w", err)
+	}
+	return tmp.Name(), cleanup, nil
+}
+
+// tempFile is a downloaded file that is deleted once closed
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
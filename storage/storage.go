@@ -0,0 +1,54 @@
+// Package storage provides remote destinations for backup artifacts.
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+)
+
+// Object describes an artifact held by a storage backend
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backend is a place backups can be uploaded to and fetched back from.
+// Keys are slash-separated paths relative to the backend's configured root.
+type Backend interface {
+	// Put uploads the contents of r under key, replacing any existing object
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get opens the object stored under key for reading
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns all objects whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// Delete removes the object stored under key
+	Delete(ctx context.Context, key string) error
+}
+
+// RateLimiter is implemented by backends that limit their own upload
+// bandwidth, rather than having the data they read throttled
+type RateLimiter interface {
+	// SetRateLimit limits uploads to about bytesPerSecond
+	SetRateLimit(bytesPerSecond int64)
+}
+
+// withPrefix prepends a configured key prefix to key
+func withPrefix(prefix, key string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return key
+	}
+	return prefix + "/" + key
+}
+
+// withoutPrefix strips a configured key prefix from an object name
+func withoutPrefix(prefix, name string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return name
+	}
+	return strings.TrimPrefix(name, prefix+"/")
+}
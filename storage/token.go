@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessToken is an OAuth bearer token and the time it stops being valid
+type accessToken struct {
+	value   string
+	expires time.Time
+}
+
+// tokenSource caches an access token and fetches a new one shortly before
+// it expires
+type tokenSource struct {
+	mu    sync.Mutex
+	token accessToken
+	fetch func(ctx context.Context) (accessToken, error)
+}
+
+// get returns a valid token, refreshing it if needed
+func (t *tokenSource) get(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token.value != "" && time.Until(t.token.expires) > time.Minute {
+		return t.token.value, nil
+	}
+	token, err := t.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	t.token = token
+	return token.value, nil
+}
+
+// fetchJSON sends req and decodes a successful JSON response into v
+func fetchJSON(client *http.Client, req *http.Request, v any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,309 @@
+// Package tracing records the work of a backup run as a trace of spans and
+// exports it to an OpenTelemetry collector over OTLP/HTTP. The trace ID
+// doubles as the run ID, so logs, manifests and notifications can be
+// matched up with the trace.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for exporting traces
+const (
+	defaultServiceName = "beackup"
+	defaultTimeout     = 10 * time.Second
+)
+
+// Config selects where traces are exported to
+type Config struct {
+	// Endpoint is the OTLP/HTTP collector URL, such as
+	// http://localhost:4318, that /v1/traces is posted to; empty to only
+	// use trace IDs as run IDs without exporting spans
+	Endpoint    string            `yaml:"endpoint"`
+	Headers     map[string]string `yaml:"headers"`      // sent with every export, e.g. for authentication
+	ServiceName string            `yaml:"service_name"` // defaults to beackup
+	Timeout     time.Duration     `yaml:"timeout"`      // per export, defaults to 10s
+}
+
+// Validate checks the endpoint URL
+func (c Config) Validate() error {
+	if c.Endpoint != "" {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("endpoint must be an http or https URL")
+		}
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	return nil
+}
+
+// Tracer starts traces and exports them once their root span ends
+type Tracer struct {
+	config  Config
+	client  *http.Client
+	onError func(error) // reports failed exports
+}
+
+// New creates a tracer. Export failures are passed to onError.
+func New(config Config, onError func(error)) *Tracer {
+	if config.ServiceName == "" {
+		config.ServiceName = defaultServiceName
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	return &Tracer{config: config, client: &http.Client{}, onError: onError}
+}
+
+// Attribute is a key-value pair describing a span
+type Attribute struct {
+	Key   string
+	Value any // string, bool, int, int64 or float64
+}
+
+// Attr creates an attribute
+func Attr(key string, value any) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// trace collects the spans of one trace until its root span ends
+type trace struct {
+	tracer *Tracer
+	id     string
+	mu     sync.Mutex
+	spans  []*Span
+}
+
+// Span is a timed operation within a trace
+type Span struct {
+	trace  *trace
+	name   string
+	id     string
+	parent string
+	start  time.Time
+	end    time.Time
+	attrs  []Attribute
+	err    error
+	ended  bool
+}
+
+type spanKey struct{}
+
+// StartTrace starts a new trace with a root span. Ending the root span
+// exports the trace.
+func (t *Tracer) StartTrace(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	tr := &trace{tracer: t, id: randomID(16)}
+	return tr.start(ctx, name, "", attrs)
+}
+
+// Start starts a span as a child of the span in ctx. Without a span in ctx
+// the returned span records nothing.
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	parent, _ := ctx.Value(spanKey{}).(*Span)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.trace.start(ctx, name, parent.id, attrs)
+}
+
+func (tr *trace) start(ctx context.Context, name, parent string, attrs []Attribute) (context.Context, *Span) {
+	span := &Span{
+		trace:  tr,
+		name:   name,
+		id:     randomID(8),
+		parent: parent,
+		start:  time.Now(),
+		attrs:  attrs,
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// TraceID returns the hex ID of the span's trace
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.trace.id
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.trace.mu.Lock()
+	defer s.trace.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// End finishes the span, marking it failed if err is not nil. Ending the
+// root span exports the trace.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	tr := s.trace
+	tr.mu.Lock()
+	if s.ended {
+		tr.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.err = err
+	tr.spans = append(tr.spans, s)
+	root := s.parent == ""
+	tr.mu.Unlock()
+
+	if root && tr.tracer.config.Endpoint != "" {
+		if err := tr.tracer.export(tr); err != nil && tr.tracer.onError != nil {
+			tr.tracer.onError(err)
+		}
+	}
+}
+
+// export posts the ended spans of a trace to the collector
+func (t *Tracer) export(tr *trace) error {
+	tr.mu.Lock()
+	body, err := json.Marshal(t.request(tr.spans))
+	tr.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode trace: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.config.Timeout)
+	defer cancel()
+	endpoint := strings.TrimSuffix(t.config.Endpoint, "/") + "/v1/traces"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to export trace: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to export trace: collector returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// OTLP JSON encoding of an export request
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpAttribute struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"` // 1 for ok, 2 for error
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// spanKindInternal marks spans of work within the service
+const spanKindInternal = 1
+
+// request encodes spans for the OTLP JSON protocol
+func (t *Tracer) request(spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.trace.id,
+			SpanID:            s.id,
+			ParentSpanID:      s.parent,
+			Name:              s.name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+			Status:            otlpStatus{Code: 1},
+		}
+		if s.err != nil {
+			span.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		encoded = append(encoded, span)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes([]Attribute{Attr("service.name", t.config.ServiceName)})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "beackup"}, Spans: encoded}},
+	}}}
+}
+
+// otlpAttributes encodes attributes as OTLP any-values
+func otlpAttributes(attrs []Attribute) []otlpAttribute {
+	var encoded []otlpAttribute
+	for _, a := range attrs {
+		var value map[string]any
+		switch v := a.Value.(type) {
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, otlpAttribute{Key: a.Key, Value: value})
+	}
+	return encoded
+}
+
+// randomID returns n random bytes in hex
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}